@@ -0,0 +1,255 @@
+// Command ratelimitctl is an operator tool for a running rate limit server.
+//
+// It talks to the server's /admin endpoints (see admin.token in config.yaml),
+// or with -direct reads, resets and drains Redis buckets without going through the
+// server. Connection details come from the same config.yaml as the server.
+//
+//	ratelimitctl [flags] inspect <key>     show tokens available for key
+//	ratelimitctl [flags] reset <key>       reset key to a full bucket
+//	ratelimitctl [flags] drain <key>       empty key's bucket until it refills
+//	ratelimitctl [flags] block <wallet>    refuse payments from wallet
+//	ratelimitctl [flags] unblock <wallet>  lift a wallet block
+//	ratelimitctl [flags] trust             dump trust tracker stats
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/haseeb/ratelimiter/internal/config"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+	ratelimitredis "github.com/haseeb/ratelimiter/pkg/ratelimit/redis"
+)
+
+// options holds the parsed command line.
+type options struct {
+	configPath string
+	server     string // Base URL of the server (default: from server.port)
+	token      string // Admin token (default: admin.token)
+	direct     bool   // Talk to Redis instead of the server
+	command    string
+	arg        string
+}
+
+// commandArgs maps each command to whether it takes an argument.
+var commandArgs = map[string]bool{
+	"inspect": true,
+	"reset":   true,
+	"drain":   true,
+	"block":   true,
+	"unblock": true,
+	"trust":   false,
+
+	"trust-config": false,
+}
+
+const usage = `usage: ratelimitctl [flags] <command> [arg]
+
+commands:
+  inspect <key>     show tokens available for key
+  reset <key>       reset key to a full bucket
+  drain <key>       empty key's bucket until it refills
+  block <wallet>    refuse payments from wallet
+  unblock <wallet>  lift a wallet block
+  trust             dump trust tracker stats
+  trust-config      show trust tracker settings
+
+flags:
+`
+
+func main() {
+	opts, err := parseArgs(os.Args[1:], os.Stderr)
+	if err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, "ratelimitctl:", err)
+		}
+		os.Exit(2)
+	}
+
+	cfg, err := config.Load(opts.configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ratelimitctl: loading config:", err)
+		os.Exit(1)
+	}
+
+	if err := run(opts, cfg, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "ratelimitctl:", err)
+		os.Exit(1)
+	}
+}
+
+// parseArgs parses flags and the command. Usage goes to stderr on error.
+func parseArgs(args []string, stderr io.Writer) (options, error) {
+	var opts options
+	fs := flag.NewFlagSet("ratelimitctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&opts.configPath, "config", "config.yaml", "path to the server's config file")
+	fs.StringVar(&opts.server, "server", "", "server base URL (default: http://localhost<server.port>)")
+	fs.StringVar(&opts.token, "token", "", "admin token (default: admin.token from config)")
+	fs.BoolVar(&opts.direct, "direct", false, "read, reset and drain Redis buckets directly (key commands only)")
+
+	if err := fs.Parse(args); err != nil {
+		return options{}, err
+	}
+
+	rest := fs.Args()
+	if len(rest) == 0 {
+		fs.Usage()
+		return options{}, errors.New("missing command")
+	}
+	opts.command = rest[0]
+
+	takesArg, ok := commandArgs[opts.command]
+	if !ok {
+		return options{}, fmt.Errorf("unknown command %q", opts.command)
+	}
+	switch {
+	case takesArg && len(rest) != 2:
+		return options{}, fmt.Errorf("%s takes exactly one argument", opts.command)
+	case !takesArg && len(rest) != 1:
+		return options{}, fmt.Errorf("%s takes no arguments", opts.command)
+	}
+	if takesArg {
+		opts.arg = rest[1]
+	}
+
+	if opts.direct && opts.command != "inspect" && opts.command != "reset" && opts.command != "drain" {
+		return options{}, fmt.Errorf("%s needs the server; -direct supports only inspect, reset and drain", opts.command)
+	}
+	return opts, nil
+}
+
+// run executes the command against Redis or the server.
+func run(opts options, cfg *config.Config, out io.Writer) error {
+	if opts.direct {
+		if cfg.RateLimit.Strategy != "redis" {
+			return fmt.Errorf("-direct needs ratelimit.strategy \"redis\", config has %q", cfg.RateLimit.Strategy)
+		}
+		client := redis.NewClient(&redis.Options{
+			Addr:     cfg.Redis.Addr,
+			Password: cfg.Redis.Password,
+			DB:       cfg.Redis.DB,
+		})
+		defer client.Close()
+		return runDirect(opts, cfg, client, out)
+	}
+
+	server := opts.server
+	if server == "" {
+		server = "http://localhost" + cfg.Server.Port
+	}
+	token := opts.token
+	if token == "" {
+		token = cfg.Admin.Token
+	}
+	return runRemote(opts, strings.TrimSuffix(server, "/"), token, &http.Client{Timeout: 10 * time.Second}, out)
+}
+
+// runDirect inspects, resets or drains a key in Redis, using the server's bucket settings.
+func runDirect(opts options, cfg *config.Config, client *redis.Client, out io.Writer) error {
+	schedule, err := cfg.RateLimit.Schedule()
+	if err != nil {
+		return fmt.Errorf("ratelimit.refill_schedule: %w", err)
+	}
+	if err := ratelimit.ValidateBucket(cfg.RateLimit.Capacity, cfg.RateLimit.RefillRate); err != nil {
+		return fmt.Errorf("ratelimit: %w", err)
+	}
+	limiter := ratelimitredis.NewTokenBucket(ratelimitredis.Config{
+		Client:         client,
+		Capacity:       cfg.RateLimit.Capacity,
+		RefillRate:     cfg.RateLimit.RefillRate,
+		RefillSchedule: schedule,
+		ServerTime:     cfg.Redis.ServerTime,
+		Namespace:      cfg.Redis.Namespace,
+		HashKeys:       cfg.Redis.HashKeys,
+	})
+
+	switch opts.command {
+	case "inspect":
+		tokens, err := limiter.Available(opts.arg)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s: %.2f tokens (capacity %.0f)\n", opts.arg, tokens, cfg.RateLimit.Capacity)
+	case "reset":
+		if err := limiter.Reset(opts.arg); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s: reset\n", opts.arg)
+	case "drain":
+		if err := limiter.Drain(opts.arg); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s: drained\n", opts.arg)
+	default:
+		return fmt.Errorf("%s is not supported with -direct", opts.command)
+	}
+	return nil
+}
+
+// runRemote calls the server's admin endpoint for the command and prints the
+// JSON response.
+func runRemote(opts options, server, token string, client *http.Client, out io.Writer) error {
+	var method, path string
+	arg := url.PathEscape(opts.arg)
+	switch opts.command {
+	case "inspect":
+		method, path = http.MethodGet, "/admin/keys/"+arg
+	case "reset":
+		method, path = http.MethodDelete, "/admin/keys/"+arg
+	case "drain":
+		method, path = http.MethodPost, "/admin/keys/"+arg+"/drain"
+	case "block":
+		method, path = http.MethodPost, "/admin/wallets/"+arg+"/block"
+	case "unblock":
+		method, path = http.MethodDelete, "/admin/wallets/"+arg+"/block"
+	case "trust":
+		method, path = http.MethodGet, "/admin/trust"
+	case "trust-config":
+		method, path = http.MethodGet, "/trust/config"
+	}
+
+	req, err := http.NewRequest(method, server+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, body, "", "  "); err != nil {
+		_, err = out.Write(body)
+		return err
+	}
+	pretty.WriteByte('\n')
+	_, err = pretty.WriteTo(out)
+	return err
+}
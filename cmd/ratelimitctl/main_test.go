@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/haseeb/ratelimiter/internal/config"
+	ratelimitredis "github.com/haseeb/ratelimiter/pkg/ratelimit/redis"
+)
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		args    []string
+		want    options
+		wantErr bool
+	}{
+		{
+			args: []string{"inspect", "10.0.0.1"},
+			want: options{configPath: "config.yaml", command: "inspect", arg: "10.0.0.1"},
+		},
+		{
+			args: []string{"-config", "/etc/rl.yaml", "-direct", "reset", "10.0.0.1"},
+			want: options{configPath: "/etc/rl.yaml", direct: true, command: "reset", arg: "10.0.0.1"},
+		},
+		{
+			args: []string{"-server", "http://rl:8081", "-token", "s3cret", "block", "0xabc"},
+			want: options{configPath: "config.yaml", server: "http://rl:8081", token: "s3cret", command: "block", arg: "0xabc"},
+		},
+		{
+			args: []string{"-direct", "drain", "10.0.0.1"},
+			want: options{configPath: "config.yaml", direct: true, command: "drain", arg: "10.0.0.1"},
+		},
+		{
+			args: []string{"trust"},
+			want: options{configPath: "config.yaml", command: "trust"},
+		},
+		{args: []string{}, wantErr: true},                            // Missing command
+		{args: []string{"drop", "x"}, wantErr: true},                 // Unknown command
+		{args: []string{"inspect"}, wantErr: true},                   // Missing argument
+		{args: []string{"trust", "extra"}, wantErr: true},            // Unexpected argument
+		{args: []string{"-direct", "block", "0xabc"}, wantErr: true}, // Trust state lives in the server
+		{args: []string{"-bogus", "trust"}, wantErr: true},           // Unknown flag
+	}
+
+	for _, tt := range tests {
+		got, err := parseArgs(tt.args, io.Discard)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseArgs(%q): expected error, got %+v", tt.args, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseArgs(%q): unexpected error: %v", tt.args, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseArgs(%q) = %+v, want %+v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestRunDirect_InspectAndReset(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+
+	cfg := &config.Config{RateLimit: config.RateLimitConfig{Capacity: 4, RefillRate: 0.001}}
+
+	// Drain some tokens through the same bucket layout the server uses
+	limiter := ratelimitredis.NewTokenBucket(ratelimitredis.Config{
+		Client:     client,
+		Capacity:   cfg.RateLimit.Capacity,
+		RefillRate: cfg.RateLimit.RefillRate,
+	})
+	for i := 0; i < 3; i++ {
+		limiter.Allow("10.0.0.1")
+	}
+
+	var out bytes.Buffer
+	if err := runDirect(options{command: "inspect", arg: "10.0.0.1"}, cfg, client, &out); err != nil {
+		t.Fatalf("inspect: %v", err)
+	}
+	if !strings.HasPrefix(out.String(), "10.0.0.1: 1.00 tokens") {
+		t.Errorf("Expected 1 token after 3 requests, got %q", out.String())
+	}
+
+	out.Reset()
+	if err := runDirect(options{command: "reset", arg: "10.0.0.1"}, cfg, client, &out); err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+	if mr.Exists("ratelimit:10.0.0.1") {
+		t.Error("Expected reset to delete the bucket")
+	}
+
+	out.Reset()
+	if err := runDirect(options{command: "inspect", arg: "10.0.0.1"}, cfg, client, &out); err != nil {
+		t.Fatalf("inspect: %v", err)
+	}
+	if !strings.HasPrefix(out.String(), "10.0.0.1: 4.00 tokens") {
+		t.Errorf("Expected full bucket after reset, got %q", out.String())
+	}
+}
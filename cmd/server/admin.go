@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+	"github.com/haseeb/ratelimiter/pkg/trust"
+)
+
+// registerAdminRoutes adds the operator endpoints used by ratelimitctl under
+// /admin, plus the /events stream and recent settlements. Every request must
+// carry "Authorization: Bearer <token>". Trust, settlement and route
+// endpoints respond 404 when the tracker, settlement queue or payments are off.
+//
+//	GET    /admin/keys?cursor=&limit=  page of keys and their tokens, if the limiter can list them
+//	GET    /admin/keys/:key            tokens available for key, with bucket info if supported
+//	DELETE /admin/keys/:key            reset key to a full bucket
+//	POST   /admin/keys/:key/drain      empty key's bucket until it refills
+//	POST   /admin/wallets/:wallet/block
+//	DELETE /admin/wallets/:wallet/block
+//	GET    /admin/wallets/:wallet/stats payments settled, tokens granted and amount paid by the wallet
+//	GET    /admin/trust                trust tracker stats
+//	GET    /admin/routes               routes registered at runtime
+//	PUT    /admin/routes               register a route: {"method", "path", "price", "cost", "description", "paid_only"}
+//	DELETE /admin/routes?method=&path= unregister a route
+//	GET    /events                     Server-Sent Events stream of request and payment events
+//	GET    /settlements/recent         last queued settlements, oldest first, for reconciliation
+//	GET    /trust/config               trust tracker settings and tiers, defaults applied
+func registerAdminRoutes(r gin.IRouter, token string, limiter ratelimit.Limiter, tracker *trust.Tracker, queue *SettlementQueue, routes *RouteRegistry, events *eventHub) {
+	admin := r.Group("/admin", adminAuth(token))
+	r.GET("/events", adminAuth(token), streamEvents(events))
+
+	r.GET("/settlements/recent", adminAuth(token), func(c *gin.Context) {
+		if queue == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Optimistic settlement is disabled"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"settlements": queue.RecentSettlements()})
+	})
+
+	admin.GET("/keys", func(c *gin.Context) {
+		snapshotter, ok := limiter.(ratelimit.Snapshotter)
+		if !ok {
+			c.JSON(http.StatusNotImplemented, gin.H{"error": "Limiter can't list its keys"})
+			return
+		}
+		limit := 100
+		if s := c.Query("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive integer"})
+				return
+			}
+			limit = min(n, ratelimit.MaxSnapshotPage)
+		}
+
+		keys, next, err := snapshotter.Snapshot(c.Query("cursor"), limit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"keys": keys, "next_cursor": next})
+	})
+
+	admin.GET("/keys/:key", func(c *gin.Context) {
+		key := c.Param("key")
+		if inspector, ok := limiter.(ratelimit.Inspector); ok {
+			info, err := inspector.Info(key)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"key": key, "tokens": info.Tokens, "info": info})
+			return
+		}
+
+		tokens, err := limiter.Available(key)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"key": key, "tokens": tokens})
+	})
+
+	admin.DELETE("/keys/:key", func(c *gin.Context) {
+		resetter, ok := limiter.(ratelimit.Resetter)
+		if !ok {
+			c.JSON(http.StatusNotImplemented, gin.H{"error": "Limiter does not support reset"})
+			return
+		}
+		key := c.Param("key")
+		if err := resetter.Reset(key); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"key": key, "reset": true})
+	})
+
+	admin.POST("/keys/:key/drain", func(c *gin.Context) {
+		drainer, ok := limiter.(ratelimit.Drainer)
+		if !ok {
+			c.JSON(http.StatusNotImplemented, gin.H{"error": "Limiter does not support drain"})
+			return
+		}
+		key := c.Param("key")
+		if err := drainer.Drain(key); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"key": key, "drained": true})
+	})
+
+	withTracker := func(fn func(c *gin.Context)) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			if tracker == nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Trust tracking is disabled"})
+				return
+			}
+			fn(c)
+		}
+	}
+
+	admin.POST("/wallets/:wallet/block", withTracker(func(c *gin.Context) {
+		wallet := strings.ToLower(c.Param("wallet"))
+		tracker.Block(wallet)
+		c.JSON(http.StatusOK, gin.H{"wallet": wallet, "blocked": true})
+	}))
+
+	admin.DELETE("/wallets/:wallet/block", withTracker(func(c *gin.Context) {
+		wallet := strings.ToLower(c.Param("wallet"))
+		tracker.Unblock(wallet)
+		c.JSON(http.StatusOK, gin.H{"wallet": wallet, "blocked": false})
+	}))
+
+	admin.GET("/wallets/:wallet/stats", withTracker(func(c *gin.Context) {
+		wallet := strings.ToLower(c.Param("wallet"))
+		c.JSON(http.StatusOK, gin.H{"wallet": wallet, "stats": tracker.WalletStats(wallet)})
+	}))
+
+	admin.GET("/trust", withTracker(func(c *gin.Context) {
+		c.JSON(http.StatusOK, tracker.Stats())
+	}))
+
+	r.GET("/trust/config", adminAuth(token), withTracker(func(c *gin.Context) {
+		cfg := tracker.Config()
+		tiers := make([]gin.H, 0, 2)
+		for _, tier := range tracker.Tiers() {
+			tiers = append(tiers, gin.H{"level": tier.Level.String(), "payments": tier.Payments})
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"threshold":            cfg.Threshold,
+			"optimistic_threshold": cfg.OptimisticThreshold,
+			"window":               cfg.Window.String(),
+			"retried_weight":       cfg.RetriedWeight,
+			"sweep_interval":       cfg.SweepInterval.String(),
+			"max_wallets":          cfg.MaxWallets,
+			"max_trusted":          cfg.MaxTrusted,
+			"tiers":                tiers,
+		})
+	}))
+
+	withRoutes := func(fn func(c *gin.Context)) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			if routes == nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Payments are disabled"})
+				return
+			}
+			fn(c)
+		}
+	}
+
+	admin.GET("/routes", withRoutes(func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"routes": routes.Routes()})
+	}))
+
+	admin.PUT("/routes", withRoutes(func(c *gin.Context) {
+		var route RegisteredRoute
+		if err := c.ShouldBindJSON(&route); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := routes.RegisterRoute(route.Method, route.Path, route.RouteLimit); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"method": route.Method, "path": route.Path, "registered": true})
+	}))
+
+	admin.DELETE("/routes", withRoutes(func(c *gin.Context) {
+		method, path := c.Query("method"), c.Query("path")
+		if !routes.UnregisterRoute(method, path) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Route not registered"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"method": method, "path": path, "registered": false})
+	}))
+}
+
+// adminAuth rejects requests without the admin bearer token.
+func adminAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !isAdmin(c, token) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// isAdmin reports whether c carries token as its bearer token. An empty
+// token admits no one.
+func isAdmin(c *gin.Context, token string) bool {
+	if token == "" {
+		return false
+	}
+	got := []byte(c.GetHeader("Authorization"))
+	return subtle.ConstantTimeCompare(got, []byte("Bearer "+token)) == 1
+}
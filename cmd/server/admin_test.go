@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/haseeb/ratelimiter/internal/paymenttest"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/memory"
+	"github.com/haseeb/ratelimiter/pkg/trust"
+)
+
+func adminRequest(r http.Handler, method, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	limiter := memory.NewTokenBucket(2, 0.001)
+	tracker := trust.New(trust.Config{Threshold: 1})
+
+	r := gin.New()
+	registerAdminRoutes(r, "s3cret", limiter, tracker, nil, nil, newEventHub())
+
+	if w := adminRequest(r, http.MethodGet, "/admin/trust", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without token, got %d", w.Code)
+	}
+	if w := adminRequest(r, http.MethodGet, "/admin/trust", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with wrong token, got %d", w.Code)
+	}
+
+	// The in-memory limiter lists its single bucket
+	if w := adminRequest(r, http.MethodGet, "/admin/keys", "s3cret"); w.Code != http.StatusOK {
+		t.Errorf("Expected 200 listing keys of the memory limiter, got %d", w.Code)
+	} else {
+		var keys struct {
+			Keys []struct {
+				Tokens float64 `json:"tokens"`
+			} `json:"keys"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &keys); err != nil || len(keys.Keys) != 1 || keys.Keys[0].Tokens < 1.99 {
+			t.Errorf("Expected the one full bucket, got %s", w.Body.String())
+		}
+	}
+
+	limiter.Allow("k")
+	limiter.Allow("k")
+	w := adminRequest(r, http.MethodGet, "/admin/keys/k", "s3cret")
+	var body struct {
+		Info struct {
+			Allowed int64 `json:"allowed"`
+		} `json:"info"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Info.Allowed != 2 {
+		t.Errorf("Expected key info with 2 allowed requests, got %s", w.Body.String())
+	}
+	if w := adminRequest(r, http.MethodDelete, "/admin/keys/k", "s3cret"); w.Code != http.StatusOK {
+		t.Fatalf("Expected reset to succeed, got %d", w.Code)
+	}
+	if avail, _ := limiter.Available("k"); avail < 1.99 {
+		t.Errorf("Expected full bucket after reset, got %.2f", avail)
+	}
+	if w := adminRequest(r, http.MethodPost, "/admin/keys/k/drain", "s3cret"); w.Code != http.StatusOK {
+		t.Fatalf("Expected drain to succeed, got %d", w.Code)
+	}
+	if allowed, _ := limiter.Allow("k"); allowed {
+		t.Error("Expected drained key to be rate limited")
+	}
+
+	w = adminRequest(r, http.MethodGet, "/trust/config", "s3cret")
+	var trustConfig struct {
+		Threshold int    `json:"threshold"`
+		Window    string `json:"window"`
+		Tiers     []struct {
+			Level    string `json:"level"`
+			Payments int    `json:"payments"`
+		} `json:"tiers"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &trustConfig); err != nil || trustConfig.Threshold != 1 || trustConfig.Window != "1h0m0s" {
+		t.Errorf("Expected threshold 1 and the default 1h window, got %s", w.Body.String())
+	}
+	if len(trustConfig.Tiers) != 2 || trustConfig.Tiers[0].Level != "probation" || trustConfig.Tiers[1].Payments != 1 {
+		t.Errorf("Expected probation and trusted tiers at 1 payment, got %s", w.Body.String())
+	}
+	if w := adminRequest(r, http.MethodGet, "/trust/config", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected /trust/config to need the admin token, got %d", w.Code)
+	}
+
+	if w := adminRequest(r, http.MethodPost, "/admin/wallets/0xABC/block", "s3cret"); w.Code != http.StatusOK {
+		t.Fatalf("Expected block to succeed, got %d", w.Code)
+	}
+	if !tracker.IsBlocked("0xabc") {
+		t.Error("Expected wallet to be blocked (case-insensitively)")
+	}
+	if w := adminRequest(r, http.MethodDelete, "/admin/wallets/0xabc/block", "s3cret"); w.Code != http.StatusOK {
+		t.Fatalf("Expected unblock to succeed, got %d", w.Code)
+	}
+	if tracker.IsBlocked("0xabc") {
+		t.Error("Expected wallet to be unblocked")
+	}
+}
+
+func TestHybridMiddleware_BlockedWalletRefused(t *testing.T) {
+	processor := &paymenttest.Processor{}
+	tracker := trust.New(trust.Config{})
+	tracker.Block(testWallet)
+
+	r := newTestRouter(hybridConfig{
+		Limiter:      memory.NewTokenBucket(1, 0.001),
+		Payments:     processor,
+		Capacity:     1,
+		TrustTracker: tracker,
+	})
+
+	doRequest(r, "") // Drain the bucket
+	if w := doRequest(r, paymentHeaderFor(testWallet)); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for blocked wallet, got %d", w.Code)
+	}
+	if verify, _ := processor.Calls(); verify != 0 {
+		t.Errorf("Expected blocked payment not to be verified, got %d verifications", verify)
+	}
+}
+
+func TestAdminRoutes_RecentSettlements(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	limiter := memory.NewTokenBucket(2, 0.001)
+
+	r := gin.New()
+	registerAdminRoutes(r, "s3cret", limiter, nil, nil, nil, newEventHub())
+	if w := adminRequest(r, http.MethodGet, "/settlements/recent", "s3cret"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 without a settlement queue, got %d", w.Code)
+	}
+
+	sq := NewSettlementQueue(&paymenttest.Processor{}, nil, 10)
+	defer sq.Close()
+	sq.Enqueue(jobFor(testWallet, "1000"))
+	if !waitFor(t, time.Second, func() bool { return len(sq.RecentSettlements()) == 1 }) {
+		t.Fatal("Expected the settlement to be recorded")
+	}
+
+	r = gin.New()
+	registerAdminRoutes(r, "s3cret", limiter, nil, sq, nil, newEventHub())
+	if w := adminRequest(r, http.MethodGet, "/settlements/recent", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without token, got %d", w.Code)
+	}
+	w := adminRequest(r, http.MethodGet, "/settlements/recent", "s3cret")
+	var body struct {
+		Settlements []SettlementReceipt `json:"settlements"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(body.Settlements) != 1 || body.Settlements[0].Transaction != "0xtx" {
+		t.Errorf("Expected the 0xtx receipt, got %+v", body.Settlements)
+	}
+}
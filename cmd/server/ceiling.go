@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// requestCeiling caps the requests served to each key per fixed window,
+// counting free and paid ones alike, so paying clients can't push more load
+// onto the backend than it can take. A nil requestCeiling has no cap.
+type requestCeiling struct {
+	limit  int
+	window time.Duration
+	now    func() time.Time
+
+	mu        sync.Mutex
+	windows   map[string]*ceilingWindow
+	lastPrune time.Time
+}
+
+// ceilingWindow counts a key's requests since start.
+type ceilingWindow struct {
+	start  time.Time
+	served int
+}
+
+// newRequestCeiling returns a ceiling serving each key at most limit
+// requests per window, or nil if limit is not positive.
+func newRequestCeiling(limit int, window time.Duration) *requestCeiling {
+	if limit <= 0 {
+		return nil
+	}
+	return &requestCeiling{
+		limit:   limit,
+		window:  window,
+		now:     time.Now,
+		windows: make(map[string]*ceilingWindow),
+	}
+}
+
+// Take counts a request for key if its window has room. Otherwise it
+// returns false and how long until the window resets. refund uncounts the
+// request, for one that ends up not being served; it's a no-op once the
+// window has moved on.
+func (r *requestCeiling) Take(key string) (refund func(), wait time.Duration, ok bool) {
+	if r == nil {
+		return func() {}, 0, true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	r.pruneLocked(now)
+	w := r.windows[key]
+	if w == nil || now.Sub(w.start) >= r.window {
+		w = &ceilingWindow{start: now}
+		r.windows[key] = w
+	}
+	if w.served >= r.limit {
+		return nil, w.start.Add(r.window).Sub(now), false
+	}
+	w.served++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if r.windows[key] == w && w.served > 0 {
+				w.served--
+			}
+		})
+	}, 0, true
+}
+
+// pruneLocked drops expired windows, at most once a window.
+func (r *requestCeiling) pruneLocked(now time.Time) {
+	if now.Sub(r.lastPrune) < r.window {
+		return
+	}
+	r.lastPrune = now
+	for key, w := range r.windows {
+		if now.Sub(w.start) >= r.window {
+			delete(r.windows, key)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/haseeb/ratelimiter/internal/paymenttest"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/memory"
+)
+
+func TestHybridMiddleware_RequestCeiling(t *testing.T) {
+	processor := &paymenttest.Processor{}
+	r := newTestRouter(hybridConfig{
+		Limiter:  memory.NewTokenBucket(1, 0.001),
+		Payments: processor,
+		Capacity: 1,
+		Ceiling:  newRequestCeiling(3, time.Minute),
+	})
+
+	if w := doRequest(r, ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected the first request served from the bucket, got %d", w.Code)
+	}
+	// A 402 isn't a served request, so it doesn't use up the ceiling
+	if w := doRequest(r, ""); w.Code != http.StatusPaymentRequired {
+		t.Fatalf("Expected 402 once the bucket is empty, got %d", w.Code)
+	}
+	for i := 0; i < 2; i++ {
+		if w := doRequest(r, paymentHeaderFor(testWallet)); w.Code != http.StatusOK {
+			t.Fatalf("Expected paid request %d served, got %d", i+1, w.Code)
+		}
+	}
+
+	// The ceiling overrides the 402 path: no payment is even looked at
+	verifyBefore, _ := processor.Calls()
+	w := doRequest(r, paymentHeaderFor(testWallet))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 past the ceiling despite payment, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Expected Retry-After on the ceiling 429")
+	}
+	if w := doRequest(r, ""); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 instead of 402 past the ceiling, got %d", w.Code)
+	}
+	if verify, _ := processor.Calls(); verify != verifyBefore {
+		t.Errorf("Expected no verification past the ceiling, got %d more", verify-verifyBefore)
+	}
+}
+
+func TestRequestCeiling_Window(t *testing.T) {
+	ceiling := newRequestCeiling(2, time.Minute)
+	now := time.Unix(1000, 0)
+	ceiling.now = func() time.Time { return now }
+
+	ceiling.Take("a")
+	refund, _, _ := ceiling.Take("a")
+	if _, wait, ok := ceiling.Take("a"); ok || wait != time.Minute {
+		t.Fatalf("Expected the third request refused for a minute, got %v, %v", ok, wait)
+	}
+	if _, _, ok := ceiling.Take("b"); !ok {
+		t.Error("Expected other keys to have their own ceiling")
+	}
+
+	// A refunded request frees its place, once
+	refund()
+	refund()
+	if _, _, ok := ceiling.Take("a"); !ok {
+		t.Error("Expected a refunded place to be reusable")
+	}
+	if _, _, ok := ceiling.Take("a"); ok {
+		t.Error("Expected a second refund to be a no-op")
+	}
+
+	now = now.Add(time.Minute)
+	if _, _, ok := ceiling.Take("a"); !ok {
+		t.Error("Expected the ceiling to reset with the window")
+	}
+
+	if newRequestCeiling(0, time.Minute) != nil {
+		t.Error("Expected a zero limit to disable the ceiling")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+)
+
+// pendingCredits holds paid tokens that couldn't be added to a key's bucket,
+// so the key's next request can apply them once the limiter recovers. The
+// client has already paid, so a backend blip shouldn't cost them the tokens,
+// nor hold up their response while it's retried.
+type pendingCredits struct {
+	mu      sync.Mutex
+	credits map[string]float64
+}
+
+func newPendingCredits() *pendingCredits {
+	return &pendingCredits{credits: make(map[string]float64)}
+}
+
+// Add records tokens owed to key.
+func (p *pendingCredits) Add(key string, tokens float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.credits[key] += tokens
+}
+
+// Pending returns the tokens still owed to key.
+func (p *pendingCredits) Pending(key string) float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.credits[key]
+}
+
+// Apply refills key with any tokens owed to it. On failure the credit is
+// kept for the next attempt.
+func (p *pendingCredits) Apply(limiter ratelimit.Limiter, key string) {
+	p.mu.Lock()
+	tokens, ok := p.credits[key]
+	delete(p.credits, key)
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	if err := limiter.Refill(key, tokens); err != nil {
+		log.Printf("[REFILL] Pending credit of %.2f for %s still failing: %v", tokens, logKey(key), err)
+		p.Add(key, tokens)
+		return
+	}
+	log.Printf("[REFILL] Applied pending credit of %.2f for %s", tokens, logKey(key))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/haseeb/ratelimiter/internal/paymenttest"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/memory"
+)
+
+// refillFailingLimiter is a memory bucket whose next failRefills refills fail,
+// as during a Redis blip.
+type refillFailingLimiter struct {
+	*memory.TokenBucket
+	mu          sync.Mutex
+	failRefills int
+}
+
+func (l *refillFailingLimiter) Refill(key string, tokens float64) error {
+	l.mu.Lock()
+	if l.failRefills > 0 {
+		l.failRefills--
+		l.mu.Unlock()
+		return errors.Join(ratelimit.ErrBackendUnavailable, errors.New("connection reset"))
+	}
+	l.mu.Unlock()
+	return l.TokenBucket.Refill(key, tokens)
+}
+
+func (l *refillFailingLimiter) failNext(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.failRefills = n
+}
+
+func TestHybridMiddleware_FailedRefillCreditedLater(t *testing.T) {
+	limiter := &refillFailingLimiter{TokenBucket: memory.NewTokenBucket(3, 0.001)}
+	processor := &paymenttest.Processor{}
+	credits := newPendingCredits()
+	r := newTestRouter(hybridConfig{
+		Limiter:  limiter,
+		Payments: processor,
+		Capacity: 3,
+		Credits:  credits,
+	})
+
+	// Settlement succeeds but the refill fails: the tokens are owed at
+	// once, without retrying on the request
+	limiter.Drain("")
+	limiter.failNext(2)
+	if w := doRequest(r, paymentHeaderFor(testWallet)); w.Code != http.StatusOK {
+		t.Fatalf("Expected the charged client to be served, got %d", w.Code)
+	}
+	if _, settle := processor.Calls(); settle != 1 {
+		t.Fatalf("Expected 1 settlement, got %d", settle)
+	}
+	if owed := credits.Pending("192.0.2.1"); owed != 3 {
+		t.Fatalf("Expected 3 tokens owed, got %.2f", owed)
+	}
+
+	// A request while the limiter still fails keeps the credit
+	doRequest(r, "")
+	if owed := credits.Pending("192.0.2.1"); owed != 3 {
+		t.Fatalf("Expected the credit kept through another failure, got %.2f", owed)
+	}
+
+	// The limiter has recovered: the next request applies the credit first
+	if w := doRequest(r, ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected the credit to serve the next request, got %d", w.Code)
+	}
+	if owed := credits.Pending("192.0.2.1"); owed != 0 {
+		t.Errorf("Expected the credit to be applied, %.2f still owed", owed)
+	}
+	if avail, _ := limiter.Available(""); avail < 1.99 || avail > 2.01 {
+		t.Errorf("Expected 3 credited tokens less one spent, got %.2f", avail)
+	}
+}
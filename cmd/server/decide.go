@@ -0,0 +1,77 @@
+package main
+
+import "github.com/haseeb/ratelimiter/internal/config"
+
+// action is what the hybrid middleware does with a request.
+type action int
+
+const (
+	actionServe                  action = iota // Serve from the bucket
+	actionRequire402                           // Answer 402 with payment requirements
+	actionPaySyncThenServe                     // Settle the payment, then serve
+	actionPayOptimisticThenServe               // Serve at once, queue the settlement
+	actionReject                               // Refuse the payment outright
+	actionRateLimit                            // Answer 429; the route takes no payment
+)
+
+func (a action) String() string {
+	switch a {
+	case actionServe:
+		return "serve"
+	case actionRequire402:
+		return "require-402"
+	case actionPaySyncThenServe:
+		return "pay-sync-then-serve"
+	case actionPayOptimisticThenServe:
+		return "pay-optimistic-then-serve"
+	case actionReject:
+		return "reject"
+	case actionRateLimit:
+		return "rate-limit"
+	}
+	return "unknown"
+}
+
+// requestState is what the hybrid middleware knows about a request when it
+// decides what to do with it.
+type requestState struct {
+	Mode         string // config.ModeHybrid, ModeMetered or ModePaidOnly
+	Allowed      bool   // The bucket covered the request's cost
+	HasPayment   bool   // A payment header is attached
+	Blocked      bool   // The payer's wallet is blocked
+	Trusted      bool   // The payer is trusted for optimistic settlement
+	QueueHealthy bool   // A settlement queue is running and keeping up
+	Free         bool   // The route never takes payment, so it's only rate limited
+}
+
+// payFirst reports whether the payment is processed without consulting the
+// bucket: metered and paid-only modes process an attached payment up front.
+func (s requestState) payFirst() bool {
+	return s.HasPayment && (s.Mode == config.ModeMetered || s.Mode == config.ModePaidOnly)
+}
+
+// checksBucket reports whether Allowed means anything for s. Paid-only mode
+// never serves from the bucket.
+func (s requestState) checksBucket() bool {
+	return !s.payFirst() && s.Mode != config.ModePaidOnly
+}
+
+// decide chooses what to do with a request. It has no side effects, so the
+// middleware can fill in Trusted and QueueHealthy only once the payment is
+// verified: until then a payment decides actionPaySyncThenServe, and the
+// middleware decides again to choose between sync and optimistic.
+func decide(s requestState) action {
+	switch {
+	case s.checksBucket() && s.Allowed:
+		return actionServe
+	case s.Free:
+		return actionRateLimit
+	case !s.HasPayment:
+		return actionRequire402
+	case s.Blocked:
+		return actionReject
+	case s.Trusted && s.QueueHealthy:
+		return actionPayOptimisticThenServe
+	}
+	return actionPaySyncThenServe
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/haseeb/ratelimiter/internal/config"
+)
+
+func TestDecide(t *testing.T) {
+	// want returns the expected action, spelled out independently of decide
+	want := func(s requestState) action {
+		payFirst := s.HasPayment && s.Mode != config.ModeHybrid
+		if !payFirst && s.Mode != config.ModePaidOnly && s.Allowed {
+			return actionServe
+		}
+		if s.Free {
+			return actionRateLimit
+		}
+		if !s.HasPayment {
+			return actionRequire402
+		}
+		if s.Blocked {
+			return actionReject
+		}
+		if s.Trusted && s.QueueHealthy {
+			return actionPayOptimisticThenServe
+		}
+		return actionPaySyncThenServe
+	}
+
+	// Every combination of mode and flags
+	seen := make(map[action]bool)
+	for _, mode := range []string{config.ModeHybrid, config.ModeMetered, config.ModePaidOnly} {
+		for bits := 0; bits < 1<<6; bits++ {
+			s := requestState{
+				Mode:         mode,
+				Allowed:      bits&1 != 0,
+				HasPayment:   bits&2 != 0,
+				Blocked:      bits&4 != 0,
+				Trusted:      bits&8 != 0,
+				QueueHealthy: bits&16 != 0,
+				Free:         bits&32 != 0,
+			}
+			got := decide(s)
+			if got != want(s) {
+				t.Errorf("decide(%+v) = %v, want %v", s, got, want(s))
+			}
+			seen[got] = true
+		}
+	}
+	if len(seen) != 6 {
+		t.Errorf("Expected the matrix to reach all 6 actions, got %v", seen)
+	}
+}
+
+func TestDecide_Cases(t *testing.T) {
+	tests := []struct {
+		name  string
+		state requestState
+		want  action
+	}{
+		{"tokens left", requestState{Mode: config.ModeHybrid, Allowed: true}, actionServe},
+		{"tokens left, payment attached", requestState{Mode: config.ModeHybrid, Allowed: true, HasPayment: true}, actionServe},
+		{"limited, no payment", requestState{Mode: config.ModeHybrid}, actionRequire402},
+		{"limited, untrusted payment", requestState{Mode: config.ModeHybrid, HasPayment: true, QueueHealthy: true}, actionPaySyncThenServe},
+		{"limited, trusted payment", requestState{Mode: config.ModeHybrid, HasPayment: true, Trusted: true, QueueHealthy: true}, actionPayOptimisticThenServe},
+		{"trusted, queue stalled", requestState{Mode: config.ModeHybrid, HasPayment: true, Trusted: true}, actionPaySyncThenServe},
+		{"blocked wallet", requestState{Mode: config.ModeHybrid, HasPayment: true, Blocked: true, Trusted: true, QueueHealthy: true}, actionReject},
+		{"metered, payment attached", requestState{Mode: config.ModeMetered, Allowed: true, HasPayment: true}, actionPaySyncThenServe},
+		{"metered, no payment", requestState{Mode: config.ModeMetered, Allowed: true}, actionServe},
+		{"paid-only, no payment", requestState{Mode: config.ModePaidOnly, Allowed: true}, actionRequire402},
+		{"paid-only, payment attached", requestState{Mode: config.ModePaidOnly, Allowed: true, HasPayment: true}, actionPaySyncThenServe},
+		{"free route, tokens left", requestState{Mode: config.ModeHybrid, Allowed: true, Free: true}, actionServe},
+		{"free route, limited", requestState{Mode: config.ModeHybrid, Free: true}, actionRateLimit},
+		{"free route, payment attached", requestState{Mode: config.ModeHybrid, HasPayment: true, Trusted: true, QueueHealthy: true, Free: true}, actionRateLimit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := decide(tt.state); got != tt.want {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	if got := fmt.Sprint(action(99)); got != "unknown" {
+		t.Errorf("Expected an unknown action to print as unknown, got %q", got)
+	}
+}
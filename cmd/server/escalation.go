@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// refillEscalation scales the tokens a payment grants by how many 402s its
+// key has been sent within a sliding window, following a curve of
+// multipliers: the nth recent 402 picks curve[n-1], and the last entry holds
+// for any more. A rising curve grants a small burst on a client's first
+// payment and larger ones as it keeps paying; a falling one does the
+// reverse. A nil refillEscalation scales nothing.
+type refillEscalation struct {
+	curve  []float64
+	window time.Duration
+	now    func() time.Time
+
+	mu        sync.Mutex
+	sent      map[string][]time.Time // Each key's latest 402s within the window, oldest first, at most len(curve)
+	lastPrune time.Time
+}
+
+// newRefillEscalation returns an escalation following curve over window, or
+// nil if either is unset.
+func newRefillEscalation(curve []float64, window time.Duration) *refillEscalation {
+	if len(curve) == 0 || window <= 0 {
+		return nil
+	}
+	return &refillEscalation{
+		curve:  curve,
+		window: window,
+		now:    time.Now,
+		sent:   make(map[string][]time.Time),
+	}
+}
+
+// Record counts a 402 sent to key and returns the multiplier key's next
+// payment will get.
+func (e *refillEscalation) Record(key string) float64 {
+	if e == nil {
+		return 1
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := e.now()
+	e.pruneLocked(now)
+	sent := append(e.trimLocked(key, now), now)
+	// Past the curve's end more 402s change nothing, so only that many
+	// are kept
+	if over := len(sent) - len(e.curve); over > 0 {
+		sent = sent[:copy(sent, sent[over:])]
+	}
+	e.sent[key] = sent
+	return e.multiplier(len(sent))
+}
+
+// Multiplier returns the multiplier for a payment from key, by the 402s it
+// was sent within the window. A key paying before any 402 gets curve[0].
+func (e *refillEscalation) Multiplier(key string) float64 {
+	if e == nil {
+		return 1
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.multiplier(len(e.trimLocked(key, e.now())))
+}
+
+// multiplier returns the curve's multiplier after n 402s.
+func (e *refillEscalation) multiplier(n int) float64 {
+	return e.curve[min(max(n, 1), len(e.curve))-1]
+}
+
+// trimLocked drops key's 402s older than the window and returns the rest.
+func (e *refillEscalation) trimLocked(key string, now time.Time) []time.Time {
+	sent := e.sent[key]
+	i := 0
+	for i < len(sent) && now.Sub(sent[i]) >= e.window {
+		i++
+	}
+	if i == len(sent) {
+		delete(e.sent, key)
+		return nil
+	}
+	sent = sent[i:]
+	e.sent[key] = sent
+	return sent
+}
+
+// pruneLocked drops keys whose 402s have all expired, at most once a window.
+func (e *refillEscalation) pruneLocked(now time.Time) {
+	if now.Sub(e.lastPrune) < e.window {
+		return
+	}
+	e.lastPrune = now
+	for key, sent := range e.sent {
+		if now.Sub(sent[len(sent)-1]) >= e.window {
+			delete(e.sent, key)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/haseeb/ratelimiter/internal/paymenttest"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/memory"
+)
+
+func TestRefillEscalation_Curve(t *testing.T) {
+	e := newRefillEscalation([]float64{0.5, 1, 2}, time.Minute)
+	now := time.Unix(1700000000, 0)
+	e.now = func() time.Time { return now }
+
+	// Paying before any 402 gets the first multiplier
+	if m := e.Multiplier("a"); m != 0.5 {
+		t.Errorf("Expected 0.5 with no 402s, got %g", m)
+	}
+
+	// Each 402 climbs the curve; the last multiplier holds
+	for i, want := range []float64{0.5, 1, 2, 2} {
+		if m := e.Record("a"); m != want {
+			t.Errorf("402 #%d: expected %g, got %g", i+1, want, m)
+		}
+	}
+	for range 10 {
+		e.Record("a")
+	}
+	if got := len(e.sent["a"]); got != 3 {
+		t.Errorf("Expected a key's 402s capped at the curve's length, %d held", got)
+	}
+	if m := e.Multiplier("b"); m != 0.5 {
+		t.Errorf("Expected another key to be unaffected, got %g", m)
+	}
+
+	// 402s age out of the window one by one
+	now = now.Add(time.Minute)
+	if m := e.Multiplier("a"); m != 0.5 {
+		t.Errorf("Expected the curve to restart once the window passed, got %g", m)
+	}
+	if len(e.sent) != 0 {
+		t.Errorf("Expected expired keys to be dropped, %d held", len(e.sent))
+	}
+
+	if newRefillEscalation(nil, time.Minute) != nil || newRefillEscalation([]float64{1}, 0) != nil {
+		t.Error("Expected no escalation without both a curve and a window")
+	}
+	var disabled *refillEscalation
+	if disabled.Record("a") != 1 || disabled.Multiplier("a") != 1 {
+		t.Error("Expected a nil escalation to scale nothing")
+	}
+}
+
+func TestHybridMiddleware_RefillEscalation(t *testing.T) {
+	limiter := memory.NewTokenBucket(2, 0.000001)
+	r := newTestRouter(hybridConfig{
+		Limiter:    limiter,
+		Payments:   &paymenttest.Processor{},
+		Capacity:   2,
+		Escalation: newRefillEscalation([]float64{1, 2, 3}, time.Minute),
+	})
+
+	// Each pay cycle: empty the bucket, get a 402, pay. The grant climbs
+	// with every 402: 1, 2, then 3 times capacity.
+	doRequest(r, "")
+	doRequest(r, "")
+	for i, want := range []float64{2, 4, 6} {
+		if w := doRequest(r, ""); w.Code != http.StatusPaymentRequired {
+			t.Fatalf("Cycle %d: expected 402, got %d", i+1, w.Code)
+		}
+		if w := doRequest(r, paymentHeaderFor(testWallet)); w.Code != http.StatusOK {
+			t.Fatalf("Cycle %d: expected the payment to be served, got %d", i+1, w.Code)
+		}
+		if got, _ := limiter.Available(""); got < want-0.01 || got > want+0.01 {
+			t.Errorf("Cycle %d: expected a grant of %g tokens, got %.2f", i+1, want, got)
+		}
+		for j := 0; j < int(want); j++ {
+			doRequest(r, "")
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Event types published to the event hub.
+const (
+	eventRequestAllowed   = "request_allowed"   // Served, from the bucket or after payment
+	eventRequestDenied    = "request_denied"    // Refused with 429 or 403
+	eventPaymentRequired  = "payment_required"  // 402 issued
+	eventPaymentSettled   = "payment_settled"   // Settlement succeeded, sync or queued
+	eventSettlementFailed = "settlement_failed" // Settlement failed, sync or queued
+	eventTrustChanged     = "trust_changed"     // Wallet crossed the trust threshold
+)
+
+// eventBufferSize is how many events a slow subscriber may fall behind by
+// before new events are dropped for it.
+const eventBufferSize = 64
+
+// Event is a rate limit or payment event, streamed to operators as JSON.
+type Event struct {
+	Type        string    `json:"type"`
+	Time        time.Time `json:"time"`
+	Key         string    `json:"key,omitempty"`
+	Wallet      string    `json:"wallet,omitempty"`
+	Via         string    `json:"via,omitempty"` // X-Served-Via value for request_allowed
+	Transaction string    `json:"transaction,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	Trusted     *bool     `json:"trusted,omitempty"` // New trust state for trust_changed
+	DryRun      bool      `json:"dry_run,omitempty"` // Decision wasn't enforced
+}
+
+// eventHub fans events out to subscribers. Publishing never blocks: a
+// subscriber that can't keep up misses events rather than slowing requests.
+// A nil hub discards events, so publishers needn't check for one.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan Event]struct{})}
+}
+
+// Publish sends ev to every subscriber, stamping its time if unset.
+func (h *eventHub) Publish(ev Event) {
+	if h == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default: // Subscriber is behind - drop rather than block
+		}
+	}
+}
+
+// Subscribe returns a channel of future events and a func that unsubscribes
+// and closes it.
+func (h *eventHub) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBufferSize)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			delete(h.subs, ch)
+			h.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// subscribers returns the number of active subscribers.
+func (h *eventHub) subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+// streamEvents serves the hub as Server-Sent Events, one "event: <type>"
+// message with a JSON payload per event, until the client disconnects.
+func streamEvents(h *eventHub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		events, unsubscribe := h.Subscribe()
+		defer unsubscribe()
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header("X-Accel-Buffering", "no") // Stop nginx buffering the stream
+
+		// An initial comment tells the client the subscription is live
+		io.WriteString(c.Writer, ": connected\n\n")
+		c.Writer.Flush()
+
+		keepAlive := time.NewTicker(15 * time.Second)
+		defer keepAlive.Stop()
+
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case <-c.Request.Context().Done():
+				return false
+			case <-keepAlive.C:
+				io.WriteString(w, ": keep-alive\n\n")
+				return true
+			case ev := <-events:
+				c.SSEvent(ev.Type, ev)
+				return true
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/haseeb/ratelimiter/internal/paymenttest"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/memory"
+)
+
+// readEvent returns the next SSE message of the given type from the stream.
+func readEvent(t *testing.T, r *bufio.Reader, eventType string) Event {
+	t.Helper()
+	var name string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Reading event stream: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			name = strings.TrimPrefix(line, "event:")
+		case strings.HasPrefix(line, "data:") && name == eventType:
+			var ev Event
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &ev); err != nil {
+				t.Fatalf("Parsing event: %v", err)
+			}
+			return ev
+		}
+	}
+}
+
+func TestEvents_StreamsPaymentSettled(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	events := newEventHub()
+	limiter := memory.NewTokenBucket(1, 0.001)
+
+	// Admin routes go before the rate limiter, as in main
+	r := gin.New()
+	registerAdminRoutes(r, "s3cret", limiter, nil, nil, nil, events)
+	r.Use(hybridRateLimitPaymentMiddleware(hybridConfig{
+		Limiter:  limiter,
+		Payments: &paymenttest.Processor{},
+		Capacity: 1,
+		Events:   events,
+	}))
+	r.GET("/cpu", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	if w := adminRequest(r, http.MethodGet, "/events", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without token, got %d", w.Code)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/events", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Connecting to /events: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected text/event-stream, got %q", ct)
+	}
+
+	stream := bufio.NewReader(resp.Body)
+	if line, _ := stream.ReadString('\n'); line != ": connected\n" {
+		t.Fatalf("Expected connected comment, got %q", line)
+	}
+
+	doRequest(r, "") // Drain the bucket
+	if w := doRequest(r, paymentHeaderFor(testWallet)); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 after payment, got %d", w.Code)
+	}
+
+	ev := readEvent(t, stream, eventPaymentSettled)
+	if ev.Wallet != testWallet || ev.Transaction != "0xtx" {
+		t.Errorf("Unexpected payment_settled event: %+v", ev)
+	}
+}
+
+func TestEvents_UnsubscribesOnDisconnect(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	events := newEventHub()
+	r := gin.New()
+	r.GET("/events", streamEvents(events))
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/events")
+	if err != nil {
+		t.Fatalf("Connecting to /events: %v", err)
+	}
+	bufio.NewReader(resp.Body).ReadString('\n')
+	if events.subscribers() != 1 {
+		t.Fatalf("Expected 1 subscriber, got %d", events.subscribers())
+	}
+
+	resp.Body.Close()
+	if !waitFor(t, time.Second, func() bool { return events.subscribers() == 0 }) {
+		t.Error("Expected subscriber to be removed after the client disconnected")
+	}
+}
+
+func TestEventHub_SlowSubscriberDoesNotBlock(t *testing.T) {
+	events := newEventHub()
+	_, unsubscribe := events.Subscribe()
+	defer unsubscribe()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < eventBufferSize*2; i++ {
+			events.Publish(Event{Type: eventRequestAllowed})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Publish blocked on a subscriber that never reads")
+	}
+
+	var nilHub *eventHub
+	nilHub.Publish(Event{Type: eventRequestAllowed}) // Must not panic
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+)
+
+// facilitatorCooldown is how long a failed facilitator is tried only after
+// the healthy ones.
+const facilitatorCooldown = 30 * time.Second
+
+// facilitatorHealth is a snapshot of one facilitator's recent behaviour.
+type facilitatorHealth struct {
+	Name        string    `json:"name"`
+	Healthy     bool      `json:"healthy"`
+	Failures    int       `json:"failures"` // Consecutive failures
+	LastError   string    `json:"last_error,omitempty"`
+	LastFailure time.Time `json:"last_failure,omitempty"`
+}
+
+type facilitatorEndpoint struct {
+	client x402.FacilitatorClient
+	health facilitatorHealth
+}
+
+// failoverFacilitator is an x402.FacilitatorClient over a prioritized list of
+// facilitators. Each call goes to the first healthy one and falls over to
+// the next if it can't be reached. A facilitator that fails is tried last
+// until it succeeds again or its cooldown passes.
+//
+// Only transport-level failures fail over. A verify or settle rejection is a
+// verdict on the payment, so it's returned as-is. Re-sending a settlement is
+// safe: the authorization nonce can only be spent on-chain once.
+type failoverFacilitator struct {
+	mu        sync.Mutex
+	endpoints []*facilitatorEndpoint
+	now       func() time.Time
+}
+
+// newFailoverFacilitator wraps clients in priority order; names label them in
+// logs and health reports.
+func newFailoverFacilitator(names []string, clients []x402.FacilitatorClient) *failoverFacilitator {
+	f := &failoverFacilitator{now: time.Now}
+	for i, client := range clients {
+		f.endpoints = append(f.endpoints, &facilitatorEndpoint{
+			client: client,
+			health: facilitatorHealth{Name: names[i], Healthy: true},
+		})
+	}
+	return f
+}
+
+// Verify verifies a payment with the first facilitator that answers.
+func (f *failoverFacilitator) Verify(ctx context.Context, payloadBytes, requirementsBytes []byte) (*x402.VerifyResponse, error) {
+	var resp *x402.VerifyResponse
+	err := f.try("verify", func(c x402.FacilitatorClient) error {
+		var err error
+		resp, err = c.Verify(ctx, payloadBytes, requirementsBytes)
+		return err
+	})
+	return resp, err
+}
+
+// Settle settles a payment with the first facilitator that answers.
+func (f *failoverFacilitator) Settle(ctx context.Context, payloadBytes, requirementsBytes []byte) (*x402.SettleResponse, error) {
+	var resp *x402.SettleResponse
+	err := f.try("settle", func(c x402.FacilitatorClient) error {
+		var err error
+		resp, err = c.Settle(ctx, payloadBytes, requirementsBytes)
+		return err
+	})
+	return resp, err
+}
+
+// GetSupported returns the supported kinds of the first facilitator that answers.
+func (f *failoverFacilitator) GetSupported(ctx context.Context) (x402.SupportedResponse, error) {
+	var resp x402.SupportedResponse
+	err := f.try("supported", func(c x402.FacilitatorClient) error {
+		var err error
+		resp, err = c.GetSupported(ctx)
+		return err
+	})
+	return resp, err
+}
+
+// Health returns a snapshot of every facilitator, in priority order.
+func (f *failoverFacilitator) Health() []facilitatorHealth {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	out := make([]facilitatorHealth, len(f.endpoints))
+	for i, e := range f.endpoints {
+		out[i] = e.health
+	}
+	return out
+}
+
+// try runs call against each facilitator in order until one answers.
+func (f *failoverFacilitator) try(op string, call func(x402.FacilitatorClient) error) error {
+	var errs []error
+	for _, e := range f.order() {
+		err := call(e.client)
+		if err == nil || isPaymentVerdict(err) {
+			f.markHealthy(e)
+			return err
+		}
+		f.markFailed(e, err)
+		log.Printf("[FACILITATOR] %s via %s failed, trying next: %v", op, e.health.Name, err)
+		errs = append(errs, fmt.Errorf("%s: %w", e.health.Name, err))
+	}
+	return fmt.Errorf("all facilitators failed to %s: %w", op, errors.Join(errs...))
+}
+
+// order returns healthy facilitators first, then failed ones, each group in
+// priority order. A failed facilitator counts as healthy again once its
+// cooldown has passed.
+func (f *failoverFacilitator) order() []*facilitatorEndpoint {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := f.now()
+	var healthy, failed []*facilitatorEndpoint
+	for _, e := range f.endpoints {
+		if e.health.Healthy || now.Sub(e.health.LastFailure) >= facilitatorCooldown {
+			healthy = append(healthy, e)
+		} else {
+			failed = append(failed, e)
+		}
+	}
+	return append(healthy, failed...)
+}
+
+func (f *failoverFacilitator) markHealthy(e *facilitatorEndpoint) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !e.health.Healthy {
+		log.Printf("[FACILITATOR] %s recovered", e.health.Name)
+	}
+	e.health.Healthy = true
+	e.health.Failures = 0
+}
+
+func (f *failoverFacilitator) markFailed(e *facilitatorEndpoint, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	e.health.Healthy = false
+	e.health.Failures++
+	e.health.LastError = err.Error()
+	e.health.LastFailure = f.now()
+}
+
+// isPaymentVerdict reports whether err is the facilitator rejecting the
+// payment itself, rather than failing to process it.
+func isPaymentVerdict(err error) bool {
+	var verifyErr *x402.VerifyError
+	var settleErr *x402.SettleError
+	return errors.As(err, &verifyErr) || errors.As(err, &settleErr)
+}
+
+// Ensure failoverFacilitator implements x402.FacilitatorClient.
+var _ x402.FacilitatorClient = (*failoverFacilitator)(nil)
+
+// Facilitator request logging detail, set by payment.facilitator_log.
+const (
+	facilitatorLogOff     = "off"     // Nothing logged
+	facilitatorLogSummary = "summary" // URL, status and duration
+	facilitatorLogVerbose = "verbose" // Also method, body sizes and redacted headers
+)
+
+// loggingRoundTripper logs the facilitator requests made through it, in as
+// much detail as its level asks for.
+type loggingRoundTripper struct {
+	proxied http.RoundTripper
+	detail  string // One of the facilitatorLog levels; empty is summary
+	logf    func(format string, args ...interface{})
+}
+
+func (lrt *loggingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if lrt.detail == facilitatorLogOff {
+		return lrt.proxied.RoundTrip(req)
+	}
+
+	start := time.Now()
+	resp, err := lrt.proxied.RoundTrip(req)
+	duration := time.Since(start)
+
+	url := req.URL.Redacted()
+	if lrt.detail != facilitatorLogVerbose {
+		if err != nil {
+			lrt.logf("[FACILITATOR] Request to %s failed in %v: %v", url, duration, err)
+		} else {
+			lrt.logf("[FACILITATOR] Request to %s [%d] took %v", url, resp.StatusCode, duration)
+		}
+		return resp, err
+	}
+
+	if err != nil {
+		lrt.logf("[FACILITATOR] %s %s failed in %v: %v (request: %s, headers: %s)",
+			req.Method, url, duration, err, bodySize(req.ContentLength), redactHeaders(req.Header))
+	} else {
+		lrt.logf("[FACILITATOR] %s %s [%d] took %v (request: %s, response: %s, headers: %s)",
+			req.Method, url, resp.StatusCode, duration, bodySize(req.ContentLength), bodySize(resp.ContentLength), redactHeaders(req.Header))
+	}
+	return resp, err
+}
+
+// bodySize describes a body by its length alone, never its contents.
+func bodySize(n int64) string {
+	if n < 0 {
+		return "unknown size"
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
+
+// sensitiveHeaders are logged by name only.
+var sensitiveHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	"X-Api-Key":           true,
+	"X-Payment":           true,
+	"Payment-Signature":   true,
+}
+
+// redactHeaders formats h for logging, sorted by name, with the values of
+// credentials and payment signatures replaced.
+func redactHeaders(h http.Header) string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, len(names))
+	for i, name := range names {
+		value := strings.Join(h[name], ",")
+		lower := strings.ToLower(name)
+		if sensitiveHeaders[http.CanonicalHeaderKey(name)] || strings.Contains(lower, "token") || strings.Contains(lower, "secret") {
+			value = "[REDACTED]"
+		}
+		parts[i] = name + "=" + value
+	}
+	return "{" + strings.Join(parts, " ") + "}"
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	x402 "github.com/coinbase/x402/go"
+
+	"github.com/haseeb/ratelimiter/internal/config"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/memory"
+)
+
+// downFacilitator fails every call as if it couldn't be reached.
+type downFacilitator struct{}
+
+var errFacilitatorDown = errors.New("dial tcp: connection refused")
+
+func (downFacilitator) Verify(ctx context.Context, payloadBytes, requirementsBytes []byte) (*x402.VerifyResponse, error) {
+	return nil, errFacilitatorDown
+}
+
+func (downFacilitator) Settle(ctx context.Context, payloadBytes, requirementsBytes []byte) (*x402.SettleResponse, error) {
+	return nil, errFacilitatorDown
+}
+
+func (downFacilitator) GetSupported(ctx context.Context) (x402.SupportedResponse, error) {
+	return x402.SupportedResponse{}, errFacilitatorDown
+}
+
+// countingFacilitator is a fakeFacilitator that counts settlements, or
+// rejects them with a settle error when reject is set.
+type countingFacilitator struct {
+	fakeFacilitator
+	reject  bool
+	settled int
+}
+
+func (f *countingFacilitator) Settle(ctx context.Context, payloadBytes, requirementsBytes []byte) (*x402.SettleResponse, error) {
+	if f.reject {
+		return nil, x402.NewSettleError("insufficient_funds", "", paymentNetwork, "", nil)
+	}
+	f.settled++
+	return &x402.SettleResponse{Success: true, Transaction: "0xsettled"}, nil
+}
+
+func TestFailoverFacilitator_PaymentSettlesViaSecondary(t *testing.T) {
+	secondary := &countingFacilitator{}
+	facilitator := newFailoverFacilitator(
+		[]string{"primary", "secondary"},
+		[]x402.FacilitatorClient{downFacilitator{}, secondary},
+	)
+
+	cfg := &config.Config{Payment: config.PaymentConfig{
+		Enabled:          true,
+		WalletAddress:    "0x95eB3EcE2e308eCC51c8498a19cB4D5B5B929675",
+		PricePerCapacity: "0.001",
+	}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Invalid config: %v", err)
+	}
+	server, err := newPaymentServer(cfg.Payment, facilitator)
+	if err != nil {
+		t.Fatalf("newPaymentServer: %v", err)
+	}
+	if err := server.Initialize(context.Background()); err != nil {
+		t.Fatalf("Initialize should fall over to the secondary: %v", err)
+	}
+
+	limiter := memory.NewTokenBucket(1, 0.001)
+	r := newTestRouter(hybridConfig{
+		Limiter:  limiter,
+		Payments: server,
+		Capacity: 1,
+	})
+
+	doRequest(r, "") // Drain the bucket
+	w := doRequest(r, "")
+	if w.Code != http.StatusPaymentRequired {
+		t.Fatalf("Expected 402, got %d", w.Code)
+	}
+	reqs := decodeRequirements(t, w)
+
+	payload, _ := json.Marshal(x402.PaymentPayload{
+		X402Version: 2,
+		Accepted:    reqs,
+		Payload: map[string]interface{}{
+			"authorization": map[string]interface{}{"from": testWallet},
+		},
+	})
+	if w := doRequest(r, base64.StdEncoding.EncodeToString(payload)); w.Code != http.StatusOK {
+		t.Fatalf("Expected payment to settle via the secondary, got %d: %s", w.Code, w.Body.String())
+	}
+	if secondary.settled != 1 {
+		t.Errorf("Expected 1 settlement on the secondary, got %d", secondary.settled)
+	}
+
+	health := facilitator.Health()
+	if health[0].Healthy || health[0].Failures == 0 {
+		t.Errorf("Expected primary to be marked unhealthy, got %+v", health[0])
+	}
+	if !health[1].Healthy {
+		t.Errorf("Expected secondary to stay healthy, got %+v", health[1])
+	}
+}
+
+func TestFailoverFacilitator_RejectionDoesNotFailOver(t *testing.T) {
+	primary := &countingFacilitator{reject: true}
+	secondary := &countingFacilitator{}
+	facilitator := newFailoverFacilitator(
+		[]string{"primary", "secondary"},
+		[]x402.FacilitatorClient{primary, secondary},
+	)
+
+	_, err := facilitator.Settle(context.Background(), nil, nil)
+	var settleErr *x402.SettleError
+	if !errors.As(err, &settleErr) {
+		t.Fatalf("Expected the primary's settle error, got %v", err)
+	}
+	if secondary.settled != 0 {
+		t.Error("Expected a rejected payment not to be retried on the secondary")
+	}
+	if !facilitator.Health()[0].Healthy {
+		t.Error("Expected a facilitator that answered to stay healthy")
+	}
+}
+
+func TestFailoverFacilitator_AllDown(t *testing.T) {
+	facilitator := newFailoverFacilitator(
+		[]string{"a", "b"},
+		[]x402.FacilitatorClient{downFacilitator{}, downFacilitator{}},
+	)
+	if _, err := facilitator.Verify(context.Background(), nil, nil); !errors.Is(err, errFacilitatorDown) {
+		t.Errorf("Expected joined facilitator errors, got %v", err)
+	}
+}
+
+func TestLoggingRoundTripper_Detail(t *testing.T) {
+	facilitator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"isValid":true}`))
+	}))
+	defer facilitator.Close()
+
+	for _, tc := range []struct {
+		detail  string
+		want    []string
+		notWant []string
+	}{
+		{detail: facilitatorLogOff},
+		{
+			detail:  facilitatorLogSummary,
+			want:    []string{"/verify [200]"},
+			notWant: []string{"POST", "bytes", "Authorization"},
+		},
+		{
+			detail:  facilitatorLogVerbose,
+			want:    []string{"POST", "/verify [200]", "request: 7 bytes", "response: 16 bytes", "Authorization=[REDACTED]", "X-Auth-Token=[REDACTED]", "Content-Type=application/json"},
+			notWant: []string{"Bearer s3cret", "tok123", "payload"},
+		},
+	} {
+		t.Run(tc.detail, func(t *testing.T) {
+			var lines []string
+			client := &http.Client{Transport: &loggingRoundTripper{
+				proxied: http.DefaultTransport,
+				detail:  tc.detail,
+				logf: func(format string, args ...interface{}) {
+					lines = append(lines, fmt.Sprintf(format, args...))
+				},
+			}}
+
+			req, _ := http.NewRequest(http.MethodPost, facilitator.URL+"/verify", strings.NewReader("payload"))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer s3cret")
+			req.Header.Set("X-Auth-Token", "tok123")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			resp.Body.Close()
+
+			if len(tc.want) == 0 {
+				if len(lines) != 0 {
+					t.Errorf("Expected nothing logged, got %q", lines)
+				}
+				return
+			}
+			if len(lines) != 1 {
+				t.Fatalf("Expected one log line, got %q", lines)
+			}
+			for _, s := range tc.want {
+				if !strings.Contains(lines[0], s) {
+					t.Errorf("Expected %q in %q", s, lines[0])
+				}
+			}
+			for _, s := range tc.notWant {
+				if strings.Contains(lines[0], s) {
+					t.Errorf("Expected no %q in %q", s, lines[0])
+				}
+			}
+		})
+	}
+}
@@ -2,23 +2,25 @@ package main
 
 import (
 	"context"
-	"encoding/base64"
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
-	"strings"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	x402 "github.com/coinbase/x402/go"
-	x402http "github.com/coinbase/x402/go/http"
-	evm "github.com/coinbase/x402/go/mechanisms/evm/exact/server"
 	"github.com/gin-gonic/gin"
 	"github.com/redis/go-redis/v9"
 
 	"github.com/haseeb/ratelimiter/internal/config"
-	"github.com/haseeb/ratelimiter/internal/handlers"
+	"github.com/haseeb/ratelimiter/internal/middleware"
 	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/bucket"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/concurrency"
 	"github.com/haseeb/ratelimiter/pkg/ratelimit/memory"
 	ratelimitredis "github.com/haseeb/ratelimiter/pkg/ratelimit/redis"
 	"github.com/haseeb/ratelimiter/pkg/trust"
@@ -26,334 +28,257 @@ import (
 
 func main() {
 	// Load configuration
-	cfg, err := config.Load("../../config.yaml")
+	path, err := configPath(os.Args[1:], os.Getenv)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		log.Fatalf("Invalid arguments: %v", err)
+	}
+	cfg, err := loadConfig(path)
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+
+	schedule, err := cfg.RateLimit.Schedule()
+	if err != nil {
+		log.Fatalf("Invalid refill schedule: %v", err)
+	}
+	refillMode, err := ratelimit.ParseRefillMode(cfg.RateLimit.RefillMode)
+	if err != nil {
+		log.Fatalf("Invalid refill mode: %v", err)
+	}
+	if err := ratelimit.ValidateBucket(cfg.RateLimit.Capacity, cfg.RateLimit.RefillRate); err != nil {
+		log.Fatalf("Invalid rate limit: %v (capacity %g, refill_rate %g)", err, cfg.RateLimit.Capacity, cfg.RateLimit.RefillRate)
+	}
+	logRedaction, err = newIdentityRedaction(cfg.Server.LogRedaction, cfg.Server.LogRedactionSalt)
+	if err != nil {
+		log.Fatalf("Invalid log redaction: %v", err)
+	}
 
 	// Create rate limiter with config values
 	var limiter ratelimit.Limiter
 	if cfg.RateLimit.Strategy == "redis" {
-		rdb := redis.NewClient(&redis.Options{
-			Addr:     cfg.Redis.Addr,
-			Password: cfg.Redis.Password,
-			DB:       cfg.Redis.DB,
-		})
+		rdb := redis.NewClient(redisOptions(cfg.Redis))
 		limiter = ratelimitredis.NewTokenBucket(ratelimitredis.Config{
-			Client:     rdb,
-			Capacity:   cfg.RateLimit.Capacity,
-			RefillRate: cfg.RateLimit.RefillRate,
+			Client:         rdb,
+			Capacity:       cfg.RateLimit.Capacity,
+			RefillRate:     cfg.RateLimit.RefillRate,
+			BurstCapacity:  cfg.RateLimit.BurstCapacity,
+			GraceOverage:   cfg.RateLimit.GraceOverage,
+			BurstTTL:       cfg.RateLimit.BurstTTL,
+			RefillMode:     refillMode,
+			RefillSchedule: schedule,
+			ServerTime:     cfg.Redis.ServerTime,
+			Namespace:      cfg.Redis.Namespace,
+			HashKeys:       cfg.Redis.HashKeys,
+			Redact:         logRedaction.key,
+
+			RefillLogEvery:     cfg.Redis.RefillLogEvery,
+			RefillLogPerSecond: cfg.Redis.RefillLogPerSecond,
 		})
 		fmt.Printf("Using Redis rate limiter at %s\n", cfg.Redis.Addr)
 	} else {
-		limiter = memory.NewTokenBucket(cfg.RateLimit.Capacity, cfg.RateLimit.RefillRate)
+		limiter = newMemoryLimiter(cfg, refillMode, schedule)
 		fmt.Printf("Using in-memory rate limiter\n")
 	}
 
-	// Create Gin router
-	r := gin.Default()
-
-	// Token monitoring endpoint (for testing/debugging) - registered BEFORE rate limiting
-	r.GET("/tokens", func(c *gin.Context) {
-		key := c.ClientIP()
-		tokens, err := limiter.Available(key)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-		c.JSON(http.StatusOK, gin.H{
-			"client":   key,
-			"tokens":   tokens,
-			"capacity": cfg.RateLimit.Capacity,
-		})
-	})
-
-	if cfg.Payment.Enabled {
-		// Configure X402 payment options for when rate limit is exceeded
-		paymentOptions := x402http.PaymentOptions{
-			{
-				Scheme:  "exact",
-				Price:   cfg.Payment.PricePerCapacity, // "$0.001"
-				Network: "eip155:84532",               // Base Sepolia
-				PayTo:   cfg.Payment.WalletAddress,
-			},
-		}
-
-		// Create facilitator client
-		facilitatorConfig := &x402http.FacilitatorConfig{
-			URL: cfg.Payment.FacilitatorURL,
-			HTTPClient: &http.Client{
-				Timeout: 10 * time.Second,
-				Transport: &loggingRoundTripper{
-					proxied: http.DefaultTransport,
-				},
-			},
-		}
-		facilitator := x402http.NewHTTPFacilitatorClient(facilitatorConfig)
-
-		// Create X402 resource server for payment processing
-		server := x402.Newx402ResourceServer(
-			x402.WithFacilitatorClient(facilitator),
-		).Register("eip155:84532", evm.NewExactEvmScheme())
-
-		// Create the HTTP server wrapper
-		routes := x402http.RoutesConfig{
-			"GET /cpu": {
-				Accepts:     paymentOptions,
-				Description: "CPU utilization endpoint - pay to refill rate limit",
-				MimeType:    "application/json",
-			},
-		}
-		httpServer := x402http.Wrappedx402HTTPResourceServer(routes, server)
-
-		// Initialize - sync with facilitator to populate internal maps
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		if err := httpServer.Initialize(ctx); err != nil {
-			log.Printf("Warning: failed to initialize x402 server: %v", err)
-		}
-		cancel()
-
-		// Create trust tracker for optimistic settlement
-		var trustTracker *trust.Tracker
-		var settlementQueue *SettlementQueue
-		if cfg.Payment.Optimistic.Enabled {
-			trustTracker = trust.New(trust.Config{
-				Threshold: cfg.Payment.Optimistic.TrustThreshold,
-				Window:    cfg.Payment.Optimistic.TrustWindow,
-			})
-			// Create settlement queue for sequential background processing
-			settlementQueue = NewSettlementQueue(httpServer, trustTracker, 100)
-			log.Printf("Optimistic settlement enabled (threshold: %d in %s, queued settlements)",
-				cfg.Payment.Optimistic.TrustThreshold,
-				cfg.Payment.Optimistic.TrustWindow)
-		}
-
-		// Apply custom rate limit + payment middleware
-		r.Use(hybridRateLimitPaymentMiddleware(limiter, httpServer, cfg.RateLimit.Capacity, trustTracker, settlementQueue))
-
-		fmt.Printf("Payment enabled: %s %s on %s\n",
-			cfg.Payment.PricePerCapacity, cfg.Payment.Currency, cfg.Payment.Network)
-	} else {
-		// Simple rate limiting without payment
-		r.Use(simpleRateLimitMiddleware(limiter))
+	srv, err := NewServer(cfg, limiter, nil)
+	if err != nil {
+		log.Fatalf("Failed to set up server: %v", err)
 	}
 
-	// Register handlers
-	r.GET("/cpu", handlers.GinCPUHandler())
-	r.GET("/dashboard", handlers.GinDashboardHandler())
-
 	// Start server
 	fmt.Printf("Server starting on %s (rate limit: %.0f tokens, %.1f/sec refill)\n",
 		cfg.Server.Port, cfg.RateLimit.Capacity, cfg.RateLimit.RefillRate)
-	r.Run(cfg.Server.Port)
+	serve(srv, cfg.Server.Port, srv.Close)
 }
 
-// simpleRateLimitMiddleware is a basic rate limiter that returns 429 when exceeded.
-func simpleRateLimitMiddleware(limiter ratelimit.Limiter) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		key := c.ClientIP()
-		allowed, err := limiter.Allow(key)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Rate limiter error"})
-			c.Abort()
-			return
-		}
-		if !allowed {
-			c.Header("Retry-After", "1")
-			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too Many Requests"})
-			c.Abort()
-			return
-		}
-		c.Next()
+// newMemoryLimiter returns the in-memory limiter for cfg: one bucket shared
+// by every client, or with wallet buckets a bucket per key, as Redis keeps.
+func newMemoryLimiter(cfg *config.Config, refillMode ratelimit.RefillMode, schedule ratelimit.RefillSchedule) ratelimit.Limiter {
+	if cfg.Payment.PaidBucket == config.PaidBucketWallet {
+		return bucket.NewWithConfig(bucket.Config{
+			Store:          memory.NewStore(),
+			Capacity:       cfg.RateLimit.Capacity,
+			RefillRate:     cfg.RateLimit.RefillRate,
+			BurstCapacity:  cfg.RateLimit.BurstCapacity,
+			GraceOverage:   cfg.RateLimit.GraceOverage,
+			BurstTTL:       cfg.RateLimit.BurstTTL,
+			RefillMode:     refillMode,
+			RefillSchedule: schedule,
+			Redact:         logRedaction.key,
+		})
 	}
+	return memory.NewTokenBucketWithConfig(memory.Config{
+		Capacity:       cfg.RateLimit.Capacity,
+		RefillRate:     cfg.RateLimit.RefillRate,
+		BurstCapacity:  cfg.RateLimit.BurstCapacity,
+		GraceOverage:   cfg.RateLimit.GraceOverage,
+		BurstTTL:       cfg.RateLimit.BurstTTL,
+		RefillMode:     refillMode,
+		RefillSchedule: schedule,
+		Redact:         logRedaction.key,
+	})
 }
 
-// hybridRateLimitPaymentMiddleware combines rate limiting with X402 payment.
-// - If tokens available: serve request
-// - If rate limited AND payment provided: verify, settle, refill, serve
-// - If rate limited AND no payment: return 402 with payment requirements
-// - If trusted client: optimistically refill and settle in background queue
-func hybridRateLimitPaymentMiddleware(limiter ratelimit.Limiter, httpServer *x402http.HTTPServer, capacity float64, trustTracker *trust.Tracker, settlementQueue *SettlementQueue) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		key := c.ClientIP()
-
-		allowed, err := limiter.Allow(key)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Rate limiter error"})
-			c.Abort()
-			return
+// serve runs the server until SIGINT or SIGTERM, then stops accepting
+// requests, lets in-flight ones finish, and calls onShutdown.
+func serve(handler http.Handler, addr string, onShutdown func()) {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Server failed: %v", err)
 		}
+	}()
 
-		if allowed {
-			// Tokens available, proceed
-			c.Next()
-			return
-		}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
 
-		// Rate limited - check for payment header (V2: PAYMENT-SIGNATURE, V1: X-PAYMENT)
-		adapter := NewGinAdapter(c)
-		paymentHeader := adapter.GetHeader("PAYMENT-SIGNATURE") // V2
-		if paymentHeader == "" {
-			paymentHeader = adapter.GetHeader("X-PAYMENT") // V1 fallback
-		}
+	log.Printf("Shutting down...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Warning: server shutdown: %v", err)
+	}
+	onShutdown()
+}
 
-		reqCtx := x402http.HTTPRequestContext{
-			Adapter:       adapter,
-			Path:          c.Request.URL.Path,
-			Method:        c.Request.Method,
-			PaymentHeader: paymentHeader, // Important: populate this for payment verification
-		}
+// loadTrustSnapshot restores trust state saved by a previous run. A missing
+// file is normal on first start.
+func loadTrustSnapshot(tracker *trust.Tracker, path string) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err == nil {
+		err = tracker.Import(data)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to restore trust snapshot %s: %v", path, err)
+		return
+	}
+	log.Printf("Restored trust snapshot from %s (%d wallets)", path, tracker.Stats().TotalWalletsSeen)
+}
 
-		if paymentHeader == "" {
-			// No payment - generate 402 response
-			result := httpServer.ProcessHTTPRequest(c.Request.Context(), reqCtx, nil)
-			if result.Response != nil {
-				for k, v := range result.Response.Headers {
-					c.Header(k, v)
-				}
-				c.JSON(result.Response.Status, result.Response.Body)
-			} else {
-				c.JSON(http.StatusPaymentRequired, gin.H{
-					"error":   "Payment Required",
-					"message": "Rate limit exceeded. Pay to refill your quota.",
-				})
-			}
-			c.Abort()
-			return
+// saveTrustSnapshot writes the tracker's state to path, via a temporary file
+// so a crash mid-write can't leave a truncated snapshot.
+func saveTrustSnapshot(tracker *trust.Tracker, path string) {
+	data, err := tracker.Export()
+	if err == nil {
+		tmp := path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o600); err == nil {
+			err = os.Rename(tmp, path)
 		}
+	}
+	if err != nil {
+		log.Printf("Warning: failed to save trust snapshot %s: %v", path, err)
+		return
+	}
+	log.Printf("Saved trust snapshot to %s", path)
+}
 
-		// Payment present - process it (verification happens in ProcessHTTPRequest)
-		paymentStart := time.Now()
-		result := httpServer.ProcessHTTPRequest(c.Request.Context(), reqCtx, nil)
-		verificationLatency := time.Since(paymentStart)
-
-		if result.Type == x402http.ResultPaymentVerified {
-			// Extract wallet address from payment for trust tracking
-			walletAddr := extractWalletAddress(paymentHeader)
-
-			// Check if client is trusted for optimistic settlement
-			if trustTracker != nil && settlementQueue != nil && trustTracker.IsTrusted(walletAddr) {
-				// OPTIMISTIC: Refill immediately, settle via queue
-				if err := limiter.Refill(key, capacity); err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "Refill error"})
-					c.Abort()
-					return
-				}
-
-				log.Printf("[OPTIMISTIC] Trusted wallet %s, queueing settlement (verify: %v)",
-					truncateWallet(walletAddr), verificationLatency)
-
-				// Enqueue settlement for sequential processing
-				settlementQueue.Enqueue(SettlementJob{
-					PaymentPayload:      *result.PaymentPayload,
-					PaymentRequirements: *result.PaymentRequirements,
-					WalletAddr:          walletAddr,
-				})
-
-				// Allow the request through immediately
-				c.Next()
-				return
-			}
-
-			// SYNCHRONOUS: Not trusted, settle before responding
-			settlementStart := time.Now()
-			settleResult := httpServer.ProcessSettlement(
-				c.Request.Context(),
-				*result.PaymentPayload,
-				*result.PaymentRequirements,
-			)
-			settlementLatency := time.Since(settlementStart)
-
-			if settleResult.Success {
-				// Refill the bucket
-				refillStart := time.Now()
-				if err := limiter.Refill(key, capacity); err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "Refill error"})
-					c.Abort()
-					return
-				}
-				refillLatency := time.Since(refillStart)
-
-				// Record success for trust building
-				if trustTracker != nil {
-					trustTracker.RecordSuccess(walletAddr)
-					log.Printf("[PAYMENT] Settled TX: %s in %v (Verify: %v, Settle: %v, Refill: %v) [trust: %d/%d]",
-						settleResult.Transaction, time.Since(paymentStart), verificationLatency, settlementLatency, refillLatency,
-						trustTracker.RecentPayments(walletAddr), 3) // 3 is threshold, could make configurable
-				} else {
-					log.Printf("[PAYMENT] Settled TX: %s in %v (Verify: %v, Settle: %v, Refill: %v)",
-						settleResult.Transaction, time.Since(paymentStart), verificationLatency, settlementLatency, refillLatency)
-				}
-
-				// Allow the request through
-				c.Next()
-				return
-			}
-
-			// Settlement failed
-			c.JSON(http.StatusPaymentRequired, gin.H{
-				"error":  "Settlement failed",
-				"reason": settleResult.ErrorReason,
-			})
-			c.Abort()
-			return
-		}
+// configPathEnv names the environment variable giving the config file path.
+const configPathEnv = "CONFIG_PATH"
+
+// defaultConfigPaths are tried in turn when no path is given: the working
+// directory, then the repo root as seen from cmd/server.
+var defaultConfigPaths = []string{"config.yaml", "../../config.yaml"}
+
+// configPath returns the config file path from the -config flag, else the
+// CONFIG_PATH environment variable, else the first of defaultConfigPaths
+// that exists (or the first, so the error names it).
+func configPath(args []string, getenv func(string) string) (string, error) {
+	var path string
+	flags := flag.NewFlagSet("server", flag.ContinueOnError)
+	flags.StringVar(&path, "config", "", "path to the config file (default: $"+configPathEnv+", then ./config.yaml or ../../config.yaml)")
+	if err := flags.Parse(args); err != nil {
+		return "", err
+	}
+	if flags.NArg() > 0 {
+		return "", fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
 
-		// Payment verification failed
-		if result.Response != nil {
-			for k, v := range result.Response.Headers {
-				c.Header(k, v)
-			}
-			c.JSON(result.Response.Status, result.Response.Body)
-		} else {
-			c.JSON(http.StatusPaymentRequired, gin.H{
-				"error":   "Payment Required",
-				"message": "Invalid payment or rate limit exceeded.",
-			})
+	if path != "" {
+		return path, nil
+	}
+	if path = getenv(configPathEnv); path != "" {
+		return path, nil
+	}
+	for _, candidate := range defaultConfigPaths {
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
 		}
-		c.Abort()
 	}
+	return defaultConfigPaths[0], nil
 }
 
-// extractWalletAddress extracts the sender wallet address from the payment header.
-// The payment header is a base64-encoded JSON with a "payload" containing "authorization.from".
-func extractWalletAddress(paymentHeader string) string {
-	if paymentHeader == "" {
-		return ""
+// loadConfig reads the config file at path, saying how to point the server
+// elsewhere if it doesn't exist.
+func loadConfig(path string) (*config.Config, error) {
+	cfg, err := config.Load(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("config file %s not found; set -config or %s", path, configPathEnv)
 	}
-
-	// Try to decode the base64 payment header
-	decoded, err := base64.StdEncoding.DecodeString(paymentHeader)
 	if err != nil {
-		// Try URL-safe base64
-		decoded, err = base64.URLEncoding.DecodeString(paymentHeader)
-		if err != nil {
-			return ""
-		}
+		return nil, fmt.Errorf("%s: %w", path, err)
 	}
+	return cfg, nil
+}
 
-	// Parse as JSON to extract the wallet address
-	var payment struct {
-		Payload struct {
-			Authorization struct {
-				From string `json:"from"`
-			} `json:"authorization"`
-		} `json:"payload"`
+// redisOptions builds the Redis client options configured in rc. Settings
+// left at zero keep go-redis's defaults.
+func redisOptions(rc config.RedisConfig) *redis.Options {
+	return &redis.Options{
+		Addr:         rc.Addr,
+		Password:     rc.Password,
+		DB:           rc.DB,
+		PoolSize:     rc.PoolSize,
+		DialTimeout:  rc.DialTimeout,
+		ReadTimeout:  rc.ReadTimeout,
+		WriteTimeout: rc.WriteTimeout,
+		MaxRetries:   rc.MaxRetries,
 	}
+}
 
-	if err := json.Unmarshal(decoded, &payment); err != nil {
-		return ""
+// requestCost builds the request pricing configured in rl, or nil when every
+// request costs one token.
+func requestCost(rl config.RateLimitConfig) middleware.CostFunc {
+	var fns []middleware.CostFunc
+	if rl.CostBytesPerToken > 0 {
+		fns = append(fns, middleware.ContentLengthCost(rl.CostBytesPerToken))
 	}
+	if rl.CostHeader {
+		fns = append(fns, middleware.HeaderCost(middleware.RequestCostHeader))
+	}
+	if len(fns) == 0 {
+		return nil
+	}
+	return middleware.HighestCost(fns...)
+}
 
-	return strings.ToLower(payment.Payload.Authorization.From)
+// maxRequestCost returns the cap on one request's cost, defaulting to the
+// bucket capacity so a costly request can't be refused forever.
+func maxRequestCost(rl config.RateLimitConfig) float64 {
+	if rl.MaxCost > 0 {
+		return rl.MaxCost
+	}
+	return rl.Capacity
 }
 
-// truncateWallet returns a truncated wallet address for logging.
-func truncateWallet(wallet string) string {
-	if len(wallet) <= 10 {
-		return wallet
+// useInFlightLimit caps each client's in-flight requests on the routes
+// registered after it, when maxInFlight is set. It goes ahead of the rate
+// limiter so turned-away requests don't spend tokens.
+func useInFlightLimit(r *gin.Engine, maxInFlight int) {
+	if maxInFlight <= 0 {
+		return
 	}
-	return wallet[:6] + "..." + wallet[len(wallet)-4:]
+	r.Use(middleware.GinConcurrencyMiddleware(concurrency.New(float64(maxInFlight))))
+	fmt.Printf("Concurrency limit: %d in-flight requests per client\n", maxInFlight)
 }
 
 // GinAdapter implements x402http.HTTPAdapter for Gin
@@ -396,21 +321,3 @@ func (a *GinAdapter) GetAcceptHeader() string {
 func (a *GinAdapter) GetUserAgent() string {
 	return a.ctx.GetHeader("User-Agent")
 }
-
-// loggingRoundTripper logs the duration of HTTP requests
-type loggingRoundTripper struct {
-	proxied http.RoundTripper
-}
-
-func (lrt *loggingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
-	start := time.Now()
-	resp, err := lrt.proxied.RoundTrip(req)
-	duration := time.Since(start)
-
-	if err != nil {
-		log.Printf("[FACILITATOR] Request to %s failed in %v: %v", req.URL.String(), duration, err)
-	} else {
-		log.Printf("[FACILITATOR] Request to %s [%d] took %v", req.URL.String(), resp.StatusCode, duration)
-	}
-	return resp, err
-}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/haseeb/ratelimiter/internal/config"
+)
+
+func TestRedisOptions(t *testing.T) {
+	client := redis.NewClient(redisOptions(config.RedisConfig{
+		Addr:         "redis.internal:6380",
+		Password:     "s3cret",
+		DB:           2,
+		PoolSize:     40,
+		DialTimeout:  2 * time.Second,
+		ReadTimeout:  500 * time.Millisecond,
+		WriteTimeout: 750 * time.Millisecond,
+		MaxRetries:   5,
+	}))
+	defer client.Close()
+
+	opts := client.Options()
+	if opts.Addr != "redis.internal:6380" || opts.Password != "s3cret" || opts.DB != 2 {
+		t.Errorf("Expected the connection settings, got addr %q, db %d", opts.Addr, opts.DB)
+	}
+	if opts.PoolSize != 40 {
+		t.Errorf("Expected pool size 40, got %d", opts.PoolSize)
+	}
+	if opts.DialTimeout != 2*time.Second || opts.ReadTimeout != 500*time.Millisecond || opts.WriteTimeout != 750*time.Millisecond {
+		t.Errorf("Expected timeouts 2s/500ms/750ms, got %v/%v/%v", opts.DialTimeout, opts.ReadTimeout, opts.WriteTimeout)
+	}
+	if opts.MaxRetries != 5 {
+		t.Errorf("Expected 5 retries, got %d", opts.MaxRetries)
+	}
+
+	// Unset settings keep go-redis's defaults
+	defaults := redis.NewClient(redisOptions(config.RedisConfig{Addr: "localhost:6379"}))
+	defer defaults.Close()
+	if opts := defaults.Options(); opts.PoolSize <= 0 || opts.DialTimeout != 5*time.Second || opts.MaxRetries != 3 {
+		t.Errorf("Expected go-redis defaults, got pool %d, dial %v, retries %d", opts.PoolSize, opts.DialTimeout, opts.MaxRetries)
+	}
+}
+
+func TestConfigPath(t *testing.T) {
+	env := map[string]string{}
+	getenv := func(name string) string { return env[name] }
+
+	// The flag beats the environment, which beats the defaults
+	env[configPathEnv] = "/etc/ratelimiter/env.yaml"
+	if path, err := configPath([]string{"-config", "/etc/ratelimiter/flag.yaml"}, getenv); err != nil || path != "/etc/ratelimiter/flag.yaml" {
+		t.Errorf("Expected the -config path, got %q (err %v)", path, err)
+	}
+	if path, err := configPath(nil, getenv); err != nil || path != "/etc/ratelimiter/env.yaml" {
+		t.Errorf("Expected the %s path, got %q (err %v)", configPathEnv, path, err)
+	}
+
+	// Without either, the repo's config.yaml is found from cmd/server
+	delete(env, configPathEnv)
+	if path, err := configPath(nil, getenv); err != nil || path != "../../config.yaml" {
+		t.Errorf("Expected the default path ../../config.yaml, got %q (err %v)", path, err)
+	}
+
+	if _, err := configPath([]string{"extra"}, getenv); err == nil {
+		t.Error("Expected an error for a stray argument")
+	}
+	if _, err := configPath([]string{"-conf", "x.yaml"}, getenv); err == nil {
+		t.Error("Expected an error for an unknown flag")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.yaml")
+	_, err := loadConfig(missing)
+	if err == nil || !strings.Contains(err.Error(), missing) || !strings.Contains(err.Error(), configPathEnv) {
+		t.Errorf("Expected a not-found error naming the path and %s, got %v", configPathEnv, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("server:\n  port: \":9090\"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig error: %v", err)
+	}
+	if cfg.Server.Port != ":9090" {
+		t.Errorf("Expected port :9090, got %q", cfg.Server.Port)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Paths a paid request can take, as the path label of paidRequestsMetric.
+const (
+	paidPathSync       = "sync"       // Settled before serving
+	paidPathOptimistic = "optimistic" // Served at once, settlement queued
+	paidPathRejected   = "rejected"   // Payment refused or failed to settle
+)
+
+// paidRequestsMetric is the Prometheus counter of paid requests by path.
+const paidRequestsMetric = "ratelimiter_paid_requests_total"
+
+// paymentReplaysMetric is the Prometheus counter of payments refused as
+// replays of one already accepted.
+const paymentReplaysMetric = "ratelimiter_payment_replays_total"
+
+// paymentMetrics counts paid requests by the path they took, so operators
+// can see how much traffic trust moves onto the optimistic path. A nil
+// paymentMetrics counts nothing.
+type paymentMetrics struct {
+	sync       atomic.Int64
+	optimistic atomic.Int64
+	rejected   atomic.Int64
+	replays    atomic.Int64
+}
+
+func newPaymentMetrics() *paymentMetrics {
+	return &paymentMetrics{}
+}
+
+// Record counts a paid request that took path.
+func (m *paymentMetrics) Record(path string) {
+	if m == nil {
+		return
+	}
+	switch path {
+	case paidPathSync:
+		m.sync.Add(1)
+	case paidPathOptimistic:
+		m.optimistic.Add(1)
+	case paidPathRejected:
+		m.rejected.Add(1)
+	}
+}
+
+// RecordReplay counts a payment refused as a replay.
+func (m *paymentMetrics) RecordReplay() {
+	if m == nil {
+		return
+	}
+	m.replays.Add(1)
+}
+
+// Handler serves the counters in the Prometheus text exposition format.
+func (m *paymentMetrics) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Content-Type", "text/plain; version=0.0.4")
+		c.Status(http.StatusOK)
+		fmt.Fprintf(c.Writer, "# HELP %s Paid requests by the path they took.\n", paidRequestsMetric)
+		fmt.Fprintf(c.Writer, "# TYPE %s counter\n", paidRequestsMetric)
+		for _, path := range []struct {
+			label string
+			count *atomic.Int64
+		}{
+			{paidPathSync, &m.sync},
+			{paidPathOptimistic, &m.optimistic},
+			{paidPathRejected, &m.rejected},
+		} {
+			fmt.Fprintf(c.Writer, "%s{path=%q} %d\n", paidRequestsMetric, path.label, path.count.Load())
+		}
+		fmt.Fprintf(c.Writer, "# HELP %s Payments refused as replays of one already accepted.\n", paymentReplaysMetric)
+		fmt.Fprintf(c.Writer, "# TYPE %s counter\n", paymentReplaysMetric)
+		fmt.Fprintf(c.Writer, "%s %d\n", paymentReplaysMetric, m.replays.Load())
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/haseeb/ratelimiter/internal/paymenttest"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/memory"
+	"github.com/haseeb/ratelimiter/pkg/trust"
+)
+
+func TestHybridMiddleware_PaidPathMetrics(t *testing.T) {
+	tracker := trust.New(trust.Config{Threshold: 1})
+	processor := &paymenttest.Processor{}
+	sq := NewSettlementQueue(processor, tracker, 10)
+	sq.SetSpacing(0)
+	defer sq.Close()
+
+	limiter := memory.NewTokenBucket(1, 0.001)
+	metrics := newPaymentMetrics()
+	r := newTestRouter(hybridConfig{
+		Limiter:         limiter,
+		Payments:        processor,
+		Capacity:        1,
+		TrustTracker:    tracker,
+		SettlementQueue: sq,
+		Metrics:         metrics,
+	})
+
+	limiter.Drain("")
+	doRequest(r, paymentHeaderFor(testWallet)) // Untrusted: sync, earning trust
+	for i := 0; i < 2; i++ {
+		limiter.Drain("")
+		doRequest(r, paymentHeaderFor(testWallet)) // Trusted: optimistic
+	}
+	processor.SetRejectPay(true)
+	limiter.Drain("")
+	doRequest(r, paymentHeaderFor(testWallet)) // Fails verification
+	limiter.Drain("")
+	doRequest(r, "") // Unpaid 402s aren't paid requests
+
+	// Served ahead of the rate limiter, as in main
+	m := gin.New()
+	m.GET("/metrics", metrics.Handler())
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 from /metrics, got %d", w.Code)
+	}
+	for _, want := range []string{
+		"# TYPE ratelimiter_paid_requests_total counter",
+		`ratelimiter_paid_requests_total{path="sync"} 1`,
+		`ratelimiter_paid_requests_total{path="optimistic"} 2`,
+		`ratelimiter_paid_requests_total{path="rejected"} 1`,
+		"# TYPE ratelimiter_payment_replays_total counter",
+		"ratelimiter_payment_replays_total 0",
+	} {
+		if !strings.Contains(w.Body.String(), want+"\n") {
+			t.Errorf("Expected %q in metrics, got:\n%s", want, w.Body.String())
+		}
+	}
+}
+
+func TestPaymentMetrics_NilCountsNothing(t *testing.T) {
+	var m *paymentMetrics
+	m.Record(paidPathSync) // Must not panic
+
+	metrics := newPaymentMetrics()
+	metrics.Record(paidPathRejected)
+	metrics.Record("unknown")
+	if got := metrics.rejected.Load(); got != 1 {
+		t.Errorf("Expected 1 rejected, got %d", got)
+	}
+	if got := metrics.sync.Load() + metrics.optimistic.Load(); got != 0 {
+		t.Errorf("Expected unknown paths ignored, got %d", got)
+	}
+}
@@ -0,0 +1,977 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+	x402http "github.com/coinbase/x402/go/http"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/sha3"
+
+	"github.com/haseeb/ratelimiter/internal/config"
+	"github.com/haseeb/ratelimiter/internal/middleware"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+	"github.com/haseeb/ratelimiter/pkg/trust"
+)
+
+// PaymentProcessor is the subset of x402http.HTTPServer used by the middleware.
+// Tests substitute paymenttest.Processor, which is scripted to verify, settle
+// or fail without a live facilitator.
+type PaymentProcessor interface {
+	ProcessHTTPRequest(ctx context.Context, reqCtx x402http.HTTPRequestContext, paywallConfig *x402http.PaywallConfig) x402http.HTTPProcessResult
+	ProcessSettlement(ctx context.Context, payload x402.PaymentPayload, requirements x402.PaymentRequirements) *x402http.ProcessSettleResult
+}
+
+// Ensure HTTPServer satisfies PaymentProcessor.
+var _ PaymentProcessor = (*x402http.HTTPServer)(nil)
+
+// hybridConfig holds the dependencies and options for the hybrid middleware.
+type hybridConfig struct {
+	Limiter         ratelimit.Limiter
+	Payments        PaymentProcessor
+	Capacity        float64 // Tokens added per successful payment
+	TrustTracker    *trust.Tracker
+	SettlementQueue *SettlementQueue
+	Mode            string // config.ModeHybrid (default), config.ModeMetered or config.ModePaidOnly
+	FailOpen        bool   // Serve requests when the limiter backend is unavailable
+
+	// BucketCapacity is the limiter's capacity. When set, 402 bodies report
+	// it with the client's current_tokens and tokens_after_payment, so a
+	// client can choose between paying and waiting for natural refill.
+	BucketCapacity float64
+
+	// OptimisticCapacity is the tokens added when a trusted wallet's payment
+	// takes the optimistic path, letting proven clients burst further than
+	// a synchronously settled payment allows. 0 uses Capacity.
+	OptimisticCapacity float64
+
+	// PayPerRequest charges for the overage only: a payment buys just the
+	// request it's attached to, adding nothing to the bucket, so every
+	// over-limit request needs a fresh payment. Capacity and
+	// OptimisticCapacity are ignored.
+	PayPerRequest bool
+
+	// DeclineUnneeded serves a paid request from the bucket, without
+	// settling the payment, if the bucket refilled while the payment was
+	// being verified, so the client isn't charged for tokens it already
+	// has. Only the hybrid flow is affected; false always settles.
+	DeclineUnneeded bool
+
+	// BlockUnsettleable blocks the wallet of a verified payment that fails
+	// to settle permanently, e.g. for insufficient balance, on top of
+	// revoking its trust. Needs TrustTracker.
+	BlockUnsettleable bool
+
+	// WalletBuckets refills a bucket kept for the payer's wallet instead of
+	// the client IP's, so a paying wallet carries its tokens across IPs and
+	// devices. The IP bucket is still checked first; once it's empty, a
+	// verified payment from a wallet with tokens left is served from the
+	// wallet's bucket without settling. A wallet's bucket starts empty at
+	// its first payment, then refills naturally like any other. Needs a
+	// per-key limiter implementing ratelimit.Inspector and Opener.
+	WalletBuckets bool
+
+	// Cost prices each request in tokens, e.g. by body size; see
+	// middleware.Options. Nil charges one token per request.
+	Cost    middleware.CostFunc
+	MaxCost float64 // Cap on a single request's cost (0 = no cap)
+
+	// MaxWait holds a rate limited request without a payment, whose client
+	// sent waitHeader, for up to this long until its bucket can pay for it;
+	// past it the request gets a 429. RefillRate, the bucket's tokens per
+	// second, paces the wait. 0 disables waiting.
+	MaxWait    time.Duration
+	RefillRate float64
+
+	// Escalation scales each payment's refill by the 402s its client was
+	// sent recently. Nil grants Capacity (or OptimisticCapacity) every time.
+	Escalation *refillEscalation
+
+	// DryRun serves every request, logging what the middleware would have
+	// done instead and recording it in middleware.DryRunHeader: a 402, 429,
+	// 403 or 503 is never sent, and attached payments are neither verified
+	// nor settled.
+	DryRun bool
+
+	// MinPaymentInterval is the shortest gap allowed between accepted
+	// payments from one wallet; faster repeats get a 429 instead of another
+	// settlement. Needs TrustTracker. 0 disables the check.
+	MinPaymentInterval time.Duration
+
+	// Events receives request and payment events. Nil discards them.
+	Events *eventHub
+
+	// Routes overrides Payments and Cost for routes registered at runtime.
+	// Nil uses the startup setup for every route.
+	Routes *RouteRegistry
+
+	// RoutePolicies overrides Mode by route path, as gin's FullPath reports
+	// it: config.RoutePolicyFree, RoutePolicyHybrid or RoutePolicyPaid.
+	// Routes registered at runtime take precedence.
+	RoutePolicies map[string]string
+
+	// Replays refuses a payment already accepted within its window. Nil
+	// accepts every verified payment.
+	Replays *replayGuard
+
+	// Credits holds tokens owed to keys whose refill failed after their
+	// payment settled; each key's next request applies them. Nil uses a
+	// store private to the middleware.
+	Credits *pendingCredits
+
+	// TrustUnit is the payment amount, in the asset's atomic units, that
+	// counts as one success toward trust. Nil counts every payment once.
+	TrustUnit *big.Int
+
+	// PaymentResponse optionally customizes the 402 sent when no payment is
+	// attached. Nil keeps the x402 default.
+	PaymentResponse PaymentResponseFunc
+
+	// Metrics counts paid requests by the path they took. Nil counts
+	// nothing.
+	Metrics *paymentMetrics
+
+	// Ceiling caps the requests served to each key per window, free or
+	// paid. Past it a request gets a 429, even with a payment attached, so
+	// the backend is protected from clients willing to keep paying. Nil has
+	// no ceiling. Not enforced in DryRun.
+	Ceiling *requestCeiling
+
+	// TrustKey chooses the identity trust is built under, e.g. an API key
+	// combined with the payer's wallet. Nil uses the payer's wallet. An
+	// empty key isn't tracked. Blocking and MinPaymentInterval still apply
+	// to the wallet.
+	TrustKey TrustKeyFunc
+}
+
+// TrustKeyFunc returns the trust identity of a verified payment made with
+// the request described by reqCtx.
+type TrustKeyFunc func(payload x402.PaymentPayload, reqCtx x402http.HTTPRequestContext) string
+
+// PaymentResponseFunc builds a custom 402 response for an unpaid request.
+// A zero status keeps 402, and headers are added to the x402 ones (the
+// PAYMENT-REQUIRED header is always kept). A map body is merged with the x402
+// payment requirements (x402Version, accepts, ...), with its own keys taking
+// precedence; any other body is sent as-is.
+type PaymentResponseFunc func(reqCtx x402http.HTTPRequestContext) (status int, headers map[string]string, body any)
+
+// X-Served-Via values recording which path served a request, for billing
+// reconciliation. The value is also stored on the gin context under the same key.
+const (
+	servedViaHeader  = "X-Served-Via"
+	servedFree       = "free"            // Token from the bucket
+	servedPaidSync   = "paid-sync"       // Payment settled before serving
+	servedOptimistic = "paid-optimistic" // Trusted wallet, settlement queued
+	servedDryRun     = "dry-run"         // Would have been limited, served in dry-run mode
+)
+
+// settlementHeader carries proof of a paid request's settlement as
+// "<network>:<tx hash>", e.g. "eip155:84532:0xabc...". A queued optimistic
+// settlement reports "<network>:pending"; its hash is listed by
+// /settlements/recent once it settles.
+const (
+	settlementHeader  = "X-Payment-Settlement"
+	settlementPending = "pending"
+)
+
+// settlementProof formats a settlementHeader value.
+func settlementProof(network, tx string) string {
+	return network + ":" + tx
+}
+
+// markServed tags the response with the path that served it.
+func markServed(c *gin.Context, via string) {
+	c.Header(servedViaHeader, via)
+	c.Set(servedViaHeader, via)
+}
+
+// simpleRateLimitMiddleware is a basic rate limiter that returns 429 when exceeded.
+func simpleRateLimitMiddleware(limiter ratelimit.Limiter, opts middleware.Options, events *eventHub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := clientKey(c)
+		if !ratelimit.IsReady(limiter) {
+			abortNotReady(c)
+			return
+		}
+		cost := middleware.RequestCost(c, opts)
+		allowed, err := limiter.AllowN(key, cost)
+		if err != nil {
+			abortLimiterError(c, err)
+			return
+		}
+		if opts.DryRun {
+			serveDryRun(c, events, key, allowed)
+			return
+		}
+		if !allowed && wantsWait(c, opts.MaxWait) {
+			if !holdForTokens(c, limiter, key, cost, opts, events) {
+				return
+			}
+			allowed = true
+		}
+		if !allowed {
+			events.Publish(Event{Type: eventRequestDenied, Key: key, Reason: "rate_limited"})
+			c.Header("Retry-After", middleware.RetryAfter(limiter, key, opts))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too Many Requests"})
+			c.Abort()
+			return
+		}
+		events.Publish(Event{Type: eventRequestAllowed, Key: key, Via: servedFree})
+		c.Next()
+	}
+}
+
+// hybridRateLimitPaymentMiddleware combines rate limiting with X402 payment.
+// - If tokens available: serve request
+// - If rate limited AND payment provided: verify, settle, refill, serve
+// - If rate limited AND no payment: return 402 with payment requirements
+// - If trusted client: optimistically refill and settle in background queue
+//
+// In metered mode an attached payment is always processed, even when tokens
+// are available. In paid-only mode every request without a payment gets a 402.
+func hybridRateLimitPaymentMiddleware(cfg hybridConfig) gin.HandlerFunc {
+	limiter := cfg.Limiter
+	capacity := cfg.Capacity
+	optimisticCapacity := cfg.OptimisticCapacity
+	if optimisticCapacity <= 0 {
+		optimisticCapacity = capacity
+	}
+	if cfg.PayPerRequest {
+		// The payment covers this request's cost directly, so the bucket
+		// gets no tokens to carry over
+		capacity, optimisticCapacity = 0, 0
+	}
+	trustTracker := cfg.TrustTracker
+	settlementQueue := cfg.SettlementQueue
+	events := cfg.Events
+	credits := cfg.Credits
+	if credits == nil {
+		credits = newPendingCredits()
+	}
+	var wallets walletLimiter
+	if cfg.WalletBuckets {
+		var ok bool
+		if wallets, ok = limiter.(walletLimiter); !ok {
+			log.Printf("[PAYMENT] Limiter can't hold wallet buckets; payments refill IP buckets")
+		}
+	}
+
+	return func(c *gin.Context) {
+		key := clientKey(c)
+
+		// A route's policy can make it free, or paid on every request
+		httpServer := cfg.Payments
+		costOpts := middleware.Options{Cost: cfg.Cost, MaxCost: cfg.MaxCost}
+		mode, refill, optimisticRefill := cfg.Mode, capacity, optimisticCapacity
+		var free bool
+		switch cfg.RoutePolicies[c.FullPath()] {
+		case config.RoutePolicyFree:
+			mode, free = config.ModeHybrid, true
+		case config.RoutePolicyHybrid:
+			mode = config.ModeHybrid
+		case config.RoutePolicyPaid:
+			mode, refill, optimisticRefill = config.ModePaidOnly, 0, 0
+		}
+
+		// A route registered at runtime brings its own price and cost, and
+		// a paid-only route skips the bucket like paid-only mode. One with
+		// no handler to serve it gets its 404 without paying or spending.
+		if route, ok := cfg.Routes.lookup(c.Request.Method, c.Request.URL.Path); ok {
+			if c.FullPath() == "" {
+				c.Next()
+				return
+			}
+			httpServer = route.payments
+			if cost := route.route.Cost; cost > 0 {
+				costOpts.Cost = func(*gin.Context) float64 { return cost }
+			}
+			if route.route.PaidOnly {
+				mode, refill, optimisticRefill = config.ModePaidOnly, 0, 0
+			}
+		}
+
+		// Check for payment header (V2: PAYMENT-SIGNATURE, V1: X-PAYMENT)
+		adapter := NewGinAdapter(c)
+		paymentHeader := adapter.GetHeader("PAYMENT-SIGNATURE") // V2
+		if paymentHeader == "" {
+			paymentHeader = adapter.GetHeader("X-PAYMENT") // V1 fallback
+		}
+
+		state := requestState{Mode: mode, HasPayment: paymentHeader != "", Free: free}
+
+		// Past the hard ceiling nothing is served, paid or not
+		if !cfg.DryRun {
+			refund, wait, ok := cfg.Ceiling.Take(key)
+			if !ok {
+				events.Publish(Event{Type: eventRequestDenied, Key: key, Reason: "request_ceiling"})
+				c.Header("Retry-After", strconv.Itoa(max(1, int(math.Ceil(wait.Seconds())))))
+				c.JSON(http.StatusTooManyRequests, gin.H{
+					"error":   "Too Many Requests",
+					"message": "Request ceiling reached. Payments are not accepted until it resets.",
+				})
+				c.Abort()
+				return
+			}
+			// Requests turned away below don't count toward the ceiling
+			defer func() {
+				if c.IsAborted() {
+					refund()
+				}
+			}()
+		}
+
+		if !ratelimit.IsReady(limiter) {
+			if cfg.FailOpen {
+				log.Printf("[FAIL-OPEN] Serving %s unmetered: rate limiter not ready", logKey(key))
+				c.Next()
+				return
+			}
+			if cfg.DryRun {
+				serveDryRunDenied(c, events, key, "not_ready", "answer 503 (rate limiter not ready) to")
+				return
+			}
+			abortNotReady(c)
+			return
+		}
+
+		// Tokens paid for earlier but lost to a failed refill
+		credits.Apply(limiter, key)
+
+		if state.checksBucket() {
+			cost := middleware.RequestCost(c, costOpts)
+			allowed, err := limiter.AllowN(key, cost)
+			if err != nil {
+				if cfg.FailOpen && errors.Is(err, ratelimit.ErrBackendUnavailable) {
+					log.Printf("[FAIL-OPEN] Serving %s unmetered: %v", logKey(key), err)
+					c.Next()
+					return
+				}
+				if cfg.DryRun {
+					serveDryRunDenied(c, events, key, "limiter_error", fmt.Sprintf("answer a limiter error (%v) to", err))
+					return
+				}
+				abortLimiterError(c, err)
+				return
+			}
+
+			if cfg.DryRun {
+				serveDryRun(c, events, key, allowed)
+				return
+			}
+
+			// A patient client waits for its bucket instead of paying
+			if !allowed && !state.HasPayment && wantsWait(c, cfg.MaxWait) {
+				waitOpts := costOpts
+				waitOpts.MaxWait, waitOpts.RefillRate = cfg.MaxWait, cfg.RefillRate
+				if !holdForTokens(c, limiter, key, cost, waitOpts, events) {
+					return
+				}
+				allowed = true
+			}
+			state.Allowed = allowed
+		}
+
+		// Extract wallet address from payment for trust tracking. A malformed
+		// address is never tracked, so it can't pollute the trust map.
+		var walletAddr string
+		if state.HasPayment {
+			var err error
+			if walletAddr, err = extractWalletAddress(paymentHeader); err != nil {
+				log.Printf("[PAYMENT] Ignoring payer address for trust: %v", err)
+			}
+			state.Blocked = trustTracker != nil && walletAddr != "" && trustTracker.IsBlocked(walletAddr)
+		}
+
+		// With wallet buckets, payments refill the payer's bucket rather
+		// than the IP's
+		walletKey := ""
+		if wallets != nil && walletAddr != "" {
+			walletKey = walletBucketKey(walletAddr)
+			credits.Apply(limiter, walletKey)
+		}
+
+		// paidKey readies the bucket a payment's tokens go to, falling back
+		// to the IP's if the wallet's can't be opened
+		paidKey := func() string {
+			if walletKey == "" {
+				return key
+			}
+			if err := openWalletBucket(wallets, walletKey); err != nil {
+				log.Printf("[PAYMENT] Failed to open bucket for wallet %s, refilling %s instead: %v",
+					logWallet(walletAddr), logKey(key), err)
+				return key
+			}
+			return walletKey
+		}
+
+		// Requests the bucket wasn't asked about: paid-only ones, or ones
+		// paying up front
+		if cfg.DryRun {
+			switch decide(state) {
+			case actionRequire402:
+				serveDryRunDenied(c, events, key, "payment_required", "require payment from")
+			case actionReject:
+				serveDryRunDenied(c, events, key, "wallet_blocked", "refuse the payment of blocked wallet "+logWallet(walletAddr)+" from")
+			default:
+				log.Printf("[DRY-RUN] Would settle the payment from %s, serving it unpaid", logKey(key))
+				c.Header(middleware.DryRunHeader, middleware.DryRunAllow)
+				markServed(c, servedDryRun)
+				events.Publish(Event{Type: eventRequestAllowed, Key: key, Wallet: walletAddr, Via: servedDryRun, DryRun: true})
+				c.Next()
+			}
+			return
+		}
+
+		reqCtx := x402http.HTTPRequestContext{
+			Adapter:       adapter,
+			Path:          c.Request.URL.Path,
+			Method:        c.Request.Method,
+			PaymentHeader: paymentHeader, // Important: populate this for payment verification
+		}
+
+		switch decide(state) {
+		case actionServe:
+			// Tokens available, proceed
+			markServed(c, servedFree)
+			events.Publish(Event{Type: eventRequestAllowed, Key: key, Via: servedFree})
+			c.Next()
+			return
+
+		case actionRequire402:
+			// No payment - generate 402 response
+			events.Publish(Event{Type: eventPaymentRequired, Key: key})
+			balance := paymentBalance(limiter, key, cfg.BucketCapacity, refill*cfg.Escalation.Record(key))
+			result := httpServer.ProcessHTTPRequest(c.Request.Context(), reqCtx, nil)
+			if result.Response != nil && cfg.PaymentResponse != nil && !result.Response.IsHTML {
+				writeCustomPaymentResponse(c, cfg.PaymentResponse, reqCtx, result.Response, balance)
+			} else if result.Response != nil {
+				for k, v := range result.Response.Headers {
+					c.Header(k, v)
+				}
+				body := result.Response.Body
+				if !result.Response.IsHTML {
+					body = withFields(body, balance)
+				}
+				c.JSON(result.Response.Status, body)
+			} else {
+				c.JSON(http.StatusPaymentRequired, withFields(map[string]any{
+					"error":   "Payment Required",
+					"message": "Rate limit exceeded. Pay to refill your quota.",
+				}, balance))
+			}
+			c.Abort()
+			return
+
+		case actionRateLimit:
+			// A free route takes no payment, attached or not
+			events.Publish(Event{Type: eventRequestDenied, Key: key, Reason: "rate_limited"})
+			c.Header("Retry-After", middleware.RetryAfter(limiter, key, costOpts))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too Many Requests"})
+			c.Abort()
+			return
+
+		case actionReject:
+			// Refuse payments from wallets an operator has blocked
+			events.Publish(Event{Type: eventRequestDenied, Key: key, Wallet: walletAddr, Reason: "wallet_blocked"})
+			cfg.Metrics.Record(paidPathRejected)
+			c.JSON(http.StatusForbidden, gin.H{"error": "Wallet blocked"})
+			c.Abort()
+			return
+		}
+
+		// The payment's tokens follow the escalation curve, by the 402s sent
+		// to this client recently
+		if m := cfg.Escalation.Multiplier(key); m != 1 {
+			refill, optimisticRefill = refill*m, optimisticRefill*m
+		}
+
+		// Payment present - process it (verification happens in ProcessHTTPRequest)
+		paymentStart := time.Now()
+		result := httpServer.ProcessHTTPRequest(c.Request.Context(), reqCtx, nil)
+		verificationLatency := time.Since(paymentStart)
+
+		if result.Type == x402http.ResultPaymentVerified {
+			trustKey := walletAddr
+			if cfg.TrustKey != nil {
+				trustKey = cfg.TrustKey(*result.PaymentPayload, reqCtx)
+			}
+
+			// The bucket may have refilled during verification. If so, serve
+			// from it and leave the payment unsettled. A limiter error here
+			// just falls through to settling the payment.
+			if cfg.DeclineUnneeded && !state.payFirst() {
+				if allowed, err := limiter.AllowN(key, middleware.RequestCost(c, costOpts)); err == nil && allowed {
+					log.Printf("[PAYMENT] Bucket for %s refilled during verification, payment from %s not settled",
+						logKey(key), logWallet(walletAddr))
+					markServed(c, servedFree)
+					events.Publish(Event{Type: eventRequestAllowed, Key: key, Wallet: walletAddr, Via: servedFree, Reason: "payment_unneeded"})
+					c.Next()
+					return
+				}
+			}
+
+			// A wallet that paid before, from this IP or another, spends its
+			// own bucket before paying again
+			if walletKey != "" && !state.payFirst() {
+				if allowed, err := allowWalletBucket(wallets, walletKey, middleware.RequestCost(c, costOpts)); err == nil && allowed {
+					log.Printf("[PAYMENT] Serving %s from wallet %s's bucket, payment not settled",
+						logKey(key), logWallet(walletAddr))
+					markServed(c, servedFree)
+					events.Publish(Event{Type: eventRequestAllowed, Key: key, Wallet: walletAddr, Via: servedFree, Reason: "wallet_bucket"})
+					c.Next()
+					return
+				}
+			}
+
+			// Refuse a payment already accepted, which would otherwise be
+			// granted tokens again before its second settlement fails
+			if !cfg.Replays.Claim(*result.PaymentPayload) {
+				log.Printf("[PAYMENT] Refusing replayed payment from %s", logWallet(walletAddr))
+				events.Publish(Event{Type: eventPaymentRequired, Key: key, Wallet: walletAddr, Reason: "payment_replayed"})
+				cfg.Metrics.Record(paidPathRejected)
+				cfg.Metrics.RecordReplay()
+				c.JSON(http.StatusPaymentRequired, gin.H{
+					"error":   "Payment already used",
+					"message": "This payment was already accepted. Sign a new one.",
+				})
+				c.Abort()
+				return
+			}
+
+			// Refuse micro-payment spam before it triggers another settlement
+			if cfg.MinPaymentInterval > 0 && trustTracker != nil && walletAddr != "" {
+				if wait, ok := trustTracker.ReservePayment(walletAddr, cfg.MinPaymentInterval); !ok {
+					cfg.Replays.Release(*result.PaymentPayload)
+					retryAfter := int(math.Ceil(wait.Seconds()))
+					events.Publish(Event{Type: eventRequestDenied, Key: key, Wallet: walletAddr, Reason: "payment_too_soon"})
+					cfg.Metrics.Record(paidPathRejected)
+					c.Header("Retry-After", strconv.Itoa(retryAfter))
+					c.JSON(http.StatusTooManyRequests, gin.H{
+						"error":   "Payment too soon",
+						"message": fmt.Sprintf("This wallet paid less than %v ago. Wait %ds before paying again.", cfg.MinPaymentInterval, retryAfter),
+					})
+					c.Abort()
+					return
+				}
+			}
+
+			// Check if client is trusted for optimistic settlement. A stalled
+			// queue falls back to synchronous settlement, and trust is only
+			// asked with a healthy queue, since IsTrusted may claim a slot.
+			state.QueueHealthy = settlementQueue != nil && settlementQueue.Healthy()
+			state.Trusted = state.QueueHealthy && trustTracker != nil && trustKey != "" && trustTracker.IsTrusted(trustKey)
+			if decide(state) == actionPayOptimisticThenServe {
+				// OPTIMISTIC: Refill immediately, settle via queue
+				refillStart := time.Now()
+				if optimisticRefill > 0 {
+					if err := limiter.Refill(paidKey(), optimisticRefill); err != nil {
+						cfg.Replays.Release(*result.PaymentPayload)
+						c.JSON(http.StatusInternalServerError, gin.H{"error": "Refill error"})
+						c.Abort()
+						return
+					}
+				}
+				refillLatency := time.Since(refillStart)
+				c.Header("Server-Timing", serverTiming(
+					timing{"verify", verificationLatency},
+					timing{"refill", refillLatency},
+				))
+
+				markServed(c, servedOptimistic)
+				c.Header(settlementHeader, settlementProof(result.PaymentRequirements.Network, settlementPending))
+				events.Publish(Event{Type: eventRequestAllowed, Key: key, Wallet: walletAddr, Via: servedOptimistic})
+				cfg.Metrics.Record(paidPathOptimistic)
+				log.Printf("[OPTIMISTIC] Trusted wallet %s, queueing settlement (verify: %v) via=%s",
+					logWallet(walletAddr), verificationLatency, servedOptimistic)
+
+				// Enqueue settlement for sequential processing
+				settlementQueue.Enqueue(SettlementJob{
+					PaymentPayload:      *result.PaymentPayload,
+					PaymentRequirements: *result.PaymentRequirements,
+					WalletAddr:          walletAddr,
+					TrustKey:            trustKey,
+					Tokens:              optimisticRefill,
+				})
+
+				// Allow the request through immediately
+				c.Next()
+				return
+			}
+
+			// SYNCHRONOUS: Not trusted, settle before responding
+			settlementStart := time.Now()
+			settleResult := httpServer.ProcessSettlement(
+				c.Request.Context(),
+				*result.PaymentPayload,
+				*result.PaymentRequirements,
+			)
+			settlementLatency := time.Since(settlementStart)
+
+			if settleResult.Success {
+				// Refill the bucket. The client has paid, so if the limiter
+				// fails, serve them anyway and owe the tokens.
+				refillStart := time.Now()
+				if refill > 0 {
+					target := paidKey()
+					if err := limiter.Refill(target, refill); err != nil {
+						log.Printf("[PAYMENT] Refill failed after settling %s, crediting %s later: %v",
+							settleResult.Transaction, logKey(target), err)
+						credits.Add(target, refill)
+					}
+				}
+				refillLatency := time.Since(refillStart)
+				c.Header("Server-Timing", serverTiming(
+					timing{"verify", verificationLatency},
+					timing{"settle", settlementLatency},
+					timing{"refill", refillLatency},
+				))
+
+				markServed(c, servedPaidSync)
+				c.Header(settlementHeader, settlementProof(string(settleResult.Network), settleResult.Transaction))
+				events.Publish(Event{Type: eventPaymentSettled, Key: key, Wallet: walletAddr, Transaction: settleResult.Transaction})
+				events.Publish(Event{Type: eventRequestAllowed, Key: key, Wallet: walletAddr, Via: servedPaidSync})
+				cfg.Metrics.Record(paidPathSync)
+
+				if trustTracker != nil && walletAddr != "" {
+					trustTracker.RecordGrant(walletAddr, refill, result.PaymentRequirements.Amount)
+				}
+
+				// Record success for trust building
+				if trustTracker != nil && trustKey != "" {
+					trustTracker.RecordSuccessN(trustKey, trustWeight(result.PaymentRequirements.Amount, cfg.TrustUnit))
+					log.Printf("[PAYMENT] Settled TX: %s in %v (Verify: %v, Settle: %v, Refill: %v) [trust: %.2f/%d, %s] via=%s",
+						settleResult.Transaction, time.Since(paymentStart), verificationLatency, settlementLatency, refillLatency,
+						trustTracker.RecentScore(trustKey), trustTracker.Config().OptimisticThreshold, trustTracker.Level(trustKey), servedPaidSync)
+				} else {
+					log.Printf("[PAYMENT] Settled TX: %s in %v (Verify: %v, Settle: %v, Refill: %v) via=%s",
+						settleResult.Transaction, time.Since(paymentStart), verificationLatency, settlementLatency, refillLatency, servedPaidSync)
+				}
+
+				// Allow the request through
+				c.Next()
+				return
+			}
+
+			// Settlement failed. A transient failure may succeed if the
+			// client retries; a permanent one can't, so it costs the payer
+			// its trust.
+			failure := classifySettleFailure(settleResult.ErrorReason)
+			cfg.Replays.Release(*result.PaymentPayload)
+			if failure == settlePermanent && trustTracker != nil {
+				if trustKey != "" {
+					trustTracker.RecordFailure(trustKey)
+				}
+				if cfg.BlockUnsettleable && walletAddr != "" {
+					trustTracker.Block(walletAddr)
+				}
+			}
+			log.Printf("[PAYMENT] Settlement FAILED: %s (%s failure, wallet %s)",
+				settleResult.ErrorReason, failure, logWallet(walletAddr))
+			events.Publish(Event{Type: eventSettlementFailed, Key: key, Wallet: walletAddr, Reason: settleResult.ErrorReason})
+			cfg.Metrics.Record(paidPathRejected)
+			c.JSON(http.StatusPaymentRequired, gin.H{
+				"error":     "Settlement failed",
+				"reason":    settleResult.ErrorReason,
+				"retryable": failure == settleTransient,
+			})
+			c.Abort()
+			return
+		}
+
+		// Payment verification failed
+		events.Publish(Event{Type: eventPaymentRequired, Key: key, Wallet: walletAddr, Reason: "verification_failed"})
+		cfg.Metrics.Record(paidPathRejected)
+		if result.Response != nil {
+			for k, v := range result.Response.Headers {
+				c.Header(k, v)
+			}
+			c.JSON(result.Response.Status, result.Response.Body)
+		} else {
+			c.JSON(http.StatusPaymentRequired, gin.H{
+				"error":   "Payment Required",
+				"message": "Invalid payment or rate limit exceeded.",
+			})
+		}
+		c.Abort()
+	}
+}
+
+// paymentBalance describes key's bucket for a 402 body: its current tokens,
+// the bucket capacity and the balance a payment adding refill tokens would
+// leave. It's empty when bucketCapacity is unset or the limiter can't say.
+func paymentBalance(limiter ratelimit.Limiter, key string, bucketCapacity, refill float64) map[string]any {
+	if bucketCapacity <= 0 {
+		return nil
+	}
+	current, err := limiter.Available(key)
+	if err != nil {
+		return nil
+	}
+	return map[string]any{
+		"current_tokens":       current,
+		"capacity":             bucketCapacity,
+		"tokens_after_payment": current + refill,
+	}
+}
+
+// withFields adds fields to a JSON object body. A body that isn't an object
+// once encoded is returned unchanged.
+func withFields(body any, fields map[string]any) any {
+	if len(fields) == 0 {
+		return body
+	}
+	obj, ok := body.(map[string]any)
+	if ok {
+		merged := make(map[string]any, len(obj)+len(fields))
+		for k, v := range obj {
+			merged[k] = v
+		}
+		obj = merged
+	} else {
+		data, err := json.Marshal(body)
+		if err != nil || json.Unmarshal(data, &obj) != nil || obj == nil {
+			return body
+		}
+	}
+	for k, v := range fields {
+		obj[k] = v
+	}
+	return obj
+}
+
+// writeCustomPaymentResponse writes the 402 built by fn on top of the default
+// x402 response. extra fields go under the custom body's own.
+func writeCustomPaymentResponse(c *gin.Context, fn PaymentResponseFunc, reqCtx x402http.HTTPRequestContext, resp *x402http.HTTPResponseInstructions, extra map[string]any) {
+	status, headers, body := fn(reqCtx)
+	if status == 0 {
+		status = resp.Status
+	}
+
+	for k, v := range headers {
+		c.Header(k, v)
+	}
+	for k, v := range resp.Headers {
+		if k == "PAYMENT-REQUIRED" || headers[k] == "" {
+			c.Header(k, v)
+		}
+	}
+
+	if custom, ok := body.(map[string]any); ok {
+		merged := paymentRequiredFields(resp)
+		for k, v := range extra {
+			merged[k] = v
+		}
+		for k, v := range custom {
+			merged[k] = v
+		}
+		body = merged
+	}
+	c.JSON(status, body)
+}
+
+// paymentRequiredFields returns the x402 payment requirements of a 402 as a
+// map, taken from its body or else decoded from its PAYMENT-REQUIRED header.
+func paymentRequiredFields(resp *x402http.HTTPResponseInstructions) map[string]any {
+	fields := make(map[string]any)
+	if body, ok := resp.Body.(map[string]any); ok {
+		for k, v := range body {
+			fields[k] = v
+		}
+		return fields
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(resp.Headers["PAYMENT-REQUIRED"])
+	if err != nil {
+		return fields
+	}
+	_ = json.Unmarshal(decoded, &fields)
+	return fields
+}
+
+// serveDryRun serves a request whatever the bucket decided, recording the
+// decision for operators tuning limits before enforcing them.
+func serveDryRun(c *gin.Context, events *eventHub, key string, allowed bool) {
+	if allowed {
+		c.Header(middleware.DryRunHeader, middleware.DryRunAllow)
+		markServed(c, servedFree)
+		events.Publish(Event{Type: eventRequestAllowed, Key: key, Via: servedFree, DryRun: true})
+		c.Next()
+		return
+	}
+	serveDryRunDenied(c, events, key, "rate_limited", "rate limit")
+}
+
+// serveDryRunDenied serves a request the middleware would have turned away,
+// logging what it would have done and publishing the denial with reason.
+func serveDryRunDenied(c *gin.Context, events *eventHub, key, reason, decision string) {
+	log.Printf("[DRY-RUN] Would %s %s", decision, logKey(key))
+	c.Header(middleware.DryRunHeader, middleware.DryRunDeny)
+	markServed(c, servedDryRun)
+	events.Publish(Event{Type: eventRequestDenied, Key: key, Reason: reason, DryRun: true})
+	c.Next()
+}
+
+// abortNotReady answers 503 while the limiter's backend is still coming up,
+// so clients retry shortly rather than see a 500.
+func abortNotReady(c *gin.Context) {
+	c.Header("Retry-After", "1")
+	c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Rate limiter starting"})
+	c.Abort()
+}
+
+// abortLimiterError responds to a limiter failure with a status for its class:
+// 400 for a bad key, 503 when the backend is down and 500 for anything else.
+func abortLimiterError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ratelimit.ErrInvalidKey):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rate limit key"})
+	case errors.Is(err, ratelimit.ErrBackendUnavailable):
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Rate limiter unavailable"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Rate limiter error"})
+	}
+	c.Abort()
+}
+
+// errInvalidWallet is returned for payer addresses that aren't well-formed EVM addresses.
+var errInvalidWallet = errors.New("invalid wallet address")
+
+// extractWalletAddress extracts the sender wallet address from the payment header.
+// The payment header is a base64-encoded JSON with a "payload" containing "authorization.from".
+// The address is validated and lowercased; "" is returned when the header
+// carries no address, and an error when the address is malformed.
+func extractWalletAddress(paymentHeader string) (string, error) {
+	if paymentHeader == "" {
+		return "", nil
+	}
+
+	decoded, ok := decodePaymentHeader(paymentHeader)
+	if !ok {
+		return "", nil
+	}
+
+	// Parse as JSON to extract the wallet address
+	var payment struct {
+		Payload struct {
+			Authorization struct {
+				From string `json:"from"`
+			} `json:"authorization"`
+		} `json:"payload"`
+	}
+
+	if err := json.Unmarshal(decoded, &payment); err != nil {
+		return "", nil
+	}
+	if payment.Payload.Authorization.From == "" {
+		return "", nil
+	}
+
+	return normalizeWallet(payment.Payload.Authorization.From)
+}
+
+// decodePaymentHeader decodes a payment header's base64, standard or URL-safe.
+func decodePaymentHeader(paymentHeader string) ([]byte, bool) {
+	decoded, err := base64.StdEncoding.DecodeString(paymentHeader)
+	if err != nil {
+		decoded, err = base64.URLEncoding.DecodeString(paymentHeader)
+		if err != nil {
+			return nil, false
+		}
+	}
+	return decoded, true
+}
+
+// normalizeWallet validates a 0x-prefixed, 40 hex digit address and returns
+// it lowercased. Mixed-case addresses must carry a valid EIP-55 checksum;
+// all-lowercase or all-uppercase ones have no checksum to verify.
+func normalizeWallet(addr string) (string, error) {
+	if len(addr) != 42 || addr[0] != '0' || (addr[1] != 'x' && addr[1] != 'X') {
+		return "", fmt.Errorf("%w: %q", errInvalidWallet, addr)
+	}
+	hexPart := addr[2:]
+	if _, err := hex.DecodeString(hexPart); err != nil {
+		return "", fmt.Errorf("%w: %q", errInvalidWallet, addr)
+	}
+
+	lower := strings.ToLower(hexPart)
+	if hexPart != lower && hexPart != strings.ToUpper(hexPart) && hexPart != checksumHex(lower) {
+		return "", fmt.Errorf("%w: bad EIP-55 checksum %q", errInvalidWallet, addr)
+	}
+	return "0x" + lower, nil
+}
+
+// checksumHex applies EIP-55 capitalization to a lowercase hex address
+// (without 0x): a letter is uppercased when the matching nibble of the
+// Keccak-256 hash of the address is >= 8.
+func checksumHex(lower string) string {
+	h := sha3.NewLegacyKeccak256()
+	h.Write([]byte(lower))
+	hash := h.Sum(nil)
+
+	out := []byte(lower)
+	for i, ch := range out {
+		nibble := hash[i/2]
+		if i%2 == 0 {
+			nibble >>= 4
+		}
+		if ch >= 'a' && ch <= 'f' && nibble&0x0f >= 8 {
+			out[i] = ch - 'a' + 'A'
+		}
+	}
+	return string(out)
+}
+
+// timing is a single named Server-Timing metric.
+type timing struct {
+	name string
+	dur  time.Duration
+}
+
+// serverTiming formats payment latencies as a Server-Timing header value,
+// e.g. "verify;dur=12.34, settle;dur=1500.00". Durations are in milliseconds.
+func serverTiming(metrics ...timing) string {
+	parts := make([]string, len(metrics))
+	for i, m := range metrics {
+		parts[i] = fmt.Sprintf("%s;dur=%.2f", m.name, float64(m.dur.Microseconds())/1000)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// truncateWallet returns a truncated wallet address for logging.
+func truncateWallet(wallet string) string {
+	if len(wallet) <= 10 {
+		return wallet
+	}
+	return wallet[:6] + "..." + wallet[len(wallet)-4:]
+}
+
+// trustWeight returns how many times a payment of amount counts toward trust:
+// once per whole unit, and at least once. A nil unit or an unparseable amount
+// counts once.
+func trustWeight(amount string, unit *big.Int) int {
+	if unit == nil || unit.Sign() <= 0 {
+		return 1
+	}
+	paid, ok := new(big.Int).SetString(amount, 10)
+	if !ok {
+		return 1
+	}
+	weight := new(big.Int).Quo(paid, unit)
+	if !weight.IsInt64() || weight.Int64() > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return max(1, int(weight.Int64()))
+}
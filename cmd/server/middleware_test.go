@@ -0,0 +1,1249 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	x402 "github.com/coinbase/x402/go"
+	x402http "github.com/coinbase/x402/go/http"
+	"github.com/gin-gonic/gin"
+	goredis "github.com/redis/go-redis/v9"
+
+	"github.com/haseeb/ratelimiter/internal/config"
+	"github.com/haseeb/ratelimiter/internal/middleware"
+	"github.com/haseeb/ratelimiter/internal/paymenttest"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/memory"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/ratelimittest"
+	ratelimitredis "github.com/haseeb/ratelimiter/pkg/ratelimit/redis"
+	"github.com/haseeb/ratelimiter/pkg/trust"
+)
+
+const testWallet = "0x1111111111111111111111111111111111111111"
+
+// paymentHeaderFor builds a payment header whose authorization comes from wallet.
+func paymentHeaderFor(wallet string) string {
+	payload := map[string]interface{}{
+		"payload": map[string]interface{}{
+			"authorization": map[string]interface{}{"from": wallet},
+		},
+	}
+	data, _ := json.Marshal(payload)
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// newTestRouter wires the hybrid middleware in front of a trivial handler.
+func newTestRouter(cfg hybridConfig) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(hybridRateLimitPaymentMiddleware(cfg))
+	r.GET("/cpu", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+	return r
+}
+
+// doRequest sends GET /cpu, attaching a payment header when paymentHeader is set.
+func doRequest(r http.Handler, paymentHeader string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/cpu", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	if paymentHeader != "" {
+		req.Header.Set("PAYMENT-SIGNATURE", paymentHeader)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestHybridMiddleware_HybridMode(t *testing.T) {
+	processor := &paymenttest.Processor{}
+	r := newTestRouter(hybridConfig{
+		Limiter:  memory.NewTokenBucket(1, 0.001),
+		Payments: processor,
+		Capacity: 1,
+	})
+
+	// Payment attached while tokens are available is ignored
+	if w := doRequest(r, paymentHeaderFor(testWallet)); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 from bucket, got %d", w.Code)
+	}
+	if verify, _ := processor.Calls(); verify != 0 {
+		t.Errorf("Expected payment to be ignored while tokens remain, got %d verifications", verify)
+	}
+
+	// Bucket empty, no payment -> 402
+	if w := doRequest(r, ""); w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected 402 once bucket is empty, got %d", w.Code)
+	}
+
+	// Bucket empty, with payment -> settled and served
+	if w := doRequest(r, paymentHeaderFor(testWallet)); w.Code != http.StatusOK {
+		t.Errorf("Expected 200 after payment, got %d", w.Code)
+	}
+	if _, settle := processor.Calls(); settle != 1 {
+		t.Errorf("Expected 1 settlement, got %d", settle)
+	}
+}
+
+func TestHybridMiddleware_MeteredMode(t *testing.T) {
+	processor := &paymenttest.Processor{}
+	limiter := memory.NewTokenBucket(2, 0.001)
+	r := newTestRouter(hybridConfig{
+		Limiter:  limiter,
+		Payments: processor,
+		Capacity: 2,
+		Mode:     config.ModeMetered,
+	})
+
+	// Payment is processed even though tokens are available
+	if w := doRequest(r, paymentHeaderFor(testWallet)); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 for metered payment, got %d", w.Code)
+	}
+	verify, settle := processor.Calls()
+	if verify != 1 || settle != 1 {
+		t.Errorf("Expected payment to be verified and settled, got verify=%d settle=%d", verify, settle)
+	}
+	if avail, _ := limiter.Available(""); avail < 3.99 {
+		t.Errorf("Expected payment to refill on top of the untouched bucket (4 tokens), got %.2f", avail)
+	}
+
+	// Without payment, tokens are still served for free
+	for i := 0; i < 4; i++ {
+		if w := doRequest(r, ""); w.Code != http.StatusOK {
+			t.Fatalf("Request %d: expected 200 from bucket, got %d", i+1, w.Code)
+		}
+	}
+
+	// Once empty, unpaid requests get a 402
+	if w := doRequest(r, ""); w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected 402 once bucket is empty, got %d", w.Code)
+	}
+}
+
+func TestHybridMiddleware_PaidOnlyMode(t *testing.T) {
+	processor := &paymenttest.Processor{}
+	limiter := memory.NewTokenBucket(5, 1)
+	r := newTestRouter(hybridConfig{
+		Limiter:  limiter,
+		Payments: processor,
+		Capacity: 5,
+		Mode:     config.ModePaidOnly,
+	})
+
+	// Full bucket, but no payment -> 402
+	if w := doRequest(r, ""); w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected 402 without payment in paid-only mode, got %d", w.Code)
+	}
+	if avail, _ := limiter.Available(""); avail < 4.99 {
+		t.Errorf("Expected bucket untouched in paid-only mode, got %.2f", avail)
+	}
+
+	// With payment -> served
+	if w := doRequest(r, paymentHeaderFor(testWallet)); w.Code != http.StatusOK {
+		t.Errorf("Expected 200 with payment, got %d", w.Code)
+	}
+
+	// Invalid payment -> 402
+	processor.SetRejectPay(true)
+	if w := doRequest(r, paymentHeaderFor(testWallet)); w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected 402 for rejected payment, got %d", w.Code)
+	}
+}
+
+// serverTimingPattern matches "name;dur=1.23" entries joined by ", ".
+var serverTimingPattern = regexp.MustCompile(`^[a-z]+;dur=\d+\.\d{2}(, [a-z]+;dur=\d+\.\d{2})*$`)
+
+// serverTimingNames returns the metric names in a Server-Timing header value.
+func serverTimingNames(header string) []string {
+	var names []string
+	for _, part := range strings.Split(header, ", ") {
+		names = append(names, strings.SplitN(part, ";", 2)[0])
+	}
+	return names
+}
+
+func TestHybridMiddleware_ServerTiming(t *testing.T) {
+	tracker := trust.New(trust.Config{Threshold: 1})
+	processor := &paymenttest.Processor{}
+	sq := NewSettlementQueue(processor, tracker, 10)
+	defer sq.Close()
+
+	r := newTestRouter(hybridConfig{
+		Limiter:         memory.NewTokenBucket(1, 0.001),
+		Payments:        processor,
+		Capacity:        1,
+		TrustTracker:    tracker,
+		SettlementQueue: sq,
+	})
+
+	// Free request: no payment, no timing header
+	if w := doRequest(r, ""); w.Header().Get("Server-Timing") != "" {
+		t.Errorf("Expected no Server-Timing on free request, got %q", w.Header().Get("Server-Timing"))
+	}
+
+	// Synchronous payment: verify, settle and refill
+	w := doRequest(r, paymentHeaderFor(testWallet))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 after payment, got %d", w.Code)
+	}
+	header := w.Header().Get("Server-Timing")
+	if !serverTimingPattern.MatchString(header) {
+		t.Fatalf("Malformed Server-Timing header: %q", header)
+	}
+	if got := strings.Join(serverTimingNames(header), ","); got != "verify,settle,refill" {
+		t.Errorf("Expected verify,settle,refill metrics, got %s", got)
+	}
+
+	// Optimistic payment (wallet now trusted): verify and refill only
+	doRequest(r, "") // Drain the refilled token
+	w = doRequest(r, paymentHeaderFor(testWallet))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 after optimistic payment, got %d", w.Code)
+	}
+	header = w.Header().Get("Server-Timing")
+	if !serverTimingPattern.MatchString(header) {
+		t.Fatalf("Malformed Server-Timing header: %q", header)
+	}
+	if got := strings.Join(serverTimingNames(header), ","); got != "verify,refill" {
+		t.Errorf("Expected verify,refill metrics, got %s", got)
+	}
+}
+
+// errLimiter is a Limiter whose every call fails with err.
+type errLimiter struct{ err error }
+
+func (l errLimiter) Allow(key string) (bool, error)             { return false, l.err }
+func (l errLimiter) AllowN(key string, n float64) (bool, error) { return false, l.err }
+func (l errLimiter) Refill(key string, tokens float64) error    { return l.err }
+func (l errLimiter) Available(key string) (float64, error)      { return 0, l.err }
+
+func TestHybridMiddleware_LimiterErrors(t *testing.T) {
+	unavailable := fmt.Errorf("%w: dial tcp: connection refused", ratelimit.ErrBackendUnavailable)
+
+	tests := []struct {
+		name     string
+		err      error
+		failOpen bool
+		want     int
+	}{
+		{"unavailable fails closed", unavailable, false, http.StatusServiceUnavailable},
+		{"unavailable fails open", unavailable, true, http.StatusOK},
+		{"invalid key", ratelimit.ErrInvalidKey, true, http.StatusBadRequest},
+		{"other error never fails open", errors.New("script error"), true, http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRouter(hybridConfig{
+				Limiter:  errLimiter{tt.err},
+				Payments: &paymenttest.Processor{},
+				Capacity: 1,
+				FailOpen: tt.failOpen,
+			})
+			if w := doRequest(r, ""); w.Code != tt.want {
+				t.Errorf("Expected %d, got %d", tt.want, w.Code)
+			}
+		})
+	}
+}
+
+func TestHybridMiddleware_ServedVia(t *testing.T) {
+	tracker := trust.New(trust.Config{Threshold: 1})
+	processor := &paymenttest.Processor{}
+	sq := NewSettlementQueue(processor, tracker, 10)
+	defer sq.Close()
+
+	r := newTestRouter(hybridConfig{
+		Limiter:         memory.NewTokenBucket(1, 0.001),
+		Payments:        processor,
+		Capacity:        1,
+		TrustTracker:    tracker,
+		SettlementQueue: sq,
+	})
+
+	// Tokens available
+	if got := doRequest(r, "").Header().Get("X-Served-Via"); got != "free" {
+		t.Errorf("Expected free, got %q", got)
+	}
+
+	// Bucket empty, untrusted wallet pays synchronously
+	if got := doRequest(r, paymentHeaderFor(testWallet)).Header().Get("X-Served-Via"); got != "paid-sync" {
+		t.Errorf("Expected paid-sync, got %q", got)
+	}
+
+	// Wallet now trusted: optimistic path
+	doRequest(r, "") // Drain the refilled token
+	if got := doRequest(r, paymentHeaderFor(testWallet)).Header().Get("X-Served-Via"); got != "paid-optimistic" {
+		t.Errorf("Expected paid-optimistic, got %q", got)
+	}
+
+	// Refused requests aren't tagged
+	doRequest(r, "") // Drain the refilled token
+	if got := doRequest(r, "").Header().Get("X-Served-Via"); got != "" {
+		t.Errorf("Expected no tag on a 402, got %q", got)
+	}
+}
+
+func TestNormalizeWallet(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"lowercase", "0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed", "0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed", false},
+		{"uppercase", "0x5AAEB6053F3E94C9B9A09F33669435E7EF1BEAED", "0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed", false},
+		{"valid checksum", "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed", "0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed", false},
+		{"valid checksum 2", "0xfB6916095ca1df60bB79Ce92cE3Ea74c37c5d359", "0xfb6916095ca1df60bb79ce92ce3ea74c37c5d359", false},
+		{"bad checksum", "0x5AAeb6053F3E94C9b9A09f33669435E7Ef1BeAed", "", true},
+		{"too short", "0x5aaeb6053f3e94c9b9a09f33669435e7ef1bea", "", true},
+		{"too long", "0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed00", "", true},
+		{"non-hex", "0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaeg", "", true},
+		{"missing prefix", "5aaeb6053f3e94c9b9a09f33669435e7ef1beaed00", "", true},
+		{"empty", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeWallet(tt.in)
+			if tt.wantErr {
+				if !errors.Is(err, errInvalidWallet) {
+					t.Errorf("Expected errInvalidWallet, got %q, %v", got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("normalizeWallet(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestHybridMiddleware_MalformedWalletNotTracked(t *testing.T) {
+	tracker := trust.New(trust.Config{Threshold: 1})
+	r := newTestRouter(hybridConfig{
+		Limiter:      memory.NewTokenBucket(1, 0.001),
+		Payments:     &paymenttest.Processor{},
+		Capacity:     1,
+		TrustTracker: tracker,
+	})
+
+	doRequest(r, "") // Drain the bucket
+	if w := doRequest(r, paymentHeaderFor("0xnot-a-wallet")); w.Code != http.StatusOK {
+		t.Fatalf("Expected payment to be served, got %d", w.Code)
+	}
+	if stats := tracker.Stats(); stats.TotalWalletsSeen != 0 {
+		t.Errorf("Expected malformed wallet to stay out of the trust map, got %+v", stats)
+	}
+}
+
+// keyLimiter is an always-allowing Limiter that records the keys it sees.
+type keyLimiter struct {
+	mu   sync.Mutex
+	keys []string
+}
+
+func (l *keyLimiter) Allow(key string) (bool, error) { return l.AllowN(key, 1) }
+func (l *keyLimiter) AllowN(key string, n float64) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.keys = append(l.keys, key)
+	return true, nil
+}
+func (l *keyLimiter) Refill(key string, tokens float64) error { return nil }
+func (l *keyLimiter) Available(key string) (float64, error)   { return 1, nil }
+
+func TestHybridMiddleware_TrustedProxies(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxies []string
+		peer    string
+		xff     string
+		want    string
+	}{
+		{"no proxies ignores header", nil, "203.0.113.5:1234", "198.51.100.7", "203.0.113.5"},
+		{"untrusted peer can't spoof", []string{"10.0.0.0/8"}, "203.0.113.5:1234", "198.51.100.7", "203.0.113.5"},
+		{"trusted proxy forwards client", []string{"10.0.0.0/8"}, "10.1.2.3:1234", "198.51.100.7", "198.51.100.7"},
+		{"spoofed prefix behind trusted proxy", []string{"10.0.0.0/8"}, "10.1.2.3:1234", "1.2.3.4, 198.51.100.7", "198.51.100.7"},
+		{"chain of trusted proxies", []string{"10.0.0.0/8"}, "10.1.2.3:1234", "198.51.100.7, 10.9.9.9", "198.51.100.7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := &keyLimiter{}
+			r := newTestRouter(hybridConfig{
+				Limiter:  limiter,
+				Payments: &paymenttest.Processor{},
+				Capacity: 1,
+			})
+			if err := r.SetTrustedProxies(tt.proxies); err != nil {
+				t.Fatalf("SetTrustedProxies error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/cpu", nil)
+			req.RemoteAddr = tt.peer
+			req.Header.Set("X-Forwarded-For", tt.xff)
+			r.ServeHTTP(httptest.NewRecorder(), req)
+
+			if len(limiter.keys) != 1 || limiter.keys[0] != tt.want {
+				t.Errorf("Expected rate limit key %q, got %v", tt.want, limiter.keys)
+			}
+		})
+	}
+}
+
+func TestHybridMiddleware_WeightedTrust(t *testing.T) {
+	tracker := trust.New(trust.Config{Threshold: 3})
+	processor := &paymenttest.Processor{}
+	r := newTestRouter(hybridConfig{
+		Limiter:      memory.NewTokenBucket(1, 0.001),
+		Payments:     processor,
+		Capacity:     1,
+		TrustTracker: tracker,
+		TrustUnit:    big.NewInt(250), // The fake's 1000-unit payment counts 4 times
+	})
+
+	doRequest(r, "") // Drain the bucket
+	if w := doRequest(r, paymentHeaderFor(testWallet)); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 after payment, got %d", w.Code)
+	}
+	if !tracker.IsTrusted(testWallet) {
+		t.Errorf("Expected one large payment to reach the trust threshold, got %d payments", tracker.RecentPayments(testWallet))
+	}
+}
+
+func TestTrustWeight(t *testing.T) {
+	tests := []struct {
+		amount string
+		unit   *big.Int
+		want   int
+	}{
+		{"1000", nil, 1},
+		{"1000", big.NewInt(1000), 1},
+		{"3500", big.NewInt(1000), 3},
+		{"500", big.NewInt(1000), 1}, // Small payments still count once
+		{"bogus", big.NewInt(1000), 1},
+		{"1000", big.NewInt(0), 1},
+	}
+	for _, tt := range tests {
+		if got := trustWeight(tt.amount, tt.unit); got != tt.want {
+			t.Errorf("trustWeight(%q, %v) = %d, want %d", tt.amount, tt.unit, got, tt.want)
+		}
+	}
+}
+
+func TestHybridMiddleware_RefillMultiplier(t *testing.T) {
+	cfg := &config.Config{
+		RateLimit: config.RateLimitConfig{Capacity: 2, RefillRate: 0.001},
+		Payment:   config.PaymentConfig{RefillMultiplier: 3},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Invalid config: %v", err)
+	}
+
+	limiter := memory.NewTokenBucket(cfg.RateLimit.Capacity, cfg.RateLimit.RefillRate)
+	r := newTestRouter(hybridConfig{
+		Limiter:  limiter,
+		Payments: &paymenttest.Processor{},
+		Capacity: cfg.RefillTokens(),
+	})
+
+	doRequest(r, "") // Drain the bucket
+	doRequest(r, "")
+	if w := doRequest(r, paymentHeaderFor(testWallet)); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 after payment, got %d", w.Code)
+	}
+
+	// One payment grants 3x capacity; the paid request doesn't spend a token
+	if avail, _ := limiter.Available(""); avail < 5.99 || avail > 6.01 {
+		t.Errorf("Expected 3 x capacity 2 = 6 tokens after payment, got %.2f", avail)
+	}
+}
+
+func TestHybridMiddleware_MinPaymentInterval(t *testing.T) {
+	processor := &paymenttest.Processor{}
+	r := newTestRouter(hybridConfig{
+		Limiter:            memory.NewTokenBucket(1, 0.001),
+		Payments:           processor,
+		Capacity:           1,
+		TrustTracker:       trust.New(trust.Config{}),
+		MinPaymentInterval: time.Minute,
+	})
+
+	doRequest(r, "") // Drain the bucket
+	if w := doRequest(r, paymentHeaderFor(testWallet)); w.Code != http.StatusOK {
+		t.Fatalf("Expected first payment to be served, got %d", w.Code)
+	}
+	doRequest(r, "") // Spend the refilled token
+
+	w := doRequest(r, paymentHeaderFor(testWallet))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected rapid repeat payment to get 429, got %d", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "60" && got != "59" {
+		t.Errorf("Expected Retry-After of about 60s, got %q", got)
+	}
+	if !strings.Contains(w.Body.String(), "Payment too soon") {
+		t.Errorf("Expected a clear error message, got %s", w.Body.String())
+	}
+	if _, settle := processor.Calls(); settle != 1 {
+		t.Errorf("Expected the refused payment not to settle, got %d settlements", settle)
+	}
+
+	// Other wallets aren't held back
+	const other = "0x2222222222222222222222222222222222222222"
+	if w := doRequest(r, paymentHeaderFor(other)); w.Code != http.StatusOK {
+		t.Errorf("Expected another wallet's payment to be served, got %d", w.Code)
+	}
+}
+
+func TestHybridMiddleware_MinPaymentIntervalIgnoresUnverified(t *testing.T) {
+	processor := &paymenttest.Processor{RejectPay: true}
+	tracker := trust.New(trust.Config{})
+	r := newTestRouter(hybridConfig{
+		Limiter:            memory.NewTokenBucket(1, 0.001),
+		Payments:           processor,
+		Capacity:           1,
+		TrustTracker:       tracker,
+		MinPaymentInterval: time.Minute,
+	})
+
+	// A forged payment naming the wallet must not lock it out
+	doRequest(r, "")
+	doRequest(r, paymentHeaderFor(testWallet))
+	if _, ok := tracker.ReservePayment(testWallet, time.Minute); !ok {
+		t.Error("Expected an unverified payment not to start the wallet's interval")
+	}
+}
+
+func TestHybridMiddleware_NotReadyUntilRedisStarts(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to reserve a port: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	client := goredis.NewClient(&goredis.Options{Addr: addr, MaxRetries: -1})
+	defer client.Close()
+	r := newTestRouter(hybridConfig{
+		Limiter:  ratelimitredis.NewTokenBucket(ratelimitredis.Config{Client: client, Capacity: 5, RefillRate: 1}),
+		Payments: &paymenttest.Processor{},
+		Capacity: 5,
+	})
+
+	w := doRequest(r, "")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 before Redis is up, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Expected Retry-After on 503")
+	}
+
+	mr := miniredis.NewMiniRedis()
+	if err := mr.StartAddr(addr); err != nil {
+		t.Fatalf("Failed to start miniredis: %v", err)
+	}
+	defer mr.Close()
+
+	if w := doRequest(r, ""); w.Code != http.StatusOK {
+		t.Errorf("Expected 200 once Redis is up, got %d", w.Code)
+	}
+}
+
+func TestHybridMiddleware_DryRun(t *testing.T) {
+	processor := &paymenttest.Processor{}
+	events := newEventHub()
+	sub, unsubscribe := events.Subscribe()
+	defer unsubscribe()
+
+	r := newTestRouter(hybridConfig{
+		Limiter:  memory.NewTokenBucket(1, 0.001),
+		Payments: processor,
+		Capacity: 1,
+		DryRun:   true,
+		Events:   events,
+	})
+
+	w := doRequest(r, "")
+	if got := w.Header().Get(middleware.DryRunHeader); got != middleware.DryRunAllow {
+		t.Errorf("Expected dry-run decision %q, got %q", middleware.DryRunAllow, got)
+	}
+
+	// The bucket is empty, but the request still passes through
+	w = doRequest(r, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected dry run to serve an over-limit request, got %d", w.Code)
+	}
+	if got := w.Header().Get(middleware.DryRunHeader); got != middleware.DryRunDeny {
+		t.Errorf("Expected dry-run decision %q, got %q", middleware.DryRunDeny, got)
+	}
+	if got := w.Header().Get("X-Served-Via"); got != "dry-run" {
+		t.Errorf("Expected X-Served-Via dry-run, got %q", got)
+	}
+	if verify, _ := processor.Calls(); verify != 0 {
+		t.Errorf("Expected no payment processing in dry run, got %d calls", verify)
+	}
+
+	<-sub // request_allowed
+	if ev := <-sub; ev.Type != eventRequestDenied || !ev.DryRun {
+		t.Errorf("Expected a dry-run request_denied event, got %+v", ev)
+	}
+}
+
+// notReadyLimiter is a limiter whose backend is never reached.
+type notReadyLimiter struct{ ratelimit.Limiter }
+
+func (notReadyLimiter) Ready() bool { return false }
+
+func TestHybridMiddleware_DryRunNeverAborts(t *testing.T) {
+	processor := &paymenttest.Processor{}
+	r := newTestRouter(hybridConfig{
+		Limiter:  memory.NewTokenBucket(1, 0.001),
+		Payments: processor,
+		Mode:     config.ModePaidOnly,
+		DryRun:   true,
+	})
+
+	// Paid-only would ask for payment
+	w := doRequest(r, "")
+	if w.Code != http.StatusOK || w.Header().Get(middleware.DryRunHeader) != middleware.DryRunDeny {
+		t.Errorf("Expected a would-be 402 served and tagged deny, got %d %q", w.Code, w.Header().Get(middleware.DryRunHeader))
+	}
+
+	// A payment is neither verified nor settled
+	w = doRequest(r, paymentHeaderFor(testWallet))
+	if w.Code != http.StatusOK || w.Header().Get(middleware.DryRunHeader) != middleware.DryRunAllow {
+		t.Errorf("Expected a paid request served and tagged allow, got %d %q", w.Code, w.Header().Get(middleware.DryRunHeader))
+	}
+	if verify, settle := processor.Calls(); verify != 0 || settle != 0 {
+		t.Errorf("Expected no payment processing in dry run, got %d verifies and %d settles", verify, settle)
+	}
+
+	// Nor does a limiter that isn't ready answer 503
+	r = newTestRouter(hybridConfig{
+		Limiter:  notReadyLimiter{memory.NewTokenBucket(1, 0.001)},
+		Payments: processor,
+		Capacity: 1,
+		DryRun:   true,
+	})
+	if w := doRequest(r, ""); w.Code != http.StatusOK || w.Header().Get(middleware.DryRunHeader) != middleware.DryRunDeny {
+		t.Errorf("Expected a would-be 503 served and tagged deny, got %d", w.Code)
+	}
+}
+
+func TestHybridMiddleware_OptimisticCapacity(t *testing.T) {
+	tracker := trust.New(trust.Config{Threshold: 1})
+	processor := &paymenttest.Processor{}
+	sq := NewSettlementQueue(processor, tracker, 10)
+	defer sq.Close()
+
+	limiter := memory.NewTokenBucket(2, 0.001)
+	r := newTestRouter(hybridConfig{
+		Limiter:            limiter,
+		Payments:           processor,
+		Capacity:           2,
+		OptimisticCapacity: 5,
+		TrustTracker:       tracker,
+		SettlementQueue:    sq,
+	})
+
+	// Untrusted wallet: a sync payment grants the regular capacity
+	limiter.Drain("")
+	if got := doRequest(r, paymentHeaderFor(testWallet)).Header().Get("X-Served-Via"); got != "paid-sync" {
+		t.Fatalf("Expected paid-sync, got %q", got)
+	}
+	if avail, _ := limiter.Available(""); avail < 1.99 || avail > 2.01 {
+		t.Errorf("Expected sync payment to grant 2 tokens, got %.2f", avail)
+	}
+
+	// Trusted now: the optimistic payment grants the larger burst
+	limiter.Drain("")
+	if got := doRequest(r, paymentHeaderFor(testWallet)).Header().Get("X-Served-Via"); got != "paid-optimistic" {
+		t.Fatalf("Expected paid-optimistic, got %q", got)
+	}
+	if avail, _ := limiter.Available(""); avail < 4.99 || avail > 5.01 {
+		t.Errorf("Expected optimistic payment to grant 5 tokens, got %.2f", avail)
+	}
+}
+
+func TestHybridMiddleware_GraceOverage(t *testing.T) {
+	limiter := memory.NewTokenBucketWithConfig(memory.Config{Capacity: 2, RefillRate: 0.001, GraceOverage: 2})
+	r := newTestRouter(hybridConfig{
+		Limiter:  limiter,
+		Payments: &paymenttest.Processor{},
+		Capacity: 2,
+	})
+
+	// The bucket's 2 tokens, then 2 more on grace, before payment is asked for
+	for i := 0; i < 4; i++ {
+		if w := doRequest(r, ""); w.Code != http.StatusOK {
+			t.Fatalf("Request %d: expected 200, got %d", i+1, w.Code)
+		}
+	}
+	if w := doRequest(r, ""); w.Code != http.StatusPaymentRequired {
+		t.Fatalf("Expected 402 once the grace is spent, got %d", w.Code)
+	}
+	if w := doRequest(r, paymentHeaderFor(testWallet)); w.Code != http.StatusOK {
+		t.Fatalf("Expected payment to be accepted, got %d", w.Code)
+	}
+}
+
+func TestHybridMiddleware_WalletSpending(t *testing.T) {
+	tracker := trust.New(trust.Config{Threshold: 1})
+	processor := &paymenttest.Processor{}
+	sq := NewSettlementQueue(processor, tracker, 10)
+	sq.SetSpacing(0)
+
+	limiter := memory.NewTokenBucket(2, 0.001)
+	r := newTestRouter(hybridConfig{
+		Limiter:            limiter,
+		Payments:           processor,
+		Capacity:           2,
+		OptimisticCapacity: 5,
+		TrustTracker:       tracker,
+		SettlementQueue:    sq,
+	})
+
+	// One sync payment granting 2 tokens, then two optimistic ones granting 5
+	for i := 0; i < 3; i++ {
+		limiter.Drain("")
+		if w := doRequest(r, paymentHeaderFor(testWallet)); w.Code != http.StatusOK {
+			t.Fatalf("Payment %d: expected 200, got %d", i+1, w.Code)
+		}
+	}
+	sq.Close() // Optimistic payments count once they settle
+
+	stats := tracker.WalletStats(testWallet)
+	if stats.Payments != 3 {
+		t.Errorf("Expected 3 payments, got %d", stats.Payments)
+	}
+	if stats.TokensGranted < 11.99 || stats.TokensGranted > 12.01 {
+		t.Errorf("Expected 12 tokens granted, got %.2f", stats.TokensGranted)
+	}
+	if stats.AmountPaid != "3000" {
+		t.Errorf("Expected 3000 atomic units paid, got %s", stats.AmountPaid)
+	}
+}
+
+func TestHybridMiddleware_RequestCost(t *testing.T) {
+	limiter := memory.NewTokenBucket(10, 0.001)
+	r := newTestRouter(hybridConfig{
+		Limiter:  limiter,
+		Payments: &paymenttest.Processor{},
+		Capacity: 10,
+		Cost:     middleware.ContentLengthCost(1024),
+		MaxCost:  10,
+	})
+
+	send := func(body string) int {
+		req := httptest.NewRequest(http.MethodGet, "/cpu", strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// A small body costs one token
+	if code := send("small"); code != http.StatusOK {
+		t.Fatalf("Expected small request to be served, got %d", code)
+	}
+	if avail, _ := limiter.Available(""); avail < 8.99 || avail > 9.01 {
+		t.Errorf("Expected small request to cost 1 token, %.2f left", avail)
+	}
+
+	// A 4KB upload costs four
+	if code := send(strings.Repeat("x", 4*1024)); code != http.StatusOK {
+		t.Fatalf("Expected upload to be served, got %d", code)
+	}
+	if avail, _ := limiter.Available(""); avail < 4.99 || avail > 5.01 {
+		t.Errorf("Expected upload to cost 4 tokens, %.2f left", avail)
+	}
+
+	// One that costs more than is left is refused
+	if code := send(strings.Repeat("x", 6*1024)); code != http.StatusPaymentRequired {
+		t.Errorf("Expected 402 for an upload costing more than the balance, got %d", code)
+	}
+}
+
+func TestHybridMiddleware_PayPerRequest(t *testing.T) {
+	processor := &paymenttest.Processor{}
+	limiter := memory.NewTokenBucket(2, 0.001)
+	r := newTestRouter(hybridConfig{
+		Limiter:       limiter,
+		Payments:      processor,
+		Capacity:      2,
+		PayPerRequest: true,
+	})
+
+	// The free tier is served from the bucket
+	for i := 0; i < 2; i++ {
+		if w := doRequest(r, ""); w.Code != http.StatusOK {
+			t.Fatalf("Request %d: expected 200 from bucket, got %d", i+1, w.Code)
+		}
+	}
+
+	// Each over-limit request is paid for on its own, with no burst left over
+	for i := 0; i < 3; i++ {
+		if w := doRequest(r, paymentHeaderFor(testWallet)); w.Code != http.StatusOK {
+			t.Fatalf("Paid request %d: expected 200, got %d", i+1, w.Code)
+		}
+		if avail, _ := limiter.Available(""); avail > 0.01 {
+			t.Errorf("Paid request %d: expected no tokens granted, got %.2f", i+1, avail)
+		}
+		if w := doRequest(r, ""); w.Code != http.StatusPaymentRequired {
+			t.Errorf("Expected 402 right after paid request %d, got %d", i+1, w.Code)
+		}
+	}
+	if _, settle := processor.Calls(); settle != 3 {
+		t.Errorf("Expected one settlement per paid request, got %d", settle)
+	}
+}
+
+func TestHybridMiddleware_PayPerRequestOptimistic(t *testing.T) {
+	tracker := trust.New(trust.Config{Threshold: 1})
+	processor := &paymenttest.Processor{}
+	sq := NewSettlementQueue(processor, tracker, 10)
+	defer sq.Close()
+
+	limiter := memory.NewTokenBucket(2, 0.001)
+	limiter.Drain("")
+	tracker.RecordSuccess(testWallet)
+	r := newTestRouter(hybridConfig{
+		Limiter:         limiter,
+		Payments:        processor,
+		Capacity:        2,
+		TrustTracker:    tracker,
+		SettlementQueue: sq,
+		PayPerRequest:   true,
+	})
+
+	// A trusted wallet skips settlement latency but still gets no burst
+	if got := doRequest(r, paymentHeaderFor(testWallet)).Header().Get("X-Served-Via"); got != "paid-optimistic" {
+		t.Fatalf("Expected paid-optimistic, got %q", got)
+	}
+	if avail, _ := limiter.Available(""); avail > 0.01 {
+		t.Errorf("Expected no tokens granted, got %.2f", avail)
+	}
+	if w := doRequest(r, ""); w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected 402 for the next unpaid request, got %d", w.Code)
+	}
+}
+
+func TestHybridMiddleware_DeclineUnneeded(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		decline bool
+		via     string
+		settles int
+	}{
+		{"decline-if-unneeded", true, servedFree, 0},
+		{"always-settle", false, servedPaidSync, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := ratelimittest.NewFakeClock()
+			limiter := memory.NewTokenBucketWithConfig(memory.Config{Capacity: 2, RefillRate: 1, Clock: clock})
+			limiter.Drain("")
+
+			// The bucket refills while the payment is being verified
+			processor := &paymenttest.Processor{OnVerify: func() { clock.Advance(2 * time.Second) }}
+			r := newTestRouter(hybridConfig{
+				Limiter:         limiter,
+				Payments:        processor,
+				Capacity:        2,
+				DeclineUnneeded: tc.decline,
+			})
+
+			w := doRequest(r, paymentHeaderFor(testWallet))
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected 200, got %d", w.Code)
+			}
+			if via := w.Header().Get(servedViaHeader); via != tc.via {
+				t.Errorf("Expected %s=%s, got %q", servedViaHeader, tc.via, via)
+			}
+			if _, settle := processor.Calls(); settle != tc.settles {
+				t.Errorf("Expected %d settlements, got %d", tc.settles, settle)
+			}
+		})
+	}
+}
+
+func TestHybridMiddleware_DeclineUnneededStillSettlesWhenNeeded(t *testing.T) {
+	processor := &paymenttest.Processor{}
+	limiter := memory.NewTokenBucket(2, 0.001)
+	limiter.Drain("")
+	r := newTestRouter(hybridConfig{
+		Limiter:         limiter,
+		Payments:        processor,
+		Capacity:        2,
+		DeclineUnneeded: true,
+	})
+
+	w := doRequest(r, paymentHeaderFor(testWallet))
+	if w.Code != http.StatusOK || w.Header().Get(servedViaHeader) != servedPaidSync {
+		t.Fatalf("Expected a settled paid request, got %d via %q", w.Code, w.Header().Get(servedViaHeader))
+	}
+	if _, settle := processor.Calls(); settle != 1 {
+		t.Errorf("Expected the payment settled, got %d settlements", settle)
+	}
+}
+
+func TestHybridMiddleware_SettlementHeader(t *testing.T) {
+	tracker := trust.New(trust.Config{Threshold: 1})
+	processor := &paymenttest.Processor{}
+	sq := NewSettlementQueue(processor, tracker, 10)
+	defer sq.Close()
+
+	limiter := memory.NewTokenBucket(1, 0.001)
+	limiter.Drain("")
+	r := newTestRouter(hybridConfig{
+		Limiter:         limiter,
+		Payments:        processor,
+		Capacity:        1,
+		TrustTracker:    tracker,
+		SettlementQueue: sq,
+	})
+
+	// Served from the bucket: nothing was paid
+	limiter.Refill("", 1)
+	if w := doRequest(r, ""); w.Header().Get(settlementHeader) != "" {
+		t.Errorf("Expected no %s on a free request, got %q", settlementHeader, w.Header().Get(settlementHeader))
+	}
+
+	// An untrusted wallet settles synchronously and gets the transaction
+	w := doRequest(r, paymentHeaderFor(testWallet))
+	if got := w.Header().Get(settlementHeader); got != "eip155:84532:0xtx" {
+		t.Errorf("Expected %s of eip155:84532:0xtx on a settled request, got %q", settlementHeader, got)
+	}
+
+	// Now trusted, the next payment is settled later
+	limiter.Drain("")
+	w = doRequest(r, paymentHeaderFor(testWallet))
+	if via := w.Header().Get(servedViaHeader); via != servedOptimistic {
+		t.Fatalf("Expected the optimistic path, got %q", via)
+	}
+	if got := w.Header().Get(settlementHeader); got != "eip155:84532:pending" {
+		t.Errorf("Expected %s of eip155:84532:pending on an optimistic request, got %q", settlementHeader, got)
+	}
+}
+
+func TestHybridMiddleware_TrustKey(t *testing.T) {
+	tracker := trust.New(trust.Config{Threshold: 1})
+	processor := &paymenttest.Processor{}
+	sq := NewSettlementQueue(processor, tracker, 10)
+	defer sq.Close()
+
+	limiter := memory.NewTokenBucket(1, 0.001)
+	r := newTestRouter(hybridConfig{
+		Limiter:         limiter,
+		Payments:        processor,
+		Capacity:        1,
+		TrustTracker:    tracker,
+		SettlementQueue: sq,
+		TrustKey: func(payload x402.PaymentPayload, reqCtx x402http.HTTPRequestContext) string {
+			wallet, _ := extractWalletAddress(reqCtx.PaymentHeader)
+			return reqCtx.Adapter.GetHeader("X-Api-Key") + "/" + wallet
+		},
+	})
+	payWithKey := func(apiKey string) string {
+		limiter.Drain("")
+		req := httptest.NewRequest(http.MethodGet, "/cpu", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("PAYMENT-SIGNATURE", paymentHeaderFor(testWallet))
+		req.Header.Set("X-Api-Key", apiKey)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Header().Get(servedViaHeader)
+	}
+
+	if via := payWithKey("alpha"); via != servedPaidSync {
+		t.Fatalf("Expected an unknown identity on the sync path, got %q", via)
+	}
+	if !tracker.IsTrusted("alpha/" + testWallet) {
+		t.Error("Expected trust to accrue to the composite key")
+	}
+	if tracker.RecentPayments(testWallet) != 0 {
+		t.Error("Expected nothing recorded against the bare wallet")
+	}
+
+	if via := payWithKey("alpha"); via != servedOptimistic {
+		t.Errorf("Expected the trusted identity on the optimistic path, got %q", via)
+	}
+	if via := payWithKey("beta"); via != servedPaidSync {
+		t.Errorf("Expected the same wallet under another API key on the sync path, got %q", via)
+	}
+}
+
+func TestHybridMiddleware_MaxTrustedKeepsNewWalletSync(t *testing.T) {
+	const otherWallet = "0x2222222222222222222222222222222222222222"
+	tracker := trust.New(trust.Config{Threshold: 1, MaxTrusted: 1})
+	processor := &paymenttest.Processor{}
+	sq := NewSettlementQueue(processor, tracker, 10)
+	defer sq.Close()
+
+	limiter := memory.NewTokenBucket(1, 0.001)
+	r := newTestRouter(hybridConfig{
+		Limiter:         limiter,
+		Payments:        processor,
+		Capacity:        1,
+		TrustTracker:    tracker,
+		SettlementQueue: sq,
+	})
+
+	// Both wallets qualify, but testWallet takes the only slot first
+	tracker.RecordSuccess(testWallet)
+	tracker.RecordSuccess(otherWallet)
+	limiter.Drain("")
+	if via := doRequest(r, paymentHeaderFor(testWallet)).Header().Get(servedViaHeader); via != servedOptimistic {
+		t.Fatalf("Expected the slot holder on the optimistic path, got %q", via)
+	}
+
+	limiter.Drain("")
+	if via := doRequest(r, paymentHeaderFor(otherWallet)).Header().Get(servedViaHeader); via != servedPaidSync {
+		t.Errorf("Expected the capped-out wallet on the sync path, got %q", via)
+	}
+}
+
+func TestHybridMiddleware_Branches(t *testing.T) {
+	tests := []struct {
+		name       string
+		processor  *paymenttest.Processor
+		drain      bool
+		payment    bool
+		setup      func(tracker *trust.Tracker)
+		wantStatus int
+		wantVia    string
+		wantVerify int
+		wantSettle int
+	}{
+		{name: "tokens available", processor: &paymenttest.Processor{}, wantStatus: http.StatusOK, wantVia: servedFree},
+		{name: "no payment", processor: &paymenttest.Processor{}, drain: true, wantStatus: http.StatusPaymentRequired},
+		{name: "verification fails", processor: &paymenttest.Processor{RejectPay: true}, drain: true, payment: true,
+			wantStatus: http.StatusPaymentRequired, wantVerify: 1},
+		{name: "settlement fails", processor: &paymenttest.Processor{FailSettle: "insufficient_funds"}, drain: true, payment: true,
+			wantStatus: http.StatusPaymentRequired, wantVerify: 1, wantSettle: 1},
+		{name: "settled synchronously", processor: &paymenttest.Processor{}, drain: true, payment: true,
+			wantStatus: http.StatusOK, wantVia: servedPaidSync, wantVerify: 1, wantSettle: 1},
+		{name: "trusted wallet", processor: &paymenttest.Processor{Block: make(chan struct{})}, drain: true, payment: true,
+			setup:      func(tracker *trust.Tracker) { tracker.RecordSuccess(testWallet) },
+			wantStatus: http.StatusOK, wantVia: servedOptimistic, wantVerify: 1},
+		{name: "blocked wallet", processor: &paymenttest.Processor{}, drain: true, payment: true,
+			setup:      func(tracker *trust.Tracker) { tracker.Block(testWallet) },
+			wantStatus: http.StatusForbidden},
+		{name: "payment too soon", processor: &paymenttest.Processor{}, drain: true, payment: true,
+			setup:      func(tracker *trust.Tracker) { tracker.ReservePayment(testWallet, time.Minute) },
+			wantStatus: http.StatusTooManyRequests, wantVerify: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := trust.New(trust.Config{Threshold: 1})
+			sq := NewSettlementQueue(tt.processor, tracker, 10)
+			defer sq.Close()
+			if tt.processor.Block != nil {
+				defer close(tt.processor.Block) // Holds the queued settlement out of the counts
+			}
+			if tt.setup != nil {
+				tt.setup(tracker)
+			}
+
+			limiter := memory.NewTokenBucket(1, 0.001)
+			if tt.drain {
+				limiter.Drain("")
+			}
+			r := newTestRouter(hybridConfig{
+				Limiter:            limiter,
+				Payments:           tt.processor,
+				Capacity:           1,
+				TrustTracker:       tracker,
+				SettlementQueue:    sq,
+				MinPaymentInterval: time.Minute,
+			})
+
+			header := ""
+			if tt.payment {
+				header = paymentHeaderFor(testWallet)
+			}
+			w := doRequest(r, header)
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if via := w.Header().Get(servedViaHeader); via != tt.wantVia {
+				t.Errorf("Expected %s=%q, got %q", servedViaHeader, tt.wantVia, via)
+			}
+			if verify, settle := tt.processor.Calls(); verify != tt.wantVerify || settle != tt.wantSettle {
+				t.Errorf("Expected %d verifications and %d settlements, got %d and %d",
+					tt.wantVerify, tt.wantSettle, verify, settle)
+			}
+		})
+	}
+}
+
+func TestHybridMiddleware_PaymentRequiredReportsBalance(t *testing.T) {
+	limiter := memory.NewTokenBucket(4, 0.001)
+	r := newTestRouter(hybridConfig{
+		Limiter:        limiter,
+		Payments:       &paymenttest.Processor{},
+		Capacity:       6,
+		BucketCapacity: 4,
+	})
+
+	for i := 0; i < 4; i++ {
+		doRequest(r, "")
+	}
+	w := doRequest(r, "")
+	if w.Code != http.StatusPaymentRequired {
+		t.Fatalf("Expected 402 once the bucket is exhausted, got %d", w.Code)
+	}
+
+	var body struct {
+		X402Version        int      `json:"x402Version"`
+		CurrentTokens      *float64 `json:"current_tokens"`
+		Capacity           *float64 `json:"capacity"`
+		TokensAfterPayment *float64 `json:"tokens_after_payment"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Invalid 402 body: %v", err)
+	}
+	if body.X402Version != 2 {
+		t.Errorf("Expected the x402 requirements kept, got %s", w.Body.String())
+	}
+	if body.CurrentTokens == nil || body.Capacity == nil || body.TokensAfterPayment == nil {
+		t.Fatalf("Expected balance fields in the 402 body, got %s", w.Body.String())
+	}
+	if *body.CurrentTokens < 0 || *body.CurrentTokens > 0.01 {
+		t.Errorf("Expected current_tokens near 0, got %.4f", *body.CurrentTokens)
+	}
+	if *body.Capacity != 4 {
+		t.Errorf("Expected capacity 4, got %g", *body.Capacity)
+	}
+	if got := *body.TokensAfterPayment - *body.CurrentTokens; math.Abs(got-6) > 1e-9 {
+		t.Errorf("Expected tokens_after_payment to add the 6 refill tokens, got %.4f more", got)
+	}
+}
+
+func TestHybridMiddleware_PaymentRequiredBalanceOptional(t *testing.T) {
+	limiter := memory.NewTokenBucket(1, 0.001)
+	limiter.Drain("")
+	r := newTestRouter(hybridConfig{Limiter: limiter, Payments: &paymenttest.Processor{}, Capacity: 1})
+
+	w := doRequest(r, "")
+	if strings.Contains(w.Body.String(), "current_tokens") {
+		t.Errorf("Expected no balance fields without BucketCapacity, got %s", w.Body.String())
+	}
+}
+
+func TestHybridMiddleware_SettlementFailureClass(t *testing.T) {
+	tests := []struct {
+		reason        string
+		wantRetryable bool
+		wantBlocked   bool
+	}{
+		{"invalid_exact_evm_transaction_failed", true, false},
+		{"invalid_exact_evm_insufficient_balance", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.reason, func(t *testing.T) {
+			tracker := trust.New(trust.Config{Threshold: 10})
+			tracker.RecordSuccess(testWallet)
+			limiter := memory.NewTokenBucket(1, 0.001)
+			limiter.Allow("192.0.2.1")
+			r := newTestRouter(hybridConfig{
+				Limiter:           limiter,
+				Payments:          &paymenttest.Processor{FailSettle: tt.reason},
+				Capacity:          1,
+				TrustTracker:      tracker,
+				BlockUnsettleable: true,
+			})
+
+			w := doRequest(r, paymentHeaderFor(testWallet))
+			if w.Code != http.StatusPaymentRequired {
+				t.Fatalf("Expected 402 for a failed settlement, got %d", w.Code)
+			}
+			var body struct {
+				Reason    string `json:"reason"`
+				Retryable bool   `json:"retryable"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("Failed to decode body: %v", err)
+			}
+			if body.Reason != tt.reason || body.Retryable != tt.wantRetryable {
+				t.Errorf("Expected reason %q retryable=%v, got %+v", tt.reason, tt.wantRetryable, body)
+			}
+			if got := tracker.IsBlocked(testWallet); got != tt.wantBlocked {
+				t.Errorf("Expected blocked=%v, got %v", tt.wantBlocked, got)
+			}
+			if kept := tracker.RecentPayments(testWallet) == 1; kept != tt.wantRetryable {
+				t.Errorf("Expected trust history kept=%v, got %v", tt.wantRetryable, kept)
+			}
+		})
+	}
+}
+
+func TestHybridMiddleware_RoutePolicies(t *testing.T) {
+	processor := &paymenttest.Processor{}
+	limiter := memory.NewTokenBucket(1, 0.001)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(hybridRateLimitPaymentMiddleware(hybridConfig{
+		Limiter:       limiter,
+		Payments:      processor,
+		Capacity:      1,
+		RoutePolicies: map[string]string{"/free": config.RoutePolicyFree, "/paid/:id": config.RoutePolicyPaid},
+	}))
+	for _, path := range []string{"/free", "/paid/:id"} {
+		r.GET(path, func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"ok": true}) })
+	}
+	get := func(path, paymentHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		if paymentHeader != "" {
+			req.Header.Set("PAYMENT-SIGNATURE", paymentHeader)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// A paid route asks for payment even with tokens in the bucket
+	if w := get("/paid/1", ""); w.Code != http.StatusPaymentRequired {
+		t.Fatalf("Expected 402 from the paid route, got %d", w.Code)
+	}
+	if w := get("/paid/1", paymentHeaderFor(testWallet)); w.Code != http.StatusOK {
+		t.Fatalf("Expected a paid request to be served, got %d", w.Code)
+	}
+	if verify, settle := processor.Calls(); verify != 1 || settle != 1 {
+		t.Fatalf("Expected one payment processed, got %d verify / %d settle", verify, settle)
+	}
+
+	// A free route serves from the bucket, then rate limits without ever
+	// asking for or taking payment
+	if w := get("/free", ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected the free route to serve from the bucket, got %d", w.Code)
+	}
+	for _, header := range []string{"", paymentHeaderFor(testWallet)} {
+		w := get("/free", header)
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("Expected 429 from the exhausted free route (payment attached: %v), got %d", header != "", w.Code)
+		}
+		if w.Header().Get("Retry-After") == "" {
+			t.Error("Expected Retry-After on the free route's 429")
+		}
+	}
+	if verify, _ := processor.Calls(); verify != 1 {
+		t.Errorf("Expected the free route never to verify a payment, got %d verify calls", verify)
+	}
+}
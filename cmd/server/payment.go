@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+
+	x402 "github.com/coinbase/x402/go"
+	x402http "github.com/coinbase/x402/go/http"
+	"github.com/coinbase/x402/go/mechanisms/evm"
+	evmserver "github.com/coinbase/x402/go/mechanisms/evm/exact/server"
+
+	"github.com/haseeb/ratelimiter/internal/config"
+)
+
+// paymentNetwork is the CAIP-2 network payments are accepted on (Base Sepolia).
+const paymentNetwork = "eip155:84532"
+
+// paymentPrice returns the advertised price of one capacity refill as an
+// explicit asset amount, so clients see the configured token and decimals
+// rather than the scheme's implied default. The config must be validated.
+func paymentPrice(p config.PaymentConfig) (x402.Price, error) {
+	asset := p.AssetAddress
+	if asset == "" {
+		netCfg, err := evm.GetNetworkConfig(paymentNetwork)
+		if err != nil {
+			return nil, err
+		}
+		asset = netCfg.DefaultAsset.Address
+	}
+
+	amount, err := atomicAmount(p.PricePerCapacity, p.Decimals)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"amount": amount.String(),
+		"asset":  asset,
+		"extra":  map[string]interface{}{"name": p.Currency},
+	}, nil
+}
+
+// paymentTrustUnit returns the payment amount, in atomic units, that counts as
+// one success toward trust, or nil to count every payment once.
+func paymentTrustUnit(p config.PaymentConfig) (*big.Int, error) {
+	if p.Optimistic.TrustUnitPrice == "" {
+		return nil, nil
+	}
+	return atomicAmount(p.Optimistic.TrustUnitPrice, p.Decimals)
+}
+
+// atomicAmount converts a decimal price such as "$0.001" to the token's
+// atomic units.
+func atomicAmount(price string, decimals int) (*big.Int, error) {
+	amount, err := evm.ParseAmount(strings.TrimPrefix(strings.TrimSpace(price), "$"), decimals)
+	if err != nil {
+		return nil, fmt.Errorf("price %q: %w", price, err)
+	}
+	return amount, nil
+}
+
+// payTo returns the PayTo of a payment option: the address itself for a
+// single wallet, or a rotation across several.
+func payTo(p config.PaymentConfig) interface{} {
+	wallets := p.Wallets()
+	if len(wallets) == 1 {
+		return wallets[0].Address
+	}
+	return x402http.DynamicPayToFunc(newPayToRotation(wallets).resolve)
+}
+
+// payToRotation spreads advertised payments across receiving wallets by
+// smooth weighted round-robin: a wallet with weight 2 of 3 is advertised on
+// two of every three 402s, interleaved with the others rather than in a run.
+type payToRotation struct {
+	mu      sync.Mutex
+	wallets []config.PayToConfig
+	current []int // Running scores; the highest is advertised next
+	total   int
+}
+
+func newPayToRotation(wallets []config.PayToConfig) *payToRotation {
+	r := &payToRotation{current: make([]int, len(wallets))}
+	for _, w := range wallets {
+		if w.Weight <= 0 {
+			w.Weight = 1
+		}
+		r.wallets = append(r.wallets, w)
+		r.total += w.Weight
+	}
+	return r
+}
+
+// next returns the address to advertise on the next 402.
+func (r *payToRotation) next() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	best := 0
+	for i, w := range r.wallets {
+		r.current[i] += w.Weight
+		if r.current[i] > r.current[best] {
+			best = i
+		}
+	}
+	r.current[best] -= r.total
+	return r.wallets[best].Address
+}
+
+// resolve is an x402http.DynamicPayToFunc. A request carrying a payment made
+// out to one of the wallets resolves to that wallet, so the payment verifies
+// and settles against the address its 402 advertised; any other request
+// advances the rotation.
+func (r *payToRotation) resolve(ctx context.Context, reqCtx x402http.HTTPRequestContext) (string, error) {
+	if addr := paidTo(reqCtx.PaymentHeader); addr != "" {
+		for _, w := range r.wallets {
+			if strings.EqualFold(w.Address, addr) {
+				return w.Address, nil
+			}
+		}
+	}
+	return r.next(), nil
+}
+
+// paidTo returns the address a payment header's accepted requirements pay,
+// or "" if there is none.
+func paidTo(paymentHeader string) string {
+	if paymentHeader == "" {
+		return ""
+	}
+	decoded, ok := decodePaymentHeader(paymentHeader)
+	if !ok {
+		return ""
+	}
+	var payment struct {
+		Accepted struct {
+			PayTo string `json:"payTo"`
+		} `json:"accepted"`
+	}
+	if err := json.Unmarshal(decoded, &payment); err != nil {
+		return ""
+	}
+	return payment.Accepted.PayTo
+}
+
+// newPaymentServer builds the x402 HTTP server that advertises and processes
+// payments for GET /cpu. Call Initialize before use.
+func newPaymentServer(p config.PaymentConfig, facilitator x402.FacilitatorClient) (*x402http.HTTPServer, error) {
+	price, err := paymentPrice(p)
+	if err != nil {
+		return nil, err
+	}
+
+	// Configure X402 payment options for when rate limit is exceeded
+	paymentOptions := x402http.PaymentOptions{
+		{
+			Scheme:  "exact",
+			Price:   price,
+			Network: paymentNetwork,
+			PayTo:   payTo(p),
+		},
+	}
+
+	// Create X402 resource server for payment processing
+	server := x402.Newx402ResourceServer(
+		x402.WithFacilitatorClient(facilitator),
+	).Register(paymentNetwork, evmserver.NewExactEvmScheme())
+
+	routes := x402http.RoutesConfig{
+		"GET /cpu": {
+			Accepts:     paymentOptions,
+			Description: "CPU utilization endpoint - pay to refill rate limit",
+			MimeType:    "application/json",
+		},
+	}
+	return x402http.Wrappedx402HTTPResourceServer(routes, server), nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	x402 "github.com/coinbase/x402/go"
+	x402http "github.com/coinbase/x402/go/http"
+	"github.com/gin-gonic/gin"
+
+	"github.com/haseeb/ratelimiter/internal/config"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/memory"
+)
+
+// fakeFacilitator advertises support for the exact scheme on paymentNetwork.
+type fakeFacilitator struct{}
+
+func (fakeFacilitator) Verify(ctx context.Context, payloadBytes, requirementsBytes []byte) (*x402.VerifyResponse, error) {
+	return &x402.VerifyResponse{IsValid: true}, nil
+}
+
+func (fakeFacilitator) Settle(ctx context.Context, payloadBytes, requirementsBytes []byte) (*x402.SettleResponse, error) {
+	return &x402.SettleResponse{Success: true}, nil
+}
+
+func (fakeFacilitator) GetSupported(ctx context.Context) (x402.SupportedResponse, error) {
+	return x402.SupportedResponse{
+		Kinds: []x402.SupportedKind{{X402Version: 2, Scheme: "exact", Network: paymentNetwork}},
+	}, nil
+}
+
+// advertisedRequirements returns the payment requirements of a 402 from the
+// hybrid middleware wired to a real x402 server built from p.
+func advertisedRequirements(t *testing.T, p config.PaymentConfig) x402.PaymentRequirements {
+	t.Helper()
+
+	cfg := &config.Config{Payment: p}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Invalid config: %v", err)
+	}
+	server, err := newPaymentServer(cfg.Payment, fakeFacilitator{})
+	if err != nil {
+		t.Fatalf("newPaymentServer: %v", err)
+	}
+	if err := server.Initialize(context.Background()); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+
+	r := newTestRouter(hybridConfig{
+		Limiter:  memory.NewTokenBucket(1, 0.001),
+		Payments: server,
+		Capacity: 1,
+		Mode:     config.ModePaidOnly,
+	})
+	w := doRequest(r, "")
+	if w.Code != http.StatusPaymentRequired {
+		t.Fatalf("Expected 402, got %d", w.Code)
+	}
+	return decodeRequirements(t, w)
+}
+
+// decodeRequirements returns the single payment option advertised by a 402.
+func decodeRequirements(t *testing.T, w *httptest.ResponseRecorder) x402.PaymentRequirements {
+	t.Helper()
+
+	decoded, err := base64.StdEncoding.DecodeString(w.Header().Get("PAYMENT-REQUIRED"))
+	if err != nil {
+		t.Fatalf("Decoding PAYMENT-REQUIRED header: %v", err)
+	}
+	var required struct {
+		Accepts []x402.PaymentRequirements `json:"accepts"`
+	}
+	if err := json.Unmarshal(decoded, &required); err != nil {
+		t.Fatalf("Parsing PAYMENT-REQUIRED header: %v", err)
+	}
+	if len(required.Accepts) != 1 {
+		t.Fatalf("Expected 1 payment option, got %d", len(required.Accepts))
+	}
+	return required.Accepts[0]
+}
+
+func TestPaymentServer_DefaultCurrency(t *testing.T) {
+	reqs := advertisedRequirements(t, config.PaymentConfig{
+		Enabled:          true,
+		WalletAddress:    "0x95eB3EcE2e308eCC51c8498a19cB4D5B5B929675",
+		PricePerCapacity: "0.001",
+	})
+
+	if reqs.Amount != "1000" {
+		t.Errorf("Expected 0.001 USDC = 1000 atomic units, got %s", reqs.Amount)
+	}
+	if reqs.Asset != "0x036CbD53842c5426634e7929541eC2318f3dCF7e" {
+		t.Errorf("Expected Base Sepolia USDC asset, got %s", reqs.Asset)
+	}
+	if reqs.Extra["name"] != "USDC" {
+		t.Errorf("Expected currency USDC, got %v", reqs.Extra["name"])
+	}
+}
+
+func TestPaymentServer_ConfiguredCurrency(t *testing.T) {
+	const asset = "0x1234567890AbcdEF1234567890aBcdef12345678"
+	reqs := advertisedRequirements(t, config.PaymentConfig{
+		Enabled:          true,
+		WalletAddress:    "0x95eB3EcE2e308eCC51c8498a19cB4D5B5B929675",
+		PricePerCapacity: "$0.25",
+		Currency:         "EURC",
+		Decimals:         18,
+		AssetAddress:     asset,
+	})
+
+	if reqs.Amount != "250000000000000000" {
+		t.Errorf("Expected 0.25 at 18 decimals, got %s", reqs.Amount)
+	}
+	if reqs.Asset != asset {
+		t.Errorf("Expected configured asset %s, got %s", asset, reqs.Asset)
+	}
+	if reqs.Extra["name"] != "EURC" {
+		t.Errorf("Expected currency EURC, got %v", reqs.Extra["name"])
+	}
+}
+
+func TestNewServer_CustomPaymentResponse(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := &config.Config{Payment: config.PaymentConfig{
+		Enabled:          true,
+		WalletAddress:    "0x95eB3EcE2e308eCC51c8498a19cB4D5B5B929675",
+		PricePerCapacity: "0.001",
+		Mode:             config.ModePaidOnly,
+	}}
+	cfg.RateLimit.Capacity = 1
+	cfg.RateLimit.RefillRate = 0.001
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Invalid config: %v", err)
+	}
+	server, err := newPaymentServer(cfg.Payment, fakeFacilitator{})
+	if err != nil {
+		t.Fatalf("newPaymentServer: %v", err)
+	}
+	if err := server.Initialize(context.Background()); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+
+	r, err := NewServer(cfg, memory.NewTokenBucket(1, 0.001), server,
+		WithPaymentResponse(func(reqCtx x402http.HTTPRequestContext) (int, map[string]string, any) {
+			return 0, map[string]string{"X-Pay-Here": "https://pay.example.com"}, map[string]any{
+				"paymentUrl": "https://pay.example.com" + reqCtx.Path,
+			}
+		}))
+	if err != nil {
+		t.Fatalf("NewServer error: %v", err)
+	}
+
+	w := doRequest(r, "")
+	if w.Code != http.StatusPaymentRequired {
+		t.Fatalf("Expected 402, got %d", w.Code)
+	}
+	if w.Header().Get("X-Pay-Here") == "" || w.Header().Get("PAYMENT-REQUIRED") == "" {
+		t.Errorf("Expected both custom and PAYMENT-REQUIRED headers, got %v", w.Header())
+	}
+
+	var body struct {
+		PaymentURL  string                     `json:"paymentUrl"`
+		X402Version int                        `json:"x402Version"`
+		Accepts     []x402.PaymentRequirements `json:"accepts"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Parsing body: %v", err)
+	}
+	if body.PaymentURL != "https://pay.example.com/cpu" {
+		t.Errorf("Expected custom paymentUrl field, got %q", body.PaymentURL)
+	}
+	if body.X402Version != 2 || len(body.Accepts) != 1 || body.Accepts[0].Amount != "1000" {
+		t.Errorf("Expected x402 payment requirements in body, got %s", w.Body.String())
+	}
+}
+
+// payToFacilitator is a fakeFacilitator that records the PayTo of each
+// settled payment.
+type payToFacilitator struct {
+	fakeFacilitator
+	settledTo []string
+}
+
+func (f *payToFacilitator) Settle(ctx context.Context, payloadBytes, requirementsBytes []byte) (*x402.SettleResponse, error) {
+	var reqs x402.PaymentRequirements
+	json.Unmarshal(requirementsBytes, &reqs)
+	f.settledTo = append(f.settledTo, reqs.PayTo)
+	return &x402.SettleResponse{Success: true, Transaction: "0xsettled"}, nil
+}
+
+func TestPaymentServer_RotatesPayTo(t *testing.T) {
+	const walletA = "0xAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+	const walletB = "0xBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB"
+
+	cfg := &config.Config{Payment: config.PaymentConfig{
+		Enabled:          true,
+		PayTo:            []config.PayToConfig{{Address: walletA, Weight: 2}, {Address: walletB}},
+		PricePerCapacity: "0.001",
+	}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Invalid config: %v", err)
+	}
+	facilitator := &payToFacilitator{}
+	server, err := newPaymentServer(cfg.Payment, facilitator)
+	if err != nil {
+		t.Fatalf("newPaymentServer: %v", err)
+	}
+	if err := server.Initialize(context.Background()); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+
+	r := newTestRouter(hybridConfig{
+		Limiter:  memory.NewTokenBucket(1, 0.001),
+		Payments: server,
+		Capacity: 1,
+		Mode:     config.ModePaidOnly,
+	})
+
+	// Successive 402s follow the weights, interleaved
+	want := []string{walletA, walletB, walletA, walletA, walletB, walletA}
+	var advertised []x402.PaymentRequirements
+	for i, wantPayTo := range want {
+		w := doRequest(r, "")
+		if w.Code != http.StatusPaymentRequired {
+			t.Fatalf("Request %d: expected 402, got %d", i, w.Code)
+		}
+		reqs := decodeRequirements(t, w)
+		if reqs.PayTo != wantPayTo {
+			t.Errorf("402 %d: expected PayTo %s, got %s", i, wantPayTo, reqs.PayTo)
+		}
+		advertised = append(advertised, reqs)
+	}
+
+	// A payment settles to the address its 402 advertised, whatever the
+	// rotation has moved on to
+	payload, _ := json.Marshal(x402.PaymentPayload{
+		X402Version: 2,
+		Accepted:    advertised[1],
+		Payload: map[string]interface{}{
+			"authorization": map[string]interface{}{"from": testWallet},
+		},
+	})
+	if w := doRequest(r, base64.StdEncoding.EncodeToString(payload)); w.Code != http.StatusOK {
+		t.Fatalf("Expected the payment accepted, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(facilitator.settledTo) != 1 || facilitator.settledTo[0] != walletB {
+		t.Errorf("Expected a settlement to %s, got %v", walletB, facilitator.settledTo)
+	}
+
+	// The payment didn't advance the rotation
+	if reqs := decodeRequirements(t, doRequest(r, "")); reqs.PayTo != walletA {
+		t.Errorf("Expected the rotation to continue with %s, got %s", walletA, reqs.PayTo)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+	x402http "github.com/coinbase/x402/go/http"
+	"github.com/gin-gonic/gin"
+
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+	"github.com/haseeb/ratelimiter/pkg/trust"
+)
+
+// clientKey returns the limiter key c's client is rate limited under: its
+// IP, as set by trusted proxies. The middleware and the quota endpoints all
+// key off it.
+func clientKey(c *gin.Context) string {
+	return c.ClientIP()
+}
+
+// quotaConfig configures the /v1/quota endpoint.
+type quotaConfig struct {
+	Limiter     ratelimit.Limiter
+	Capacity    float64 // The bucket's capacity
+	RefillRate  float64 // Tokens per second, for the reset time
+	Granularity float64 // Step remaining balances are rounded to (0 = full precision)
+	AdminToken  string  // Bearer token that may look up wallets ("" = none may)
+
+	// Payment terms; Payments false reports payment as unavailable
+	Payments         bool
+	PaymentTokens    float64 // Tokens a payment adds
+	TrustedTokens    float64 // Tokens an optimistic payment from a trusted wallet adds
+	BurstCapacity    float64 // Cap on paid refills (0 = uncapped)
+	TrustTracker     *trust.Tracker
+	TrustKey         TrustKeyFunc      // The middleware's, so trust_level reads the same identity
+	OptimisticTrusts bool              // Trusted wallets get TrustedTokens
+	WalletBuckets    bool              // Payments refill the wallet's own bucket
+	Escalation       *refillEscalation // Scales payments by the caller's recent 402s
+}
+
+// quotaHandler reports the caller's quota: their bucket's capacity, what
+// remains and when it's next full, and what a payment would buy them.
+// Callers with the admin token may name a wallet, for its trust level and
+// wallet bucket, by the wallet query parameter or an attached payment
+// header; neither proves the caller holds the wallet, so anyone else gets
+// a 401 for the parameter and has the header ignored.
+func quotaHandler(cfg quotaConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := clientKey(c)
+		tokens, err := cfg.Limiter.Available(key)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		var wallet, header string
+		if isAdmin(c, cfg.AdminToken) {
+			header = c.GetHeader("PAYMENT-SIGNATURE")
+			if header == "" {
+				header = c.GetHeader("X-PAYMENT")
+			}
+			wallet = c.Query("wallet")
+			if wallet == "" {
+				wallet, err = extractWalletAddress(header)
+			} else {
+				wallet, err = normalizeWallet(wallet)
+			}
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		} else if c.Query("wallet") != "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+
+		now := time.Now()
+		if clocked, ok := cfg.Limiter.(ratelimit.Clocked); ok && clocked.Clock() != nil {
+			now = clocked.Clock().Now()
+		}
+		reset := ratelimit.ResetTime(now, tokens, cfg.Capacity, cfg.RefillRate)
+		resp := gin.H{
+			"client":        key,
+			"capacity":      cfg.Capacity,
+			"remaining":     roundTokens(tokens, cfg.Granularity),
+			"reset":         reset.UTC().Format(time.RFC3339),
+			"reset_seconds": int64(math.Ceil(reset.Sub(now).Seconds())),
+		}
+
+		// A payment's tokens land in the wallet's bucket when it has one
+		balance := tokens
+		level := trust.Untrusted
+		if wallet != "" {
+			resp["wallet"] = wallet
+			if cfg.TrustTracker != nil {
+				level = cfg.TrustTracker.Level(quotaTrustKey(c, cfg.TrustKey, wallet, header))
+				resp["trust_level"] = level.String()
+			}
+			if wallets, ok := cfg.Limiter.(walletLimiter); ok && cfg.WalletBuckets {
+				balance = 0
+				info, err := wallets.Info(walletBucketKey(wallet))
+				if err == nil && !info.CreatedAt.IsZero() {
+					balance = info.Tokens
+				}
+				resp["wallet_remaining"] = roundTokens(balance, cfg.Granularity)
+			}
+		}
+
+		payment := gin.H{"enabled": cfg.Payments}
+		if cfg.Payments {
+			grant := cfg.PaymentTokens
+			if cfg.OptimisticTrusts && level == trust.Trusted {
+				grant = cfg.TrustedTokens
+			}
+			grant *= cfg.Escalation.Multiplier(key)
+			after := balance + grant
+			if cfg.BurstCapacity > 0 {
+				after = math.Min(after, math.Max(cfg.BurstCapacity, balance))
+			}
+			payment["tokens"] = grant
+			payment["grants_burst"] = after > cfg.Capacity
+		}
+		resp["payment"] = payment
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+// quotaTrustKey returns the identity wallet's trust is tracked under for c:
+// what trustKey makes of the attached payment, as the middleware would once
+// it verified, or the wallet itself without a trustKey or a payment to read.
+func quotaTrustKey(c *gin.Context, trustKey TrustKeyFunc, wallet, paymentHeader string) string {
+	if trustKey == nil || paymentHeader == "" {
+		return wallet
+	}
+	decoded, ok := decodePaymentHeader(paymentHeader)
+	if !ok {
+		return wallet
+	}
+	var payload x402.PaymentPayload
+	if err := json.Unmarshal(decoded, &payload); err != nil {
+		return wallet
+	}
+	return trustKey(payload, x402http.HTTPRequestContext{
+		Adapter:       NewGinAdapter(c),
+		Path:          c.Request.URL.Path,
+		Method:        c.Request.Method,
+		PaymentHeader: paymentHeader,
+	})
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	x402 "github.com/coinbase/x402/go"
+	x402http "github.com/coinbase/x402/go/http"
+	"github.com/gin-gonic/gin"
+	goredis "github.com/redis/go-redis/v9"
+
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/memory"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/ratelimittest"
+	ratelimitredis "github.com/haseeb/ratelimiter/pkg/ratelimit/redis"
+	"github.com/haseeb/ratelimiter/pkg/trust"
+)
+
+type quotaResponse struct {
+	Client       string  `json:"client"`
+	Capacity     float64 `json:"capacity"`
+	Remaining    float64 `json:"remaining"`
+	Reset        string  `json:"reset"`
+	ResetSeconds int64   `json:"reset_seconds"`
+	Wallet       string  `json:"wallet"`
+	WalletLeft   float64 `json:"wallet_remaining"`
+	TrustLevel   string  `json:"trust_level"`
+	Payment      struct {
+		Enabled     bool    `json:"enabled"`
+		Tokens      float64 `json:"tokens"`
+		GrantsBurst bool    `json:"grants_burst"`
+	} `json:"payment"`
+}
+
+// quotaAdminToken is the admin token the quota tests look wallets up with.
+const quotaAdminToken = "s3cret"
+
+// getQuota fetches target as an admin, who may look up wallets.
+func getQuota(t *testing.T, r *gin.Engine, target, paymentHeader string) quotaResponse {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("Authorization", "Bearer "+quotaAdminToken)
+	if paymentHeader != "" {
+		req.Header.Set("X-PAYMENT", paymentHeader)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 from %s, got %d: %s", target, w.Code, w.Body.String())
+	}
+	var body quotaResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Failed to decode body: %v", err)
+	}
+	return body
+}
+
+func TestQuotaHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	clock := ratelimittest.NewFakeClock()
+	limiter := memory.NewTokenBucketWithConfig(memory.Config{Capacity: 4, RefillRate: 1, Clock: clock})
+	tracker := trust.New(trust.Config{Threshold: 1})
+	defer tracker.Close()
+
+	r := gin.New()
+	r.GET("/v1/quota", quotaHandler(quotaConfig{
+		Limiter:          limiter,
+		Capacity:         4,
+		RefillRate:       1,
+		AdminToken:       quotaAdminToken,
+		Payments:         true,
+		PaymentTokens:    2,
+		TrustedTokens:    8,
+		TrustTracker:     tracker,
+		OptimisticTrusts: true,
+	}))
+
+	// A full bucket resets now, and any payment tops it past capacity
+	q := getQuota(t, r, "/v1/quota", "")
+	if q.Client != "192.0.2.1" || q.Capacity != 4 || q.Remaining != 4 || q.ResetSeconds != 0 {
+		t.Errorf("Unexpected quota for a full bucket: %+v", q)
+	}
+	if !q.Payment.Enabled || q.Payment.Tokens != 2 || !q.Payment.GrantsBurst {
+		t.Errorf("Expected a 2 token payment granting burst, got %+v", q.Payment)
+	}
+	if q.TrustLevel != "" {
+		t.Errorf("Expected no trust level without a wallet, got %q", q.TrustLevel)
+	}
+
+	// Spending moves remaining and the reset time
+	limiter.AllowN("192.0.2.1", 3)
+	q = getQuota(t, r, "/v1/quota", "")
+	if q.Remaining != 1 || q.ResetSeconds != 3 {
+		t.Errorf("Expected 1 remaining, full in 3s, got %v and %ds", q.Remaining, q.ResetSeconds)
+	}
+	if want := clock.Now().Add(3 * time.Second).UTC().Format(time.RFC3339); q.Reset != want {
+		t.Errorf("Expected reset at %s, got %s", want, q.Reset)
+	}
+	if q.Payment.GrantsBurst {
+		t.Error("Expected a 2 token payment on 1 remaining to stay within capacity")
+	}
+
+	// An untrusted wallet, named by query or by its payment header
+	q = getQuota(t, r, "/v1/quota?wallet="+testWallet, "")
+	if q.Wallet != testWallet || q.TrustLevel != "untrusted" || q.Payment.Tokens != 2 {
+		t.Errorf("Expected an untrusted wallet buying 2 tokens, got %+v", q)
+	}
+
+	// Once trusted, the wallet's optimistic refill grants burst
+	tracker.RecordSuccess(testWallet)
+	q = getQuota(t, r, "/v1/quota", paymentHeaderFor(testWallet))
+	if q.Wallet != testWallet || q.TrustLevel != "trusted" {
+		t.Errorf("Expected the header's wallet to be trusted, got %q at %q", q.Wallet, q.TrustLevel)
+	}
+	if q.Payment.Tokens != 8 || !q.Payment.GrantsBurst {
+		t.Errorf("Expected an 8 token payment granting burst, got %+v", q.Payment)
+	}
+}
+
+func TestQuotaHandler_TrustKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tracker := trust.New(trust.Config{Threshold: 1})
+	defer tracker.Close()
+
+	r := gin.New()
+	r.GET("/v1/quota", quotaHandler(quotaConfig{
+		Limiter:      memory.NewTokenBucket(4, 1),
+		Capacity:     4,
+		RefillRate:   1,
+		AdminToken:   quotaAdminToken,
+		TrustTracker: tracker,
+		TrustKey: func(payload x402.PaymentPayload, reqCtx x402http.HTTPRequestContext) string {
+			wallet, _ := extractWalletAddress(reqCtx.PaymentHeader)
+			return "tenant/" + wallet
+		},
+	}))
+
+	// Trust built under the key shows for the wallet's payment
+	tracker.RecordSuccess("tenant/" + testWallet)
+	if q := getQuota(t, r, "/v1/quota", paymentHeaderFor(testWallet)); q.TrustLevel != "trusted" {
+		t.Errorf("Expected the payment's trust key to be trusted, got %q", q.TrustLevel)
+	}
+
+	// Without a payment to key, the wallet alone has no trust
+	if q := getQuota(t, r, "/v1/quota?wallet="+testWallet, ""); q.TrustLevel != "untrusted" {
+		t.Errorf("Expected the bare wallet to be untrusted, got %q", q.TrustLevel)
+	}
+}
+
+func TestQuotaHandler_WalletBuckets(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mr := miniredis.RunT(t)
+	client := goredis.NewClient(&goredis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	limiter := ratelimitredis.NewTokenBucket(ratelimitredis.Config{Client: client, Capacity: 4, RefillRate: 0.001})
+
+	r := gin.New()
+	r.GET("/v1/quota", quotaHandler(quotaConfig{
+		Limiter:       limiter,
+		Capacity:      4,
+		RefillRate:    0.001,
+		AdminToken:    quotaAdminToken,
+		Payments:      true,
+		PaymentTokens: 4,
+		WalletBuckets: true,
+	}))
+
+	// The IP's bucket is full, but a wallet that has never paid has none
+	q := getQuota(t, r, "/v1/quota?wallet="+testWallet, "")
+	if q.Remaining != 4 || q.WalletLeft != 0 || q.Payment.GrantsBurst {
+		t.Errorf("Expected a full IP bucket and an empty wallet bucket, got %+v", q)
+	}
+
+	// A payment's tokens, and burst, are judged against the wallet's bucket
+	if err := openWalletBucket(limiter, walletBucketKey(testWallet)); err != nil {
+		t.Fatalf("openWalletBucket failed: %v", err)
+	}
+	if err := limiter.Refill(walletBucketKey(testWallet), 2); err != nil {
+		t.Fatalf("Refill failed: %v", err)
+	}
+	q = getQuota(t, r, "/v1/quota?wallet="+testWallet, "")
+	if q.WalletLeft < 1.99 || q.WalletLeft > 2.01 || !q.Payment.GrantsBurst {
+		t.Errorf("Expected 2 tokens in the wallet bucket and a payment granting burst, got %+v", q)
+	}
+}
+
+func TestQuotaHandler_Errors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/v1/quota", quotaHandler(quotaConfig{Limiter: memory.NewTokenBucket(4, 1), Capacity: 4, AdminToken: quotaAdminToken}))
+
+	// Payments off: the endpoint says so
+	if q := getQuota(t, r, "/v1/quota", ""); q.Payment.Enabled || q.Payment.Tokens != 0 {
+		t.Errorf("Expected payment disabled, got %+v", q.Payment)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/quota?wallet=0x123", nil)
+	req.Header.Set("Authorization", "Bearer "+quotaAdminToken)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a malformed wallet, got %d", w.Code)
+	}
+}
+
+func TestQuotaHandler_WalletLookupNeedsAdmin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tracker := trust.New(trust.Config{Threshold: 1})
+	defer tracker.Close()
+	tracker.RecordSuccess(testWallet)
+
+	r := gin.New()
+	r.GET("/v1/quota", quotaHandler(quotaConfig{
+		Limiter:      memory.NewTokenBucket(4, 1),
+		Capacity:     4,
+		AdminToken:   quotaAdminToken,
+		TrustTracker: tracker,
+	}))
+	get := func(target, token, paymentHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if paymentHeader != "" {
+			req.Header.Set("X-PAYMENT", paymentHeader)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// Naming another wallet without the admin token is refused
+	for _, token := range []string{"", "wrong"} {
+		if w := get("/v1/quota?wallet="+testWallet, token, ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 for a wallet lookup with token %q, got %d", token, w.Code)
+		}
+	}
+
+	// An unverified payment header names no wallet either
+	w := get("/v1/quota", "", paymentHeaderFor(testWallet))
+	var q quotaResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &q); err != nil {
+		t.Fatalf("Failed to decode body: %v", err)
+	}
+	if w.Code != http.StatusOK || q.Wallet != "" || q.TrustLevel != "" {
+		t.Errorf("Expected the caller's own quota without wallet details, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+)
+
+// Log redaction modes for server.log_redaction.
+const (
+	redactNone = "none" // Wallets truncated, keys as is
+	redactMask = "mask" // Wallets truncated, keys masked
+	redactHash = "hash" // Wallets and keys replaced by salted digests
+)
+
+// identityRedaction masks client identities in log lines.
+type identityRedaction struct {
+	key    ratelimit.Redactor // Limiter keys, usually client IPs (nil logs them as is)
+	wallet ratelimit.Redactor // Payer wallets (nil truncates them)
+}
+
+// logRedaction is applied by every log line naming a client. main sets it
+// from the config before serving.
+var logRedaction identityRedaction
+
+// newIdentityRedaction returns the redaction for mode, salting digests with
+// salt in hash mode.
+func newIdentityRedaction(mode, salt string) (identityRedaction, error) {
+	switch mode {
+	case "", redactNone:
+		return identityRedaction{}, nil
+	case redactMask:
+		return identityRedaction{key: ratelimit.MaskRedactor()}, nil
+	case redactHash:
+		hash := ratelimit.HashRedactor(salt)
+		return identityRedaction{key: hash, wallet: hash}, nil
+	}
+	return identityRedaction{}, fmt.Errorf("unknown log redaction %q", mode)
+}
+
+// logKey returns a limiter key as log lines show it.
+func logKey(key string) string {
+	return logRedaction.key.Redact(key)
+}
+
+// logWallet returns a wallet address as log lines show it.
+func logWallet(wallet string) string {
+	if logRedaction.wallet == nil {
+		return truncateWallet(wallet)
+	}
+	return logRedaction.wallet(wallet)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/haseeb/ratelimiter/internal/paymenttest"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/memory"
+	"github.com/haseeb/ratelimiter/pkg/trust"
+)
+
+// captureLogs redirects the standard logger into a buffer for the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+// useRedaction sets logRedaction for the test.
+func useRedaction(t *testing.T, mode, salt string) identityRedaction {
+	t.Helper()
+	redaction, err := newIdentityRedaction(mode, salt)
+	if err != nil {
+		t.Fatalf("newIdentityRedaction(%q) error: %v", mode, err)
+	}
+	prev := logRedaction
+	logRedaction = redaction
+	t.Cleanup(func() { logRedaction = prev })
+	return redaction
+}
+
+func TestNewIdentityRedaction(t *testing.T) {
+	useRedaction(t, redactNone, "")
+	if got := logKey("192.0.2.1"); got != "192.0.2.1" {
+		t.Errorf("Expected keys logged as is by default, got %q", got)
+	}
+	if got := logWallet(testWallet); got != truncateWallet(testWallet) {
+		t.Errorf("Expected wallets truncated by default, got %q", got)
+	}
+
+	useRedaction(t, redactMask, "")
+	if got := logKey("192.0.2.1"); got != "192.x.x.x" {
+		t.Errorf("Expected a masked key, got %q", got)
+	}
+	if got := logWallet(testWallet); got != truncateWallet(testWallet) {
+		t.Errorf("Expected wallets still truncated when masking, got %q", got)
+	}
+
+	if _, err := newIdentityRedaction("rot13", ""); err == nil {
+		t.Error("Expected an error for an unknown mode")
+	}
+}
+
+func TestLogRedaction_Hash(t *testing.T) {
+	redaction := useRedaction(t, redactHash, "test-salt")
+	logs := captureLogs(t)
+
+	// Limiter, middleware and queue log lines all name the client
+	limiter := memory.NewTokenBucketWithConfig(memory.Config{
+		Capacity:   1,
+		RefillRate: 0.001,
+		Redact:     redaction.key,
+	})
+	r := newTestRouter(hybridConfig{
+		Limiter:  limiter,
+		Payments: &paymenttest.Processor{},
+		Capacity: 1,
+		DryRun:   true,
+	})
+	doRequest(r, "")
+	doRequest(r, "") // Over the limit: logged as a dry-run rejection
+	limiter.Refill("192.0.2.1", 1)
+
+	sq := NewSettlementQueue(&paymenttest.Processor{}, trust.New(trust.Config{}), 10)
+	sq.Enqueue(jobFor(testWallet, "1000"))
+
+	out := logs.String()
+	for _, raw := range []string{"192.0.2.1", truncateWallet(testWallet), testWallet[:10]} {
+		if strings.Contains(out, raw) {
+			t.Errorf("Expected %q redacted from logs, got:\n%s", raw, out)
+		}
+	}
+	hash := ratelimit.HashRedactor("test-salt")
+	for _, line := range []string{
+		"[DRY-RUN] Would rate limit " + hash("192.0.2.1"),
+		"[REFILL] key=" + hash("192.0.2.1"),
+		"[QUEUE] Enqueued settlement for wallet " + hash(testWallet),
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("Expected log line %q, got:\n%s", line, out)
+		}
+	}
+}
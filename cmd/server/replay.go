@@ -0,0 +1,120 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+)
+
+// defaultReplayMaxEntries caps the payments a replayGuard remembers when no
+// cap is configured.
+const defaultReplayMaxEntries = 100000
+
+// replayGuard remembers the payments the server has accepted, so the same
+// payment presented again within window is refused instead of being granted
+// tokens twice, e.g. optimistically before its second settlement fails. At
+// most max payments are remembered; past that the oldest is forgotten
+// early. A nil replayGuard remembers nothing.
+type replayGuard struct {
+	window time.Duration
+	max    int
+	now    func() time.Time
+
+	mu    sync.Mutex
+	seen  map[[sha256.Size]byte]*list.Element
+	order *list.List // *replayEntry, most recently accepted at the front
+}
+
+type replayEntry struct {
+	id [sha256.Size]byte
+	at time.Time
+}
+
+// newReplayGuard returns a guard remembering payments for window, or nil
+// if window is 0. A max of 0 uses defaultReplayMaxEntries.
+func newReplayGuard(window time.Duration, max int) *replayGuard {
+	if window <= 0 {
+		return nil
+	}
+	if max <= 0 {
+		max = defaultReplayMaxEntries
+	}
+	return &replayGuard{
+		window: window,
+		max:    max,
+		now:    time.Now,
+		seen:   make(map[[sha256.Size]byte]*list.Element),
+		order:  list.New(),
+	}
+}
+
+// Claim records payload as accepted, reporting false if it was already
+// accepted within the window. A payload that can't be identified is
+// always accepted.
+func (g *replayGuard) Claim(payload x402.PaymentPayload) bool {
+	if g == nil {
+		return true
+	}
+	id, err := payloadHash(payload)
+	if err != nil {
+		return true
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.now()
+	g.expire(now)
+	if _, ok := g.seen[id]; ok {
+		return false
+	}
+	g.seen[id] = g.order.PushFront(&replayEntry{id: id, at: now})
+	if g.order.Len() > g.max {
+		g.remove(g.order.Back())
+	}
+	return true
+}
+
+// Release forgets payload, e.g. after it failed to settle, so the client
+// may present it again.
+func (g *replayGuard) Release(payload x402.PaymentPayload) {
+	if g == nil {
+		return
+	}
+	id, err := payloadHash(payload)
+	if err != nil {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if el, ok := g.seen[id]; ok {
+		g.remove(el)
+	}
+}
+
+// Len returns how many payments are remembered.
+func (g *replayGuard) Len() int {
+	if g == nil {
+		return 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.expire(g.now())
+	return g.order.Len()
+}
+
+// expire forgets payments accepted a full window ago. The caller holds mu.
+func (g *replayGuard) expire(now time.Time) {
+	for el := g.order.Back(); el != nil && now.Sub(el.Value.(*replayEntry).at) >= g.window; el = g.order.Back() {
+		g.remove(el)
+	}
+}
+
+// remove forgets el's payment. The caller holds mu.
+func (g *replayGuard) remove(el *list.Element) {
+	g.order.Remove(el)
+	delete(g.seen, el.Value.(*replayEntry).id)
+}
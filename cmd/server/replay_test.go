@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+
+	"github.com/haseeb/ratelimiter/internal/paymenttest"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/memory"
+)
+
+func paymentWithNonce(nonce string) x402.PaymentPayload {
+	return x402.PaymentPayload{Payload: map[string]interface{}{"nonce": nonce}}
+}
+
+func TestReplayGuard(t *testing.T) {
+	now := time.Unix(1000, 0)
+	g := newReplayGuard(time.Minute, 2)
+	g.now = func() time.Time { return now }
+
+	if !g.Claim(paymentWithNonce("a")) {
+		t.Fatal("Expected a new payment to be accepted")
+	}
+	if g.Claim(paymentWithNonce("a")) {
+		t.Error("Expected a payment replayed within the window to be refused")
+	}
+
+	// Released payments may be presented again
+	g.Release(paymentWithNonce("a"))
+	if !g.Claim(paymentWithNonce("a")) {
+		t.Error("Expected a released payment to be accepted again")
+	}
+
+	// Past the window it's forgotten
+	now = now.Add(time.Minute)
+	if g.Len() != 0 {
+		t.Errorf("Expected expired payments forgotten, got %d remembered", g.Len())
+	}
+	if !g.Claim(paymentWithNonce("a")) {
+		t.Error("Expected a payment replayed after the window to be treated as new")
+	}
+
+	// Past the cap the oldest is forgotten early
+	g.Claim(paymentWithNonce("b"))
+	g.Claim(paymentWithNonce("c"))
+	if g.Len() != 2 {
+		t.Errorf("Expected the cap of 2 payments, got %d", g.Len())
+	}
+	if !g.Claim(paymentWithNonce("a")) {
+		t.Error("Expected the evicted oldest payment to be accepted again")
+	}
+
+	var disabled *replayGuard
+	if disabled != newReplayGuard(0, 0) || !disabled.Claim(paymentWithNonce("a")) || !disabled.Claim(paymentWithNonce("a")) {
+		t.Error("Expected a nil guard to accept every payment")
+	}
+}
+
+func TestHybridMiddleware_ReplayedPayment(t *testing.T) {
+	now := time.Unix(1000, 0)
+	replays := newReplayGuard(time.Minute, 0)
+	replays.now = func() time.Time { return now }
+	processor := &paymenttest.Processor{}
+	limiter := memory.NewTokenBucket(1, 0.000001)
+	metrics := newPaymentMetrics()
+	r := newTestRouter(hybridConfig{
+		Limiter:  limiter,
+		Payments: processor,
+		Capacity: 1,
+		Replays:  replays,
+		Metrics:  metrics,
+	})
+	payment := paymentHeaderFor(testWallet)
+
+	limiter.Drain("")
+	if w := doRequest(r, payment); w.Code != http.StatusOK {
+		t.Fatalf("Expected the payment to be accepted, got %d", w.Code)
+	}
+
+	// The same payment again, within the window, is refused before settling
+	limiter.Drain("")
+	w := doRequest(r, payment)
+	if w.Code != http.StatusPaymentRequired || !strings.Contains(w.Body.String(), "Payment already used") {
+		t.Fatalf("Expected the replay refused with 402, got %d: %s", w.Code, w.Body.String())
+	}
+	if _, settle := processor.Calls(); settle != 1 {
+		t.Errorf("Expected the replay not to be settled, got %d settlements", settle)
+	}
+	if got := metrics.replays.Load(); got != 1 {
+		t.Errorf("Expected one replay counted, got %d", got)
+	}
+
+	// After the window it's treated as a new payment
+	now = now.Add(time.Minute)
+	if w := doRequest(r, payment); w.Code != http.StatusOK {
+		t.Fatalf("Expected the payment accepted after the window, got %d", w.Code)
+	}
+	if _, settle := processor.Calls(); settle != 2 {
+		t.Errorf("Expected a second settlement, got %d", settle)
+	}
+}
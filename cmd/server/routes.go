@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	x402 "github.com/coinbase/x402/go"
+	x402http "github.com/coinbase/x402/go/http"
+
+	"github.com/haseeb/ratelimiter/internal/config"
+)
+
+// RouteLimit is the rate limit and payment setup of a route registered while
+// the server runs.
+type RouteLimit struct {
+	Price       string  `json:"price"`                 // Price of one refill on the route, e.g. "$0.005", in the configured currency
+	Cost        float64 `json:"cost,omitempty"`        // Tokens each request costs (0 keeps the middleware's cost)
+	Description string  `json:"description,omitempty"` // Shown in the route's payment requirements
+
+	// PaidOnly gives the route zero capacity: every request needs a payment,
+	// which buys just that request. The bucket is neither consumed nor
+	// refilled, so natural refill never lets a request through for free.
+	PaidOnly bool `json:"paid_only,omitempty"`
+}
+
+// RegisteredRoute is a route in a RouteRegistry.
+type RegisteredRoute struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	RouteLimit
+}
+
+type routeEntry struct {
+	route    RegisteredRoute
+	payments PaymentProcessor
+}
+
+// RouteRegistry holds routes whose cost and payment requirements can change
+// without a restart, for platforms that add endpoints at runtime. The hybrid
+// middleware checks it on every request; a registered route overrides the
+// payment setup given at startup. Paths are matched exactly, so serve
+// dynamic endpoints behind a catch-all handler. It is safe for concurrent
+// use, and a nil registry has no routes.
+type RouteRegistry struct {
+	mu           sync.RWMutex
+	routes       map[string]routeEntry
+	newProcessor func(method string, limit RouteLimit) (PaymentProcessor, error)
+}
+
+// NewRouteRegistry returns an empty registry whose routes are paid for
+// through server, using the payee, asset and network of p.
+func NewRouteRegistry(p config.PaymentConfig, server *x402http.HTTPServer) *RouteRegistry {
+	return newRouteRegistry(func(method string, limit RouteLimit) (PaymentProcessor, error) {
+		return newRouteProcessor(p, server.X402ResourceServer, method, limit)
+	})
+}
+
+func newRouteRegistry(newProcessor func(method string, limit RouteLimit) (PaymentProcessor, error)) *RouteRegistry {
+	return &RouteRegistry{
+		routes:       make(map[string]routeEntry),
+		newProcessor: newProcessor,
+	}
+}
+
+// newRouteProcessor builds an x402 server advertising limit's price for
+// every request it sees; the registry has already matched the route. It
+// shares resourceServer, so settlements go through the same facilitator.
+func newRouteProcessor(p config.PaymentConfig, resourceServer *x402.X402ResourceServer, method string, limit RouteLimit) (PaymentProcessor, error) {
+	p.PricePerCapacity = limit.Price
+	price, err := paymentPrice(p)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := x402http.RoutesConfig{
+		method + " *": {
+			Accepts: x402http.PaymentOptions{
+				{
+					Scheme:  "exact",
+					Price:   price,
+					Network: paymentNetwork,
+					PayTo:   payTo(p),
+				},
+			},
+			Description: limit.Description,
+			MimeType:    "application/json",
+		},
+	}
+	return x402http.Wrappedx402HTTPResourceServer(routes, resourceServer), nil
+}
+
+// routeKey normalizes a method and path into a registry key.
+func routeKey(method, path string) string {
+	return strings.ToUpper(method) + " " + path
+}
+
+// RegisterRoute adds the route or replaces its limit. The change applies to
+// the next request. It only prices the route: the caller must already serve
+// method and path through a gin route, such as a catch-all. Until one does,
+// the route's requests get a 404 without paying or spending tokens.
+func (r *RouteRegistry) RegisterRoute(method, path string, limit RouteLimit) error {
+	method = strings.ToUpper(strings.TrimSpace(method))
+	if method == "" || strings.ContainsAny(method, " \t") {
+		return fmt.Errorf("invalid method %q", method)
+	}
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("path %q must start with /", path)
+	}
+	if math.IsNaN(limit.Cost) || math.IsInf(limit.Cost, 0) || limit.Cost < 0 {
+		return fmt.Errorf("cost must be a non-negative number, got %g", limit.Cost)
+	}
+
+	payments, err := r.newProcessor(method, limit)
+	if err != nil {
+		return fmt.Errorf("route %s %s: %w", method, path, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes[routeKey(method, path)] = routeEntry{
+		route:    RegisteredRoute{Method: method, Path: path, RouteLimit: limit},
+		payments: payments,
+	}
+	return nil
+}
+
+// UnregisterRoute removes the route, reporting whether it was registered.
+// Its requests fall back to the startup payment setup.
+func (r *RouteRegistry) UnregisterRoute(method, path string) bool {
+	key := routeKey(method, path)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.routes[key]
+	delete(r.routes, key)
+	return ok
+}
+
+// Routes returns the registered routes sorted by path, then method.
+func (r *RouteRegistry) Routes() []RegisteredRoute {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	out := make([]RegisteredRoute, 0, len(r.routes))
+	for _, e := range r.routes {
+		out = append(out, e.route)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Path != out[j].Path {
+			return out[i].Path < out[j].Path
+		}
+		return out[i].Method < out[j].Method
+	})
+	return out
+}
+
+// lookup returns the entry for a request's method and path.
+func (r *RouteRegistry) lookup(method, path string) (routeEntry, bool) {
+	if r == nil {
+		return routeEntry{}, false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e, ok := r.routes[routeKey(method, path)]
+	return e, ok
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/haseeb/ratelimiter/internal/config"
+	"github.com/haseeb/ratelimiter/internal/paymenttest"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/memory"
+)
+
+// requestPath sends GET path, attaching a payment header when paymentHeader is set.
+func requestPath(r http.Handler, path, paymentHeader string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	if paymentHeader != "" {
+		req.Header.Set("PAYMENT-SIGNATURE", paymentHeader)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestRouteRegistry_RegisterAfterStartup(t *testing.T) {
+	routeProcessor := &paymenttest.Processor{}
+	routes := newRouteRegistry(func(string, RouteLimit) (PaymentProcessor, error) {
+		return routeProcessor, nil
+	})
+
+	limiter := memory.NewTokenBucket(4, 0.001)
+	r := newTestRouter(hybridConfig{
+		Limiter:  limiter,
+		Payments: &paymenttest.Processor{RejectPay: true}, // Startup setup doesn't price /report
+		Capacity: 4,
+		Routes:   routes,
+	})
+	r.GET("/report", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+
+	// Registered while serving: /report now costs 2 tokens and is payable
+	if err := routes.RegisterRoute("get", "/report", RouteLimit{Price: "$0.005", Cost: 2}); err != nil {
+		t.Fatalf("RegisterRoute failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if w := requestPath(r, "/report", ""); w.Code != http.StatusOK {
+			t.Fatalf("Request %d: expected 200, got %d", i+1, w.Code)
+		}
+	}
+	if avail, _ := limiter.Available(""); avail > 0.01 {
+		t.Errorf("Expected two 2-token requests to empty the bucket, got %.2f", avail)
+	}
+	if w := requestPath(r, "/report", ""); w.Code != http.StatusPaymentRequired {
+		t.Fatalf("Expected 402 once the bucket is empty, got %d", w.Code)
+	}
+	if w := requestPath(r, "/report", paymentHeaderFor(testWallet)); w.Code != http.StatusOK {
+		t.Fatalf("Expected payment on the registered route to be accepted, got %d", w.Code)
+	}
+	if _, settle := routeProcessor.Calls(); settle != 1 {
+		t.Errorf("Expected the route's processor to settle once, got %d", settle)
+	}
+
+	// Unregistered, the route falls back to the startup setup
+	if !routes.UnregisterRoute("GET", "/report") {
+		t.Fatal("Expected UnregisterRoute to find the route")
+	}
+	limiter.Drain("")
+	if w := requestPath(r, "/report", paymentHeaderFor(testWallet)); w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected 402 after unregistering, got %d", w.Code)
+	}
+	if _, settle := routeProcessor.Calls(); settle != 1 {
+		t.Errorf("Expected no further settlements by the route's processor, got %d", settle)
+	}
+}
+
+func TestRouteRegistry_UnservedRouteIsNotCharged(t *testing.T) {
+	routeProcessor := &paymenttest.Processor{}
+	routes := newRouteRegistry(func(string, RouteLimit) (PaymentProcessor, error) {
+		return routeProcessor, nil
+	})
+
+	limiter := memory.NewTokenBucket(1, 0.001)
+	r := newTestRouter(hybridConfig{
+		Limiter:  limiter,
+		Payments: &paymenttest.Processor{},
+		Capacity: 1,
+		Routes:   routes,
+	})
+
+	// Registered, but no gin route serves /missing
+	if err := routes.RegisterRoute("GET", "/missing", RouteLimit{Price: "$0.005", PaidOnly: true}); err != nil {
+		t.Fatalf("RegisterRoute failed: %v", err)
+	}
+	if w := requestPath(r, "/missing", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 rather than 402 for an unserved route, got %d", w.Code)
+	}
+	if w := requestPath(r, "/missing", paymentHeaderFor(testWallet)); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a payment to an unserved route, got %d", w.Code)
+	}
+	if verify, settle := routeProcessor.Calls(); verify != 0 || settle != 0 {
+		t.Errorf("Expected the payment neither verified nor settled, got %d and %d", verify, settle)
+	}
+	if avail, _ := limiter.Available(""); avail != 1 {
+		t.Errorf("Expected no tokens spent, got %.2f left", avail)
+	}
+}
+
+func TestRouteRegistry_PaidOnlyRoute(t *testing.T) {
+	routeProcessor := &paymenttest.Processor{}
+	routes := newRouteRegistry(func(string, RouteLimit) (PaymentProcessor, error) {
+		return routeProcessor, nil
+	})
+	if err := routes.RegisterRoute("GET", "/report", RouteLimit{Price: "$0.005", PaidOnly: true}); err != nil {
+		t.Fatalf("RegisterRoute failed: %v", err)
+	}
+
+	limiter := memory.NewTokenBucket(4, 0.001)
+	r := newTestRouter(hybridConfig{
+		Limiter:  limiter,
+		Payments: &paymenttest.Processor{},
+		Capacity: 4,
+		Routes:   routes,
+	})
+	r.GET("/report", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+
+	// A full bucket buys nothing on a paid-only route
+	for i := 0; i < 2; i++ {
+		if w := requestPath(r, "/report", ""); w.Code != http.StatusPaymentRequired {
+			t.Fatalf("Request %d: expected 402 without payment, got %d", i+1, w.Code)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if w := requestPath(r, "/report", paymentHeaderFor(testWallet)); w.Code != http.StatusOK {
+			t.Fatalf("Paid request %d: expected 200, got %d", i+1, w.Code)
+		}
+	}
+	if _, settle := routeProcessor.Calls(); settle != 2 {
+		t.Errorf("Expected each paid request settled, got %d", settle)
+	}
+	if avail, _ := limiter.Available(""); avail < 3.99 || avail > 4.01 {
+		t.Errorf("Expected the bucket untouched by the paid-only route, got %.2f", avail)
+	}
+
+	// Other routes still spend the bucket
+	if w := doRequest(r, ""); w.Code != http.StatusOK {
+		t.Errorf("Expected /cpu served from the bucket, got %d", w.Code)
+	}
+}
+
+func TestRouteRegistry_AdvertisesRoutePrice(t *testing.T) {
+	cfg := &config.Config{Payment: config.PaymentConfig{
+		Enabled:          true,
+		WalletAddress:    "0x95eB3EcE2e308eCC51c8498a19cB4D5B5B929675",
+		PricePerCapacity: "0.001",
+	}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Invalid config: %v", err)
+	}
+	server, err := newPaymentServer(cfg.Payment, fakeFacilitator{})
+	if err != nil {
+		t.Fatalf("newPaymentServer: %v", err)
+	}
+	if err := server.Initialize(context.Background()); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+
+	routes := NewRouteRegistry(cfg.Payment, server)
+	if err := routes.RegisterRoute("GET", "/report", RouteLimit{Price: "$0.005"}); err != nil {
+		t.Fatalf("RegisterRoute failed: %v", err)
+	}
+	r := newTestRouter(hybridConfig{
+		Limiter:  memory.NewTokenBucket(1, 0.001),
+		Payments: server,
+		Capacity: 1,
+		Mode:     config.ModePaidOnly,
+		Routes:   routes,
+	})
+	r.GET("/report", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+
+	if reqs := decodeRequirements(t, requestPath(r, "/report", "")); reqs.Amount != "5000" {
+		t.Errorf("Expected the route's price of 5000 atomic units, got %s", reqs.Amount)
+	}
+	if reqs := decodeRequirements(t, doRequest(r, "")); reqs.Amount != "1000" {
+		t.Errorf("Expected /cpu to keep the startup price, got %s", reqs.Amount)
+	}
+}
+
+func TestRouteRegistry_RejectsInvalidRoutes(t *testing.T) {
+	routes := newRouteRegistry(func(string, RouteLimit) (PaymentProcessor, error) {
+		return &paymenttest.Processor{}, nil
+	})
+
+	for _, tt := range []struct {
+		method, path string
+		limit        RouteLimit
+	}{
+		{"", "/report", RouteLimit{}},
+		{"GET", "report", RouteLimit{}},
+		{"GET", "/report", RouteLimit{Cost: -1}},
+	} {
+		if err := routes.RegisterRoute(tt.method, tt.path, tt.limit); err == nil {
+			t.Errorf("Expected an error registering %q %q %+v", tt.method, tt.path, tt.limit)
+		}
+	}
+	if len(routes.Routes()) != 0 {
+		t.Errorf("Expected no routes registered, got %+v", routes.Routes())
+	}
+}
+
+func TestRouteRegistry_ConcurrentUse(t *testing.T) {
+	routes := newRouteRegistry(func(string, RouteLimit) (PaymentProcessor, error) {
+		return &paymenttest.Processor{}, nil
+	})
+	r := newTestRouter(hybridConfig{
+		Limiter:  memory.NewTokenBucket(1000, 1000),
+		Payments: &paymenttest.Processor{},
+		Capacity: 1000,
+		Routes:   routes,
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				routes.RegisterRoute("GET", "/cpu", RouteLimit{Price: "$0.001", Cost: 1})
+				routes.UnregisterRoute("GET", "/cpu")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				doRequest(r, "")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestAdminRoutes_RegisterRoute(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	routes := newRouteRegistry(func(string, RouteLimit) (PaymentProcessor, error) {
+		return &paymenttest.Processor{}, nil
+	})
+	r := gin.New()
+	registerAdminRoutes(r, "s3cret", memory.NewTokenBucket(2, 0.001), nil, nil, routes, newEventHub())
+
+	put := func(body string) int {
+		req := httptest.NewRequest(http.MethodPut, "/admin/routes", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer s3cret")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := put(`{"method": "GET", "path": "/report", "price": "$0.005", "cost": 2}`); code != http.StatusOK {
+		t.Fatalf("Expected route registration to succeed, got %d", code)
+	}
+	if code := put(`{"method": "GET", "path": "report"}`); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a relative path, got %d", code)
+	}
+	if got := routes.Routes(); len(got) != 1 || got[0].Path != "/report" || got[0].Cost != 2 {
+		t.Errorf("Expected /report registered at cost 2, got %+v", got)
+	}
+
+	if w := adminRequest(r, http.MethodDelete, "/admin/routes?method=GET&path=/report", "s3cret"); w.Code != http.StatusOK {
+		t.Fatalf("Expected unregistering to succeed, got %d", w.Code)
+	}
+	if w := adminRequest(r, http.MethodDelete, "/admin/routes?method=GET&path=/report", "s3cret"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown route, got %d", w.Code)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+	x402http "github.com/coinbase/x402/go/http"
+	"github.com/gin-gonic/gin"
+
+	"github.com/haseeb/ratelimiter/internal/config"
+	"github.com/haseeb/ratelimiter/internal/handlers"
+	"github.com/haseeb/ratelimiter/internal/middleware"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+	"github.com/haseeb/ratelimiter/pkg/trust"
+)
+
+// Server is the rate limited, payment gated HTTP handler, wired from
+// config: the middleware, the routes and, with payments enabled, the trust
+// tracker and settlement queue. Close it once the HTTP server has stopped
+// taking requests.
+type Server struct {
+	*gin.Engine
+
+	onShutdown []func() // Run in order by Close
+}
+
+// Option customizes a Server with hooks config can't express.
+type Option func(*serverOptions)
+
+// serverOptions are the hooks set by Options.
+type serverOptions struct {
+	paymentResponse PaymentResponseFunc
+	trustKey        TrustKeyFunc
+}
+
+// WithPaymentResponse customizes the 402 sent when no payment is attached.
+// It has no effect with payments disabled.
+func WithPaymentResponse(fn PaymentResponseFunc) Option {
+	return func(o *serverOptions) { o.paymentResponse = fn }
+}
+
+// WithTrustKey builds trust under the identity fn returns for a payment,
+// rather than the payer's wallet. /v1/quota reads trust_level through the
+// same fn. It has no effect with payments disabled.
+func WithTrustKey(fn TrustKeyFunc) Option {
+	return func(o *serverOptions) { o.trustKey = fn }
+}
+
+// NewServer wires a Server from cfg, which must be validated, around
+// limiter. With payments enabled, payments processes them; nil builds an
+// x402 server on cfg's facilitators. Routes registered at runtime then get
+// their own price; with payments given, they use it too.
+func NewServer(cfg *config.Config, limiter ratelimit.Limiter, payments PaymentProcessor, opts ...Option) (*Server, error) {
+	var options serverOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	// Request and payment events, streamed to operators on /events
+	events := newEventHub()
+
+	// Create Gin router. Only configured proxies may set the client IP via
+	// X-Forwarded-For; otherwise clients could pick their own rate limit key.
+	r := gin.Default()
+	if err := r.SetTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %w", err)
+	}
+	s := &Server{Engine: r}
+
+	// Token monitoring endpoint (for testing/debugging) - registered BEFORE rate limiting
+	r.GET("/tokens", tokensHandler(limiter, cfg.RateLimit.Capacity, cfg.Server.TokenGranularity))
+
+	if cfg.Payment.Enabled {
+		if err := s.usePayments(cfg, limiter, payments, events, options); err != nil {
+			return nil, err
+		}
+	} else {
+		r.GET("/v1/quota", quotaHandler(newQuotaConfig(cfg, limiter)))
+		if cfg.Admin.Token != "" {
+			registerAdminRoutes(r, cfg.Admin.Token, limiter, nil, nil, nil, events)
+		}
+
+		// Simple rate limiting without payment
+		useInFlightLimit(r, cfg.RateLimit.MaxInFlight)
+		r.Use(simpleRateLimitMiddleware(limiter, middleware.Options{
+			RetryAfterFormat: cfg.RateLimit.RetryAfterFormat,
+			RefillRate:       cfg.RateLimit.RefillRate,
+			DryRun:           cfg.RateLimit.DryRun,
+			Cost:             requestCost(cfg.RateLimit),
+			MaxCost:          maxRequestCost(cfg.RateLimit),
+			MaxWait:          cfg.RateLimit.MaxWait,
+			Redact:           logRedaction.key,
+		}, events))
+	}
+
+	// Register handlers
+	r.GET("/cpu", handlers.GinCPUHandler())
+	r.GET("/dashboard", handlers.GinDashboardHandler())
+	return s, nil
+}
+
+// Close settles queued payments, then saves the trust snapshot.
+func (s *Server) Close() {
+	for _, fn := range s.onShutdown {
+		fn()
+	}
+}
+
+// usePayments wires the payment flow: the trust tracker, settlement queue,
+// route registry, admin routes, metrics and hybrid middleware.
+func (s *Server) usePayments(cfg *config.Config, limiter ratelimit.Limiter, payments PaymentProcessor, events *eventHub, options serverOptions) error {
+	r := s.Engine
+
+	// Routes whose price and cost operators can change at runtime
+	var routes *RouteRegistry
+	if payments == nil {
+		httpServer, err := newFacilitatorServer(cfg.Payment)
+		if err != nil {
+			return err
+		}
+		routes = NewRouteRegistry(cfg.Payment, httpServer)
+
+		// Retried requests reuse their payment's verification for a while
+		payments = httpServer
+		if cfg.Payment.VerifyCacheTTL > 0 {
+			payments = newVerifyCache(httpServer, cfg.Payment.VerifyCacheTTL, cfg.Payment.VerifyCacheMaxEntries)
+		}
+	} else {
+		routes = newRouteRegistry(func(string, RouteLimit) (PaymentProcessor, error) {
+			return payments, nil
+		})
+	}
+
+	// Wallet buckets need a bucket per key; the in-memory TokenBucket keeps one
+	// for every key, so main builds a keyed limiter for them
+	if _, ok := limiter.(walletLimiter); !ok && cfg.Payment.PaidBucket == config.PaidBucketWallet {
+		return fmt.Errorf("payment.paid_bucket: wallet buckets need a limiter with a bucket per key, got %T", limiter)
+	}
+
+	trustUnit, err := paymentTrustUnit(cfg.Payment)
+	if err != nil {
+		return fmt.Errorf("failed to configure trust unit: %w", err)
+	}
+
+	// Create trust tracker for optimistic settlement, which also tracks
+	// per-wallet payment intervals
+	var trustTracker *trust.Tracker
+	var settlementQueue *SettlementQueue
+	if cfg.Payment.Optimistic.Enabled || cfg.Payment.MinInterval > 0 {
+		trustTracker = trust.New(trust.Config{
+			Threshold: cfg.Payment.Optimistic.TrustThreshold,
+			Window:    cfg.Payment.Optimistic.TrustWindow,
+
+			OptimisticThreshold: cfg.Payment.Optimistic.OptimisticThreshold,
+
+			RetriedWeight: cfg.Payment.Optimistic.RetriedWeight,
+			SweepInterval: cfg.Payment.Optimistic.SweepInterval,
+			MaxWallets:    cfg.Payment.Optimistic.MaxWallets,
+			MaxTrusted:    cfg.Payment.Optimistic.MaxTrusted,
+			OnTrustChange: func(wallet string, nowTrusted bool) {
+				log.Printf("[TRUST] Wallet %s trusted: %v", logWallet(wallet), nowTrusted)
+				events.Publish(Event{Type: eventTrustChanged, Wallet: wallet, Trusted: &nowTrusted})
+			},
+		})
+		s.onShutdown = append(s.onShutdown, trustTracker.Close)
+		if path := cfg.Payment.Optimistic.TrustSnapshot; path != "" {
+			loadTrustSnapshot(trustTracker, path)
+			s.onShutdown = append(s.onShutdown, func() { saveTrustSnapshot(trustTracker, path) })
+		}
+	}
+	if cfg.Payment.Optimistic.Enabled {
+		// Create settlement queue for sequential background processing
+		settlementQueue = NewSettlementQueueWithWorkers(payments, trustTracker,
+			cfg.Payment.Optimistic.QueueBuffer, cfg.Payment.Optimistic.Workers)
+		settlementQueue.WatchAge(cfg.Payment.Optimistic.MaxQueueAge)
+		settlementQueue.SetTrustUnit(trustUnit)
+		settlementQueue.SetEvents(events)
+		settlementQueue.SetRetries(cfg.Payment.Optimistic.SettleRetries, settlementDelay)
+		settlementQueue.SetBlockUnsettleable(cfg.Payment.BlockUnsettleable)
+		if spacing := cfg.Payment.Optimistic.WalletSpacing; spacing > 0 {
+			settlementQueue.SetSpacing(spacing)
+		}
+		if jitter := cfg.Payment.Optimistic.SpacingJitter; jitter > 0 {
+			settlementQueue.SetJitter(jitter)
+		}
+		// Settle what's queued before the trust snapshot is saved
+		s.onShutdown = append([]func(){settlementQueue.Close}, s.onShutdown...)
+		log.Printf("Optimistic settlement enabled (threshold: %d in %s, queued settlements, %d workers)",
+			cfg.Payment.Optimistic.TrustThreshold,
+			cfg.Payment.Optimistic.TrustWindow,
+			settlementQueue.Workers())
+	}
+
+	// Refills scaled by recent 402s, shared with /v1/quota
+	escalation := newRefillEscalation(cfg.Payment.EscalationCurve, cfg.Payment.EscalationWindow)
+
+	// Caller's quota and payment terms - registered BEFORE rate limiting
+	quota := newQuotaConfig(cfg, limiter)
+	quota.Payments = true
+	quota.PaymentTokens = cfg.RefillTokens()
+	quota.TrustedTokens = cfg.OptimisticRefillTokens()
+	if cfg.Payment.PayPerRequest {
+		quota.PaymentTokens, quota.TrustedTokens = 0, 0
+	}
+	quota.BurstCapacity = cfg.RateLimit.BurstCapacity
+	quota.TrustTracker = trustTracker
+	quota.TrustKey = options.trustKey
+	quota.OptimisticTrusts = cfg.Payment.Optimistic.Enabled
+	quota.WalletBuckets = cfg.Payment.PaidBucket == config.PaidBucketWallet
+	quota.Escalation = escalation
+	r.GET("/v1/quota", quotaHandler(quota))
+
+	// Admin endpoints for ratelimitctl - registered BEFORE rate limiting
+	if cfg.Admin.Token != "" {
+		registerAdminRoutes(r, cfg.Admin.Token, limiter, trustTracker, settlementQueue, routes, events)
+	}
+
+	// Paid request counts for Prometheus - registered BEFORE rate limiting
+	metrics := newPaymentMetrics()
+	r.GET("/metrics", metrics.Handler())
+
+	// Apply custom rate limit + payment middleware
+	useInFlightLimit(r, cfg.RateLimit.MaxInFlight)
+	r.Use(hybridRateLimitPaymentMiddleware(hybridConfig{
+		Limiter:         limiter,
+		Payments:        payments,
+		Capacity:        cfg.RefillTokens(),
+		BucketCapacity:  cfg.RateLimit.Capacity,
+		TrustTracker:    trustTracker,
+		SettlementQueue: settlementQueue,
+		Mode:            cfg.Payment.Mode,
+		FailOpen:        cfg.RateLimit.FailOpen,
+		DryRun:          cfg.RateLimit.DryRun,
+		TrustUnit:       trustUnit,
+		Events:          events,
+		Routes:          routes,
+		Metrics:         metrics,
+
+		Cost:               requestCost(cfg.RateLimit),
+		MaxCost:            maxRequestCost(cfg.RateLimit),
+		MaxWait:            cfg.RateLimit.MaxWait,
+		RefillRate:         cfg.RateLimit.RefillRate,
+		MinPaymentInterval: cfg.Payment.MinInterval,
+		OptimisticCapacity: cfg.OptimisticRefillTokens(),
+		PayPerRequest:      cfg.Payment.PayPerRequest,
+		DeclineUnneeded:    cfg.Payment.DeclineUnneeded,
+		RoutePolicies:      cfg.Payment.RoutePolicies,
+		WalletBuckets:      cfg.Payment.PaidBucket == config.PaidBucketWallet,
+		BlockUnsettleable:  cfg.Payment.BlockUnsettleable,
+		Replays:            newReplayGuard(cfg.Payment.ReplayWindow, cfg.Payment.ReplayMaxEntries),
+		Escalation:         escalation,
+		Ceiling:            newRequestCeiling(cfg.RateLimit.RequestCeiling, cfg.RateLimit.CeilingWindow),
+		PaymentResponse:    options.paymentResponse,
+		TrustKey:           options.trustKey,
+	}))
+
+	fmt.Printf("Payment enabled: %s %s on %s (mode: %s)\n",
+		cfg.Payment.PricePerCapacity, cfg.Payment.Currency, cfg.Payment.Network, cfg.Payment.Mode)
+	return nil
+}
+
+// newQuotaConfig returns the /v1/quota settings for cfg's bucket, without
+// payment terms.
+func newQuotaConfig(cfg *config.Config, limiter ratelimit.Limiter) quotaConfig {
+	return quotaConfig{
+		Limiter:     limiter,
+		Capacity:    cfg.RateLimit.Capacity,
+		RefillRate:  cfg.RateLimit.RefillRate,
+		Granularity: cfg.Server.TokenGranularity,
+		AdminToken:  cfg.Admin.Token,
+	}
+}
+
+// newFacilitatorServer builds the x402 server advertising p's price,
+// verifying and settling through p's facilitators in turn.
+func newFacilitatorServer(p config.PaymentConfig) (*x402http.HTTPServer, error) {
+	// Create facilitator clients, falling over between them in order
+	urls := p.Facilitators()
+	clients := make([]x402.FacilitatorClient, len(urls))
+	for i, url := range urls {
+		clients[i] = x402http.NewHTTPFacilitatorClient(&x402http.FacilitatorConfig{
+			URL: url,
+			HTTPClient: &http.Client{
+				Timeout: 10 * time.Second,
+				Transport: &loggingRoundTripper{
+					proxied: http.DefaultTransport,
+					detail:  p.FacilitatorLog,
+					logf:    log.Printf,
+				},
+			},
+		})
+	}
+	facilitator := newFailoverFacilitator(urls, clients)
+
+	// Create the HTTP server wrapper advertising the configured price
+	httpServer, err := newPaymentServer(p, facilitator)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure payments: %w", err)
+	}
+
+	// Initialize - sync with facilitator to populate internal maps
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := httpServer.Initialize(ctx); err != nil {
+		log.Printf("Warning: failed to initialize x402 server: %v", err)
+	}
+	return httpServer, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+	x402http "github.com/coinbase/x402/go/http"
+	"github.com/gin-gonic/gin"
+
+	"github.com/haseeb/ratelimiter/internal/config"
+	"github.com/haseeb/ratelimiter/internal/paymenttest"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/memory"
+)
+
+func TestServer_PaymentFlow(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := &config.Config{}
+	cfg.RateLimit.Capacity = 1
+	cfg.RateLimit.RefillRate = 0.001
+	cfg.Payment.Enabled = true
+	cfg.Payment.PricePerCapacity = "0.001"
+	cfg.Payment.Optimistic.Enabled = true
+	cfg.Payment.Optimistic.TrustThreshold = 1
+	cfg.Payment.Optimistic.TrustWindow = time.Hour
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Invalid config: %v", err)
+	}
+
+	processor := &paymenttest.Processor{}
+	srv, err := NewServer(cfg, memory.NewTokenBucket(1, 0.001), processor)
+	if err != nil {
+		t.Fatalf("NewServer error: %v", err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	get := func(paymentHeader string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/dashboard", nil)
+		if paymentHeader != "" {
+			req.Header.Set("PAYMENT-SIGNATURE", paymentHeader)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := get(""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the first request served from the bucket, got %d", resp.StatusCode)
+	}
+	if resp := get(""); resp.StatusCode != http.StatusPaymentRequired {
+		t.Fatalf("Expected 402 once the bucket is empty, got %d", resp.StatusCode)
+	}
+
+	// A first payment settles before the response; it makes the wallet
+	// trusted, so the next one is served at once and settled in the queue
+	resp := get(paymentHeaderFor(testWallet))
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(servedViaHeader) != servedPaidSync {
+		t.Fatalf("Expected a synchronously settled payment, got %d via %q", resp.StatusCode, resp.Header.Get(servedViaHeader))
+	}
+	get("") // Spend the paid token
+	resp = get(paymentHeaderFor(testWallet))
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(servedViaHeader) != servedOptimistic {
+		t.Fatalf("Expected an optimistic payment, got %d via %q", resp.StatusCode, resp.Header.Get(servedViaHeader))
+	}
+
+	// Routes outside the rate limiter are registered too
+	if resp, err := http.Get(ts.URL + "/metrics"); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected /metrics to be served, got %v, %v", resp, err)
+	} else {
+		resp.Body.Close()
+	}
+
+	// Closing settles what's queued
+	srv.Close()
+	if _, settle := processor.Calls(); settle != 2 {
+		t.Errorf("Expected both payments settled after Close, got %d", settle)
+	}
+}
+
+func TestNewServer_RejectsWalletBucketsWithoutPerKeyLimiter(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := &config.Config{}
+	cfg.RateLimit.Capacity = 1
+	cfg.RateLimit.RefillRate = 0.001
+	cfg.Payment.Enabled = true
+	cfg.Payment.PricePerCapacity = "0.001"
+	cfg.Payment.PaidBucket = config.PaidBucketWallet
+
+	// The in-memory TokenBucket keeps one bucket for every key
+	_, err := NewServer(cfg, memory.NewTokenBucket(1, 0.001), &paymenttest.Processor{})
+	if err == nil || !strings.Contains(err.Error(), "payment.paid_bucket") {
+		t.Errorf("Expected NewServer to reject wallet buckets on the memory limiter, got %v", err)
+	}
+}
+
+func TestNewServer_WalletBucketsOnMemoryStrategy(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := &config.Config{}
+	cfg.RateLimit.Strategy = "memory"
+	cfg.RateLimit.Capacity = 1
+	cfg.RateLimit.RefillRate = 0.001
+	cfg.Payment.Enabled = true
+	cfg.Payment.PricePerCapacity = "0.001"
+	cfg.Payment.PaidBucket = config.PaidBucketWallet
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Expected wallet buckets valid on the memory strategy, got %v", err)
+	}
+
+	// main gives wallet buckets a keyed in-memory limiter
+	limiter := newMemoryLimiter(cfg, ratelimit.RefillStack, nil)
+	if _, ok := limiter.(walletLimiter); !ok {
+		t.Fatalf("Expected a limiter that can hold wallet buckets, got %T", limiter)
+	}
+	if _, err := NewServer(cfg, limiter, &paymenttest.Processor{}); err != nil {
+		t.Errorf("Expected NewServer to accept the keyed memory limiter, got %v", err)
+	}
+	cfg.Payment.PaidBucket = config.PaidBucketIP
+	if _, ok := newMemoryLimiter(cfg, ratelimit.RefillStack, nil).(*memory.TokenBucket); !ok {
+		t.Error("Expected IP buckets alone to keep the single in-memory bucket")
+	}
+}
+
+func TestNewServer_TrustKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := &config.Config{}
+	cfg.RateLimit.Capacity = 1
+	cfg.RateLimit.RefillRate = 0.001
+	cfg.Payment.Enabled = true
+	cfg.Payment.PricePerCapacity = "0.001"
+	cfg.Payment.Optimistic.Enabled = true
+	cfg.Payment.Optimistic.TrustThreshold = 1
+	cfg.Payment.Optimistic.TrustWindow = time.Hour
+	cfg.Admin.Token = quotaAdminToken
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Invalid config: %v", err)
+	}
+
+	limiter := memory.NewTokenBucket(1, 0.001)
+	srv, err := NewServer(cfg, limiter, &paymenttest.Processor{},
+		WithTrustKey(func(payload x402.PaymentPayload, reqCtx x402http.HTTPRequestContext) string {
+			wallet, _ := extractWalletAddress(reqCtx.PaymentHeader)
+			return reqCtx.Adapter.GetHeader("X-Api-Key") + "/" + wallet
+		}))
+	if err != nil {
+		t.Fatalf("NewServer error: %v", err)
+	}
+	defer srv.Close()
+
+	get := func(target, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("PAYMENT-SIGNATURE", paymentHeaderFor(testWallet))
+		req.Header.Set("X-Api-Key", apiKey)
+		req.Header.Set("Authorization", "Bearer "+quotaAdminToken)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w
+	}
+	pay := func(apiKey string) string {
+		limiter.Drain("")
+		return get("/dashboard", apiKey).Header().Get(servedViaHeader)
+	}
+	trustLevel := func(apiKey string) string {
+		var body quotaResponse
+		if err := json.Unmarshal(get("/v1/quota", apiKey).Body.Bytes(), &body); err != nil {
+			t.Fatalf("Failed to decode quota: %v", err)
+		}
+		return body.TrustLevel
+	}
+
+	if via := pay("alpha"); via != servedPaidSync {
+		t.Fatalf("Expected an unknown identity on the sync path, got %q", via)
+	}
+
+	// The middleware and /v1/quota key trust the same way
+	if level := trustLevel("alpha"); level != "trusted" {
+		t.Errorf("Expected quota to report the paying identity trusted, got %q", level)
+	}
+	if level := trustLevel("beta"); level != "untrusted" {
+		t.Errorf("Expected quota to report another identity untrusted, got %q", level)
+	}
+	if via := pay("alpha"); via != servedOptimistic {
+		t.Errorf("Expected the trusted identity on the optimistic path, got %q", via)
+	}
+	if via := pay("beta"); via != servedPaidSync {
+		t.Errorf("Expected the same wallet under another API key on the sync path, got %q", via)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import "strings"
+
+// settleFailure classifies why a verified payment didn't settle.
+type settleFailure int
+
+const (
+	settleTransient settleFailure = iota // Facilitator or chain trouble; retrying may succeed
+	settlePermanent                      // The payment itself can't settle, e.g. insufficient balance
+)
+
+// permanentSettleReasons are fragments of x402 error reasons that retrying
+// the same payment can't fix: the payer lacks the funds, or the
+// authorization is unusable.
+var permanentSettleReasons = []string{
+	"insufficient",              // Balance, funds or authorized amount too low
+	"signature",                 // Bad or unverifiable signature
+	"nonce_already_used",        // Authorization already spent
+	"authorization_valid",       // Authorization expired or not yet valid
+	"recipient_mismatch",        // Paid to an address we don't own
+	"undeployed_smart_wallet",   // Smart wallet can't sign yet
+	"authorization_value",       // Authorized amount doesn't match
+	"unsupported_scheme",        // Scheme the facilitator can't settle
+	"invalid_exact_evm_payload", // Malformed payload
+}
+
+// classifySettleFailure classifies a settlement's error reason. Unknown
+// reasons are treated as transient, so they're still retried.
+func classifySettleFailure(reason string) settleFailure {
+	for _, fragment := range permanentSettleReasons {
+		if strings.Contains(reason, fragment) {
+			return settlePermanent
+		}
+	}
+	return settleTransient
+}
+
+// String returns the failure class as it appears in logs and responses.
+func (f settleFailure) String() string {
+	if f == settlePermanent {
+		return "permanent"
+	}
+	return "transient"
+}
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestClassifySettleFailure(t *testing.T) {
+	tests := map[string]settleFailure{
+		"invalid_exact_evm_insufficient_balance":                     settlePermanent,
+		"invalid_exact_evm_payload_authorization_value_insufficient": settlePermanent,
+		"invalid_exact_evm_payload_signature":                        settlePermanent,
+		"invalid_exact_evm_nonce_already_used":                       settlePermanent,
+		"invalid_exact_evm_payload_authorization_valid_before":       settlePermanent,
+		"invalid_exact_evm_transaction_failed":                       settleTransient,
+		"invalid_exact_evm_failed_to_get_receipt":                    settleTransient,
+		"nonce_too_low": settleTransient,
+		"":              settleTransient,
+	}
+	for reason, want := range tests {
+		if got := classifySettleFailure(reason); got != want {
+			t.Errorf("classifySettleFailure(%q) = %s, want %s", reason, got, want)
+		}
+	}
+}
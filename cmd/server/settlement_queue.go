@@ -2,62 +2,176 @@ package main
 
 import (
 	"context"
+	"hash/fnv"
 	"log"
+	"math/big"
+	"math/rand/v2"
+	"slices"
 	"sync"
 	"time"
 
 	x402 "github.com/coinbase/x402/go"
-	x402http "github.com/coinbase/x402/go/http"
 	"github.com/haseeb/ratelimiter/pkg/trust"
 )
 
+// settlementDelay is the default spacing between settlements from the same
+// wallet, letting chain state (and the sender's nonce) propagate.
+const settlementDelay = 3 * time.Second
+
+// settlementShutdownGrace is how long Close waits for queued settlements to
+// finish before cancelling the one in flight.
+const settlementShutdownGrace = 10 * time.Second
+
+// receiptHistory is how many successful settlements the queue remembers for
+// reconciliation.
+const receiptHistory = 100
+
+// SettlementReceipt records a successful settlement, so operators can match
+// on-chain transactions to served requests.
+type SettlementReceipt struct {
+	Transaction string    `json:"transaction"`
+	Wallet      string    `json:"wallet"`
+	Amount      string    `json:"amount"` // Atomic units
+	SettledAt   time.Time `json:"settled_at"`
+}
+
 // SettlementJob represents a background settlement to process.
 type SettlementJob struct {
 	PaymentPayload      x402.PaymentPayload
 	PaymentRequirements x402.PaymentRequirements
 	WalletAddr          string
+	TrustKey            string  // Identity the outcome counts toward ("" = WalletAddr)
+	Tokens              float64 // Tokens the payment granted, for accounting
 	QueuedAt            time.Time
+
+	attempts int // Failed settlement attempts, for retries
+}
+
+// trustKey returns the identity the job's outcome counts toward.
+func (j SettlementJob) trustKey() string {
+	if j.TrustKey != "" {
+		return j.TrustKey
+	}
+	return j.WalletAddr
 }
 
 // SettlementQueue processes settlements sequentially to avoid nonce collisions.
+//
+// Ordering invariant: jobs from the same wallet settle in the order they were
+// enqueued, whatever the spacing between them. Reordering them would settle a later nonce before an earlier
+// one, so any change to how jobs are dispatched (e.g. sharding workers) must
+// preserve it. With several workers, each wallet is hashed to one shard, which
+// a single worker drains in order.
 type SettlementQueue struct {
-	jobs         chan SettlementJob
-	httpServer   *x402http.HTTPServer
+	shards       []*settlementShard
+	httpServer   PaymentProcessor
 	trustTracker *trust.Tracker
 	wg           sync.WaitGroup
 	mu           sync.Mutex
 	pending      int
+	unhealthy    bool
+	done         chan struct{}
+	delay        time.Duration       // Minimum gap between settlements from the same wallet
+	jitter       float64             // Fraction of delay each gap is randomly moved by
+	trustUnit    *big.Int            // Amount counting as one payment toward trust (nil: every payment once)
+	events       *eventHub           // Receives settlement events (nil discards them)
+	retries      int                 // Extra attempts for a failed settlement
+	retryDelay   time.Duration       // Wait between settlement attempts
+	blockFailed  bool                // Block wallets whose payments can't settle
+	receipts     []SettlementReceipt // Ring buffer of recent successful settlements
+	receiptNext  int                 // Slot the next receipt overwrites once the buffer is full
+	ctx          context.Context     // Passed to settlements; cancelled once Close's grace period runs out
+	cancel       context.CancelFunc
+	grace        time.Duration // How long Close lets settlements finish
+}
+
+// settlementShard is one worker's share of the queue: the jobs of the
+// wallets hashed to it.
+type settlementShard struct {
+	jobs     chan SettlementJob
+	held     []SettlementJob      // Jobs set aside until their wallet's spacing passes, oldest first; only the shard's worker touches it
+	readyAt  map[string]time.Time // When each recently settled wallet may settle again; only the shard's worker touches it
+	queuedAt []time.Time          // QueuedAt of pending jobs, oldest first; guarded by the queue's mu
 }
 
 // NewSettlementQueue creates a new settlement queue with a worker.
-func NewSettlementQueue(httpServer *x402http.HTTPServer, trustTracker *trust.Tracker, bufferSize int) *SettlementQueue {
+func NewSettlementQueue(httpServer PaymentProcessor, trustTracker *trust.Tracker, bufferSize int) *SettlementQueue {
+	return NewSettlementQueueWithWorkers(httpServer, trustTracker, bufferSize, 1)
+}
+
+// NewSettlementQueueWithWorkers creates a settlement queue settling with
+// workers workers at once (default 1). Each worker holds its share of
+// bufferSize (default 100) jobs, rounded up; Enqueue blocks while the
+// share its wallet hashes to is full.
+func NewSettlementQueueWithWorkers(httpServer PaymentProcessor, trustTracker *trust.Tracker, bufferSize, workers int) *SettlementQueue {
 	if bufferSize <= 0 {
 		bufferSize = 100
 	}
+	if workers <= 0 {
+		workers = 1
+	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	sq := &SettlementQueue{
-		jobs:         make(chan SettlementJob, bufferSize),
+		ctx:          ctx,
+		cancel:       cancel,
+		grace:        settlementShutdownGrace,
+		shards:       make([]*settlementShard, workers),
 		httpServer:   httpServer,
 		trustTracker: trustTracker,
+		done:         make(chan struct{}),
+		delay:        settlementDelay,
 	}
 
-	// Start worker goroutine
-	sq.wg.Add(1)
-	go sq.worker()
+	// Start a worker goroutine per shard
+	perShard := (bufferSize + workers - 1) / workers
+	for i := range sq.shards {
+		shard := &settlementShard{
+			jobs:    make(chan SettlementJob, perShard),
+			readyAt: make(map[string]time.Time),
+		}
+		sq.shards[i] = shard
+		sq.wg.Add(1)
+		go sq.worker(shard)
+	}
 
 	return sq
 }
 
-// Enqueue adds a settlement job to the queue.
+// Workers returns the number of workers settling at once.
+func (sq *SettlementQueue) Workers() int {
+	return len(sq.shards)
+}
+
+// shardFor returns the shard wallet's jobs queue on.
+func (sq *SettlementQueue) shardFor(wallet string) *settlementShard {
+	if len(sq.shards) == 1 {
+		return sq.shards[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(wallet))
+	return sq.shards[h.Sum32()%uint32(len(sq.shards))]
+}
+
+// Enqueue adds a settlement job to the queue. It blocks while the job's
+// shard is full, pushing back on the payments that fill it.
 func (sq *SettlementQueue) Enqueue(job SettlementJob) {
+	job.QueuedAt = time.Now()
+	shard := sq.shardFor(job.WalletAddr)
+
 	sq.mu.Lock()
 	sq.pending++
+	shard.queuedAt = append(shard.queuedAt, job.QueuedAt)
 	sq.mu.Unlock()
 
-	job.QueuedAt = time.Now()
-	sq.jobs <- job
+	select {
+	case shard.jobs <- job:
+	default:
+		log.Printf("[QUEUE] WARNING: settlement buffer full (%d jobs), waiting for the worker", cap(shard.jobs))
+		shard.jobs <- job
+	}
 	log.Printf("[QUEUE] Enqueued settlement for wallet %s (pending: %d)",
-		truncateWallet(job.WalletAddr), sq.Pending())
+		logWallet(job.WalletAddr), sq.Pending())
 }
 
 // Pending returns the number of pending settlements.
@@ -67,58 +181,411 @@ func (sq *SettlementQueue) Pending() int {
 	return sq.pending
 }
 
-// worker processes settlements one at a time with delay between each.
-func (sq *SettlementQueue) worker() {
+// OldestPendingAge returns how long the oldest pending job has been waiting.
+// Returns 0 when the queue is empty.
+func (sq *SettlementQueue) OldestPendingAge() time.Duration {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	var oldest time.Time
+	for _, shard := range sq.shards {
+		if len(shard.queuedAt) > 0 && (oldest.IsZero() || shard.queuedAt[0].Before(oldest)) {
+			oldest = shard.queuedAt[0]
+		}
+	}
+	if oldest.IsZero() {
+		return 0
+	}
+	return time.Since(oldest)
+}
+
+// Healthy returns false while the monitor started by WatchAge sees a pending
+// job older than the configured maximum age.
+func (sq *SettlementQueue) Healthy() bool {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	return !sq.unhealthy
+}
+
+// WatchAge starts a monitor that marks the queue unhealthy (and logs a warning)
+// while the oldest pending job has waited longer than maxAge, e.g. because the
+// worker stalled. The monitor stops when the queue is closed.
+func (sq *SettlementQueue) WatchAge(maxAge time.Duration) {
+	if maxAge <= 0 {
+		return
+	}
+
+	interval := maxAge / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-sq.done:
+				return
+			case <-ticker.C:
+				age := sq.OldestPendingAge()
+				stale := age > maxAge
+
+				sq.mu.Lock()
+				changed := stale != sq.unhealthy
+				sq.unhealthy = stale
+				sq.mu.Unlock()
+
+				if changed && stale {
+					log.Printf("[QUEUE] WARNING: oldest pending settlement is %v old (max %v), queue unhealthy",
+						age.Round(time.Millisecond), maxAge)
+				} else if changed {
+					log.Printf("[QUEUE] Queue healthy again")
+				}
+			}
+		}
+	}()
+}
+
+// SetSpacing sets the minimum gap between settlements from the same wallet
+// (default 3s). Settlements from different wallets never wait on each other,
+// since nonce collisions only happen per sender. Call before enqueueing.
+func (sq *SettlementQueue) SetSpacing(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	sq.delay = d
+}
+
+// SetJitter spreads same-wallet settlements by moving each gap randomly
+// within fraction of the spacing either way, e.g. 0.2 turns 3s into
+// 2.4s-3.6s, so bursts don't hit the facilitator in lockstep. The fraction
+// is clamped to 0-1. Call before enqueueing.
+func (sq *SettlementQueue) SetJitter(fraction float64) {
+	sq.jitter = min(max(fraction, 0), 1)
+}
+
+// spacing returns the gap before a wallet's next settlement, with jitter
+// applied.
+func (sq *SettlementQueue) spacing() time.Duration {
+	if sq.jitter == 0 {
+		return sq.delay
+	}
+	return time.Duration(float64(sq.delay) * (1 + sq.jitter*(2*rand.Float64()-1)))
+}
+
+// SetTrustUnit makes each settled payment count toward trust once per unit
+// of its amount (in the asset's atomic units), so large payments build
+// trust faster. Nil counts every payment once. Call before enqueueing.
+func (sq *SettlementQueue) SetTrustUnit(unit *big.Int) {
+	sq.trustUnit = unit
+}
+
+// SetRetries makes the worker retry a failed settlement up to n more times,
+// holding it for delay between attempts like a wallet spacing out, so the
+// worker settles other wallets meanwhile. A success after retries still
+// settles the payment but builds trust more slowly than a clean one. Call
+// before enqueueing.
+func (sq *SettlementQueue) SetRetries(n int, delay time.Duration) {
+	sq.retries = max(0, n)
+	sq.retryDelay = delay
+}
+
+// SetBlockUnsettleable makes a payment that fails to settle permanently,
+// such as for insufficient balance, block its wallet as well as revoking
+// its trust. Call before enqueueing.
+func (sq *SettlementQueue) SetBlockUnsettleable(block bool) {
+	sq.blockFailed = block
+}
+
+// SetShutdownGrace sets how long Close waits for queued settlements before
+// cancelling the one in flight (default 10s). Call before closing.
+func (sq *SettlementQueue) SetShutdownGrace(d time.Duration) {
+	sq.grace = max(0, d)
+}
+
+// SetEvents publishes the outcome of each settlement to h. Call before
+// enqueueing.
+func (sq *SettlementQueue) SetEvents(h *eventHub) {
+	sq.events = h
+}
+
+// worker processes shard's settlements one at a time. A job whose wallet
+// settled less than the spacing ago is held until the wallet is ready, while
+// the worker moves on to other wallets; jobs from a wallet with one held
+// queue behind it, keeping each wallet's order. Held jobs count against the
+// shard's buffer, so a wallet bursting past it still pushes back on Enqueue.
+func (sq *SettlementQueue) worker(shard *settlementShard) {
 	defer sq.wg.Done()
 
-	first := true
-	for job := range sq.jobs {
-		// Add delay between settlements to let blockchain state propagate
-		// Skip delay for the first job
-		if !first {
-			log.Printf("[QUEUE] Waiting 3s before next settlement...")
-			time.Sleep(3 * time.Second)
+	jobs := shard.jobs
+	for jobs != nil || len(shard.held) > 0 {
+		if job, ok := shard.takeReady(time.Now()); ok {
+			sq.run(shard, job)
+			continue
+		}
+
+		// Wait for a new job, unless held ones fill the buffer, or for the
+		// first held wallet to become ready
+		incoming := jobs
+		if len(shard.held) >= cap(shard.jobs) {
+			incoming = nil
+		}
+		var timer *time.Timer
+		var ready <-chan time.Time
+		if len(shard.held) > 0 {
+			timer = time.NewTimer(time.Until(shard.nextReady()))
+			ready = timer.C
+		}
+
+		select {
+		case job, ok := <-incoming:
+			if !ok {
+				jobs = nil
+			} else if shard.mustHold(job.WalletAddr, time.Now()) {
+				log.Printf("[QUEUE] Holding settlement for wallet %s until its spacing passes",
+					logWallet(job.WalletAddr))
+				shard.held = append(shard.held, job)
+			} else {
+				sq.run(shard, job)
+			}
+		case <-ready:
+		case <-sq.ctx.Done():
+			// Past the shutdown deadline, a held job's wait is cut short
+			for _, job := range shard.held {
+				sq.drop(shard, job)
+			}
+			shard.held = nil
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// run settles job, or drops it once the shutdown deadline has passed rather
+// than failing it against a cancelled context.
+func (sq *SettlementQueue) run(shard *settlementShard, job SettlementJob) {
+	if sq.ctx.Err() != nil {
+		sq.drop(shard, job)
+		return
+	}
+	if sq.processSettlement(job) {
+		// Held ahead of the wallet's later jobs, keeping their order
+		job.attempts++
+		shard.readyAt[job.WalletAddr] = time.Now().Add(sq.retryDelay)
+		shard.held = slices.Insert(shard.held, 0, job)
+		return
+	}
+	sq.markSettled(shard, job.WalletAddr)
+	sq.finish(shard, job)
+}
+
+// drop abandons job unsettled at shutdown.
+func (sq *SettlementQueue) drop(shard *settlementShard, job SettlementJob) {
+	log.Printf("[QUEUE] Shutdown: dropping unsettled payment from wallet %s", logWallet(job.WalletAddr))
+	sq.finish(shard, job)
+}
+
+// finish removes job from the pending count and shard's queue ages.
+func (sq *SettlementQueue) finish(shard *settlementShard, job SettlementJob) {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	sq.pending--
+	if i := slices.IndexFunc(shard.queuedAt, job.QueuedAt.Equal); i >= 0 {
+		shard.queuedAt = slices.Delete(shard.queuedAt, i, i+1)
+	}
+}
+
+// markSettled starts wallet's spacing and forgets wallets whose spacing has
+// already passed, so the map only holds recently active wallets.
+func (sq *SettlementQueue) markSettled(shard *settlementShard, wallet string) {
+	now := time.Now()
+	for w, at := range shard.readyAt {
+		if !at.After(now) {
+			delete(shard.readyAt, w)
 		}
-		first = false
+	}
+	if spacing := sq.spacing(); spacing > 0 {
+		shard.readyAt[wallet] = now.Add(spacing)
+	}
+}
+
+// mustHold reports whether a new job from wallet has to be held: its wallet
+// is still spacing out, or has an earlier job held.
+func (shard *settlementShard) mustHold(wallet string, now time.Time) bool {
+	if shard.readyAt[wallet].After(now) {
+		return true
+	}
+	return slices.ContainsFunc(shard.held, func(job SettlementJob) bool { return job.WalletAddr == wallet })
+}
 
-		sq.processSettlement(job)
+// takeReady removes and returns the oldest held job whose wallet's spacing
+// has passed. It's its wallet's oldest held job, since the wallet's earlier
+// ones would be ready too.
+func (shard *settlementShard) takeReady(now time.Time) (SettlementJob, bool) {
+	for i, job := range shard.held {
+		if !shard.readyAt[job.WalletAddr].After(now) {
+			shard.held = slices.Delete(shard.held, i, i+1)
+			return job, true
+		}
+	}
+	return SettlementJob{}, false
+}
 
-		sq.mu.Lock()
-		sq.pending--
-		sq.mu.Unlock()
+// nextReady returns when the first held job's wallet becomes ready.
+func (shard *settlementShard) nextReady() time.Time {
+	next := shard.readyAt[shard.held[0].WalletAddr]
+	for _, job := range shard.held[1:] {
+		if at := shard.readyAt[job.WalletAddr]; at.Before(next) {
+			next = at
+		}
 	}
+	return next
 }
 
-// processSettlement handles a single settlement.
-func (sq *SettlementQueue) processSettlement(job SettlementJob) {
+// processSettlement makes one attempt at job's settlement, reporting
+// whether it failed but should be retried. A success after retries counts
+// toward trust as a retried outcome.
+func (sq *SettlementQueue) processSettlement(job SettlementJob) (retry bool) {
 	queueLatency := time.Since(job.QueuedAt)
 	settlementStart := time.Now()
 
 	settleResult := sq.httpServer.ProcessSettlement(
-		context.Background(),
+		sq.ctx,
 		job.PaymentPayload,
 		job.PaymentRequirements,
 	)
 	settlementLatency := time.Since(settlementStart)
 
+	outcome := trust.Clean
+	if job.attempts > 0 {
+		outcome = trust.Retried
+	}
+	if !settleResult.Success && sq.ctx.Err() == nil && job.attempts < sq.retries &&
+		classifySettleFailure(settleResult.ErrorReason) != settlePermanent {
+		log.Printf("[QUEUE] Settlement attempt %d failed (%s), retrying in %v", job.attempts+1, settleResult.ErrorReason, sq.retryDelay)
+		return true
+	}
+
 	if settleResult.Success {
 		if sq.trustTracker != nil {
-			sq.trustTracker.RecordSuccess(job.WalletAddr)
+			sq.trustTracker.RecordOutcome(job.trustKey(), outcome, trustWeight(job.PaymentRequirements.Amount, sq.trustUnit))
+			sq.trustTracker.RecordGrant(job.WalletAddr, job.Tokens, job.PaymentRequirements.Amount)
 		}
-		log.Printf("[QUEUE] Settlement succeeded: %s (queue: %v, settle: %v)",
-			settleResult.Transaction, queueLatency, settlementLatency)
-	} else {
+		sq.recordReceipt(SettlementReceipt{
+			Transaction: settleResult.Transaction,
+			Wallet:      job.WalletAddr,
+			Amount:      job.PaymentRequirements.Amount,
+			SettledAt:   time.Now(),
+		})
+		sq.events.Publish(Event{Type: eventPaymentSettled, Wallet: job.WalletAddr, Transaction: settleResult.Transaction})
 		if sq.trustTracker != nil {
-			// Soft penalty: revoke trust, don't debit tokens
-			sq.trustTracker.RecordFailure(job.WalletAddr)
+			log.Printf("[QUEUE] Settlement succeeded: %s (queue: %v, settle: %v) [trust: %.2f/%d, %s]",
+				settleResult.Transaction, queueLatency, settlementLatency, sq.trustTracker.RecentScore(job.trustKey()),
+				sq.trustTracker.Config().OptimisticThreshold, sq.trustTracker.Level(job.trustKey()))
+		} else {
+			log.Printf("[QUEUE] Settlement succeeded: %s (queue: %v, settle: %v)",
+				settleResult.Transaction, queueLatency, settlementLatency)
 		}
-		log.Printf("[QUEUE] Settlement FAILED: %s (queue: %v, wallet trust revoked)",
-			settleResult.ErrorReason, queueLatency)
+	} else if sq.ctx.Err() != nil {
+		// Shutdown, not the wallet's fault - don't revoke trust
+		log.Printf("[QUEUE] Settlement cancelled by shutdown (wallet %s)", logWallet(job.WalletAddr))
+	} else {
+		sq.penalize(job, settleResult.ErrorReason)
+		sq.events.Publish(Event{Type: eventSettlementFailed, Wallet: job.WalletAddr, Reason: settleResult.ErrorReason})
+		log.Printf("[QUEUE] Settlement FAILED: %s (queue: %v, %s)",
+			settleResult.ErrorReason, queueLatency, sq.penalty(settleResult.ErrorReason))
+	}
+	return false
+}
+
+// penalize revokes the trust of a job whose settlement failed for reason,
+// and blocks its wallet if the failure is permanent and
+// SetBlockUnsettleable asked for it. Tokens already granted aren't debited.
+func (sq *SettlementQueue) penalize(job SettlementJob, reason string) {
+	if sq.trustTracker == nil {
+		return
 	}
+	sq.trustTracker.RecordFailure(job.trustKey())
+	if sq.blocks(reason) && job.WalletAddr != "" {
+		sq.trustTracker.Block(job.WalletAddr)
+	}
+}
+
+// blocks reports whether a settlement failing for reason blocks the wallet.
+func (sq *SettlementQueue) blocks(reason string) bool {
+	return sq.blockFailed && classifySettleFailure(reason) == settlePermanent
+}
+
+// penalty describes, for logs, what a failure for reason cost the wallet.
+func (sq *SettlementQueue) penalty(reason string) string {
+	if sq.blocks(reason) && sq.trustTracker != nil {
+		return classifySettleFailure(reason).String() + " failure, wallet trust revoked and blocked"
+	}
+	return classifySettleFailure(reason).String() + " failure, wallet trust revoked"
 }
 
-// Close shuts down the queue gracefully.
+// recordReceipt remembers a successful settlement, overwriting the oldest
+// once receiptHistory are held.
+func (sq *SettlementQueue) recordReceipt(r SettlementReceipt) {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+
+	if len(sq.receipts) < receiptHistory {
+		sq.receipts = append(sq.receipts, r)
+		return
+	}
+	sq.receipts[sq.receiptNext] = r
+	sq.receiptNext = (sq.receiptNext + 1) % receiptHistory
+}
+
+// RecentSettlements returns up to the last receiptHistory successful
+// settlements, oldest first.
+func (sq *SettlementQueue) RecentSettlements() []SettlementReceipt {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+
+	out := make([]SettlementReceipt, 0, len(sq.receipts))
+	out = append(out, sq.receipts[sq.receiptNext:]...)
+	return append(out, sq.receipts[:sq.receiptNext]...)
+}
+
+// Close shuts down the queue gracefully. Queued settlements get the grace
+// period to finish; after that the one in flight is cancelled through its
+// context and the rest are dropped.
 func (sq *SettlementQueue) Close() {
-	close(sq.jobs)
-	sq.wg.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), sq.grace)
+	defer cancel()
+	sq.Shutdown(ctx)
+}
+
+// Shutdown is Close with the caller's deadline instead of the grace period:
+// queued settlements run until ctx is done, then the one in flight is
+// cancelled, a wallet spacing wait is cut short, and the rest are dropped.
+// It returns once the workers have stopped, with ctx's error if settlements
+// were cut off.
+func (sq *SettlementQueue) Shutdown(ctx context.Context) error {
+	for _, shard := range sq.shards {
+		close(shard.jobs)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		sq.wg.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		log.Printf("[QUEUE] Shutdown deadline reached with %d pending, cancelling settlements", sq.Pending())
+		sq.cancel()
+		<-drained
+		err = ctx.Err()
+	}
+	sq.cancel()
+	close(sq.done)
+	return err
 }
@@ -0,0 +1,669 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+	x402http "github.com/coinbase/x402/go/http"
+
+	"github.com/haseeb/ratelimiter/internal/paymenttest"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/memory"
+	"github.com/haseeb/ratelimiter/pkg/trust"
+)
+
+// waitFor polls cond until it returns true or the timeout elapses.
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestSettlementQueue_OldestPendingAge(t *testing.T) {
+	processor := &paymenttest.Processor{Block: make(chan struct{})}
+	sq := NewSettlementQueue(processor, trust.New(trust.Config{}), 10)
+	defer sq.Close()
+
+	const maxAge = 50 * time.Millisecond
+	sq.WatchAge(maxAge)
+
+	if age := sq.OldestPendingAge(); age != 0 {
+		t.Errorf("Expected 0 age for empty queue, got %v", age)
+	}
+
+	// Worker picks up the job and stalls inside settlement
+	sq.Enqueue(SettlementJob{WalletAddr: testWallet})
+
+	if !sq.Healthy() {
+		t.Error("Queue should start healthy")
+	}
+
+	if !waitFor(t, time.Second, func() bool { return sq.OldestPendingAge() > maxAge }) {
+		t.Fatalf("Expected oldest pending age to exceed %v, got %v", maxAge, sq.OldestPendingAge())
+	}
+	if !waitFor(t, time.Second, func() bool { return !sq.Healthy() }) {
+		t.Fatal("Expected queue to be marked unhealthy once oldest job exceeded max age")
+	}
+
+	// Unblock the worker - the queue drains and recovers
+	close(processor.Block)
+	if !waitFor(t, time.Second, func() bool { return sq.Pending() == 0 }) {
+		t.Fatalf("Expected queue to drain, %d pending", sq.Pending())
+	}
+	if age := sq.OldestPendingAge(); age != 0 {
+		t.Errorf("Expected 0 age after drain, got %v", age)
+	}
+	if !waitFor(t, time.Second, sq.Healthy) {
+		t.Error("Expected queue to become healthy after draining")
+	}
+}
+
+func TestHybridMiddleware_UnhealthyQueueFallsBackToSync(t *testing.T) {
+	stalled := &paymenttest.Processor{Block: make(chan struct{})}
+	tracker := trust.New(trust.Config{Threshold: 1})
+	sq := NewSettlementQueue(stalled, tracker, 10)
+	defer sq.Close()
+	defer close(stalled.Block)
+
+	sq.WatchAge(20 * time.Millisecond)
+	sq.Enqueue(SettlementJob{WalletAddr: "0xother"})
+	if !waitFor(t, time.Second, func() bool { return !sq.Healthy() }) {
+		t.Fatal("Expected queue to become unhealthy")
+	}
+
+	processor := &paymenttest.Processor{}
+	tracker.RecordSuccess(testWallet) // Trusted at threshold 1
+	r := newTestRouter(hybridConfig{
+		Limiter:         memory.NewTokenBucket(1, 0.001),
+		Payments:        processor,
+		Capacity:        1,
+		TrustTracker:    tracker,
+		SettlementQueue: sq,
+	})
+
+	doRequest(r, "") // Drain the bucket
+	if w := doRequest(r, paymentHeaderFor(testWallet)); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 after payment, got %d", w.Code)
+	}
+	if _, settle := processor.Calls(); settle != 1 {
+		t.Errorf("Expected trusted wallet to settle synchronously while queue is unhealthy, got %d settlements", settle)
+	}
+	if sq.Pending() != 1 {
+		t.Errorf("Expected no new queued settlement, got %d pending", sq.Pending())
+	}
+}
+
+// jobFor builds a queued settlement of amount from wallet.
+func jobFor(wallet, amount string) SettlementJob {
+	reqs := x402.PaymentRequirements{Scheme: "exact", Network: "eip155:84532", Amount: amount, PayTo: "0xpayto"}
+	return SettlementJob{
+		PaymentPayload:      x402.PaymentPayload{X402Version: 2, Accepted: reqs},
+		PaymentRequirements: reqs,
+		WalletAddr:          wallet,
+	}
+}
+
+func TestSettlementQueue_SpacesOnlySameWallet(t *testing.T) {
+	const spacing = 300 * time.Millisecond
+	processor := &paymenttest.Processor{}
+	sq := NewSettlementQueue(processor, nil, 10)
+	defer sq.Close()
+	sq.SetSpacing(spacing)
+
+	sq.Enqueue(jobFor("0xaaaa", "1000"))
+	sq.Enqueue(jobFor("0xbbbb", "1000"))
+	sq.Enqueue(jobFor("0xaaaa", "1000"))
+
+	if !waitFor(t, 2*time.Second, func() bool { return sq.Pending() == 0 }) {
+		t.Fatalf("Expected queue to drain, %d pending", sq.Pending())
+	}
+
+	settledAt := processor.SettledAt()
+	if len(settledAt) != 3 {
+		t.Fatalf("Expected 3 settlements, got %d", len(settledAt))
+	}
+
+	// Different wallets settle back to back
+	if gap := settledAt[1].Sub(settledAt[0]); gap >= spacing/2 {
+		t.Errorf("Expected unrelated wallets to settle without spacing, gap was %v", gap)
+	}
+	// The same wallet waits out the spacing since its last settlement
+	if gap := settledAt[2].Sub(settledAt[0]); gap < spacing {
+		t.Errorf("Expected same-wallet settlements at least %v apart, gap was %v", spacing, gap)
+	}
+}
+
+func TestSettlementQueue_HeldWalletDoesNotBlockOthers(t *testing.T) {
+	processor := &paymenttest.Processor{}
+	sq := NewSettlementQueue(processor, nil, 10)
+	defer sq.Close()
+	sq.SetSpacing(time.Minute)
+	sq.SetShutdownGrace(0)
+
+	// The second 0xaaaa job is held for a minute; 0xbbbb's settles meanwhile
+	sq.Enqueue(jobFor("0xaaaa", "1000"))
+	sq.Enqueue(jobFor("0xaaaa", "1000"))
+	sq.Enqueue(jobFor("0xbbbb", "1000"))
+	if !waitFor(t, time.Second, func() bool { _, settle := processor.Calls(); return settle == 2 }) {
+		t.Fatal("Expected another wallet's job to settle while the first waits out its spacing")
+	}
+	if sq.Pending() != 1 || sq.OldestPendingAge() <= 0 {
+		t.Errorf("Expected the held job still pending, got %d pending", sq.Pending())
+	}
+}
+
+func TestSettlementQueue_SpacingJitter(t *testing.T) {
+	const (
+		spacing = 100 * time.Millisecond
+		jitter  = 0.5
+		jobs    = 6
+	)
+	processor := &paymenttest.Processor{}
+	sq := NewSettlementQueue(processor, nil, 10)
+	defer sq.Close()
+	sq.SetSpacing(spacing)
+	sq.SetJitter(jitter)
+
+	for i := 0; i < jobs; i++ {
+		sq.Enqueue(jobFor("0xaaaa", "1000"))
+	}
+	if !waitFor(t, 3*time.Second, func() bool { return sq.Pending() == 0 }) {
+		t.Fatalf("Expected queue to drain, %d pending", sq.Pending())
+	}
+
+	settledAt := processor.SettledAt()
+	if len(settledAt) != jobs {
+		t.Fatalf("Expected %d settlements, got %d", jobs, len(settledAt))
+	}
+
+	// Every gap lands in the jitter band, and they don't all match
+	low, high := time.Duration(float64(spacing)*(1-jitter)), time.Duration(float64(spacing)*(1+jitter))
+	var gaps []time.Duration
+	for i := 1; i < jobs; i++ {
+		gap := settledAt[i].Sub(settledAt[i-1])
+		if gap < low || gap > high+40*time.Millisecond {
+			t.Errorf("Expected gap %d within %v-%v, got %v", i, low, high, gap)
+		}
+		gaps = append(gaps, gap)
+	}
+	spread := slices.Max(gaps) - slices.Min(gaps)
+	if spread < 5*time.Millisecond {
+		t.Errorf("Expected jittered gaps to vary, got %v", gaps)
+	}
+}
+
+func TestSettlementQueue_WeightedTrust(t *testing.T) {
+	tracker := trust.New(trust.Config{Threshold: 3})
+	sq := NewSettlementQueue(&paymenttest.Processor{}, tracker, 10)
+	defer sq.Close()
+	sq.SetSpacing(0)
+	sq.SetTrustUnit(big.NewInt(1000))
+
+	sq.Enqueue(jobFor(testWallet, "3000"))
+	if !waitFor(t, time.Second, func() bool { return sq.Pending() == 0 }) {
+		t.Fatalf("Expected queue to drain, %d pending", sq.Pending())
+	}
+	if got := tracker.RecentPayments(testWallet); got != 3 {
+		t.Errorf("Expected a 3-unit payment to count 3 times toward trust, got %d", got)
+	}
+}
+
+func TestSettlementQueue_RetriedSettlementBuildsLessTrust(t *testing.T) {
+	tracker := trust.New(trust.Config{Threshold: 1}) // Retried counts 0.5
+	processor := &paymenttest.Processor{FailNext: 1}
+	sq := NewSettlementQueue(processor, tracker, 10)
+	defer sq.Close()
+	sq.SetSpacing(0)
+	sq.SetRetries(2, time.Millisecond)
+
+	sq.Enqueue(jobFor(testWallet, "1000"))
+	if !waitFor(t, time.Second, func() bool { return sq.Pending() == 0 }) {
+		t.Fatalf("Expected queue to drain, %d pending", sq.Pending())
+	}
+	if _, settle := processor.Calls(); settle != 2 {
+		t.Errorf("Expected one retry (2 attempts), got %d", settle)
+	}
+	if got := tracker.RecentPayments(testWallet); got != 1 {
+		t.Fatalf("Expected the retried success to be recorded, got %d payments", got)
+	}
+	if tracker.IsTrusted(testWallet) {
+		t.Error("Expected a retried success to count less than a clean one")
+	}
+
+	// A clean success tops it up to the threshold
+	sq.Enqueue(jobFor(testWallet, "1000"))
+	if !waitFor(t, time.Second, func() bool { return tracker.IsTrusted(testWallet) }) {
+		t.Error("Expected retried + clean success to reach trust")
+	}
+}
+
+func TestSettlementQueue_RetryDoesNotBlockOtherWallets(t *testing.T) {
+	const otherWallet = "0x2222222222222222222222222222222222222222"
+	processor := &paymenttest.Processor{FailNext: 1}
+	sq := NewSettlementQueue(processor, nil, 10)
+	sq.SetSpacing(0)
+	sq.SetRetries(1, time.Hour)
+	sq.SetShutdownGrace(0)
+
+	// The first settlement fails and is held for its retry
+	sq.Enqueue(jobFor(testWallet, "1000"))
+	if !waitFor(t, time.Second, func() bool { _, settle := processor.Calls(); return settle == 1 }) {
+		t.Fatal("Expected the first settlement attempt")
+	}
+
+	// Meanwhile the worker settles other wallets, and keeps the retrying
+	// wallet's later payment behind its retry
+	sq.Enqueue(jobFor(testWallet, "1000"))
+	sq.Enqueue(jobFor(otherWallet, "1000"))
+	if !waitFor(t, time.Second, func() bool { return sq.Pending() == 2 }) {
+		t.Fatalf("Expected another wallet to settle during the retry delay, %d pending", sq.Pending())
+	}
+	if _, settle := processor.Calls(); settle != 2 {
+		t.Errorf("Expected only the other wallet settled meanwhile, got %d attempts", settle)
+	}
+	if r := sq.RecentSettlements(); len(r) != 1 || r[0].Wallet != otherWallet {
+		t.Errorf("Expected one receipt, for the other wallet, got %+v", r)
+	}
+
+	// Shutdown drops the held retry rather than waiting it out
+	sq.Close()
+	if sq.Pending() != 0 {
+		t.Errorf("Expected held jobs dropped at shutdown, %d pending", sq.Pending())
+	}
+}
+
+func TestSettlementQueue_RetriesExhausted(t *testing.T) {
+	tracker := trust.New(trust.Config{Threshold: 10})
+	tracker.RecordSuccess(testWallet)
+	processor := &paymenttest.Processor{FailNext: 5}
+	sq := NewSettlementQueue(processor, tracker, 10)
+	defer sq.Close()
+	sq.SetSpacing(0)
+	sq.SetRetries(2, time.Millisecond)
+	sq.SetBlockUnsettleable(true)
+
+	sq.Enqueue(jobFor(testWallet, "1000"))
+	if !waitFor(t, time.Second, func() bool { return sq.Pending() == 0 }) {
+		t.Fatalf("Expected queue to drain, %d pending", sq.Pending())
+	}
+	if _, settle := processor.Calls(); settle != 3 {
+		t.Errorf("Expected 3 attempts, got %d", settle)
+	}
+	if got := tracker.RecentPayments(testWallet); got != 0 {
+		t.Errorf("Expected failure after retries to clear trust history, got %d", got)
+	}
+	if tracker.IsBlocked(testWallet) {
+		t.Error("Expected a transient failure not to block the wallet")
+	}
+}
+
+func TestSettlementQueue_PermanentFailure(t *testing.T) {
+	tracker := trust.New(trust.Config{Threshold: 10})
+	tracker.RecordSuccess(testWallet)
+	processor := &paymenttest.Processor{FailSettle: "invalid_exact_evm_insufficient_balance"}
+	sq := NewSettlementQueue(processor, tracker, 10)
+	defer sq.Close()
+	sq.SetSpacing(0)
+	sq.SetRetries(2, time.Millisecond)
+	sq.SetBlockUnsettleable(true)
+
+	sq.Enqueue(jobFor(testWallet, "1000"))
+	if !waitFor(t, time.Second, func() bool { return sq.Pending() == 0 }) {
+		t.Fatalf("Expected queue to drain, %d pending", sq.Pending())
+	}
+	if _, settle := processor.Calls(); settle != 1 {
+		t.Errorf("Expected a permanent failure not to be retried, got %d attempts", settle)
+	}
+	if got := tracker.RecentPayments(testWallet); got != 0 {
+		t.Errorf("Expected the failure to clear trust history, got %d", got)
+	}
+	if !tracker.IsBlocked(testWallet) {
+		t.Error("Expected the wallet to be blocked")
+	}
+}
+
+// numberedProcessor is a paymenttest.Processor whose settlements get distinct
+// transaction hashes, 0xtx1, 0xtx2, ...
+type numberedProcessor struct {
+	*paymenttest.Processor
+}
+
+func (n *numberedProcessor) ProcessSettlement(ctx context.Context, payload x402.PaymentPayload, requirements x402.PaymentRequirements) *x402http.ProcessSettleResult {
+	result := n.Processor.ProcessSettlement(ctx, payload, requirements)
+	_, settle := n.Calls()
+	result.Transaction = fmt.Sprintf("0xtx%d", settle)
+	return result
+}
+
+func TestSettlementQueue_RecentSettlements(t *testing.T) {
+	processor := &numberedProcessor{&paymenttest.Processor{}}
+	sq := NewSettlementQueue(processor, nil, 200)
+	defer sq.Close()
+	sq.SetSpacing(0)
+
+	for i := 0; i < 3; i++ {
+		sq.Enqueue(jobFor(testWallet, "1000"))
+	}
+	if !waitFor(t, time.Second, func() bool { return len(sq.RecentSettlements()) == 3 }) {
+		t.Fatalf("Expected 3 receipts, got %d", len(sq.RecentSettlements()))
+	}
+	for i, r := range sq.RecentSettlements() {
+		if want := fmt.Sprintf("0xtx%d", i+1); r.Transaction != want {
+			t.Errorf("Receipt %d: expected %s, got %s", i, want, r.Transaction)
+		}
+		if r.Wallet != testWallet || r.Amount != "1000" || r.SettledAt.IsZero() {
+			t.Errorf("Receipt %d incomplete: %+v", i, r)
+		}
+	}
+
+	// Past receiptHistory the oldest receipts are dropped, order preserved
+	for i := 0; i < receiptHistory; i++ {
+		sq.Enqueue(jobFor(testWallet, "1000"))
+	}
+	if !waitFor(t, 5*time.Second, func() bool { return sq.Pending() == 0 }) {
+		t.Fatalf("Expected queue to drain, %d pending", sq.Pending())
+	}
+	recent := sq.RecentSettlements()
+	if len(recent) != receiptHistory {
+		t.Fatalf("Expected %d receipts, got %d", receiptHistory, len(recent))
+	}
+	if recent[0].Transaction != "0xtx4" || recent[len(recent)-1].Transaction != fmt.Sprintf("0xtx%d", receiptHistory+3) {
+		t.Errorf("Expected receipts 0xtx4..0xtx%d, got %s..%s",
+			receiptHistory+3, recent[0].Transaction, recent[len(recent)-1].Transaction)
+	}
+}
+
+// sequenceProcessor is a paymenttest.Processor that records the amount and
+// time of each settlement, so tests can tag jobs with sequence numbers.
+type sequenceProcessor struct {
+	*paymenttest.Processor
+	mu      sync.Mutex
+	amounts map[string][]string
+	times   map[string][]time.Time
+}
+
+func (p *sequenceProcessor) ProcessSettlement(ctx context.Context, payload x402.PaymentPayload, requirements x402.PaymentRequirements) *x402http.ProcessSettleResult {
+	from, _ := payload.Payload["from"].(string)
+	p.mu.Lock()
+	p.amounts[from] = append(p.amounts[from], requirements.Amount)
+	p.times[from] = append(p.times[from], time.Now())
+	p.mu.Unlock()
+	return p.Processor.ProcessSettlement(ctx, payload, requirements)
+}
+
+// sequenceJob is jobFor tagged with seq as its amount, with the payer in the
+// payload for sequenceProcessor.
+func sequenceJob(wallet string, seq int) SettlementJob {
+	job := jobFor(wallet, strconv.Itoa(seq))
+	job.PaymentPayload.Payload = map[string]any{"from": wallet}
+	return job
+}
+
+func TestSettlementQueue_SameWalletFIFO(t *testing.T) {
+	processor := &sequenceProcessor{
+		Processor: &paymenttest.Processor{},
+		amounts:   make(map[string][]string),
+		times:     make(map[string][]time.Time),
+	}
+	sq := NewSettlementQueue(processor, nil, 20)
+	const spacing = 20 * time.Millisecond
+	sq.SetSpacing(spacing)
+
+	// Two wallets interleaved, each tagged with its own sequence
+	const other = "0x2222222222222222222222222222222222222222"
+	for i := 1; i <= 5; i++ {
+		sq.Enqueue(sequenceJob(testWallet, i))
+		if i <= 3 {
+			sq.Enqueue(sequenceJob(other, 100+i))
+		}
+	}
+	if !waitFor(t, 5*time.Second, func() bool { return sq.Pending() == 0 }) {
+		t.Fatalf("Expected queue to drain, %d pending", sq.Pending())
+	}
+	sq.Close()
+
+	processor.mu.Lock()
+	defer processor.mu.Unlock()
+	for wallet, want := range map[string][]string{
+		testWallet: {"1", "2", "3", "4", "5"},
+		other:      {"101", "102", "103"},
+	} {
+		if got := processor.amounts[wallet]; !slices.Equal(got, want) {
+			t.Errorf("Wallet %s: expected settlements in enqueue order %v, got %v", truncateWallet(wallet), want, got)
+		}
+		// Each waited out the spacing after the one before
+		times := processor.times[wallet]
+		for i := 1; i < len(times); i++ {
+			if gap := times[i].Sub(times[i-1]); gap < spacing {
+				t.Errorf("Wallet %s: settlement %d only %v after the previous", truncateWallet(wallet), i+1, gap)
+			}
+		}
+	}
+}
+
+// hangingProcessor is a paymenttest.Processor whose settlements hang until their
+// context is cancelled, reporting the context's error on cancelled.
+type hangingProcessor struct {
+	*paymenttest.Processor
+	started   chan struct{}
+	cancelled chan error
+}
+
+func (h *hangingProcessor) ProcessSettlement(ctx context.Context, payload x402.PaymentPayload, requirements x402.PaymentRequirements) *x402http.ProcessSettleResult {
+	close(h.started)
+	<-ctx.Done()
+	h.cancelled <- ctx.Err()
+	return &x402http.ProcessSettleResult{Success: false, ErrorReason: ctx.Err().Error()}
+}
+
+func TestSettlementQueue_CloseCancelsHungSettlement(t *testing.T) {
+	processor := &hangingProcessor{
+		Processor: &paymenttest.Processor{},
+		started:   make(chan struct{}),
+		cancelled: make(chan error, 1),
+	}
+	tracker := trust.New(trust.Config{Threshold: 1})
+	tracker.RecordSuccess(testWallet)
+
+	sq := NewSettlementQueue(processor, tracker, 10)
+	sq.SetShutdownGrace(20 * time.Millisecond)
+	sq.Enqueue(jobFor(testWallet, "1000"))
+	sq.Enqueue(jobFor(testWallet, "1000")) // Still queued at shutdown
+	<-processor.started
+
+	closed := make(chan struct{})
+	go func() {
+		sq.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected Close to return once the grace period passed")
+	}
+
+	select {
+	case err := <-processor.cancelled:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected the settlement context to be cancelled, got %v", err)
+		}
+	default:
+		t.Fatal("Expected the hung settlement to see its context cancelled")
+	}
+	if sq.Pending() != 0 {
+		t.Errorf("Expected the remaining job to be dropped, %d pending", sq.Pending())
+	}
+	if !tracker.IsTrusted(testWallet) {
+		t.Error("Expected a shutdown cancellation not to revoke trust")
+	}
+}
+
+func TestSettlementQueue_ShutdownInterruptsSpacingWait(t *testing.T) {
+	processor := &paymenttest.Processor{}
+	sq := NewSettlementQueue(processor, nil, 10)
+	sq.SetSpacing(time.Minute)
+	sq.Enqueue(jobFor(testWallet, "1000"))
+	sq.Enqueue(jobFor(testWallet, "1000")) // Waits a minute behind the first
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		if _, settle := processor.Calls(); settle == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the first job to settle")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := sq.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline to cut the queue off, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected Shutdown to return soon after its deadline, took %v", elapsed)
+	}
+
+	if _, settle := processor.Calls(); settle != 1 {
+		t.Errorf("Expected the waiting job abandoned, not settled; %d settlements", settle)
+	}
+	if sq.Pending() != 0 {
+		t.Errorf("Expected nothing pending after shutdown, got %d", sq.Pending())
+	}
+}
+
+func TestSettlementQueue_ShutdownDrainsWithinDeadline(t *testing.T) {
+	processor := &paymenttest.Processor{}
+	sq := NewSettlementQueue(processor, nil, 10)
+	sq.Enqueue(jobFor(testWallet, "1000"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := sq.Shutdown(ctx); err != nil {
+		t.Errorf("Expected a clean shutdown, got %v", err)
+	}
+	if _, settle := processor.Calls(); settle != 1 {
+		t.Errorf("Expected the queued job settled before shutdown returned, got %d settlements", settle)
+	}
+}
+
+func TestSettlementQueue_BufferBackpressure(t *testing.T) {
+	processor := &paymenttest.Processor{Block: make(chan struct{})}
+	sq := NewSettlementQueueWithWorkers(processor, nil, 3, 1)
+	defer sq.Close()
+	sq.SetSpacing(0)
+
+	// The worker holds the first job; the buffer takes three more
+	sq.Enqueue(jobFor(testWallet, "1000"))
+	if !waitFor(t, time.Second, func() bool { return len(sq.shards[0].jobs) == 0 }) {
+		t.Fatal("Worker never picked up the first job")
+	}
+	for i := 0; i < 3; i++ {
+		sq.Enqueue(jobFor(testWallet, "1000"))
+	}
+
+	// The next waits for room
+	enqueued := make(chan struct{})
+	go func() {
+		sq.Enqueue(jobFor(testWallet, "1000"))
+		close(enqueued)
+	}()
+	select {
+	case <-enqueued:
+		t.Fatal("Expected Enqueue to block once the buffer of 3 was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(processor.Block)
+	select {
+	case <-enqueued:
+	case <-time.After(time.Second):
+		t.Fatal("Expected Enqueue to return once the worker made room")
+	}
+	if !waitFor(t, time.Second, func() bool { return sq.Pending() == 0 }) {
+		t.Fatalf("Expected queue to drain, %d pending", sq.Pending())
+	}
+	if _, settled := processor.Calls(); settled != 5 {
+		t.Errorf("Expected 5 settlements, got %d", settled)
+	}
+}
+
+// concurrentProcessor is a paymenttest.Processor whose settlements wait for
+// release, counting how many run at once.
+type concurrentProcessor struct {
+	*paymenttest.Processor
+	release chan struct{}
+
+	mu      sync.Mutex
+	running int
+	peak    int
+}
+
+func (p *concurrentProcessor) ProcessSettlement(ctx context.Context, payload x402.PaymentPayload, requirements x402.PaymentRequirements) *x402http.ProcessSettleResult {
+	p.mu.Lock()
+	p.running++
+	p.peak = max(p.peak, p.running)
+	p.mu.Unlock()
+
+	<-p.release
+
+	p.mu.Lock()
+	p.running--
+	p.mu.Unlock()
+	return p.Processor.ProcessSettlement(ctx, payload, requirements)
+}
+
+func (p *concurrentProcessor) counts() (running, peak int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.running, p.peak
+}
+
+func TestSettlementQueue_Workers(t *testing.T) {
+	processor := &concurrentProcessor{Processor: &paymenttest.Processor{}, release: make(chan struct{})}
+	sq := NewSettlementQueueWithWorkers(processor, nil, 12, 3)
+	defer sq.Close()
+	sq.SetSpacing(0)
+	if sq.Workers() != 3 {
+		t.Fatalf("Expected 3 workers, got %d", sq.Workers())
+	}
+
+	// A wallet for each worker's shard, each paying twice
+	wallets := make(map[*settlementShard]string)
+	for i := 0; len(wallets) < 3; i++ {
+		wallet := fmt.Sprintf("0x%040x", i)
+		if _, ok := wallets[sq.shardFor(wallet)]; !ok {
+			wallets[sq.shardFor(wallet)] = wallet
+		}
+	}
+	for _, wallet := range wallets {
+		sq.Enqueue(jobFor(wallet, "1000"))
+		sq.Enqueue(jobFor(wallet, "1000"))
+	}
+
+	// Every worker settles at once, but never two jobs of one wallet
+	if !waitFor(t, time.Second, func() bool { running, _ := processor.counts(); return running == 3 }) {
+		running, _ := processor.counts()
+		t.Fatalf("Expected 3 settlements running at once, got %d", running)
+	}
+	close(processor.release)
+	if !waitFor(t, time.Second, func() bool { return sq.Pending() == 0 }) {
+		t.Fatalf("Expected queue to drain, %d pending", sq.Pending())
+	}
+	if _, peak := processor.counts(); peak != 3 {
+		t.Errorf("Expected at most 3 settlements at once, peaked at %d", peak)
+	}
+}
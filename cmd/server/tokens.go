@@ -0,0 +1,48 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+)
+
+// tokensHandler reports the client's balance, rounded to granularity so
+// monitoring sees stable values. The limiter's own math is unaffected.
+func tokensHandler(limiter ratelimit.Limiter, capacity, granularity float64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := clientKey(c)
+		tokens, err := limiter.Available(key)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"client":   key,
+			"tokens":   roundTokens(tokens, granularity),
+			"capacity": capacity,
+		})
+	}
+}
+
+// roundTokens rounds tokens to the nearest multiple of step, for display.
+// A step of 0 returns tokens unchanged.
+func roundTokens(tokens, step float64) float64 {
+	if step <= 0 {
+		return tokens
+	}
+	rounded := math.Round(tokens/step) * step
+
+	// Drop the float error multiplying by step leaves, e.g. 3.8400000000000003
+	decimals := 0
+	s := strconv.FormatFloat(step, 'f', -1, 64)
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		decimals = len(s) - i - 1
+	}
+	rounded, _ = strconv.ParseFloat(strconv.FormatFloat(rounded, 'f', decimals, 64), 64)
+	return rounded
+}
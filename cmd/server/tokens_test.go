@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/memory"
+)
+
+func TestRoundTokens(t *testing.T) {
+	tests := []struct {
+		tokens, step, want float64
+	}{
+		{3.8399999, 0.01, 3.84},
+		{3.8399999, 0, 3.8399999},
+		{2.0 / 3, 0.1, 0.7},
+		{3.6, 1, 4},
+		{0.8, 0.25, 0.75},
+		{-1.234, 0.01, -1.23},
+	}
+	for _, tt := range tests {
+		if got := roundTokens(tt.tokens, tt.step); got != tt.want {
+			t.Errorf("roundTokens(%v, %v) = %v, want %v", tt.tokens, tt.step, got, tt.want)
+		}
+	}
+}
+
+func TestTokensHandler_Granularity(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	limiter := memory.NewTokenBucket(4, 0.000001)
+	limiter.AllowN("", 1.0/3) // 3.666... left
+	r := gin.New()
+	r.GET("/tokens", tokensHandler(limiter, 4, 0.01))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/tokens", nil))
+	var body struct {
+		Tokens float64 `json:"tokens"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Failed to decode body: %v", err)
+	}
+	if body.Tokens != 3.67 {
+		t.Errorf("Expected tokens reported as 3.67, got %v", body.Tokens)
+	}
+
+	// The limiter still holds the exact balance: the rounded-up figure
+	// can't be spent
+	if allowed, _ := limiter.AllowN("", 3.67); allowed {
+		t.Error("Expected a cost of the rounded balance to be denied")
+	}
+	if allowed, _ := limiter.AllowN("", 3.66); !allowed {
+		t.Error("Expected a cost just under the exact balance to be allowed")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"sync"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+	x402http "github.com/coinbase/x402/go/http"
+)
+
+// defaultVerifyCacheMaxEntries caps the verifications a verifyCache holds
+// when no cap is configured.
+const defaultVerifyCacheMaxEntries = 10000
+
+// verifyCache is a PaymentProcessor that remembers verified payments for a
+// short TTL, so an HTTP library retrying a request with the same payment
+// header doesn't cost another facilitator round trip. Entries are keyed by
+// the request's method, path and payment header. Settling a payment, or
+// failing to, drops its entry, so a retry after settlement is verified
+// afresh and rejected if the payment was spent. At most max entries are
+// held; past that the oldest is dropped early.
+type verifyCache struct {
+	next PaymentProcessor
+	ttl  time.Duration
+	max  int
+	now  func() time.Time
+
+	mu        sync.Mutex
+	entries   map[[sha256.Size]byte]*list.Element
+	byPayload map[[sha256.Size]byte][sha256.Size]byte // payload hash → entry key
+	order     *list.List                              // *verifyEntry, most recently stored at the front
+}
+
+type verifyEntry struct {
+	key     [sha256.Size]byte
+	payload [sha256.Size]byte
+	result  x402http.HTTPProcessResult
+	expires time.Time
+}
+
+// newVerifyCache wraps next, caching its verified payments for ttl. A max
+// of 0 uses defaultVerifyCacheMaxEntries.
+func newVerifyCache(next PaymentProcessor, ttl time.Duration, max int) *verifyCache {
+	if max <= 0 {
+		max = defaultVerifyCacheMaxEntries
+	}
+	return &verifyCache{
+		next:      next,
+		ttl:       ttl,
+		max:       max,
+		now:       time.Now,
+		entries:   make(map[[sha256.Size]byte]*list.Element),
+		byPayload: make(map[[sha256.Size]byte][sha256.Size]byte),
+		order:     list.New(),
+	}
+}
+
+// ProcessHTTPRequest returns the cached verification of an identical paid
+// request if there is one, and otherwise asks next, caching a verified
+// result. Requests without a payment always go to next.
+func (v *verifyCache) ProcessHTTPRequest(ctx context.Context, reqCtx x402http.HTTPRequestContext, paywallConfig *x402http.PaywallConfig) x402http.HTTPProcessResult {
+	if reqCtx.PaymentHeader == "" {
+		return v.next.ProcessHTTPRequest(ctx, reqCtx, paywallConfig)
+	}
+
+	key := sha256.Sum256([]byte(reqCtx.Method + " " + reqCtx.Path + "\n" + reqCtx.PaymentHeader))
+	if result, ok := v.lookup(key); ok {
+		return result
+	}
+
+	result := v.next.ProcessHTTPRequest(ctx, reqCtx, paywallConfig)
+	if result.Type == x402http.ResultPaymentVerified && result.PaymentPayload != nil && result.PaymentRequirements != nil {
+		if payload, err := payloadHash(*result.PaymentPayload); err == nil {
+			v.store(key, payload, result)
+		}
+	}
+	return result
+}
+
+// ProcessSettlement settles through next, dropping the payment's cached
+// verification whatever the outcome.
+func (v *verifyCache) ProcessSettlement(ctx context.Context, payload x402.PaymentPayload, requirements x402.PaymentRequirements) *x402http.ProcessSettleResult {
+	if hash, err := payloadHash(payload); err == nil {
+		v.forget(hash)
+	}
+	return v.next.ProcessSettlement(ctx, payload, requirements)
+}
+
+// lookup returns a copy of the unexpired result cached under key.
+func (v *verifyCache) lookup(key [sha256.Size]byte) (x402http.HTTPProcessResult, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.expire(v.now())
+	el, ok := v.entries[key]
+	if !ok {
+		return x402http.HTTPProcessResult{}, false
+	}
+
+	// Copy what the middleware may touch, so requests don't share it
+	result := el.Value.(*verifyEntry).result
+	payload := *result.PaymentPayload
+	requirements := *result.PaymentRequirements
+	result.PaymentPayload, result.PaymentRequirements = &payload, &requirements
+	return result, true
+}
+
+// store caches result under key, dropping the oldest entry past max.
+func (v *verifyCache) store(key, payload [sha256.Size]byte, result x402http.HTTPProcessResult) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := v.now()
+	v.expire(now)
+	if el, ok := v.entries[key]; ok {
+		v.remove(el)
+	}
+	v.entries[key] = v.order.PushFront(&verifyEntry{key: key, payload: payload, result: result, expires: now.Add(v.ttl)})
+	v.byPayload[payload] = key
+	if v.order.Len() > v.max {
+		v.remove(v.order.Back())
+	}
+}
+
+// forget drops the cached verification of the payload hashing to hash.
+func (v *verifyCache) forget(hash [sha256.Size]byte) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if key, ok := v.byPayload[hash]; ok {
+		if el, ok := v.entries[key]; ok {
+			v.remove(el)
+		}
+		delete(v.byPayload, hash)
+	}
+}
+
+// expire drops entries whose TTL has passed. Every entry has the same TTL,
+// so they're the oldest, at the back. The caller holds mu.
+func (v *verifyCache) expire(now time.Time) {
+	for el := v.order.Back(); el != nil && !now.Before(el.Value.(*verifyEntry).expires); el = v.order.Back() {
+		v.remove(el)
+	}
+}
+
+// remove drops el's entry. The caller holds mu.
+func (v *verifyCache) remove(el *list.Element) {
+	entry := v.order.Remove(el).(*verifyEntry)
+	delete(v.entries, entry.key)
+	if v.byPayload[entry.payload] == entry.key {
+		delete(v.byPayload, entry.payload)
+	}
+}
+
+// payloadHash identifies a payment payload, matching the copy settlement is
+// given to the one verification returned.
+func payloadHash(payload x402.PaymentPayload) ([sha256.Size]byte, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(data), nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	x402http "github.com/coinbase/x402/go/http"
+	"github.com/haseeb/ratelimiter/internal/paymenttest"
+)
+
+func verifyRequest(path, header string) x402http.HTTPRequestContext {
+	return x402http.HTTPRequestContext{Method: "GET", Path: path, PaymentHeader: header}
+}
+
+func TestVerifyCache_ReusesVerification(t *testing.T) {
+	processor := &paymenttest.Processor{}
+	cache := newVerifyCache(processor, time.Minute, 0)
+	ctx := context.Background()
+
+	first := cache.ProcessHTTPRequest(ctx, verifyRequest("/cpu", "pay-1"), nil)
+	second := cache.ProcessHTTPRequest(ctx, verifyRequest("/cpu", "pay-1"), nil)
+	if first.Type != x402http.ResultPaymentVerified || second.Type != x402http.ResultPaymentVerified {
+		t.Fatalf("Expected both requests verified, got %v and %v", first.Type, second.Type)
+	}
+	if verify, _ := processor.Calls(); verify != 1 {
+		t.Errorf("Expected a retried request verified once, got %d verifications", verify)
+	}
+	if first.PaymentPayload == second.PaymentPayload {
+		t.Error("Expected each request its own copy of the payload")
+	}
+
+	// Another path or payment is a different request
+	cache.ProcessHTTPRequest(ctx, verifyRequest("/memory", "pay-1"), nil)
+	cache.ProcessHTTPRequest(ctx, verifyRequest("/cpu", "pay-2"), nil)
+	if verify, _ := processor.Calls(); verify != 3 {
+		t.Errorf("Expected other paths and payments verified separately, got %d verifications", verify)
+	}
+}
+
+func TestVerifyCache_Expires(t *testing.T) {
+	processor := &paymenttest.Processor{}
+	cache := newVerifyCache(processor, time.Minute, 0)
+	now := time.Unix(1000, 0)
+	cache.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	cache.ProcessHTTPRequest(ctx, verifyRequest("/cpu", "pay-1"), nil)
+	now = now.Add(time.Minute)
+	cache.ProcessHTTPRequest(ctx, verifyRequest("/cpu", "pay-1"), nil)
+	if verify, _ := processor.Calls(); verify != 2 {
+		t.Errorf("Expected a retry after the TTL verified again, got %d verifications", verify)
+	}
+}
+
+func TestVerifyCache_EvictsOldestPastMax(t *testing.T) {
+	processor := &paymenttest.Processor{}
+	cache := newVerifyCache(processor, time.Minute, 2)
+	ctx := context.Background()
+
+	for _, header := range []string{"pay-1", "pay-2", "pay-3"} {
+		cache.ProcessHTTPRequest(ctx, verifyRequest("/cpu", header), nil)
+	}
+	if n := len(cache.entries); n != 2 {
+		t.Fatalf("Expected the cache capped at 2 entries, got %d", n)
+	}
+
+	// The newest two are still cached; the oldest went first
+	cache.ProcessHTTPRequest(ctx, verifyRequest("/cpu", "pay-2"), nil)
+	cache.ProcessHTTPRequest(ctx, verifyRequest("/cpu", "pay-3"), nil)
+	if verify, _ := processor.Calls(); verify != 3 {
+		t.Errorf("Expected the newest entries reused, got %d verifications", verify)
+	}
+	cache.ProcessHTTPRequest(ctx, verifyRequest("/cpu", "pay-1"), nil)
+	if verify, _ := processor.Calls(); verify != 4 {
+		t.Errorf("Expected the evicted entry verified again, got %d verifications", verify)
+	}
+}
+
+func TestVerifyCache_SettlementInvalidates(t *testing.T) {
+	processor := &paymenttest.Processor{}
+	cache := newVerifyCache(processor, time.Minute, 0)
+	ctx := context.Background()
+
+	result := cache.ProcessHTTPRequest(ctx, verifyRequest("/cpu", "pay-1"), nil)
+	if settle := cache.ProcessSettlement(ctx, *result.PaymentPayload, *result.PaymentRequirements); !settle.Success {
+		t.Fatalf("Expected settlement to succeed, got %q", settle.ErrorReason)
+	}
+
+	// A spent payment must go back to the facilitator, which would reject it
+	processor.SetRejectPay(true)
+	if retry := cache.ProcessHTTPRequest(ctx, verifyRequest("/cpu", "pay-1"), nil); retry.Type == x402http.ResultPaymentVerified {
+		t.Error("Expected a retry after settlement verified afresh")
+	}
+	if verify, _ := processor.Calls(); verify != 2 {
+		t.Errorf("Expected 2 verifications, got %d", verify)
+	}
+}
+
+func TestVerifyCache_IgnoresUnpaidAndRejected(t *testing.T) {
+	processor := &paymenttest.Processor{RejectPay: true}
+	cache := newVerifyCache(processor, time.Minute, 0)
+	ctx := context.Background()
+
+	cache.ProcessHTTPRequest(ctx, verifyRequest("/cpu", "pay-1"), nil)
+	processor.SetRejectPay(false)
+	if result := cache.ProcessHTTPRequest(ctx, verifyRequest("/cpu", "pay-1"), nil); result.Type != x402http.ResultPaymentVerified {
+		t.Errorf("Expected a rejection not cached, got %v", result.Type)
+	}
+	if result := cache.ProcessHTTPRequest(ctx, verifyRequest("/cpu", ""), nil); result.Type == x402http.ResultPaymentVerified {
+		t.Error("Expected a request without payment to get the 402")
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/haseeb/ratelimiter/internal/middleware"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+)
+
+// waitHeader lets patient clients, such as batch jobs, ask to be held until
+// their bucket can pay for a request rather than be turned away.
+const waitHeader = "X-RateLimit-Wait"
+
+// wantsWait reports whether c's client asked to wait and waiting is enabled.
+func wantsWait(c *gin.Context, maxWait time.Duration) bool {
+	return maxWait > 0 && strings.EqualFold(c.GetHeader(waitHeader), "true")
+}
+
+// holdForTokens holds c until key's bucket can pay cost, for at most
+// opts.MaxWait, and returns true once the tokens are taken. Otherwise it has
+// answered c: 429 when the wait runs out, and nothing to a client that went
+// away.
+func holdForTokens(c *gin.Context, limiter ratelimit.Limiter, key string, cost float64, opts middleware.Options, events *eventHub) bool {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), opts.MaxWait)
+	defer cancel()
+
+	err := ratelimit.WaitN(ctx, limiter, key, cost, opts.RefillRate)
+	switch {
+	case err == nil:
+		return true
+	case c.Request.Context().Err() != nil:
+		c.Abort()
+	case errors.Is(err, ratelimit.ErrWaitExceeded), errors.Is(err, context.DeadlineExceeded):
+		events.Publish(Event{Type: eventRequestDenied, Key: key, Reason: "wait_exceeded"})
+		c.Header("Retry-After", middleware.RetryAfter(limiter, key, opts))
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error":   "Too Many Requests",
+			"message": "No token became available within the maximum wait.",
+		})
+		c.Abort()
+	default:
+		abortLimiterError(c, err)
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/haseeb/ratelimiter/internal/middleware"
+	"github.com/haseeb/ratelimiter/internal/paymenttest"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/memory"
+)
+
+// doWaitRequest sends GET /cpu asking to wait for a token.
+func doWaitRequest(ctx context.Context, r http.Handler) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/cpu", nil).WithContext(ctx)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set(waitHeader, "true")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func newWaitRouter(refillRate float64, maxWait time.Duration) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(simpleRateLimitMiddleware(memory.NewTokenBucket(1, refillRate), middleware.Options{
+		RefillRate: refillRate,
+		MaxWait:    maxWait,
+	}, newEventHub()))
+	r.GET("/cpu", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+	return r
+}
+
+func TestSimpleMiddleware_WaitsForRefill(t *testing.T) {
+	r := newWaitRouter(20, time.Second) // A token every 50ms
+	doRequest(r, "")
+
+	// Without the header the empty bucket rejects at once
+	if w := doRequest(r, ""); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 without %s, got %d", waitHeader, w.Code)
+	}
+
+	// With it the request is held until the refill, then served
+	start := time.Now()
+	if w := doWaitRequest(context.Background(), r); w.Code != http.StatusOK {
+		t.Fatalf("Expected the waiting request to be served, got %d", w.Code)
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Errorf("Expected the request to be held for the refill, served after %v", waited)
+	}
+}
+
+func TestSimpleMiddleware_WaitExceeded(t *testing.T) {
+	r := newWaitRouter(1, 100*time.Millisecond) // A token a second
+	doRequest(r, "")
+
+	start := time.Now()
+	w := doWaitRequest(context.Background(), r)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 once the max wait can't be met, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Expected Retry-After on the 429")
+	}
+	if waited := time.Since(start); waited > 500*time.Millisecond {
+		t.Errorf("Expected the request to be held no longer than the max wait, took %v", waited)
+	}
+
+	// A client that goes away is let go
+	r = newWaitRouter(1, time.Minute)
+	doRequest(r, "")
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start = time.Now()
+	if w := doWaitRequest(ctx, r); w.Code == http.StatusOK && w.Body.Len() > 0 {
+		t.Errorf("Expected a cancelled request not to be served, got %d: %s", w.Code, w.Body.String())
+	}
+	if waited := time.Since(start); waited > 500*time.Millisecond {
+		t.Errorf("Expected cancellation to end the wait, took %v", waited)
+	}
+}
+
+func TestHybridMiddleware_WaitInsteadOfPaying(t *testing.T) {
+	processor := &paymenttest.Processor{}
+	r := newTestRouter(hybridConfig{
+		Limiter:    memory.NewTokenBucket(1, 20),
+		Payments:   processor,
+		Capacity:   1,
+		MaxWait:    time.Second,
+		RefillRate: 20,
+	})
+	doRequest(r, "")
+
+	if w := doWaitRequest(context.Background(), r); w.Code != http.StatusOK {
+		t.Fatalf("Expected the waiting request to be served without a 402, got %d", w.Code)
+	}
+	if verify, settle := processor.Calls(); verify != 0 || settle != 0 {
+		t.Errorf("Expected no payment processing, got %d verifications and %d settlements", verify, settle)
+	}
+}
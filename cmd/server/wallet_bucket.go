@@ -0,0 +1,38 @@
+package main
+
+import "github.com/haseeb/ratelimiter/pkg/ratelimit"
+
+// walletBucketPrefix keeps wallet buckets apart from IP buckets in the
+// limiter.
+const walletBucketPrefix = "wallet:"
+
+// walletBucketKey returns the limiter key of wallet's bucket.
+func walletBucketKey(wallet string) string {
+	return walletBucketPrefix + wallet
+}
+
+// walletLimiter is a limiter that can hold wallet buckets: it keeps a
+// bucket per key, tells a bucket never used from a full one, and can create
+// one empty, so a wallet's bucket holds only what the wallet paid for.
+type walletLimiter interface {
+	ratelimit.Limiter
+	ratelimit.Inspector
+	ratelimit.Opener
+}
+
+// allowWalletBucket takes cost from the wallet bucket at key. A wallet
+// that has never paid has no bucket, and is denied.
+func allowWalletBucket(limiter walletLimiter, key string, cost float64) (bool, error) {
+	info, err := limiter.Info(key)
+	if err != nil || info.CreatedAt.IsZero() {
+		return false, err
+	}
+	return limiter.AllowN(key, cost)
+}
+
+// openWalletBucket creates the wallet bucket at key empty if it has never
+// been used, so the wallet's first refill doesn't land on a full bucket.
+func openWalletBucket(limiter walletLimiter, key string) error {
+	_, err := limiter.Open(key)
+	return err
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/redis/go-redis/v9"
+
+	"github.com/haseeb/ratelimiter/internal/paymenttest"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/bucket"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/memory"
+	ratelimitredis "github.com/haseeb/ratelimiter/pkg/ratelimit/redis"
+)
+
+func TestHybridMiddleware_WalletBuckets(t *testing.T) {
+	limiters := map[string]func(t *testing.T) walletLimiter{
+		"redis": func(t *testing.T) walletLimiter {
+			mr := miniredis.RunT(t)
+			client := goredis.NewClient(&goredis.Options{Addr: mr.Addr()})
+			t.Cleanup(func() { client.Close() })
+			return ratelimitredis.NewTokenBucket(ratelimitredis.Config{Client: client, Capacity: 2, RefillRate: 0.001})
+		},
+		"memory": func(t *testing.T) walletLimiter {
+			return bucket.New(memory.NewStore(), 2, 0.001)
+		},
+	}
+	for name, newLimiter := range limiters {
+		t.Run(name, func(t *testing.T) {
+			testWalletBuckets(t, newLimiter(t))
+		})
+	}
+}
+
+// testWalletBuckets checks that a wallet's paid tokens follow it across IPs.
+func testWalletBuckets(t *testing.T, limiter walletLimiter) {
+	processor := &paymenttest.Processor{}
+	r := newTestRouter(hybridConfig{
+		Limiter:       limiter,
+		Payments:      processor,
+		Capacity:      2,
+		WalletBuckets: true,
+	})
+	from := func(ip, paymentHeader string) int {
+		req := httptest.NewRequest(http.MethodGet, "/cpu", nil)
+		req.RemoteAddr = ip + ":1234"
+		if paymentHeader != "" {
+			req.Header.Set("PAYMENT-SIGNATURE", paymentHeader)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	payment := paymentHeaderFor(testWallet)
+
+	// A wallet with no bucket yet pays, filling its bucket rather than the IP's
+	from("192.0.2.1", "")
+	from("192.0.2.1", "")
+	if code := from("192.0.2.1", payment); code != http.StatusOK {
+		t.Fatalf("Expected the first payment to be settled and served, got %d", code)
+	}
+	if code := from("192.0.2.1", ""); code != http.StatusPaymentRequired {
+		t.Errorf("Expected the paying IP's bucket to stay empty, got %d", code)
+	}
+	if tokens, _ := limiter.Available(walletBucketKey(testWallet)); tokens < 1.99 || tokens > 2.01 {
+		t.Fatalf("Expected the wallet bucket to hold the 2 paid tokens, got %g", tokens)
+	}
+
+	// From another IP, once its own bucket is empty, the wallet's paid
+	// tokens serve the request without another settlement
+	from("198.51.100.7", "")
+	from("198.51.100.7", "")
+	for i := 0; i < 2; i++ {
+		if code := from("198.51.100.7", payment); code != http.StatusOK {
+			t.Fatalf("Request %d: expected to be served from the wallet bucket, got %d", i+1, code)
+		}
+	}
+	if _, settle := processor.Calls(); settle != 1 {
+		t.Errorf("Expected the wallet bucket to be spent before paying again, got %d settlements", settle)
+	}
+
+	// With the wallet bucket spent, the payment is settled again
+	if code := from("198.51.100.7", payment); code != http.StatusOK {
+		t.Fatalf("Expected a second payment to be served, got %d", code)
+	}
+	if _, settle := processor.Calls(); settle != 2 {
+		t.Errorf("Expected a second settlement, got %d", settle)
+	}
+}
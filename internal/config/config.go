@@ -1,10 +1,16 @@
 package config
 
 import (
+	"fmt"
+	"net"
 	"os"
+	"regexp"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
+
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
 )
 
 // Config holds all configuration for the server.
@@ -13,18 +19,94 @@ type Config struct {
 	RateLimit RateLimitConfig `yaml:"ratelimit"`
 	Payment   PaymentConfig   `yaml:"payment"`
 	Redis     RedisConfig     `yaml:"redis"`
+	Admin     AdminConfig     `yaml:"admin"`
+}
+
+// AdminConfig holds configuration for the operator endpoints used by ratelimitctl.
+type AdminConfig struct {
+	Token string `yaml:"token"` // Bearer token for /admin endpoints (empty disables them)
 }
 
 // ServerConfig holds server-related configuration.
 type ServerConfig struct {
-	Port string `yaml:"port"`
+	Port           string   `yaml:"port"`
+	TrustedProxies []string `yaml:"trusted_proxies"` // Proxy CIDRs/IPs whose X-Forwarded-For is honoured (empty trusts none)
+
+	// How log lines show client IPs and wallets
+	LogRedaction     string `yaml:"log_redaction"`      // "none" (default), "mask" or "hash"
+	LogRedactionSalt string `yaml:"log_redaction_salt"` // Secret salt for "hash" digests
+
+	TokenGranularity float64 `yaml:"token_granularity"` // Step /tokens rounds balances to, e.g. 0.01 (0 = full precision)
 }
 
 // RateLimitConfig holds rate limiter configuration.
 type RateLimitConfig struct {
-	Capacity   float64 `yaml:"capacity"`
-	RefillRate float64 `yaml:"refill_rate"`
-	Strategy   string  `yaml:"strategy"` // "memory" or "redis"
+	Capacity      float64 `yaml:"capacity"`
+	BurstCapacity float64 `yaml:"burst_capacity"` // Cap on paid refills (0 = uncapped)
+	GraceOverage  float64 `yaml:"grace_overage"`  // Tokens a client may spend past zero before 402 (0 = none)
+	RefillRate    float64 `yaml:"refill_rate"`
+	Strategy      string  `yaml:"strategy"`  // "memory" or "redis"
+	FailOpen      bool    `yaml:"fail_open"` // Serve requests when the limiter backend is unreachable
+	DryRun        bool    `yaml:"dry_run"`   // Log and tag would-be rejections but serve every request
+
+	BurstTTL time.Duration `yaml:"burst_ttl"` // Unspent paid tokens above capacity expire this long after the last refill (0 = never)
+
+	RetryAfterFormat string `yaml:"retry_after_format"` // "seconds" (default) or "http-date"
+	RefillMode       string `yaml:"refill_mode"`        // What a paid refill does: "stack" (default), "set_floor", "exact" or "at_least"
+
+	// Request cost: by default every request costs one token
+	CostBytesPerToken int64   `yaml:"cost_bytes_per_token"` // Charge a token per this many body bytes (0 = off)
+	CostHeader        bool    `yaml:"cost_header"`          // Honour X-Request-Cost, which can only raise a request's cost
+	MaxCost           float64 `yaml:"max_cost"`             // Cap on one request's cost (0 = capacity)
+
+	MaxInFlight int           `yaml:"max_in_flight"` // Requests one client may have in flight at once (0 = unlimited)
+	MaxWait     time.Duration `yaml:"max_wait"`      // Longest a request sending X-RateLimit-Wait: true is held for a token (0 = never held)
+
+	// Hard ceiling on requests served, free or paid; past it payments are refused
+	RequestCeiling int           `yaml:"request_ceiling"` // Requests one client is served per ceiling_window (0 = no ceiling)
+	CeilingWindow  time.Duration `yaml:"ceiling_window"`  // Window request_ceiling counts over (default 1m)
+
+	RefillSchedule []RefillWindowConfig `yaml:"refill_schedule"` // Time-of-day refill rate multipliers, in server local time
+}
+
+// RefillWindowConfig scales the refill rate between two times of day.
+type RefillWindowConfig struct {
+	Start      string  `yaml:"start"`      // "HH:MM"
+	End        string  `yaml:"end"`        // "HH:MM"; earlier than start wraps past midnight
+	Multiplier float64 `yaml:"multiplier"` // Factor applied to refill_rate
+}
+
+// Schedule parses the refill schedule. It's nil when none is configured.
+func (r RateLimitConfig) Schedule() (ratelimit.RefillSchedule, error) {
+	var schedule ratelimit.RefillSchedule
+	for i, w := range r.RefillSchedule {
+		start, err := parseTimeOfDay(w.Start)
+		if err != nil {
+			return nil, fmt.Errorf("window %d start: %w", i, err)
+		}
+		end, err := parseTimeOfDay(w.End)
+		if err != nil {
+			return nil, fmt.Errorf("window %d end: %w", i, err)
+		}
+		schedule = append(schedule, ratelimit.RefillWindow{Start: start, End: end, Multiplier: w.Multiplier})
+	}
+	if err := schedule.Validate(); err != nil {
+		return nil, err
+	}
+	return schedule, nil
+}
+
+// parseTimeOfDay parses "HH:MM" as an offset from midnight. "24:00" is
+// accepted as the end of the day.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	if s == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q (want HH:MM)", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
 }
 
 // RedisConfig holds Redis connection configuration.
@@ -32,26 +114,145 @@ type RedisConfig struct {
 	Addr     string `yaml:"addr"`
 	Password string `yaml:"password"`
 	DB       int    `yaml:"db"`
+
+	// Connection pool and retries: 0 keeps go-redis's default for each
+	PoolSize     int           `yaml:"pool_size"`     // Maximum connections (default 10 per CPU)
+	DialTimeout  time.Duration `yaml:"dial_timeout"`  // Default 5s
+	ReadTimeout  time.Duration `yaml:"read_timeout"`  // Default 3s
+	WriteTimeout time.Duration `yaml:"write_timeout"` // Default read_timeout
+	MaxRetries   int           `yaml:"max_retries"`   // Retries per command (default 3, -1 disables)
+
+	ServerTime bool   `yaml:"server_time"` // Use Redis's clock for refill math, so app clock skew doesn't matter
+	Namespace  string `yaml:"namespace"`   // Tenant namespace keeping this deployment's keys apart in a shared Redis
+	HashKeys   bool   `yaml:"hash_keys"`   // Store keys as SHA-256 digests so client identifiers never reach Redis
+
+	RefillLogEvery     int `yaml:"refill_log_every"`      // Log one in N successful refills (0 or 1 logs all)
+	RefillLogPerSecond int `yaml:"refill_log_per_second"` // Cap on refill log lines per second (0 = no cap)
 }
 
 // OptimisticConfig holds optimistic settlement configuration.
 type OptimisticConfig struct {
 	Enabled        bool          `yaml:"enabled"`
-	TrustThreshold int           `yaml:"trust_threshold"` // Payments needed to become trusted
-	TrustWindow    time.Duration `yaml:"trust_window"`    // Time window for counting payments
+	TrustThreshold int           `yaml:"trust_threshold"`  // Payments needed to enter probation: still settled synchronously
+	TrustWindow    time.Duration `yaml:"trust_window"`     // Time window for counting payments
+	MaxQueueAge    time.Duration `yaml:"max_queue_age"`    // Oldest pending settlement age before the queue is unhealthy (0 disables)
+	WalletSpacing  time.Duration `yaml:"wallet_spacing"`   // Minimum gap between settlements from one wallet (default 3s)
+	SpacingJitter  float64       `yaml:"spacing_jitter"`   // Fraction of wallet_spacing each gap randomly varies by, 0-1 (default 0)
+	SettleRetries  int           `yaml:"settle_retries"`   // Extra attempts for a failed queued settlement (default 0)
+	RetriedWeight  float64       `yaml:"retried_weight"`   // Trust a retried success earns, relative to a clean one (default 0.5)
+	TrustUnitPrice string        `yaml:"trust_unit_price"` // Payment counting as one success toward trust; larger ones count more (default: every payment once)
+	SweepInterval  time.Duration `yaml:"sweep_interval"`   // How often wallets with only expired payments are dropped (0 = only trimmed when they pay)
+	MaxWallets     int           `yaml:"max_wallets"`      // Wallets tracked before the least recently active are evicted (0 = no cap)
+	MaxTrusted     int           `yaml:"max_trusted"`      // Wallets trusted at once; others stay on sync settlement until a slot frees (0 = no cap)
+	RefillTokens   float64       `yaml:"refill_tokens"`    // Tokens granted by a trusted wallet's optimistic payment (0 = same as a sync payment)
+	TrustSnapshot  string        `yaml:"trust_snapshot"`   // File trust state is saved to on shutdown and restored from on startup (empty = off)
+	QueueBuffer    int           `yaml:"queue_buffer"`     // Settlements queued before new optimistic payments wait for room (0 = 100)
+	Workers        int           `yaml:"workers"`          // Settlements run at once, each wallet's still in order (0 = 1)
+
+	OptimisticThreshold int `yaml:"optimistic_threshold"` // Payments needed to graduate from probation to optimistic settlement (0 = trust_threshold)
 }
 
 // PaymentConfig holds payment configuration for 402 responses.
 type PaymentConfig struct {
 	Enabled          bool             `yaml:"enabled"`
 	FacilitatorURL   string           `yaml:"facilitator_url"`
+	FallbackURLs     []string         `yaml:"fallback_facilitator_urls"` // Tried in order when facilitator_url fails
+	FacilitatorLog   string           `yaml:"facilitator_log"`           // Facilitator request logging: "off", "summary" (default) or "verbose"
 	WalletAddress    string           `yaml:"wallet_address"`
+	PayTo            []PayToConfig    `yaml:"pay_to"` // Receiving wallets rotated across 402s; replaces wallet_address when set
 	PricePerCapacity string           `yaml:"price_per_capacity"`
 	Network          string           `yaml:"network"`
-	Currency         string           `yaml:"currency"`
+	Currency         string           `yaml:"currency"`             // Token symbol, also its EIP-712 domain name (default "USDC")
+	Decimals         int              `yaml:"decimals"`             // Token decimals (default 6)
+	AssetAddress     string           `yaml:"asset_address"`        // Token contract (default: the network's USDC)
+	Mode             string           `yaml:"mode"`                 // "hybrid" (default), "metered" or "paid_only"
+	RefillMultiplier float64          `yaml:"refill_multiplier"`    // Tokens granted per payment, as a multiple of capacity (default 1)
+	MinInterval      time.Duration    `yaml:"min_payment_interval"` // Shortest gap between accepted payments from one wallet (0 disables)
+	PayPerRequest    bool             `yaml:"pay_per_request"`      // Each over-limit request needs its own payment; nothing is refilled
+	DeclineUnneeded  bool             `yaml:"decline_unneeded"`     // Don't settle a payment if the bucket refilled while it was verified
+	VerifyCacheTTL   time.Duration    `yaml:"verify_cache_ttl"`     // How long a verified payment is reused for retries of the same request (0 disables)
 	Optimistic       OptimisticConfig `yaml:"optimistic"`
+
+	VerifyCacheMaxEntries int `yaml:"verify_cache_max_entries"` // Cap on verified payments cached; the oldest go first (0 = 10000)
+
+	BlockUnsettleable bool `yaml:"block_unsettleable"` // Block wallets whose verified payments can't settle, e.g. insufficient balance
+
+	// Payment policy of routes by path, as registered with the router
+	// (e.g. "/items/:id"); routes not listed follow mode
+	RoutePolicies map[string]string `yaml:"route_policies"` // RoutePolicyFree, RoutePolicyHybrid or RoutePolicyPaid
+
+	// Bucket payments refill: the client IP's, or one kept for the payer's
+	// wallet and usable from any IP
+	PaidBucket string `yaml:"paid_bucket"` // PaidBucketIP (default) or PaidBucketWallet
+
+	// Replay protection: accepted payments are remembered this long, and
+	// one presented again is refused
+	ReplayWindow     time.Duration `yaml:"replay_window"`      // 0 disables
+	ReplayMaxEntries int           `yaml:"replay_max_entries"` // Cap on payments remembered; the oldest go first (0 = 100000)
+
+	// Refill escalation: a payment's tokens are scaled by the curve entry
+	// for the number of 402s its client was sent within the window
+	EscalationCurve  []float64     `yaml:"escalation_curve"`  // Multipliers for the 1st, 2nd, ... 402; the last holds for more (empty disables)
+	EscalationWindow time.Duration `yaml:"escalation_window"` // Window 402s are counted over
 }
 
+// PayToConfig is one receiving wallet and its share of advertised payments.
+type PayToConfig struct {
+	Address string `yaml:"address"`
+	Weight  int    `yaml:"weight"` // Relative share of 402s advertising this address (default 1)
+}
+
+// Wallets returns the receiving wallets: pay_to if set, otherwise
+// wallet_address alone with weight 1.
+func (p PaymentConfig) Wallets() []PayToConfig {
+	if len(p.PayTo) > 0 {
+		return p.PayTo
+	}
+	return []PayToConfig{{Address: p.WalletAddress, Weight: 1}}
+}
+
+// Facilitators returns the facilitator URLs in priority order: the primary
+// facilitator_url followed by any fallbacks.
+func (p PaymentConfig) Facilitators() []string {
+	var urls []string
+	if p.FacilitatorURL != "" {
+		urls = append(urls, p.FacilitatorURL)
+	}
+	return append(urls, p.FallbackURLs...)
+}
+
+// Payment modes for the hybrid middleware.
+const (
+	// ModeHybrid serves requests from the bucket and asks for payment once it is empty.
+	ModeHybrid = "hybrid"
+	// ModeMetered behaves like hybrid, but always processes an attached payment.
+	ModeMetered = "metered"
+	// ModePaidOnly requires a payment on every request, regardless of bucket state.
+	ModePaidOnly = "paid_only"
+)
+
+// Per-route payment policies for payment.route_policies.
+const (
+	// RoutePolicyFree never asks for payment: an empty bucket gets a 429.
+	RoutePolicyFree = "free"
+	// RoutePolicyHybrid serves from the bucket and asks for payment when
+	// it's empty, as ModeHybrid.
+	RoutePolicyHybrid = "hybrid"
+	// RoutePolicyPaid requires a payment on every request, which buys just
+	// that request.
+	RoutePolicyPaid = "paid"
+)
+
+// Buckets payment.paid_bucket may name.
+const (
+	// PaidBucketIP refills the paying client's IP bucket.
+	PaidBucketIP = "ip"
+	// PaidBucketWallet refills a bucket keyed by the payer's wallet, which
+	// the wallet spends from any IP once its IP bucket is empty. The memory
+	// strategy then keeps a bucket per key, IPs included, as Redis does.
+	PaidBucketWallet = "wallet"
+)
+
 // Load reads a YAML config file and returns a Config struct.
 func Load(path string) (*Config, error) {
 	data, err := os.ReadFile(path)
@@ -66,3 +267,286 @@ func Load(path string) (*Config, error) {
 
 	return &cfg, nil
 }
+
+// Default token for payments when none is configured.
+const (
+	DefaultCurrency = "USDC"
+	DefaultDecimals = 6
+)
+
+// pricePattern matches a decimal price with an optional leading "$", e.g. "$0.001".
+var pricePattern = regexp.MustCompile(`^\$?([0-9]+)(?:\.([0-9]+))?$`)
+
+// Validate checks the config for invalid values and fills in defaults.
+func (c *Config) Validate() error {
+	switch c.Payment.Mode {
+	case "":
+		c.Payment.Mode = ModeHybrid
+	case ModeHybrid, ModeMetered, ModePaidOnly:
+	default:
+		return fmt.Errorf("payment.mode: unknown mode %q", c.Payment.Mode)
+	}
+	for path, policy := range c.Payment.RoutePolicies {
+		switch policy {
+		case RoutePolicyFree, RoutePolicyHybrid, RoutePolicyPaid:
+		default:
+			return fmt.Errorf("payment.route_policies: unknown policy %q for %s", policy, path)
+		}
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("payment.route_policies: path %q must start with /", path)
+		}
+	}
+	switch c.Payment.PaidBucket {
+	case "":
+		c.Payment.PaidBucket = PaidBucketIP
+	case PaidBucketIP, PaidBucketWallet:
+	default:
+		return fmt.Errorf("payment.paid_bucket: unknown bucket %q", c.Payment.PaidBucket)
+	}
+
+	switch c.RateLimit.RetryAfterFormat {
+	case "":
+		c.RateLimit.RetryAfterFormat = "seconds"
+	case "seconds", "http-date":
+	default:
+		return fmt.Errorf("ratelimit.retry_after_format: unknown format %q", c.RateLimit.RetryAfterFormat)
+	}
+
+	if _, err := ratelimit.ParseRefillMode(c.RateLimit.RefillMode); err != nil {
+		return fmt.Errorf("ratelimit.refill_mode: %w", err)
+	}
+
+	switch c.Server.LogRedaction {
+	case "":
+		c.Server.LogRedaction = "none"
+	case "none", "mask", "hash":
+	default:
+		return fmt.Errorf("server.log_redaction: unknown mode %q", c.Server.LogRedaction)
+	}
+	if c.Server.TokenGranularity < 0 {
+		return fmt.Errorf("server.token_granularity: must not be negative")
+	}
+
+	switch c.Payment.FacilitatorLog {
+	case "":
+		c.Payment.FacilitatorLog = "summary"
+	case "off", "summary", "verbose":
+	default:
+		return fmt.Errorf("payment.facilitator_log: unknown level %q", c.Payment.FacilitatorLog)
+	}
+
+	if c.RateLimit.BurstTTL < 0 {
+		return fmt.Errorf("ratelimit.burst_ttl: must not be negative")
+	}
+	if c.RateLimit.GraceOverage < 0 {
+		return fmt.Errorf("ratelimit.grace_overage: must not be negative")
+	}
+	if c.RateLimit.CostBytesPerToken < 0 {
+		return fmt.Errorf("ratelimit.cost_bytes_per_token: must not be negative")
+	}
+	if c.RateLimit.MaxCost < 0 {
+		return fmt.Errorf("ratelimit.max_cost: must not be negative")
+	}
+	if c.RateLimit.MaxInFlight < 0 {
+		return fmt.Errorf("ratelimit.max_in_flight: must not be negative")
+	}
+	if c.RateLimit.RequestCeiling < 0 {
+		return fmt.Errorf("ratelimit.request_ceiling: must not be negative")
+	}
+	if c.RateLimit.MaxWait < 0 {
+		return fmt.Errorf("ratelimit.max_wait: must not be negative")
+	}
+	if c.RateLimit.CeilingWindow < 0 {
+		return fmt.Errorf("ratelimit.ceiling_window: must not be negative")
+	}
+	if c.RateLimit.CeilingWindow == 0 {
+		c.RateLimit.CeilingWindow = time.Minute
+	}
+
+	if c.Redis.PoolSize < 0 {
+		return fmt.Errorf("redis.pool_size: must not be negative")
+	}
+	if c.Redis.DialTimeout < 0 {
+		return fmt.Errorf("redis.dial_timeout: must not be negative")
+	}
+	if c.Redis.ReadTimeout < 0 {
+		return fmt.Errorf("redis.read_timeout: must not be negative")
+	}
+	if c.Redis.WriteTimeout < 0 {
+		return fmt.Errorf("redis.write_timeout: must not be negative")
+	}
+	if c.Redis.MaxRetries < -1 {
+		return fmt.Errorf("redis.max_retries: must be -1 (no retries) or more")
+	}
+	if c.Redis.RefillLogEvery < 0 {
+		return fmt.Errorf("redis.refill_log_every: must not be negative")
+	}
+	if c.Redis.RefillLogPerSecond < 0 {
+		return fmt.Errorf("redis.refill_log_per_second: must not be negative")
+	}
+
+	if _, err := c.RateLimit.Schedule(); err != nil {
+		return fmt.Errorf("ratelimit.refill_schedule: %w", err)
+	}
+
+	for _, p := range c.Server.TrustedProxies {
+		if err := validateProxy(p); err != nil {
+			return fmt.Errorf("server.trusted_proxies: %w", err)
+		}
+	}
+
+	if c.Payment.RefillMultiplier == 0 {
+		c.Payment.RefillMultiplier = 1
+	}
+	if c.Payment.MinInterval < 0 {
+		return fmt.Errorf("payment.min_payment_interval: must not be negative")
+	}
+	if c.Payment.ReplayWindow < 0 {
+		return fmt.Errorf("payment.replay_window: must not be negative")
+	}
+	for _, m := range c.Payment.EscalationCurve {
+		if !(m > 0) {
+			return fmt.Errorf("payment.escalation_curve: multiplier %g must be positive", m)
+		}
+	}
+	if c.Payment.EscalationWindow < 0 {
+		return fmt.Errorf("payment.escalation_window: must not be negative")
+	}
+	if len(c.Payment.EscalationCurve) > 0 && c.Payment.EscalationWindow == 0 {
+		return fmt.Errorf("payment.escalation_window: must be set with escalation_curve")
+	}
+	if c.Payment.ReplayMaxEntries < 0 {
+		return fmt.Errorf("payment.replay_max_entries: must not be negative")
+	}
+	if c.Payment.VerifyCacheTTL < 0 {
+		return fmt.Errorf("payment.verify_cache_ttl: must not be negative")
+	}
+	if c.Payment.VerifyCacheMaxEntries < 0 {
+		return fmt.Errorf("payment.verify_cache_max_entries: must not be negative")
+	}
+	if c.Payment.RefillMultiplier < 0 {
+		return fmt.Errorf("payment.refill_multiplier: must be positive, got %g", c.Payment.RefillMultiplier)
+	}
+
+	if o := c.Payment.Optimistic; o.RetriedWeight < 0 || o.RetriedWeight > 1 {
+		return fmt.Errorf("payment.optimistic.retried_weight: %g out of range 0-1", o.RetriedWeight)
+	}
+	if o := c.Payment.Optimistic; o.SpacingJitter < 0 || o.SpacingJitter > 1 {
+		return fmt.Errorf("payment.optimistic.spacing_jitter: %g out of range 0-1", o.SpacingJitter)
+	}
+	if c.Payment.Optimistic.SettleRetries < 0 {
+		return fmt.Errorf("payment.optimistic.settle_retries: must not be negative")
+	}
+	if c.Payment.Optimistic.SweepInterval < 0 {
+		return fmt.Errorf("payment.optimistic.sweep_interval: must not be negative")
+	}
+	if c.Payment.Optimistic.RefillTokens < 0 {
+		return fmt.Errorf("payment.optimistic.refill_tokens: must not be negative")
+	}
+	if c.Payment.Optimistic.MaxWallets < 0 {
+		return fmt.Errorf("payment.optimistic.max_wallets: must not be negative")
+	}
+	if t := c.Payment.Optimistic.OptimisticThreshold; t != 0 && t < c.Payment.Optimistic.TrustThreshold {
+		return fmt.Errorf("payment.optimistic.optimistic_threshold: %d is below trust_threshold %d", t, c.Payment.Optimistic.TrustThreshold)
+	}
+	if c.Payment.Optimistic.MaxTrusted < 0 {
+		return fmt.Errorf("payment.optimistic.max_trusted: must not be negative")
+	}
+	if c.Payment.Optimistic.Workers < 0 {
+		return fmt.Errorf("payment.optimistic.workers: must not be negative")
+	}
+	if c.Payment.Optimistic.Workers == 0 {
+		c.Payment.Optimistic.Workers = 1
+	}
+	if c.Payment.Optimistic.QueueBuffer < 0 {
+		return fmt.Errorf("payment.optimistic.queue_buffer: must not be negative")
+	}
+	if c.Payment.Optimistic.QueueBuffer == 0 {
+		c.Payment.Optimistic.QueueBuffer = 100
+	}
+	if o := c.Payment.Optimistic; o.QueueBuffer < o.Workers {
+		return fmt.Errorf("payment.optimistic.queue_buffer: %d leaves some of the %d workers no room", o.QueueBuffer, o.Workers)
+	}
+
+	if c.Payment.Currency == "" {
+		c.Payment.Currency = DefaultCurrency
+	}
+	if c.Payment.Decimals == 0 {
+		c.Payment.Decimals = DefaultDecimals
+	}
+	if c.Payment.Decimals < 0 || c.Payment.Decimals > 36 {
+		return fmt.Errorf("payment.decimals: %d out of range 0-36", c.Payment.Decimals)
+	}
+	if c.Payment.AssetAddress == "" && !strings.EqualFold(c.Payment.Currency, DefaultCurrency) {
+		return fmt.Errorf("payment.asset_address: required for currency %q", c.Payment.Currency)
+	}
+	for i := range c.Payment.PayTo {
+		payTo := &c.Payment.PayTo[i]
+		if payTo.Address == "" {
+			return fmt.Errorf("payment.pay_to[%d]: address is required", i)
+		}
+		if payTo.Weight < 0 {
+			return fmt.Errorf("payment.pay_to[%d]: weight must not be negative", i)
+		}
+		if payTo.Weight == 0 {
+			payTo.Weight = 1
+		}
+	}
+	if c.Payment.Enabled {
+		if err := validatePrice(c.Payment.PricePerCapacity, c.Payment.Decimals); err != nil {
+			return fmt.Errorf("payment.price_per_capacity: %w", err)
+		}
+		if unit := c.Payment.Optimistic.TrustUnitPrice; unit != "" {
+			if err := validatePrice(unit, c.Payment.Decimals); err != nil {
+				return fmt.Errorf("payment.optimistic.trust_unit_price: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// RefillTokens returns the tokens a single payment adds to the bucket. The
+// config must be validated.
+func (c *Config) RefillTokens() float64 {
+	return c.RateLimit.Capacity * c.Payment.RefillMultiplier
+}
+
+// OptimisticRefillTokens returns the tokens an optimistic payment from a
+// trusted wallet adds, defaulting to RefillTokens. The config must be
+// validated.
+func (c *Config) OptimisticRefillTokens() float64 {
+	if c.Payment.Optimistic.RefillTokens > 0 {
+		return c.Payment.Optimistic.RefillTokens
+	}
+	return c.RefillTokens()
+}
+
+// validateProxy checks that p is a CIDR or a single IP address.
+func validateProxy(p string) error {
+	if strings.Contains(p, "/") {
+		if _, _, err := net.ParseCIDR(p); err != nil {
+			return fmt.Errorf("invalid CIDR %q", p)
+		}
+		return nil
+	}
+	if net.ParseIP(p) == nil {
+		return fmt.Errorf("invalid IP %q", p)
+	}
+	return nil
+}
+
+// validatePrice checks that price is a positive decimal representable with
+// the given number of token decimals.
+func validatePrice(price string, decimals int) error {
+	m := pricePattern.FindStringSubmatch(strings.TrimSpace(price))
+	if m == nil {
+		return fmt.Errorf("invalid price %q (want a decimal such as \"0.001\")", price)
+	}
+	if len(m[2]) > decimals {
+		return fmt.Errorf("price %q has more than %d decimal places", price, decimals)
+	}
+	if strings.Trim(m[1]+m[2], "0") == "" {
+		return fmt.Errorf("price %q must be greater than zero", price)
+	}
+	return nil
+}
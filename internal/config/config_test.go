@@ -0,0 +1,329 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidate_PaymentMode(t *testing.T) {
+	cfg := &Config{}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.Payment.Mode != ModeHybrid {
+		t.Errorf("Expected default mode %q, got %q", ModeHybrid, cfg.Payment.Mode)
+	}
+
+	for _, mode := range []string{ModeHybrid, ModeMetered, ModePaidOnly} {
+		cfg.Payment.Mode = mode
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("Mode %q should be valid, got %v", mode, err)
+		}
+	}
+
+	cfg.Payment.Mode = "free_for_all"
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected error for unknown payment mode")
+	}
+}
+
+func TestValidate_PaymentPrice(t *testing.T) {
+	tests := []struct {
+		price    string
+		decimals int
+		valid    bool
+	}{
+		{"0.001", 0, true},
+		{"$0.001", 0, true},
+		{"2", 0, true},
+		{"0.0000001", 0, false}, // More places than USDC's 6 decimals
+		{"0.0000001", 18, true},
+		{"0", 0, false},
+		{"$0.000", 0, false},
+		{"", 0, false},
+		{"0.001 USDC", 0, false},
+		{"-1", 0, false},
+		{"1e-3", 0, false},
+	}
+
+	for _, tt := range tests {
+		cfg := &Config{Payment: PaymentConfig{
+			Enabled:          true,
+			PricePerCapacity: tt.price,
+			Decimals:         tt.decimals,
+		}}
+		err := cfg.Validate()
+		if tt.valid && err != nil {
+			t.Errorf("Price %q (decimals %d) should be valid, got %v", tt.price, tt.decimals, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("Price %q (decimals %d) should be invalid", tt.price, tt.decimals)
+		}
+	}
+}
+
+func TestValidate_PaymentCurrency(t *testing.T) {
+	cfg := &Config{}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.Payment.Currency != DefaultCurrency || cfg.Payment.Decimals != DefaultDecimals {
+		t.Errorf("Expected defaults %s/%d, got %s/%d",
+			DefaultCurrency, DefaultDecimals, cfg.Payment.Currency, cfg.Payment.Decimals)
+	}
+
+	// Other tokens need an explicit contract address
+	cfg = &Config{Payment: PaymentConfig{Currency: "EURC"}}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected error for non-USDC currency without asset_address")
+	}
+}
+
+func TestValidate_TrustedProxies(t *testing.T) {
+	cfg := &Config{}
+	cfg.Server.TrustedProxies = []string{"10.0.0.0/8", "192.0.2.1", "::1"}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Expected valid proxies, got %v", err)
+	}
+
+	for _, bad := range []string{"10.0.0.0/33", "proxy.internal", ""} {
+		cfg.Server.TrustedProxies = []string{bad}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected error for trusted proxy %q", bad)
+		}
+	}
+}
+
+func TestValidate_RoutePolicies(t *testing.T) {
+	cfg := &Config{}
+	cfg.Payment.RoutePolicies = map[string]string{"/health": "free", "/cpu": "paid", "/items/:id": "hybrid"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for _, bad := range []map[string]string{
+		{"/cpu": "metered"},
+		{"cpu": "free"},
+	} {
+		cfg.Payment.RoutePolicies = bad
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected error for route policies %v", bad)
+		}
+	}
+}
+
+func TestValidate_PaidBucket(t *testing.T) {
+	cfg := &Config{}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.Payment.PaidBucket != PaidBucketIP {
+		t.Errorf("Expected default paid bucket %q, got %q", PaidBucketIP, cfg.Payment.PaidBucket)
+	}
+
+	for _, strategy := range []string{"memory", "redis"} {
+		cfg.Payment.PaidBucket = PaidBucketWallet
+		cfg.RateLimit.Strategy = strategy
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("Wallet buckets should be valid with the %s strategy, got %v", strategy, err)
+		}
+	}
+
+	cfg.Payment.PaidBucket = "device"
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected error for unknown paid bucket")
+	}
+}
+
+func TestValidate_LogRedaction(t *testing.T) {
+	cfg := &Config{}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.Server.LogRedaction != "none" {
+		t.Errorf("Expected default log redaction %q, got %q", "none", cfg.Server.LogRedaction)
+	}
+
+	for _, mode := range []string{"none", "mask", "hash"} {
+		cfg.Server.LogRedaction = mode
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("Log redaction %q should be valid, got %v", mode, err)
+		}
+	}
+
+	cfg.Server.LogRedaction = "encrypt"
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected error for unknown log redaction")
+	}
+}
+
+func TestPaymentConfig_Facilitators(t *testing.T) {
+	p := PaymentConfig{
+		FacilitatorURL: "https://primary.example",
+		FallbackURLs:   []string{"https://a.example", "https://b.example"},
+	}
+	got := p.Facilitators()
+	want := []string{"https://primary.example", "https://a.example", "https://b.example"}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Facilitator %d: expected %q, got %q", i, want[i], got[i])
+		}
+	}
+}
+
+func TestPaymentConfig_Wallets(t *testing.T) {
+	cfg := &Config{Payment: PaymentConfig{WalletAddress: "0xsingle"}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := cfg.Payment.Wallets(); len(got) != 1 || got[0] != (PayToConfig{Address: "0xsingle", Weight: 1}) {
+		t.Errorf("Expected wallet_address alone, got %+v", got)
+	}
+
+	// pay_to replaces wallet_address, with weights defaulting to 1
+	cfg.Payment.PayTo = []PayToConfig{{Address: "0xa", Weight: 3}, {Address: "0xb"}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := []PayToConfig{{Address: "0xa", Weight: 3}, {Address: "0xb", Weight: 1}}
+	if got := cfg.Payment.Wallets(); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+
+	for _, bad := range []PayToConfig{{Weight: 1}, {Address: "0xa", Weight: -1}} {
+		cfg.Payment.PayTo = []PayToConfig{bad}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected error for pay_to entry %+v", bad)
+		}
+	}
+}
+
+func TestValidate_TrustUnitPrice(t *testing.T) {
+	cfg := &Config{Payment: PaymentConfig{Enabled: true, PricePerCapacity: "0.001"}}
+	cfg.Payment.Optimistic.TrustUnitPrice = "0.01"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Expected valid trust unit, got %v", err)
+	}
+
+	cfg.Payment.Optimistic.TrustUnitPrice = "0"
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected error for zero trust unit")
+	}
+}
+
+func TestValidate_SettlementQueue(t *testing.T) {
+	cfg := &Config{}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if o := cfg.Payment.Optimistic; o.QueueBuffer != 100 || o.Workers != 1 {
+		t.Errorf("Expected a 100 job buffer and 1 worker by default, got %d and %d", o.QueueBuffer, o.Workers)
+	}
+
+	cfg.Payment.Optimistic.QueueBuffer = 8
+	cfg.Payment.Optimistic.Workers = 4
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Expected 4 workers sharing 8 jobs to be valid, got %v", err)
+	}
+
+	for _, bad := range []OptimisticConfig{
+		{QueueBuffer: -1},
+		{Workers: -1},
+		{QueueBuffer: 2, Workers: 4},
+	} {
+		cfg := &Config{Payment: PaymentConfig{Optimistic: bad}}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected error for queue_buffer %d with %d workers", bad.QueueBuffer, bad.Workers)
+		}
+	}
+}
+
+func TestValidate_EscalationCurve(t *testing.T) {
+	cfg := &Config{}
+	cfg.Payment.EscalationCurve = []float64{0.5, 1, 2}
+	cfg.Payment.EscalationWindow = time.Minute
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Expected valid escalation, got %v", err)
+	}
+
+	for _, bad := range []PaymentConfig{
+		{EscalationCurve: []float64{1, 0}, EscalationWindow: time.Minute},
+		{EscalationCurve: []float64{1}},
+		{EscalationWindow: -time.Minute},
+	} {
+		cfg := &Config{Payment: bad}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected error for curve %v over %v", bad.EscalationCurve, bad.EscalationWindow)
+		}
+	}
+}
+
+func TestValidate_RefillMultiplier(t *testing.T) {
+	cfg := &Config{RateLimit: RateLimitConfig{Capacity: 4}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := cfg.RefillTokens(); got != 4 {
+		t.Errorf("Expected default refill of one capacity (4), got %g", got)
+	}
+
+	cfg.Payment.RefillMultiplier = 2.5
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := cfg.RefillTokens(); got != 10 {
+		t.Errorf("Expected 2.5x capacity (10), got %g", got)
+	}
+
+	cfg.Payment.RefillMultiplier = -1
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected error for negative refill multiplier")
+	}
+}
+
+func TestRateLimitConfig_Schedule(t *testing.T) {
+	cfg := RateLimitConfig{RefillSchedule: []RefillWindowConfig{
+		{Start: "09:00", End: "17:30", Multiplier: 2},
+		{Start: "22:00", End: "24:00", Multiplier: 0.5},
+	}}
+	schedule, err := cfg.Schedule()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(schedule) != 2 || schedule[0].End != 17*time.Hour+30*time.Minute || schedule[1].End != 24*time.Hour {
+		t.Errorf("Unexpected schedule %+v", schedule)
+	}
+
+	for _, bad := range []RefillWindowConfig{
+		{Start: "9am", End: "17:00", Multiplier: 2},
+		{Start: "09:00", End: "17:00", Multiplier: 0},
+	} {
+		cfg := &Config{RateLimit: RateLimitConfig{RefillSchedule: []RefillWindowConfig{bad}}}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected error for window %+v", bad)
+		}
+	}
+}
+
+func TestConfig_OptimisticRefillTokens(t *testing.T) {
+	cfg := &Config{RateLimit: RateLimitConfig{Capacity: 4}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := cfg.OptimisticRefillTokens(); got != 4 {
+		t.Errorf("Expected optimistic refill to default to a sync refill (4), got %g", got)
+	}
+
+	cfg.Payment.Optimistic.RefillTokens = 10
+	if got := cfg.OptimisticRefillTokens(); got != 10 {
+		t.Errorf("Expected optimistic refill of 10, got %g", got)
+	}
+
+	cfg.Payment.Optimistic.RefillTokens = -1
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected error for negative optimistic refill")
+	}
+}
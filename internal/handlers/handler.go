@@ -13,14 +13,16 @@ import (
 
 // CPUStats represents CPU utilization information.
 type CPUStats struct {
-	Utilization float64 `json:"utilization"` // Percentage (0-100)
-	Timestamp   string  `json:"timestamp"`
+	Utilization float64   `json:"utilization"`     // Percentage (0-100)
+	Cores       []float64 `json:"cores,omitempty"` // Per-core percentages, with ?detail=cores
+	Timestamp   string    `json:"timestamp"`
 }
 
-// CPUHandler returns an HTTP handler that responds with current CPU utilization.
+// CPUHandler returns an HTTP handler that responds with current CPU
+// utilization, broken down per core with ?detail=cores.
 func CPUHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		utilization, err := getCPUUtilization()
+		utilization, cores, err := getCPUUtilization(r.URL.Query().Get("detail") == "cores")
 		if err != nil {
 			http.Error(w, "Failed to get CPU utilization: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -28,6 +30,7 @@ func CPUHandler() http.HandlerFunc {
 
 		stats := CPUStats{
 			Utilization: utilization,
+			Cores:       cores,
 			Timestamp:   time.Now().UTC().Format(time.RFC3339),
 		}
 
@@ -39,7 +42,7 @@ func CPUHandler() http.HandlerFunc {
 // GinCPUHandler returns a Gin handler for CPU utilization.
 func GinCPUHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		utilization, err := getCPUUtilization()
+		utilization, cores, err := getCPUUtilization(c.Query("detail") == "cores")
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get CPU utilization"})
 			return
@@ -47,61 +50,85 @@ func GinCPUHandler() gin.HandlerFunc {
 
 		c.JSON(http.StatusOK, CPUStats{
 			Utilization: utilization,
+			Cores:       cores,
 			Timestamp:   time.Now().UTC().Format(time.RFC3339),
 		})
 	}
 }
 
+// cpuTimes are the idle and total jiffies of one /proc/stat cpu line.
+type cpuTimes struct {
+	idle, total uint64
+}
+
+// utilization returns the busy percentage between two samples.
+func utilization(before, after cpuTimes) float64 {
+	totalDelta := after.total - before.total
+	if totalDelta == 0 {
+		return 0
+	}
+	return (1.0 - float64(after.idle-before.idle)/float64(totalDelta)) * 100
+}
+
 // getCPUUtilization reads CPU stats from /proc/stat and calculates utilization.
-func getCPUUtilization() (float64, error) {
-	idle1, total1, err := readCPUStat()
+// With perCore it also returns each core's utilization, in core order.
+func getCPUUtilization(perCore bool) (float64, []float64, error) {
+	aggregate1, cores1, err := readCPUStat()
 	if err != nil {
-		return 0, err
+		return 0, nil, err
 	}
 
 	time.Sleep(50 * time.Millisecond)
 
-	idle2, total2, err := readCPUStat()
+	aggregate2, cores2, err := readCPUStat()
 	if err != nil {
-		return 0, err
+		return 0, nil, err
 	}
 
-	idleDelta := idle2 - idle1
-	totalDelta := total2 - total1
-
-	if totalDelta == 0 {
-		return 0, nil
+	var cores []float64
+	if perCore {
+		cores = make([]float64, min(len(cores1), len(cores2)))
+		for i := range cores {
+			cores[i] = utilization(cores1[i], cores2[i])
+		}
 	}
-
-	utilization := (1.0 - float64(idleDelta)/float64(totalDelta)) * 100
-	return utilization, nil
+	return utilization(aggregate1, aggregate2), cores, nil
 }
 
-// readCPUStat reads the first line of /proc/stat and returns idle and total CPU time.
-func readCPUStat() (idle, total uint64, err error) {
+// readCPUStat reads /proc/stat and returns the aggregate and per-core CPU times.
+func readCPUStat() (cpuTimes, []cpuTimes, error) {
 	data, err := os.ReadFile("/proc/stat")
 	if err != nil {
-		return 0, 0, err
+		return cpuTimes{}, nil, err
 	}
+	aggregate, cores := parseCPUStat(string(data))
+	return aggregate, cores, nil
+}
 
-	lines := strings.Split(string(data), "\n")
-	if len(lines) == 0 {
-		return 0, 0, nil
-	}
+// parseCPUStat parses the cpu lines of /proc/stat: the aggregate "cpu" line
+// and one "cpuN" line per core, returned in the order listed.
+func parseCPUStat(data string) (aggregate cpuTimes, cores []cpuTimes) {
+	for _, line := range strings.Split(data, "\n") {
+		// cpu  user nice system idle iowait irq softirq steal guest guest_nice
+		fields := strings.Fields(line)
+		if len(fields) < 5 || !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
 
-	// First line: cpu  user nice system idle iowait irq softirq steal guest guest_nice
-	fields := strings.Fields(lines[0])
-	if len(fields) < 5 {
-		return 0, 0, nil
-	}
+		var times cpuTimes
+		for i := 1; i < len(fields); i++ {
+			val, _ := strconv.ParseUint(fields[i], 10, 64)
+			times.total += val
+			if i == 4 { // idle is the 4th value (0-indexed: 4)
+				times.idle = val
+			}
+		}
 
-	for i := 1; i < len(fields); i++ {
-		val, _ := strconv.ParseUint(fields[i], 10, 64)
-		total += val
-		if i == 4 { // idle is the 4th value (0-indexed: 4)
-			idle = val
+		if fields[0] == "cpu" {
+			aggregate = times
+		} else {
+			cores = append(cores, times)
 		}
 	}
-
-	return idle, total, nil
+	return aggregate, cores
 }
@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"math"
+	"testing"
+)
+
+const sampleProcStat = `cpu  400 0 100 1500 0 0 0 0 0 0
+cpu0 300 0 50 650 0 0 0 0 0 0
+cpu1 100 0 50 850 0 0 0 0 0 0
+intr 12345 0 0
+ctxt 67890
+btime 1700000000
+processes 42
+`
+
+func TestParseCPUStat(t *testing.T) {
+	aggregate, cores := parseCPUStat(sampleProcStat)
+	if aggregate != (cpuTimes{idle: 1500, total: 2000}) {
+		t.Errorf("Expected aggregate idle 1500 of 2000, got %+v", aggregate)
+	}
+	want := []cpuTimes{{idle: 650, total: 1000}, {idle: 850, total: 1000}}
+	if len(cores) != len(want) {
+		t.Fatalf("Expected %d cores, got %d", len(want), len(cores))
+	}
+	for i := range want {
+		if cores[i] != want[i] {
+			t.Errorf("Expected core %d %+v, got %+v", i, want[i], cores[i])
+		}
+	}
+}
+
+func TestUtilization(t *testing.T) {
+	before := cpuTimes{idle: 650, total: 1000}
+	after := cpuTimes{idle: 700, total: 1200} // 50 of 200 jiffies idle
+	if got := utilization(before, after); math.Abs(got-75) > 1e-9 {
+		t.Errorf("Expected 75%% utilization, got %v", got)
+	}
+	if got := utilization(before, before); got != 0 {
+		t.Errorf("Expected 0 with no elapsed time, got %v", got)
+	}
+}
@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ClientIPResolver picks the address to rate limit a request by. The
+// X-Forwarded-For header is only honoured when the immediate peer is one of
+// the trusted proxies, so clients connecting directly can't spoof their key.
+type ClientIPResolver struct {
+	trusted []*net.IPNet
+}
+
+// NewClientIPResolver creates a resolver trusting the given proxies, each a
+// CIDR ("10.0.0.0/8") or a single IP. With no proxies, the peer address is
+// always used.
+func NewClientIPResolver(proxies []string) (*ClientIPResolver, error) {
+	nets, err := ParseTrustedProxies(proxies)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientIPResolver{trusted: nets}, nil
+}
+
+// ParseTrustedProxies parses proxy CIDRs or IPs into networks. A bare IP is
+// treated as a single-address network.
+func ParseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, p := range proxies {
+		p = strings.TrimSpace(p)
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", p)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			p = fmt.Sprintf("%s/%d", p, bits)
+		}
+		_, ipNet, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", p)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// ClientIP returns the client address for r. Starting from the peer, it walks
+// X-Forwarded-For from right to left while each hop is a trusted proxy and
+// returns the first untrusted address. Entries left of that are client
+// supplied and ignored.
+func (cr *ClientIPResolver) ClientIP(r *http.Request) string {
+	ip := remoteIP(r.RemoteAddr)
+	if !cr.isTrusted(ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break // Malformed entry - stop at the last address we could trust
+		}
+		ip = hop
+		if !cr.isTrusted(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+func (cr *ClientIPResolver) isTrusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range cr.trusted {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP strips the port from a RemoteAddr.
+func remoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
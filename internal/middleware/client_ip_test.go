@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIPResolver(t *testing.T) {
+	resolver, err := NewClientIPResolver([]string{"10.0.0.0/8", "192.0.2.1"})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name string
+		peer string
+		xff  string
+		want string
+	}{
+		{"direct client", "203.0.113.5:1234", "", "203.0.113.5"},
+		{"untrusted peer spoofing header", "203.0.113.5:1234", "198.51.100.7", "203.0.113.5"},
+		{"trusted CIDR", "10.1.2.3:1234", "198.51.100.7", "198.51.100.7"},
+		{"trusted single IP", "192.0.2.1:1234", "198.51.100.7", "198.51.100.7"},
+		{"spoofed prefix ignored", "10.1.2.3:1234", "1.2.3.4, 198.51.100.7", "198.51.100.7"},
+		{"proxy chain", "10.1.2.3:1234", "198.51.100.7, 10.9.9.9", "198.51.100.7"},
+		{"trusted peer without header", "10.1.2.3:1234", "", "10.1.2.3"},
+		{"malformed hop", "10.1.2.3:1234", "not-an-ip", "10.1.2.3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.peer
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			assert.Equal(t, tt.want, resolver.ClientIP(req))
+		})
+	}
+}
+
+func TestNewClientIPResolver_InvalidProxy(t *testing.T) {
+	_, err := NewClientIPResolver([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+	_, err = NewClientIPResolver([]string{"proxy.internal"})
+	assert.Error(t, err)
+}
+
+func TestRateLimitMiddlewareWithOptions_ClientIP(t *testing.T) {
+	resolver, err := NewClientIPResolver([]string{"10.0.0.0/8"})
+	assert.NoError(t, err)
+
+	limiter := new(MockLimiter)
+	limiter.On("Allow", "198.51.100.7").Return(true, nil)
+
+	handler := RateLimitMiddlewareWithOptions(limiter, Options{ClientIP: resolver}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.1.2.3:1234"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4, 198.51.100.7")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	limiter.AssertExpectations(t)
+}
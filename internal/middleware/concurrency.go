@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/concurrency"
+)
+
+// GinConcurrencyMiddleware caps each client's in-flight requests with l,
+// holding a slot from the request's arrival until every later handler has
+// returned. Requests over the cap get 429 without reaching the handlers, so
+// register it ahead of the rate limiter to keep them from spending tokens.
+func GinConcurrencyMiddleware(l *concurrency.Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		release, allowed, err := l.Allow(c.ClientIP())
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Concurrency limiter error"})
+			return
+		}
+		if !allowed {
+			c.Header("Retry-After", "1")
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"error":   "Too Many Concurrent Requests",
+				"message": "Wait for your in-flight requests to finish.",
+			})
+			return
+		}
+		defer release()
+		c.Next()
+	}
+}
@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/concurrency"
+)
+
+func TestGinConcurrencyMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l := concurrency.New(2)
+
+	entered := make(chan struct{})
+	unblock := make(chan struct{})
+	r := gin.New()
+	r.Use(GinConcurrencyMiddleware(l))
+	r.GET("/slow", func(c *gin.Context) {
+		entered <- struct{}{}
+		<-unblock
+		c.Status(http.StatusOK)
+	})
+
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/slow", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// Two slow requests fill the client's slots
+	var wg sync.WaitGroup
+	codes := make([]int, 2)
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = serve().Code
+		}()
+		<-entered
+	}
+	assert.Equal(t, float64(2), l.InFlight("192.0.2.1"))
+
+	// A third is turned away while they run
+	w := serve()
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+	// Finishing them frees the slots
+	close(unblock)
+	wg.Wait()
+	assert.Equal(t, []int{http.StatusOK, http.StatusOK}, codes)
+	assert.Equal(t, float64(0), l.InFlight("192.0.2.1"))
+
+	go func() { <-entered }()
+	assert.Equal(t, http.StatusOK, serve().Code)
+}
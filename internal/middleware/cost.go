@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequestCostHeader lets a client declare a request's cost in tokens.
+const RequestCostHeader = "X-Request-Cost"
+
+// CostFunc derives the tokens a request costs from the request itself, so
+// e.g. uploads consume quota in proportion to their size. Results are passed
+// through ClampCost before use.
+type CostFunc func(c *gin.Context) float64
+
+// ClampCost makes cost safe to pass to AllowN: a zero, negative or NaN cost
+// counts as 1, and a cost above maxCost (when maxCost > 0) is capped so no
+// single request can demand more than the bucket could ever hold. Without a
+// maximum, an infinite cost also counts as 1.
+func ClampCost(cost, maxCost float64) float64 {
+	switch {
+	case math.IsNaN(cost) || cost <= 0:
+		return 1
+	case maxCost > 0 && cost > maxCost:
+		return maxCost
+	case math.IsInf(cost, 1):
+		return 1
+	}
+	return cost
+}
+
+// RequestCost returns the clamped cost of the request under opts, or 1 when
+// no CostFunc is set.
+func RequestCost(c *gin.Context, opts Options) float64 {
+	if opts.Cost == nil {
+		return 1
+	}
+	return ClampCost(opts.Cost(c), opts.MaxCost)
+}
+
+// ContentLengthCost charges one token per bytesPerToken of request body,
+// rounded up, and at least one token. A body of unknown length costs one
+// token, so pair it with a server body size limit.
+func ContentLengthCost(bytesPerToken int64) CostFunc {
+	return func(c *gin.Context) float64 {
+		length := c.Request.ContentLength
+		if bytesPerToken <= 0 || length <= bytesPerToken {
+			return 1
+		}
+		return math.Ceil(float64(length) / float64(bytesPerToken))
+	}
+}
+
+// HeaderCost reads the cost from the named header (see RequestCostHeader).
+// The header is client supplied, so it can only raise the cost: missing,
+// malformed or sub-1 values cost one token.
+func HeaderCost(name string) CostFunc {
+	return func(c *gin.Context) float64 {
+		cost, err := strconv.ParseFloat(c.GetHeader(name), 64)
+		if err != nil || math.IsNaN(cost) || math.IsInf(cost, 0) || cost < 1 {
+			return 1
+		}
+		return cost
+	}
+}
+
+// HighestCost combines cost funcs, charging whichever is highest.
+func HighestCost(fns ...CostFunc) CostFunc {
+	return func(c *gin.Context) float64 {
+		cost := 1.0
+		for _, fn := range fns {
+			cost = max(cost, fn(c))
+		}
+		return cost
+	}
+}
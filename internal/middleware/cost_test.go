@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// ginContextFor wraps req in a gin context for calling cost funcs directly.
+func ginContextFor(req *http.Request) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = req
+	return c
+}
+
+func TestClampCost(t *testing.T) {
+	assert.Equal(t, 2.5, ClampCost(2.5, 0))
+	assert.Equal(t, 1.0, ClampCost(0, 10))
+	assert.Equal(t, 1.0, ClampCost(-3, 10))
+	assert.Equal(t, 1.0, ClampCost(math.NaN(), 10))
+	assert.Equal(t, 10.0, ClampCost(50, 10))
+	assert.Equal(t, 10.0, ClampCost(math.Inf(1), 10))
+	assert.Equal(t, 1.0, ClampCost(math.Inf(1), 0))
+}
+
+func TestContentLengthCost(t *testing.T) {
+	cost := ContentLengthCost(1024)
+
+	small := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("tiny"))
+	assert.Equal(t, 1.0, cost(ginContextFor(small)))
+
+	large := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("x", 3*1024+1)))
+	assert.Equal(t, 4.0, cost(ginContextFor(large)), "partial chunks round up")
+
+	unknown := httptest.NewRequest(http.MethodPost, "/", nil)
+	unknown.ContentLength = -1
+	assert.Equal(t, 1.0, cost(ginContextFor(unknown)))
+}
+
+func TestHeaderCost(t *testing.T) {
+	cost := HeaderCost(RequestCostHeader)
+	for value, want := range map[string]float64{
+		"":     1,
+		"5":    5,
+		"2.5":  2.5,
+		"0.1":  1, // Can't lower the cost
+		"-4":   1,
+		"abc":  1,
+		"+Inf": 1,
+		"NaN":  1,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if value != "" {
+			req.Header.Set(RequestCostHeader, value)
+		}
+		assert.Equal(t, want, cost(ginContextFor(req)), "header %q", value)
+	}
+}
+
+func TestHighestCost(t *testing.T) {
+	cost := HighestCost(ContentLengthCost(10), HeaderCost(RequestCostHeader))
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("x", 30)))
+	req.Header.Set(RequestCostHeader, "2")
+	assert.Equal(t, 3.0, cost(ginContextFor(req)))
+
+	req.Header.Set(RequestCostHeader, "7")
+	assert.Equal(t, 7.0, cost(ginContextFor(req)))
+}
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"log"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -10,9 +11,25 @@ import (
 // RateLimitMiddleware wraps an http.Handler and applies rate limiting.
 // Returns 429 Too Many Requests when the limit is exceeded.
 func RateLimitMiddleware(limiter ratelimit.Limiter, next http.Handler) http.Handler {
+	return RateLimitMiddlewareWithOptions(limiter, Options{}, next)
+}
+
+// RateLimitMiddlewareWithOptions is RateLimitMiddleware with a configurable
+// Retry-After header.
+func RateLimitMiddlewareWithOptions(limiter ratelimit.Limiter, opts Options, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Use client IP as the rate limit key
 		key := r.RemoteAddr
+		if opts.ClientIP != nil {
+			key = opts.ClientIP.ClientIP(r)
+		}
+
+		// Ask clients to retry while the backend is still coming up
+		if !ratelimit.IsReady(limiter) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Rate limiter starting", http.StatusServiceUnavailable)
+			return
+		}
 
 		allowed, err := limiter.Allow(key)
 		if err != nil {
@@ -20,8 +37,19 @@ func RateLimitMiddleware(limiter ratelimit.Limiter, next http.Handler) http.Hand
 			return
 		}
 
+		if opts.DryRun {
+			decision := DryRunAllow
+			if !allowed {
+				decision = DryRunDeny
+				log.Printf("[DRY-RUN] Would rate limit %s", opts.Redact.Redact(key))
+			}
+			w.Header().Set(DryRunHeader, decision)
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		if !allowed {
-			w.Header().Set("Retry-After", "1")
+			w.Header().Set("Retry-After", RetryAfter(limiter, key, opts))
 			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
 			return
 		}
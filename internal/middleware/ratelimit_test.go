@@ -3,7 +3,9 @@ package middleware
 import (
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
@@ -20,6 +22,11 @@ func (m *MockLimiter) Allow(key string) (bool, error) {
 	return args.Bool(0), args.Error(1)
 }
 
+func (m *MockLimiter) AllowN(key string, n float64) (bool, error) {
+	args := m.Called(key, n)
+	return args.Bool(0), args.Error(1)
+}
+
 func (m *MockLimiter) Refill(key string, tokens float64) error {
 	args := m.Called(key, tokens)
 	return args.Error(0)
@@ -119,3 +126,115 @@ func TestGinRateLimitMiddleware_RateLimited(t *testing.T) {
 	assert.Equal(t, http.StatusPaymentRequired, w.Code)
 	limiter.AssertExpectations(t) // Ensure Allow was called
 }
+
+func TestRetryAfter_FormatsAgree(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 250_000_000, time.UTC)
+
+	tests := []struct {
+		name       string
+		available  float64
+		refillRate float64
+		wantWait   time.Duration
+	}{
+		{"half a token at 2/sec", 0.5, 2, 250 * time.Millisecond},
+		{"empty at 0.25/sec", 0, 0.25, 4 * time.Second},
+		{"empty at low rate", 0, 0.001, 1000 * time.Second},
+		{"in debt", -2, 1, 3 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := new(MockLimiter)
+			limiter.On("Available", "k").Return(tt.available, nil)
+
+			opts := Options{RefillRate: tt.refillRate, Now: func() time.Time { return now }}
+			seconds := RetryAfter(limiter, "k", opts)
+			opts.RetryAfterFormat = RetryAfterHTTPDate
+			date := RetryAfter(limiter, "k", opts)
+
+			n, err := strconv.Atoi(seconds)
+			assert.NoError(t, err)
+			fromSeconds := now.Add(time.Duration(n) * time.Second)
+
+			fromDate, err := http.ParseTime(date)
+			assert.NoError(t, err)
+
+			// Both name the same instant, within header resolution of the true reset
+			assert.WithinDuration(t, fromSeconds, fromDate, time.Second)
+			assert.WithinDuration(t, now.Add(tt.wantWait), fromDate, time.Second)
+			assert.False(t, fromDate.Before(now.Add(tt.wantWait)), "reset must not be early")
+		})
+	}
+}
+
+func TestRateLimitMiddlewareWithOptions_HTTPDate(t *testing.T) {
+	limiter := new(MockLimiter)
+	limiter.On("Allow", mock.Anything).Return(false, nil)
+	limiter.On("Available", mock.Anything).Return(0.0, nil)
+
+	handler := RateLimitMiddlewareWithOptions(limiter, Options{
+		RetryAfterFormat: RetryAfterHTTPDate,
+		RefillRate:       0.1,
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	reset, err := http.ParseTime(w.Header().Get("Retry-After"))
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(10*time.Second), reset, 2*time.Second)
+}
+
+// startingLimiter is a MockLimiter whose backend isn't ready yet.
+type startingLimiter struct {
+	MockLimiter
+}
+
+func (m *startingLimiter) Ready() bool {
+	return m.Called().Bool(0)
+}
+
+func TestRateLimitMiddleware_NotReady(t *testing.T) {
+	limiter := new(startingLimiter)
+	limiter.On("Ready").Return(false)
+
+	handler := RateLimitMiddleware(limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	limiter.AssertNotCalled(t, "Allow", mock.Anything)
+}
+
+func TestRateLimitMiddleware_DryRun(t *testing.T) {
+	limiter := new(MockLimiter)
+	limiter.On("Allow", mock.Anything).Return(false, nil)
+
+	called := false
+	handler := RateLimitMiddlewareWithOptions(limiter, Options{DryRun: true}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.True(t, called, "dry run should always call the next handler")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, DryRunDeny, w.Header().Get(DryRunHeader))
+	assert.Empty(t, w.Header().Get("Retry-After"))
+	limiter.AssertExpectations(t)
+}
@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+)
+
+// Retry-After header formats.
+const (
+	// RetryAfterSeconds sends the delay in whole seconds, e.g. "3".
+	RetryAfterSeconds = "seconds"
+	// RetryAfterHTTPDate sends the reset instant, e.g. "Wed, 21 Oct 2026 07:28:00 GMT".
+	RetryAfterHTTPDate = "http-date"
+)
+
+// Options configures the Retry-After header sent with 429 responses.
+type Options struct {
+	// RetryAfterFormat is RetryAfterSeconds (default) or RetryAfterHTTPDate.
+	RetryAfterFormat string
+
+	// RefillRate is the limiter's refill rate in tokens per second, used to
+	// compute when the next token is available. If zero, clients are told to
+	// retry after one second.
+	RefillRate float64
+
+	// Now is an optional time source (default: time.Now).
+	Now func() time.Time
+
+	// ClientIP resolves the rate limit key for RateLimitMiddlewareWithOptions.
+	// If nil, the request's RemoteAddr is used.
+	ClientIP *ClientIPResolver
+
+	// DryRun still consumes tokens and records each decision in the
+	// DryRunHeader, but never rejects, so limits can be tuned against real
+	// traffic before they're enforced.
+	DryRun bool
+
+	// Cost prices each request in tokens for the Gin middlewares, e.g. by
+	// body size. Nil charges one token per request.
+	Cost CostFunc
+
+	// MaxCost caps what Cost may charge a single request (0 = no cap).
+	MaxCost float64
+
+	// MaxWait is the longest the Gin middlewares hold a request whose client
+	// asked to wait for a token, rather than rejecting it (0 = never wait).
+	MaxWait time.Duration
+
+	// Redact masks client keys in log lines. Nil logs them as is.
+	Redact ratelimit.Redactor
+}
+
+// DryRunHeader carries the decision a dry-run limiter would have made.
+const DryRunHeader = "X-RateLimit-DryRun-Decision"
+
+// Dry-run decisions sent in DryRunHeader.
+const (
+	DryRunAllow = "allow"
+	DryRunDeny  = "deny"
+)
+
+// RetryAfter returns the Retry-After header value for a rate-limited key.
+// Both formats round up to whole seconds, so clients never retry early.
+func RetryAfter(limiter ratelimit.Limiter, key string, opts Options) string {
+	now := time.Now
+	if opts.Now != nil {
+		now = opts.Now
+	}
+	start := now()
+
+	wait := time.Second
+	if opts.RefillRate > 0 {
+		if avail, err := limiter.Available(key); err == nil && avail < 1 {
+			// Seconds until one whole token has accrued (longer while in debt)
+			wait = time.Duration((1 - avail) / opts.RefillRate * float64(time.Second))
+		}
+	}
+
+	if opts.RetryAfterFormat == RetryAfterHTTPDate {
+		reset := start.Add(wait)
+		if truncated := reset.Truncate(time.Second); !truncated.Equal(reset) {
+			reset = truncated.Add(time.Second)
+		}
+		return reset.UTC().Format(http.TimeFormat)
+	}
+	seconds := int64(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.FormatInt(seconds, 10)
+}
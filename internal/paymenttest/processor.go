@@ -0,0 +1,131 @@
+// Package paymenttest provides a scriptable stand-in for the x402 HTTP
+// server, so the payment middleware can be tested without a facilitator,
+// a live server or a funded wallet.
+package paymenttest
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	x402 "github.com/coinbase/x402/go"
+	x402http "github.com/coinbase/x402/go/http"
+)
+
+// Transaction is the hash reported for successful settlements.
+const Transaction = "0xtx"
+
+// Requirements are the payment requirements the Processor advertises and
+// verifies payments against.
+var Requirements = x402.PaymentRequirements{
+	Scheme:  "exact",
+	Network: "eip155:84532",
+	Amount:  "1000",
+	PayTo:   "0xpayto",
+}
+
+// Processor is a fake payment processor. Any non-empty payment header passes
+// verification and settles as Transaction unless scripted otherwise. Set the
+// fields before use, or use the methods while requests are in flight.
+type Processor struct {
+	mu          sync.Mutex
+	RejectPay   bool          // Fail verification of attached payments
+	FailSettle  string        // Non-empty makes every settlement fail with this reason
+	FailNext    int           // Fail this many settlements with "nonce_too_low", then succeed
+	Block       chan struct{} // If set, settlement waits until it is closed
+	OnVerify    func()        // If set, runs while an attached payment is verified
+	verifyCalls int
+	settleCalls int
+	settledAt   []time.Time
+}
+
+// ProcessHTTPRequest answers 402 with Requirements when no payment is
+// attached, and otherwise verifies the payment.
+func (p *Processor) ProcessHTTPRequest(ctx context.Context, reqCtx x402http.HTTPRequestContext, paywallConfig *x402http.PaywallConfig) x402http.HTTPProcessResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	requirements := Requirements
+	if reqCtx.PaymentHeader == "" || p.RejectPay {
+		if reqCtx.PaymentHeader != "" {
+			p.verifyCalls++
+		}
+		return x402http.HTTPProcessResult{
+			Type: x402http.ResultPaymentError,
+			Response: &x402http.HTTPResponseInstructions{
+				Status: http.StatusPaymentRequired,
+				Body: map[string]interface{}{
+					"x402Version": 2,
+					"accepts":     []x402.PaymentRequirements{requirements},
+				},
+			},
+		}
+	}
+
+	p.verifyCalls++
+	if p.OnVerify != nil {
+		p.OnVerify()
+	}
+	return x402http.HTTPProcessResult{
+		Type:                x402http.ResultPaymentVerified,
+		PaymentPayload:      &x402.PaymentPayload{X402Version: 2, Accepted: requirements},
+		PaymentRequirements: &requirements,
+	}
+}
+
+// ProcessSettlement settles a verified payment, as scripted.
+func (p *Processor) ProcessSettlement(ctx context.Context, payload x402.PaymentPayload, requirements x402.PaymentRequirements) *x402http.ProcessSettleResult {
+	p.mu.Lock()
+	block := p.Block
+	p.mu.Unlock()
+	if block != nil {
+		<-block
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.settleCalls++
+	p.settledAt = append(p.settledAt, time.Now())
+	if p.FailNext > 0 {
+		p.FailNext--
+		return &x402http.ProcessSettleResult{Success: false, ErrorReason: "nonce_too_low"}
+	}
+	if p.FailSettle != "" {
+		return &x402http.ProcessSettleResult{Success: false, ErrorReason: p.FailSettle}
+	}
+	return &x402http.ProcessSettleResult{
+		Success:     true,
+		Transaction: Transaction,
+		Network:     x402.Network(requirements.Network),
+	}
+}
+
+// SetRejectPay changes whether attached payments fail verification.
+func (p *Processor) SetRejectPay(reject bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.RejectPay = reject
+}
+
+// SetFailSettle changes the reason settlements fail with ("" succeeds).
+func (p *Processor) SetFailSettle(reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.FailSettle = reason
+}
+
+// Calls returns how many payments were verified and settlements attempted.
+func (p *Processor) Calls() (verify, settle int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.verifyCalls, p.settleCalls
+}
+
+// SettledAt returns when each settlement was attempted, oldest first.
+func (p *Processor) SettledAt() []time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]time.Time(nil), p.settledAt...)
+}
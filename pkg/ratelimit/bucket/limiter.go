@@ -0,0 +1,279 @@
+package bucket
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+)
+
+// Limiter is a token bucket rate limiter with a bucket per key, kept in a
+// ratelimit.Store and run by Rules.
+type Limiter struct {
+	store  ratelimit.Store
+	rules  Rules
+	clock  ratelimit.Clock
+	redact ratelimit.Redactor
+}
+
+// Config holds configuration for a store-backed Limiter. The bucket
+// settings mean what they do in memory.Config.
+type Config struct {
+	Store      ratelimit.Store
+	Capacity   float64
+	RefillRate float64 // tokens per second
+
+	BurstCapacity  float64       // Cap on paid refills (0 = uncapped)
+	MinTokens      float64       // Lowest balance a request may leave (<= 0)
+	GraceOverage   float64       // Tokens a request may overdraw, even in debt
+	BurstTTL       time.Duration // How long unspent paid overflow lasts (0 = forever)
+	RefillSchedule ratelimit.RefillSchedule
+	RefillMode     ratelimit.RefillMode
+
+	Clock ratelimit.Clock // Optional time source (default: ratelimit.SystemClock)
+
+	// Redact masks keys in the limiter's log lines. Nil logs them as is.
+	Redact ratelimit.Redactor
+}
+
+// New creates a new Limiter over store with the given capacity and refill rate.
+// It panics if ratelimit.ValidateBucket rejects them.
+func New(store ratelimit.Store, capacity float64, refillRate float64) *Limiter {
+	return NewWithConfig(Config{
+		Store:      store,
+		Capacity:   capacity,
+		RefillRate: refillRate,
+	})
+}
+
+// NewWithConfig creates a new Limiter from the given config. It panics if
+// ratelimit.ValidateBucket rejects its capacity or refill rate.
+func NewWithConfig(cfg Config) *Limiter {
+	if err := ratelimit.ValidateBucket(cfg.Capacity, cfg.RefillRate); err != nil {
+		panic(fmt.Sprintf("bucket.New: %v (capacity %g, refill rate %g)", err, cfg.Capacity, cfg.RefillRate))
+	}
+	clock := cfg.Clock
+	if clock == nil {
+		clock = ratelimit.SystemClock
+	}
+	return &Limiter{
+		store: cfg.Store,
+		rules: Rules{
+			Capacity:   cfg.Capacity,
+			RefillRate: cfg.RefillRate,
+			Burst:      cfg.BurstCapacity,
+			MinTokens:  cfg.MinTokens,
+			Grace:      cfg.GraceOverage,
+			BurstTTL:   cfg.BurstTTL,
+			Schedule:   cfg.RefillSchedule,
+			Mode:       cfg.RefillMode,
+		}.Clamp(),
+		clock:  clock,
+		redact: cfg.Redact,
+	}
+}
+
+// settle returns a stored bucket with natural refill applied up to now, or
+// a new full one if there's none.
+func (l *Limiter) settle(state ratelimit.BucketState, exists bool, now time.Time) ratelimit.BucketState {
+	if !exists {
+		return l.rules.New(now)
+	}
+	return l.rules.Settle(state, now)
+}
+
+// Allow checks if a token is available for key and consumes it if so.
+func (l *Limiter) Allow(key string) (bool, error) {
+	return l.AllowN(key, 1)
+}
+
+// AllowN checks if n tokens are available for key and consumes them if so.
+// With a negative MinTokens or a GraceOverage, a request may overdraw the
+// bucket as memory.TokenBucket's does.
+func (l *Limiter) AllowN(key string, n float64) (bool, error) {
+	allowed, _, err := l.take(key, n, l.clock.Now())
+	return allowed, err
+}
+
+// AllowWithReset is Allow, also returning when key's bucket recovers: see
+// ratelimit.ResetTime.
+func (l *Limiter) AllowWithReset(key string) (bool, time.Time, error) {
+	now := l.clock.Now()
+	allowed, tokens, err := l.take(key, 1, now)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	return allowed, ratelimit.ResetTime(now, tokens, l.rules.Capacity, l.rules.Rate(now)), nil
+}
+
+// AllowAt is Allow using at, rather than the clock, for refill math. It lets
+// recorded traffic be replayed, or tests simulate refill without sleeping.
+// Timestamps older than the bucket's last update accrue no tokens.
+func (l *Limiter) AllowAt(key string, at time.Time) (bool, error) {
+	allowed, _, err := l.take(key, 1, at)
+	return allowed, err
+}
+
+// take consumes n tokens from key's bucket as of now, if available,
+// returning the balance left.
+func (l *Limiter) take(key string, n float64, now time.Time) (allowed bool, tokens float64, err error) {
+	if n <= 0 {
+		return false, 0, ratelimit.ErrInvalidCost
+	}
+	allowed, err = l.store.ConsumeIfAvailable(key, func(state ratelimit.BucketState, exists bool) (ratelimit.BucketState, bool) {
+		state, ok := l.rules.Take(l.settle(state, exists, now), n)
+		if ok {
+			state.Allowed++
+		} else {
+			state.Denied++
+		}
+		tokens = state.Tokens
+		return state, ok
+	})
+	return allowed, tokens, err
+}
+
+// Refill settles natural refill and then adds tokens without capping at
+// capacity, allowing paid "burst" tokens up to BurstCapacity, or applies
+// them as Config.RefillMode says.
+func (l *Limiter) Refill(key string, tokens float64) error {
+	return l.refillWith(l.rules.Mode, key, tokens)
+}
+
+// RefillTo raises key's balance to target if it's below, up to
+// BurstCapacity when set, whatever Config.RefillMode says. See
+// ratelimit.TargetRefiller.
+func (l *Limiter) RefillTo(key string, target float64) error {
+	return l.refillWith(ratelimit.RefillAtLeast, key, target)
+}
+
+// refillWith settles natural refill on key's bucket, then applies tokens as
+// mode says.
+func (l *Limiter) refillWith(mode ratelimit.RefillMode, key string, tokens float64) error {
+	now := l.clock.Now()
+	var before float64
+	state, err := l.store.AddTokens(key, func(state ratelimit.BucketState, exists bool) ratelimit.BucketState {
+		state = l.settle(state, exists, now)
+		before = state.Tokens
+		return l.rules.Add(state, mode, tokens, now)
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("[REFILL] key=%s before=%.2f added=%.2f after=%.2f", l.redact.Redact(key), before, tokens, state.Tokens)
+	return nil
+}
+
+// Refund returns unused tokens to key's bucket, raising the balance no higher
+// than capacity. See ratelimit.Refunder.
+func (l *Limiter) Refund(key string, tokens float64) error {
+	now := l.clock.Now()
+	_, err := l.store.AddTokens(key, func(state ratelimit.BucketState, exists bool) ratelimit.BucketState {
+		return l.rules.Refund(l.settle(state, exists, now), tokens)
+	})
+	return err
+}
+
+// Available returns the current number of tokens for key, including natural
+// refill, without modifying the stored bucket.
+func (l *Limiter) Available(key string) (float64, error) {
+	state, exists, err := l.store.GetBucket(key)
+	if err != nil || !exists {
+		return l.rules.Capacity, err
+	}
+	return l.rules.TokensAt(state, l.clock.Now()), nil
+}
+
+// Info returns key's balance, timestamps and request counters. A key never
+// used reports a full bucket with zero timestamps.
+func (l *Limiter) Info(key string) (ratelimit.BucketInfo, error) {
+	state, exists, err := l.store.GetBucket(key)
+	if err != nil {
+		return ratelimit.BucketInfo{}, err
+	}
+	if !exists {
+		return ratelimit.BucketInfo{Tokens: l.rules.Capacity}, nil
+	}
+	return ratelimit.BucketInfo{
+		Tokens:     l.rules.TokensAt(state, l.clock.Now()),
+		LastRefill: state.LastRefill,
+		CreatedAt:  state.CreatedAt,
+		Allowed:    state.Allowed,
+		Denied:     state.Denied,
+	}, nil
+}
+
+// Open creates key's bucket empty if it has none. See ratelimit.Opener.
+func (l *Limiter) Open(key string) (bool, error) {
+	now := l.clock.Now()
+	var opened bool
+	_, err := l.store.AddTokens(key, func(state ratelimit.BucketState, exists bool) ratelimit.BucketState {
+		if exists {
+			return state
+		}
+		opened = true
+		state = l.rules.New(now)
+		state.Tokens = 0
+		return state
+	})
+	return opened, err
+}
+
+// Reset restores key to a full bucket, starting it afresh: its creation
+// time and counters are reset too.
+func (l *Limiter) Reset(key string) error {
+	return l.store.SetBucket(key, l.rules.New(l.clock.Now()))
+}
+
+// Drain empties key's bucket, so it throttles until natural refill resumes.
+func (l *Limiter) Drain(key string) error {
+	now := l.clock.Now()
+	_, err := l.store.AddTokens(key, func(state ratelimit.BucketState, exists bool) ratelimit.BucketState {
+		state = l.settle(state, exists, now)
+		state.Tokens = 0
+		return state
+	})
+	return err
+}
+
+// Clock returns the clock refill math reads.
+func (l *Limiter) Clock() ratelimit.Clock {
+	return l.clock
+}
+
+// errNoScan is returned by Snapshot when the store can't list its keys.
+var errNoScan = errors.New("bucket: store does not support listing keys")
+
+// Snapshot lists a page of keys with their balance after natural refill.
+// The store must implement ratelimit.Scanner.
+func (l *Limiter) Snapshot(cursor string, limit int) ([]ratelimit.KeyTokens, string, error) {
+	scanner, ok := l.store.(ratelimit.Scanner)
+	if !ok {
+		return nil, "", errNoScan
+	}
+	keys, states, next, err := scanner.Scan(cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := l.clock.Now()
+	page := make([]ratelimit.KeyTokens, len(keys))
+	for i, key := range keys {
+		page[i] = ratelimit.KeyTokens{Key: key, Tokens: l.rules.TokensAt(states[i], now)}
+	}
+	return page, next, nil
+}
+
+// Ensure Limiter implements ratelimit.Limiter.
+var _ ratelimit.Limiter = (*Limiter)(nil)
+var _ ratelimit.Resetter = (*Limiter)(nil)
+var _ ratelimit.Drainer = (*Limiter)(nil)
+var _ ratelimit.Inspector = (*Limiter)(nil)
+var _ ratelimit.Opener = (*Limiter)(nil)
+var _ ratelimit.Snapshotter = (*Limiter)(nil)
+var _ ratelimit.Clocked = (*Limiter)(nil)
+var _ ratelimit.Refunder = (*Limiter)(nil)
+var _ ratelimit.TargetRefiller = (*Limiter)(nil)
+var _ ratelimit.ResetReporter = (*Limiter)(nil)
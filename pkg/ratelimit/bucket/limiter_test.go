@@ -0,0 +1,480 @@
+package bucket_test
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/redis/go-redis/v9"
+
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/bucket"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/memory"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/ratelimittest"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/redis"
+)
+
+// storeFactories builds each Store backend under test.
+var storeFactories = map[string]func(t *testing.T) ratelimit.Store{
+	"memory": func(t *testing.T) ratelimit.Store {
+		return memory.NewStore()
+	},
+	"redis": func(t *testing.T) ratelimit.Store {
+		mr := miniredis.RunT(t)
+		client := goredis.NewClient(&goredis.Options{Addr: mr.Addr()})
+		t.Cleanup(func() { client.Close() })
+		return redis.NewStore(redis.StoreConfig{Client: client})
+	},
+}
+
+// newTestLimiter creates a Limiter over store driven by a fake clock.
+func newTestLimiter(store ratelimit.Store, capacity, refillRate float64) (*bucket.Limiter, *ratelimittest.FakeClock) {
+	return newTestLimiterWithConfig(bucket.Config{Store: store, Capacity: capacity, RefillRate: refillRate})
+}
+
+// newTestLimiterWithConfig creates a Limiter from cfg driven by a fake clock.
+func newTestLimiterWithConfig(cfg bucket.Config) (*bucket.Limiter, *ratelimittest.FakeClock) {
+	clock := ratelimittest.NewFakeClock()
+	cfg.Clock = clock
+	return bucket.NewWithConfig(cfg), clock
+}
+
+// runStoreSuite runs fn once per Store backend.
+func runStoreSuite(t *testing.T, fn func(t *testing.T, store ratelimit.Store)) {
+	for name, factory := range storeFactories {
+		t.Run(name, func(t *testing.T) {
+			fn(t, factory(t))
+		})
+	}
+}
+
+func mustAvailable(t *testing.T, l *bucket.Limiter, key string) float64 {
+	t.Helper()
+	avail, err := l.Available(key)
+	if err != nil {
+		t.Fatalf("Available error: %v", err)
+	}
+	return avail
+}
+
+func approxEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
+
+func TestLimiter_AllowExhaust(t *testing.T) {
+	runStoreSuite(t, func(t *testing.T, store ratelimit.Store) {
+		l, _ := newTestLimiter(store, 3, 1)
+
+		for i := 0; i < 3; i++ {
+			allowed, err := l.Allow("k")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !allowed {
+				t.Errorf("Expected request %d to be allowed", i+1)
+			}
+		}
+		if allowed, _ := l.Allow("k"); allowed {
+			t.Error("Expected 4th request to be rejected")
+		}
+	})
+}
+
+func TestLimiter_NaturalRefill(t *testing.T) {
+	runStoreSuite(t, func(t *testing.T, store ratelimit.Store) {
+		l, clock := newTestLimiter(store, 3, 2) // 2 tokens/sec
+
+		for i := 0; i < 3; i++ {
+			l.Allow("k")
+		}
+
+		clock.Advance(500 * time.Millisecond)
+		if got := mustAvailable(t, l, "k"); !approxEqual(got, 1) {
+			t.Errorf("Expected 1 token after 500ms, got %.4f", got)
+		}
+
+		// Natural refill never exceeds capacity
+		clock.Advance(time.Hour)
+		if got := mustAvailable(t, l, "k"); !approxEqual(got, 3) {
+			t.Errorf("Expected refill capped at capacity 3, got %.4f", got)
+		}
+	})
+}
+
+func TestLimiter_RefillPreservesBurst(t *testing.T) {
+	runStoreSuite(t, func(t *testing.T, store ratelimit.Store) {
+		l, clock := newTestLimiter(store, 3, 2)
+
+		if err := l.Refill("k", 3); err != nil {
+			t.Fatalf("Refill error: %v", err)
+		}
+		if got := mustAvailable(t, l, "k"); !approxEqual(got, 6) {
+			t.Errorf("Expected 6 tokens after paid refill, got %.4f", got)
+		}
+
+		// Overflow isn't capped or topped up by natural refill
+		clock.Advance(10 * time.Second)
+		if got := mustAvailable(t, l, "k"); !approxEqual(got, 6) {
+			t.Errorf("Expected overflow preserved at 6, got %.4f", got)
+		}
+	})
+}
+
+func TestLimiter_RefillSettlesAccrualFirst(t *testing.T) {
+	runStoreSuite(t, func(t *testing.T, store ratelimit.Store) {
+		l, clock := newTestLimiter(store, 4, 1)
+
+		for i := 0; i < 4; i++ {
+			l.Allow("k")
+		}
+
+		// 2 tokens accrue naturally before the paid refill lands
+		clock.Advance(2 * time.Second)
+		l.Refill("k", 4)
+
+		if got := mustAvailable(t, l, "k"); !approxEqual(got, 6) {
+			t.Errorf("Expected 2 accrued + 4 paid = 6 tokens, got %.4f", got)
+		}
+
+		// Accrual before the refill isn't counted a second time
+		clock.Advance(2 * time.Second)
+		if got := mustAvailable(t, l, "k"); !approxEqual(got, 6) {
+			t.Errorf("Expected 6 tokens to stay put above capacity, got %.4f", got)
+		}
+	})
+}
+
+func TestLimiter_AllowNFractional(t *testing.T) {
+	runStoreSuite(t, func(t *testing.T, store ratelimit.Store) {
+		l, _ := newTestLimiter(store, 1, 1)
+
+		for i := 0; i < 4; i++ {
+			if allowed, _ := l.AllowN("k", 0.25); !allowed {
+				t.Errorf("Expected cheap request %d to be allowed", i+1)
+			}
+		}
+		if allowed, _ := l.AllowN("k", 0.25); allowed {
+			t.Error("Expected 5th cheap request to be rejected")
+		}
+		if _, err := l.AllowN("k", 0); err != ratelimit.ErrInvalidCost {
+			t.Errorf("Expected ErrInvalidCost, got %v", err)
+		}
+	})
+}
+
+func TestLimiter_KeysAreIndependent(t *testing.T) {
+	runStoreSuite(t, func(t *testing.T, store ratelimit.Store) {
+		l, _ := newTestLimiter(store, 1, 1)
+
+		l.Allow("a")
+		if allowed, _ := l.Allow("a"); allowed {
+			t.Error("Expected key a to be exhausted")
+		}
+		if allowed, _ := l.Allow("b"); !allowed {
+			t.Error("Expected key b to have its own bucket")
+		}
+	})
+}
+
+func TestLimiter_AvailableDoesNotMutate(t *testing.T) {
+	runStoreSuite(t, func(t *testing.T, store ratelimit.Store) {
+		l, _ := newTestLimiter(store, 5, 1)
+
+		if got := mustAvailable(t, l, "k"); !approxEqual(got, 5) {
+			t.Errorf("Expected full bucket for new key, got %.4f", got)
+		}
+		if _, exists, _ := store.GetBucket("k"); exists {
+			t.Error("Available should not create stored state")
+		}
+	})
+}
+
+func TestLimiter_Snapshot(t *testing.T) {
+	runStoreSuite(t, func(t *testing.T, store ratelimit.Store) {
+		l, clock := newTestLimiter(store, 5, 1)
+
+		l.AllowN("a", 3)
+		l.AllowN("b", 5)
+		l.Refill("c", 2)
+		clock.Advance(time.Second)
+		before, _, _ := store.GetBucket("b")
+
+		// Page through in twos until the cursor runs out
+		got := make(map[string]float64)
+		cursor := ""
+		for pages := 0; ; pages++ {
+			if pages > 10 {
+				t.Fatal("Snapshot cursor never finished")
+			}
+			page, next, err := l.Snapshot(cursor, 2)
+			if err != nil {
+				t.Fatalf("Snapshot failed: %v", err)
+			}
+			for _, kt := range page {
+				got[kt.Key] = kt.Tokens
+			}
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+
+		want := map[string]float64{"a": 3, "b": 1, "c": 7}
+		if len(got) != len(want) {
+			t.Fatalf("Expected keys %v, got %v", want, got)
+		}
+		for key, tokens := range want {
+			if !approxEqual(got[key], tokens) {
+				t.Errorf("Expected %s at %.2f with refill projected, got %.4f", key, tokens, got[key])
+			}
+		}
+
+		if after, _, _ := store.GetBucket("b"); after != before {
+			t.Errorf("Snapshot should not modify buckets: %+v became %+v", before, after)
+		}
+	})
+}
+
+func TestLimiter_Concurrent(t *testing.T) {
+	runStoreSuite(t, func(t *testing.T, store ratelimit.Store) {
+		l, _ := newTestLimiter(store, 20, 0.001)
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		allowedCount := 0
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 5; j++ {
+					if allowed, err := l.Allow("k"); err == nil && allowed {
+						mu.Lock()
+						allowedCount++
+						mu.Unlock()
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		if allowedCount != 20 {
+			t.Errorf("Expected exactly 20 allowed requests, got %d", allowedCount)
+		}
+	})
+}
+
+func TestLimiter_Conformance(t *testing.T) {
+	for name, factory := range storeFactories {
+		t.Run(name, func(t *testing.T) {
+			ratelimittest.RunConformance(t, func(capacity, refillRate float64, clock ratelimit.Clock) ratelimit.Limiter {
+				return bucket.NewWithConfig(bucket.Config{
+					Store:      factory(t),
+					Capacity:   capacity,
+					RefillRate: refillRate,
+					Clock:      clock,
+				})
+			})
+		})
+	}
+}
+
+func TestLimiter_AllowAt(t *testing.T) {
+	runStoreSuite(t, func(t *testing.T, store ratelimit.Store) {
+		l, clock := newTestLimiter(store, 2, 1) // 1 token/sec
+		start := clock.Now()
+
+		l.AllowAt("k", start)
+		l.AllowAt("k", start)
+		if allowed, _ := l.AllowAt("k", start.Add(500*time.Millisecond)); allowed {
+			t.Error("Expected rejection before a full token accrued")
+		}
+		if allowed, _ := l.AllowAt("k", start.Add(time.Second)); !allowed {
+			t.Error("Expected request at t=1s to be allowed")
+		}
+
+		// An out-of-order timestamp accrues nothing and doesn't rewind the bucket
+		if allowed, _ := l.AllowAt("k", start); allowed {
+			t.Error("Expected replayed earlier timestamp to be rejected")
+		}
+		if allowed, _ := l.AllowAt("k", start.Add(2*time.Second)); !allowed {
+			t.Error("Expected request at t=2s to be allowed")
+		}
+	})
+}
+
+func TestLimiter_Drain(t *testing.T) {
+	runStoreSuite(t, func(t *testing.T, store ratelimit.Store) {
+		l, clock := newTestLimiter(store, 4, 2) // 2 tokens/sec
+		l.Refill("k", 4)
+
+		if err := l.Drain("k"); err != nil {
+			t.Fatalf("Drain error: %v", err)
+		}
+		if allowed, _ := l.Allow("k"); allowed {
+			t.Error("Expected drained key to be rate limited immediately")
+		}
+
+		// Natural refill resumes from the drain
+		clock.Advance(time.Second)
+		if got := mustAvailable(t, l, "k"); !approxEqual(got, 2) {
+			t.Errorf("Expected 2 tokens one second after drain, got %.4f", got)
+		}
+	})
+}
+
+func TestLimiter_AllowWithReset(t *testing.T) {
+	runStoreSuite(t, func(t *testing.T, store ratelimit.Store) {
+		l, clock := newTestLimiter(store, 2, 2) // 2 tokens/sec
+
+		// One token left: reset is when the bucket is full again
+		allowed, resetAt, err := l.AllowWithReset("k")
+		if err != nil || !allowed {
+			t.Fatalf("Expected the first request allowed, got %v, %v", allowed, err)
+		}
+		if got := resetAt.Sub(clock.Now()); !approxEqual(got.Seconds(), 0.5) {
+			t.Errorf("Expected reset 500ms out at full capacity, got %v", got)
+		}
+
+		// Just below one token: reset is when the next whole token accrues
+		l.Allow("k")
+		clock.Advance(400 * time.Millisecond) // 0.8 tokens
+		allowed, resetAt, _ = l.AllowWithReset("k")
+		if allowed {
+			t.Fatal("Expected a request on 0.8 tokens denied")
+		}
+		if got := resetAt.Sub(clock.Now()); !approxEqual(got.Seconds(), 0.1) {
+			t.Errorf("Expected reset (1-0.8)/2 = 100ms out, got %v", got)
+		}
+	})
+}
+
+func TestNew_InvalidSettings(t *testing.T) {
+	for _, settings := range [][2]float64{{0.5, 1}, {4, 0}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("New with capacity %g, refill rate %g: expected a panic", settings[0], settings[1])
+				}
+			}()
+			bucket.New(memory.NewStore(), settings[0], settings[1])
+		}()
+	}
+}
+
+func TestLimiter_InfoAndOpen(t *testing.T) {
+	runStoreSuite(t, func(t *testing.T, store ratelimit.Store) {
+		l, clock := newTestLimiter(store, 4, 1)
+
+		// A key never used reports a full bucket with no creation time
+		if info, err := l.Info("w"); err != nil || !info.CreatedAt.IsZero() || info.Tokens != 4 {
+			t.Fatalf("Expected an unused key full and never created, got %+v, %v", info, err)
+		}
+
+		// Open creates it empty, once
+		if opened, err := l.Open("w"); err != nil || !opened {
+			t.Fatalf("Expected Open to create the bucket, got %v, %v", opened, err)
+		}
+		l.Refill("w", 2)
+		if opened, _ := l.Open("w"); opened {
+			t.Error("Expected Open to leave an existing bucket alone")
+		}
+		if got := mustAvailable(t, l, "w"); !approxEqual(got, 2) {
+			t.Errorf("Expected only the 2 paid tokens, got %.4f", got)
+		}
+
+		l.Allow("w")
+		l.AllowN("w", 2)
+		info, err := l.Info("w")
+		if err != nil {
+			t.Fatalf("Info error: %v", err)
+		}
+		if !info.CreatedAt.Equal(clock.Now()) || info.Allowed != 1 || info.Denied != 1 || !approxEqual(info.Tokens, 1) {
+			t.Errorf("Expected created now with 1 allowed, 1 denied and 1 token, got %+v", info)
+		}
+	})
+}
+
+func TestLimiter_Overdraft(t *testing.T) {
+	runStoreSuite(t, func(t *testing.T, store ratelimit.Store) {
+		l, _ := newTestLimiterWithConfig(bucket.Config{Store: store, Capacity: 2, RefillRate: 1, MinTokens: -2})
+
+		// One request may overdraw a bucket that isn't in debt
+		if allowed, _ := l.AllowN("k", 3); !allowed {
+			t.Fatal("Expected a 3 token request on 2 tokens allowed into debt")
+		}
+		if allowed, _ := l.Allow("k"); allowed {
+			t.Error("Expected a bucket in debt to deny")
+		}
+
+		g, _ := newTestLimiterWithConfig(bucket.Config{Store: store, Capacity: 1, RefillRate: 1, GraceOverage: 2})
+		for i := 0; i < 3; i++ {
+			if allowed, _ := g.Allow("g"); !allowed {
+				t.Errorf("Expected request %d within the 2 token grace allowed", i+1)
+			}
+		}
+		if allowed, _ := g.Allow("g"); allowed {
+			t.Error("Expected a request past the grace denied")
+		}
+	})
+}
+
+func TestLimiter_BurstCapAndExpiry(t *testing.T) {
+	runStoreSuite(t, func(t *testing.T, store ratelimit.Store) {
+		l, clock := newTestLimiterWithConfig(bucket.Config{
+			Store:         store,
+			Capacity:      2,
+			RefillRate:    1,
+			BurstCapacity: 5,
+			BurstTTL:      time.Minute,
+		})
+
+		l.Refill("k", 10)
+		if got := mustAvailable(t, l, "k"); !approxEqual(got, 5) {
+			t.Errorf("Expected paid refill capped at 5, got %.4f", got)
+		}
+		clock.Advance(time.Minute - time.Second)
+		if got := mustAvailable(t, l, "k"); !approxEqual(got, 5) {
+			t.Errorf("Expected the overflow kept before its TTL, got %.4f", got)
+		}
+		clock.Advance(time.Second)
+		if got := mustAvailable(t, l, "k"); !approxEqual(got, 2) {
+			t.Errorf("Expected the overflow dropped to capacity at its TTL, got %.4f", got)
+		}
+	})
+}
+
+func TestLimiter_RefundAndRefillTo(t *testing.T) {
+	runStoreSuite(t, func(t *testing.T, store ratelimit.Store) {
+		l, _ := newTestLimiter(store, 4, 0.001)
+
+		l.AllowN("k", 3)
+		l.Refund("k", 5)
+		if got := mustAvailable(t, l, "k"); !approxEqual(got, 4) {
+			t.Errorf("Expected a refund capped at capacity 4, got %.4f", got)
+		}
+
+		l.RefillTo("k", 6)
+		l.RefillTo("k", 6)
+		if got := mustAvailable(t, l, "k"); !approxEqual(got, 6) {
+			t.Errorf("Expected RefillTo to top up to 6 once, got %.4f", got)
+		}
+	})
+}
+
+func TestLimiter_Reset(t *testing.T) {
+	runStoreSuite(t, func(t *testing.T, store ratelimit.Store) {
+		l, _ := newTestLimiter(store, 2, 0.001)
+
+		l.AllowN("k", 2)
+		l.Allow("k")
+		if err := l.Reset("k"); err != nil {
+			t.Fatalf("Reset error: %v", err)
+		}
+		info, _ := l.Info("k")
+		if !approxEqual(info.Tokens, 2) || info.Allowed != 0 || info.Denied != 0 {
+			t.Errorf("Expected a full bucket with counters cleared, got %+v", info)
+		}
+	})
+}
@@ -0,0 +1,112 @@
+// Package bucket implements the token bucket algorithm once. Rules holds the
+// refill and consumption rules, applied to a ratelimit.BucketState; the
+// in-memory TokenBucket runs them on its one bucket, and Limiter runs them
+// on a bucket per key in any ratelimit.Store, in memory or in Redis.
+//
+// The Redis TokenBucket keeps its own Lua scripts so each request is a
+// single round trip; the conformance suite holds both to the same behavior.
+package bucket
+
+import (
+	"time"
+
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+)
+
+// Rules are a token bucket's refill and consumption rules.
+type Rules struct {
+	Capacity   float64
+	RefillRate float64 // tokens per second
+
+	Burst     float64       // Cap on paid refills (0 = uncapped), at least Capacity
+	MinTokens float64       // Lowest balance consumption may reach (<= 0)
+	Grace     float64       // Tokens a request may overdraw, even in debt (>= 0)
+	BurstTTL  time.Duration // How long unspent paid overflow lasts (0 = forever)
+
+	Schedule ratelimit.RefillSchedule // Scales RefillRate by time of day
+	Mode     ratelimit.RefillMode     // What a paid refill does with its tokens
+}
+
+// Clamp returns r with out-of-range settings brought into range: a burst
+// cap below capacity is raised to it, a positive MinTokens and a negative
+// Grace become 0.
+func (r Rules) Clamp() Rules {
+	if r.Burst > 0 && r.Burst < r.Capacity {
+		r.Burst = r.Capacity
+	}
+	r.MinTokens = min(r.MinTokens, 0)
+	r.Grace = max(r.Grace, 0)
+	return r
+}
+
+// Rate returns the refill rate at now, after the schedule.
+func (r Rules) Rate(now time.Time) float64 {
+	return r.RefillRate * r.Schedule.Multiplier(now)
+}
+
+// New returns a bucket first used at now: full, with nothing counted.
+func (r Rules) New(now time.Time) ratelimit.BucketState {
+	return ratelimit.BucketState{Tokens: r.Capacity, LastRefill: now, CreatedAt: now}
+}
+
+// TokensAt returns the balance natural refill gives s at now, without
+// changing it. Natural refill only tops up a balance below capacity and
+// caps it there, preserving overflow from paid refills until it expires.
+func (r Rules) TokensAt(s ratelimit.BucketState, now time.Time) float64 {
+	if now.Before(s.LastRefill) {
+		return s.Tokens
+	}
+	tokens := s.Tokens
+	// Unspent paid overflow past its expiry falls back to capacity
+	if tokens > r.Capacity && !s.BurstExpires.IsZero() && !now.Before(s.BurstExpires) {
+		tokens = r.Capacity
+	}
+	if tokens < r.Capacity {
+		tokens = min(tokens+now.Sub(s.LastRefill).Seconds()*r.Rate(now), r.Capacity)
+	}
+	return tokens
+}
+
+// Settle returns s with natural refill applied up to now. A now before the
+// last refill (out-of-order replay) adds nothing and doesn't rewind s.
+func (r Rules) Settle(s ratelimit.BucketState, now time.Time) ratelimit.BucketState {
+	if now.Before(s.LastRefill) {
+		return s
+	}
+	s.Tokens = r.TokensAt(s, now)
+	s.LastRefill = now
+	return s
+}
+
+// Take deducts n tokens from settled s if the bucket covers them: down to
+// MinTokens as long as it isn't already in debt, or to -Grace even if it
+// is. Counters are left to the caller.
+func (r Rules) Take(s ratelimit.BucketState, n float64) (ratelimit.BucketState, bool) {
+	if (s.Tokens > 0 && s.Tokens-n >= r.MinTokens) || s.Tokens-n >= -r.Grace {
+		s.Tokens -= n
+		return s, true
+	}
+	return s, false
+}
+
+// Add applies paid tokens to settled s as mode says. They may overflow
+// capacity up to the burst cap, though a balance already above it isn't
+// reduced, and new overflow expires BurstTTL after now.
+func (r Rules) Add(s ratelimit.BucketState, mode ratelimit.RefillMode, tokens float64, now time.Time) ratelimit.BucketState {
+	before := s.Tokens
+	s.Tokens = mode.Apply(before, tokens, r.Capacity)
+	if r.Burst > 0 && s.Tokens > r.Burst {
+		s.Tokens = max(before, r.Burst)
+	}
+	if r.BurstTTL > 0 && s.Tokens > r.Capacity && s.Tokens > before {
+		s.BurstExpires = now.Add(r.BurstTTL)
+	}
+	return s
+}
+
+// Refund returns unused tokens to settled s, raising the balance no higher
+// than capacity. A balance already above capacity is kept.
+func (r Rules) Refund(s ratelimit.BucketState, tokens float64) ratelimit.BucketState {
+	s.Tokens = max(s.Tokens, min(s.Tokens+tokens, r.Capacity))
+	return s
+}
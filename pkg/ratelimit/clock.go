@@ -0,0 +1,128 @@
+package ratelimit
+
+import "time"
+
+// Clock provides the current time for refill math.
+// Limiters accept a Clock so tests can control time instead of sleeping.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the default Clock, backed by time.Now.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// Clocked is implemented by limiters that can report the Clock their refill
+// math reads, so test helpers can move time for them.
+type Clocked interface {
+	// Clock returns the limiter's clock, or nil if time comes from somewhere
+	// the limiter doesn't control, such as the Redis server.
+	Clock() Clock
+}
+
+// Resetter is implemented by limiters that can restore a key to a full bucket.
+type Resetter interface {
+	// Reset discards any stored state for key, so its next request sees a
+	// full bucket at capacity.
+	Reset(key string) error
+}
+
+// Drainer is implemented by limiters that can empty a key's bucket, throttling
+// it immediately until natural refill catches up.
+type Drainer interface {
+	// Drain sets key's balance to zero without deleting it. Refill resumes
+	// from the moment of the drain.
+	Drain(key string) error
+}
+
+// Opener is implemented by limiters that keep a bucket per key and can
+// create one empty, for buckets that should hold only what was paid into them.
+type Opener interface {
+	// Open creates key's bucket with no tokens if it has none, atomically,
+	// and reports whether it did. An existing bucket is left as is.
+	Open(key string) (bool, error)
+}
+
+// Refunder is implemented by limiters that can give back tokens a request was
+// charged but didn't use, without the refund acting as a paid refill.
+type Refunder interface {
+	// Refund settles natural refill on key's bucket and returns tokens to
+	// it, raising the balance no higher than capacity. A balance already
+	// above capacity is kept.
+	Refund(key string, tokens float64) error
+}
+
+// TargetRefiller is implemented by limiters that can top a bucket up to a
+// balance rather than add to it, e.g. to guarantee a minimum balance after a
+// payment without crediting a retried one twice.
+type TargetRefiller interface {
+	// RefillTo settles natural refill on key's bucket and raises its balance
+	// to target, up to any burst cap. A balance already at or above target
+	// is kept, so repeated calls leave it unchanged.
+	RefillTo(key string, target float64) error
+}
+
+// ReadyChecker is implemented by limiters whose backend must be reachable
+// before they can answer, such as Redis at startup.
+type ReadyChecker interface {
+	// Ready reports whether the backend has been reached. Once it has, Ready
+	// keeps returning true; later outages surface as ErrBackendUnavailable.
+	Ready() bool
+}
+
+// IsReady reports whether l can serve requests. Limiters that don't
+// implement ReadyChecker are always ready.
+func IsReady(l Limiter) bool {
+	rc, ok := l.(ReadyChecker)
+	return !ok || rc.Ready()
+}
+
+// ResetReporter is implemented by limiters that can say, along with a
+// decision, when the key's bucket recovers, so clients can schedule retries
+// precisely.
+type ResetReporter interface {
+	// AllowWithReset is Allow, also returning resetAt: when the bucket will
+	// next hold a whole token if it's below one after this request, or
+	// otherwise when it will next be full. See ResetTime.
+	AllowWithReset(key string) (allowed bool, resetAt time.Time, err error)
+}
+
+// BucketInfo describes a key's bucket, for debugging and abuse analysis.
+type BucketInfo struct {
+	Tokens     float64   `json:"tokens"`      // Balance after natural refill, as Available
+	LastRefill time.Time `json:"last_refill"` // When the bucket was last updated (zero if never)
+	CreatedAt  time.Time `json:"created_at"`  // When the bucket was first used (zero if never)
+	Allowed    int64     `json:"allowed"`     // Requests allowed since creation
+	Denied     int64     `json:"denied"`      // Requests denied since creation
+}
+
+// Inspector is implemented by limiters that can describe a key's bucket in
+// more detail than Available.
+type Inspector interface {
+	// Info returns key's bucket. A key with no stored state reports a full
+	// bucket with zero timestamps and counters.
+	Info(key string) (BucketInfo, error)
+}
+
+// MaxSnapshotPage caps the keys a Snapshotter returns per page.
+const MaxSnapshotPage = 1000
+
+// KeyTokens is a key's balance in a snapshot.
+type KeyTokens struct {
+	Key    string  `json:"key"`
+	Tokens float64 `json:"tokens"`
+}
+
+// Snapshotter is implemented by limiters that can list the keys they hold,
+// for admin dumps and inspection tools.
+type Snapshotter interface {
+	// Snapshot returns a page of about limit keys (at most MaxSnapshotPage)
+	// with their balance after natural refill, as Available reports it,
+	// without changing any bucket. Pass "" for the first page, then the
+	// returned cursor until it is "". Keys written during a listing may be
+	// missed or listed twice.
+	Snapshot(cursor string, limit int) (page []KeyTokens, next string, err error)
+}
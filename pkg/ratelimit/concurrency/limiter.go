@@ -0,0 +1,73 @@
+// Package concurrency limits how many requests each key may have in flight
+// at once. A token bucket bounds the request rate but not how many slow
+// requests pile up; this bounds the latter, and is meant to sit alongside a
+// ratelimit.Limiter rather than replace it.
+package concurrency
+
+import (
+	"sync"
+
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+)
+
+// Limiter is a weighted semaphore per key. It is safe for concurrent use.
+type Limiter struct {
+	max float64
+
+	mu       sync.Mutex
+	inFlight map[string]float64 // Weight held per key; keys at zero are dropped
+}
+
+// New returns a Limiter letting each key hold up to max weight at once.
+func New(max float64) *Limiter {
+	return &Limiter{max: max, inFlight: make(map[string]float64)}
+}
+
+// Allow acquires one unit for key. See AllowN.
+func (l *Limiter) Allow(key string) (release func(), allowed bool, err error) {
+	return l.AllowN(key, 1)
+}
+
+// AllowN acquires n units for key if that keeps it within the limit. When
+// allowed, release must be called once the request completes; calling it
+// again is a no-op. A request heavier than the limit is never allowed.
+// Returns ratelimit.ErrInvalidCost if n is not positive.
+func (l *Limiter) AllowN(key string, n float64) (release func(), allowed bool, err error) {
+	if !(n > 0) {
+		return nil, false, ratelimit.ErrInvalidCost
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inFlight[key]+n > l.max {
+		return nil, false, nil
+	}
+	l.inFlight[key] += n
+
+	var once sync.Once
+	return func() { once.Do(func() { l.release(key, n) }) }, true, nil
+}
+
+// release returns n units held by key.
+func (l *Limiter) release(key string, n float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Tolerate float error so a key's map entry is dropped once idle
+	if held := l.inFlight[key] - n; held > 1e-9 {
+		l.inFlight[key] = held
+	} else {
+		delete(l.inFlight, key)
+	}
+}
+
+// InFlight returns the weight key currently holds.
+func (l *Limiter) InFlight(key string) float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inFlight[key]
+}
+
+// Max returns the weight each key may hold at once.
+func (l *Limiter) Max() float64 {
+	return l.max
+}
@@ -0,0 +1,102 @@
+package concurrency
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+)
+
+func TestLimiter_BoundsInFlight(t *testing.T) {
+	l := New(2)
+
+	release1, ok, _ := l.Allow("a")
+	if !ok {
+		t.Fatal("Expected the first request allowed")
+	}
+	release2, ok, _ := l.Allow("a")
+	if !ok {
+		t.Fatal("Expected the second request allowed")
+	}
+	if _, ok, _ := l.Allow("a"); ok {
+		t.Error("Expected a third simultaneous request denied")
+	}
+
+	// Other keys have their own limit
+	if _, ok, _ := l.Allow("b"); !ok {
+		t.Error("Expected key b unaffected by key a")
+	}
+
+	// Completing a request frees its slot, once
+	release1()
+	release1()
+	if got := l.InFlight("a"); got != 1 {
+		t.Errorf("Expected 1 in flight after one release, got %g", got)
+	}
+	if _, ok, _ := l.Allow("a"); !ok {
+		t.Error("Expected a request allowed after a release")
+	}
+	release2()
+}
+
+func TestLimiter_Weighted(t *testing.T) {
+	l := New(3)
+
+	release, ok, _ := l.AllowN("a", 2)
+	if !ok {
+		t.Fatal("Expected a weight-2 request allowed")
+	}
+	if _, ok, _ := l.AllowN("a", 2); ok {
+		t.Error("Expected a second weight-2 request denied past the limit of 3")
+	}
+	if _, ok, _ := l.AllowN("a", 1); !ok {
+		t.Error("Expected a weight-1 request to fit alongside")
+	}
+	release()
+
+	if _, ok, _ := l.AllowN("b", 4); ok {
+		t.Error("Expected a request heavier than the limit never allowed")
+	}
+	if _, _, err := l.AllowN("a", 0); !errors.Is(err, ratelimit.ErrInvalidCost) {
+		t.Errorf("Expected ErrInvalidCost for weight 0, got %v", err)
+	}
+}
+
+func TestLimiter_Concurrent(t *testing.T) {
+	const max = 3
+	l := New(max)
+
+	var current, peak atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				release, ok, _ := l.Allow("k")
+				if !ok {
+					continue
+				}
+				n := current.Add(1)
+				for {
+					p := peak.Load()
+					if n <= p || peak.CompareAndSwap(p, n) {
+						break
+					}
+				}
+				current.Add(-1)
+				release()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if p := peak.Load(); p > max {
+		t.Errorf("Expected at most %d in flight, saw %d", max, p)
+	}
+	if got := l.InFlight("k"); got != 0 {
+		t.Errorf("Expected nothing in flight once done, got %g", got)
+	}
+}
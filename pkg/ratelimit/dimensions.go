@@ -0,0 +1,34 @@
+package ratelimit
+
+// DimensionConfig is one named bucket a request is checked against, such as
+// the client's IP, its user or a global quota.
+type DimensionConfig struct {
+	Key        string  // Bucket key, e.g. the IP address or "global"
+	Capacity   float64 // 0 uses the limiter's capacity
+	RefillRate float64 // Tokens per second (0 uses the limiter's rate)
+	Cost       float64 // Tokens the request takes from this bucket (0 = 1)
+}
+
+// Decision is the outcome of checking a request against several dimensions.
+type Decision struct {
+	Allowed bool
+
+	// Denied names the dimensions without enough tokens, sorted. Empty when
+	// Allowed.
+	Denied []string
+
+	// Remaining is each dimension's balance after the call: after the cost
+	// if the request was allowed, untouched otherwise.
+	Remaining map[string]float64
+}
+
+// DimensionChecker is implemented by limiters that can check a request
+// against several buckets at once.
+type DimensionChecker interface {
+	// AllowDimensions allows the request only if every dimension, keyed by
+	// name, has enough tokens, taking each dimension's cost atomically. If
+	// any dimension denies, no bucket is charged. Returns ErrInvalidKey for a
+	// dimension without a key, ErrInvalidCost for a negative cost, and
+	// ValidateBucket's errors for invalid bucket settings.
+	AllowDimensions(dims map[string]DimensionConfig) (Decision, error)
+}
@@ -0,0 +1,203 @@
+package ratelimit
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LatencyMetric is the Prometheus histogram an InstrumentedLimiter exports.
+const LatencyMetric = "ratelimiter_limiter_latency_seconds"
+
+// LatencyBuckets are the histogram bucket upper bounds, in seconds. They
+// span a local in-memory call to a Redis round trip in trouble.
+var LatencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// Operations an InstrumentedLimiter times, as the op label.
+const (
+	OpAllow     = "allow" // Allow and AllowN
+	OpRefill    = "refill"
+	OpAvailable = "available"
+)
+
+// Outcomes of a timed call, as the outcome label.
+const (
+	OutcomeAllowed = "allowed" // Allow let the request through
+	OutcomeDenied  = "denied"  // Allow rejected the request
+	OutcomeOK      = "ok"      // Refill or Available succeeded
+	OutcomeError   = "error"   // The call returned an error
+)
+
+// LatencyHistogram is a snapshot of the call latencies for one operation and
+// outcome.
+type LatencyHistogram struct {
+	Count   uint64        // Calls observed
+	Sum     time.Duration // Total time spent in them
+	Buckets []uint64      // Calls at or under each of LatencyBuckets, cumulative
+}
+
+type latencyKey struct{ op, outcome string }
+
+type histogram struct {
+	count   uint64
+	sum     time.Duration
+	buckets []uint64 // Per bucket, not cumulative
+}
+
+// InstrumentedLimiter times every call to the limiter it wraps into latency
+// histograms by operation and outcome, whatever the backend. Optional
+// interfaces other than ReadyChecker aren't forwarded; reach them through
+// Limiter.
+type InstrumentedLimiter struct {
+	limiter Limiter
+
+	mu    sync.Mutex
+	hists map[latencyKey]*histogram
+}
+
+// Instrumented wraps limiter so its calls are timed.
+func Instrumented(limiter Limiter) *InstrumentedLimiter {
+	return &InstrumentedLimiter{limiter: limiter, hists: make(map[latencyKey]*histogram)}
+}
+
+// Limiter returns the wrapped limiter.
+func (l *InstrumentedLimiter) Limiter() Limiter {
+	return l.limiter
+}
+
+// Allow checks a request, as the wrapped limiter's Allow.
+func (l *InstrumentedLimiter) Allow(key string) (bool, error) {
+	start := time.Now()
+	allowed, err := l.limiter.Allow(key)
+	l.observe(OpAllow, allowOutcome(allowed, err), time.Since(start))
+	return allowed, err
+}
+
+// AllowN checks a request costing n tokens, as the wrapped limiter's AllowN.
+func (l *InstrumentedLimiter) AllowN(key string, n float64) (bool, error) {
+	start := time.Now()
+	allowed, err := l.limiter.AllowN(key, n)
+	l.observe(OpAllow, allowOutcome(allowed, err), time.Since(start))
+	return allowed, err
+}
+
+// Refill adds tokens to key's bucket, as the wrapped limiter's Refill.
+func (l *InstrumentedLimiter) Refill(key string, tokens float64) error {
+	start := time.Now()
+	err := l.limiter.Refill(key, tokens)
+	l.observe(OpRefill, errOutcome(err), time.Since(start))
+	return err
+}
+
+// Available returns key's balance, as the wrapped limiter's Available.
+func (l *InstrumentedLimiter) Available(key string) (float64, error) {
+	start := time.Now()
+	tokens, err := l.limiter.Available(key)
+	l.observe(OpAvailable, errOutcome(err), time.Since(start))
+	return tokens, err
+}
+
+// Ready reports whether the wrapped limiter is ready. See IsReady.
+func (l *InstrumentedLimiter) Ready() bool {
+	return IsReady(l.limiter)
+}
+
+func allowOutcome(allowed bool, err error) string {
+	switch {
+	case err != nil:
+		return OutcomeError
+	case allowed:
+		return OutcomeAllowed
+	}
+	return OutcomeDenied
+}
+
+func errOutcome(err error) string {
+	if err != nil {
+		return OutcomeError
+	}
+	return OutcomeOK
+}
+
+func (l *InstrumentedLimiter) observe(op, outcome string, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	h, ok := l.hists[latencyKey{op, outcome}]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(LatencyBuckets))}
+		l.hists[latencyKey{op, outcome}] = h
+	}
+	h.count++
+	h.sum += d
+	if i := sort.SearchFloat64s(LatencyBuckets, d.Seconds()); i < len(LatencyBuckets) {
+		h.buckets[i]++
+	}
+}
+
+// Latency returns the histogram for op and outcome. One with no calls has
+// a zero Count.
+func (l *InstrumentedLimiter) Latency(op, outcome string) LatencyHistogram {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	snap := LatencyHistogram{Buckets: make([]uint64, len(LatencyBuckets))}
+	h, ok := l.hists[latencyKey{op, outcome}]
+	if !ok {
+		return snap
+	}
+	snap.Count, snap.Sum = h.count, h.sum
+	var cumulative uint64
+	for i, n := range h.buckets {
+		cumulative += n
+		snap.Buckets[i] = cumulative
+	}
+	return snap
+}
+
+// WriteMetrics writes the histograms in the Prometheus text exposition
+// format, ordered by operation and outcome.
+func (l *InstrumentedLimiter) WriteMetrics(w io.Writer) error {
+	l.mu.Lock()
+	keys := make([]latencyKey, 0, len(l.hists))
+	for k := range l.hists {
+		keys = append(keys, k)
+	}
+	l.mu.Unlock()
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].op != keys[j].op {
+			return keys[i].op < keys[j].op
+		}
+		return keys[i].outcome < keys[j].outcome
+	})
+
+	if _, err := fmt.Fprintf(w, "# HELP %s Limiter call latency by operation and outcome.\n# TYPE %s histogram\n",
+		LatencyMetric, LatencyMetric); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		h := l.Latency(k.op, k.outcome)
+		labels := fmt.Sprintf("op=%q,outcome=%q", k.op, k.outcome)
+		for i, bound := range LatencyBuckets {
+			le := strconv.FormatFloat(bound, 'g', -1, 64)
+			if _, err := fmt.Fprintf(w, "%s_bucket{%s,le=%q} %d\n", LatencyMetric, labels, le, h.Buckets[i]); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n%s_sum{%s} %g\n%s_count{%s} %d\n",
+			LatencyMetric, labels, h.Count,
+			LatencyMetric, labels, h.Sum.Seconds(),
+			LatencyMetric, labels, h.Count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	_ Limiter      = (*InstrumentedLimiter)(nil)
+	_ ReadyChecker = (*InstrumentedLimiter)(nil)
+)
@@ -0,0 +1,90 @@
+package ratelimit_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/memory"
+)
+
+// slowLimiter takes delay over every call, like a Redis backend in trouble.
+type slowLimiter struct {
+	ratelimit.Limiter
+	delay time.Duration
+}
+
+func (l slowLimiter) AllowN(key string, n float64) (bool, error) {
+	time.Sleep(l.delay)
+	return l.Limiter.AllowN(key, n)
+}
+
+func (l slowLimiter) Refill(key string, tokens float64) error {
+	time.Sleep(l.delay)
+	return errors.New("backend unavailable")
+}
+
+func TestInstrumented_RecordsLatency(t *testing.T) {
+	const delay = 30 * time.Millisecond
+	l := ratelimit.Instrumented(slowLimiter{memory.NewTokenBucket(1, 0.001), delay})
+
+	l.AllowN("k", 1) // Allowed
+	l.AllowN("k", 1) // Denied
+	if err := l.Refill("k", 1); err == nil {
+		t.Fatal("Expected the wrapped limiter's Refill error")
+	}
+
+	for _, outcome := range []string{ratelimit.OutcomeAllowed, ratelimit.OutcomeDenied} {
+		h := l.Latency(ratelimit.OpAllow, outcome)
+		if h.Count != 1 {
+			t.Fatalf("Expected one %s call, got %d", outcome, h.Count)
+		}
+		if h.Sum < delay {
+			t.Errorf("Expected %s latency of at least %v, got %v", outcome, delay, h.Sum)
+		}
+	}
+	h := l.Latency(ratelimit.OpRefill, ratelimit.OutcomeError)
+	if h.Count != 1 || h.Sum < delay {
+		t.Errorf("Expected one failed refill of at least %v, got %d taking %v", delay, h.Count, h.Sum)
+	}
+
+	// Nothing lands in buckets under the delay; everything under 1s
+	for i, bound := range ratelimit.LatencyBuckets {
+		if bound < delay.Seconds() && h.Buckets[i] != 0 {
+			t.Errorf("Bucket le=%g: expected no calls, got %d", bound, h.Buckets[i])
+		}
+		if bound >= 1 && h.Buckets[i] != 1 {
+			t.Errorf("Bucket le=%g: expected 1 call, got %d", bound, h.Buckets[i])
+		}
+	}
+
+	if h := l.Latency(ratelimit.OpAvailable, ratelimit.OutcomeOK); h.Count != 0 {
+		t.Errorf("Expected no available calls, got %d", h.Count)
+	}
+}
+
+func TestInstrumented_WriteMetrics(t *testing.T) {
+	l := ratelimit.Instrumented(memory.NewTokenBucket(1, 0.001))
+	l.Allow("k")
+	l.Available("k")
+
+	var b strings.Builder
+	if err := l.WriteMetrics(&b); err != nil {
+		t.Fatalf("WriteMetrics error: %v", err)
+	}
+	out := b.String()
+	for _, line := range []string{
+		"# TYPE ratelimiter_limiter_latency_seconds histogram",
+		`ratelimiter_limiter_latency_seconds_bucket{op="allow",outcome="allowed",le="+Inf"} 1`,
+		`ratelimiter_limiter_latency_seconds_count{op="available",outcome="ok"} 1`,
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("Expected %q in metrics, got:\n%s", line, out)
+		}
+	}
+	if !ratelimit.IsReady(l) {
+		t.Error("Expected an instrumented in-memory limiter to be ready")
+	}
+}
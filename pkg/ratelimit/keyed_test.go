@@ -0,0 +1,78 @@
+package ratelimit_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/redis/go-redis/v9"
+
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/memory"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/redis"
+)
+
+func TestJoinKey_NoCollisions(t *testing.T) {
+	// Every list of up to three parts drawn from pieces chosen to tempt
+	// collisions: separators, escapes and empty strings
+	pieces := []string{"", "a", "b", ":", "\\", "a:b", "b:c", "a\\", "\\:", ":b", "a:", "c"}
+	var lists [][]string
+	for _, p := range pieces {
+		lists = append(lists, []string{p})
+		for _, q := range pieces {
+			lists = append(lists, []string{p, q})
+			for _, r := range pieces {
+				lists = append(lists, []string{p, q, r})
+			}
+		}
+	}
+
+	seen := make(map[string][]string, len(lists))
+	for _, parts := range lists {
+		key := ratelimit.JoinKey(parts...)
+		if prev, ok := seen[key]; ok {
+			t.Fatalf("Expected distinct keys, but %q and %q both give %q", prev, parts, key)
+		}
+		seen[key] = parts
+	}
+
+	if got := ratelimit.JoinKey("192.0.2.1", "/cpu"); got != "192.0.2.1:/cpu" {
+		t.Errorf("Expected plain parts joined unescaped, got %q", got)
+	}
+}
+
+func TestKeyed(t *testing.T) {
+	// The memory bucket ignores keys; Redis keeps one bucket per key
+	mr := miniredis.RunT(t)
+	client := goredis.NewClient(&goredis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	limiter := ratelimit.Keyed(redis.NewTokenBucket(redis.Config{Client: client, Capacity: 1, RefillRate: 0.001}), nil)
+
+	if allowed, _ := limiter.Allow("a:b", "c"); !allowed {
+		t.Fatal("Expected the first request allowed")
+	}
+	if allowed, _ := limiter.Allow("a:b", "c"); allowed {
+		t.Error("Expected the same identity to share a bucket")
+	}
+	if allowed, _ := limiter.Allow("a", "b:c"); !allowed {
+		t.Error("Expected an identity whose parts merely join alike to have its own bucket")
+	}
+
+	if err := limiter.Refill(2, "a:b", "c"); err != nil {
+		t.Fatalf("Refill error: %v", err)
+	}
+	if got, _ := limiter.Available("a:b", "c"); got < 1.99 {
+		t.Errorf("Expected the refill on the identity's bucket, got %.2f", got)
+	}
+	if allowed, _ := limiter.AllowN(2, "a:b", "c"); !allowed {
+		t.Error("Expected AllowN to spend the refilled tokens")
+	}
+
+	// A custom KeyFunc decides the key
+	upper := ratelimit.Keyed(memory.NewTokenBucket(1, 0.001), func(parts ...string) string {
+		return strings.ToUpper(strings.Join(parts, "/"))
+	})
+	if got := upper.Key("ip", "route"); got != "IP/ROUTE" {
+		t.Errorf("Expected the custom KeyFunc's key, got %q", got)
+	}
+}
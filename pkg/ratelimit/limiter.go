@@ -1,5 +1,33 @@
 package ratelimit
 
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// Errors returned by Limiter implementations. Backend errors are wrapped, so
+// callers should compare with errors.Is.
+var (
+	// ErrInvalidCost is returned when a request cost is not a positive number.
+	ErrInvalidCost = errors.New("ratelimit: cost must be positive")
+
+	// ErrInvalidKey is returned when a key can't identify a bucket (e.g. empty).
+	ErrInvalidKey = errors.New("ratelimit: invalid key")
+
+	// ErrInvalidCapacity is returned for a bucket capacity below one token,
+	// which could never admit a whole-token request.
+	ErrInvalidCapacity = errors.New("ratelimit: capacity must be at least 1")
+
+	// ErrInvalidRefillRate is returned for a refill rate that isn't positive.
+	ErrInvalidRefillRate = errors.New("ratelimit: refill rate must be positive")
+
+	// ErrBackendUnavailable is returned when the storage backend can't be
+	// reached (connection refused, timeout, closed client). The request was
+	// neither allowed nor denied, so callers may choose to fail open.
+	ErrBackendUnavailable = errors.New("ratelimit: backend unavailable")
+)
+
 // Limiter is the interface for rate limiters.
 // Implementations can be in-memory, Redis-backed, or any other storage.
 type Limiter interface {
@@ -7,6 +35,11 @@ type Limiter interface {
 	// Returns true if allowed, false if rate limited.
 	Allow(key string) (bool, error)
 
+	// AllowN checks if a request costing n tokens should be allowed.
+	// n may be fractional (e.g. 0.25 lets one token cover four cheap calls).
+	// Returns ErrInvalidCost if n is not positive.
+	AllowN(key string, n float64) (bool, error)
+
 	// Refill adds tokens to the bucket for the given key.
 	// Used when a user pays to refill their rate limit quota.
 	// Returns error if the refill fails.
@@ -16,3 +49,51 @@ type Limiter interface {
 	// Useful for monitoring and debugging.
 	Available(key string) (float64, error)
 }
+
+// ValidateBucket checks a token bucket's settings, returning
+// ErrInvalidCapacity or ErrInvalidRefillRate. The limiter constructors panic
+// on settings it rejects, so check user-supplied values with it first.
+func ValidateBucket(capacity, refillRate float64) error {
+	if !(capacity >= 1) || math.IsInf(capacity, 1) {
+		return ErrInvalidCapacity
+	}
+	if !(refillRate > 0) || math.IsInf(refillRate, 1) {
+		return ErrInvalidRefillRate
+	}
+	return nil
+}
+
+// RemainingRequests returns how many more requests costing costPerRequest
+// key can make right now, i.e. floor(available / costPerRequest), using
+// l.Available. Natural refill isn't counted, and a bucket in debt has none
+// left. Returns ErrInvalidCost if costPerRequest is not positive.
+func RemainingRequests(l Limiter, key string, costPerRequest float64) (int, error) {
+	if !(costPerRequest > 0) {
+		return 0, ErrInvalidCost
+	}
+	available, err := l.Available(key)
+	if err != nil {
+		return 0, err
+	}
+	if available <= 0 {
+		return 0, nil
+	}
+	// The epsilon stops float error (e.g. 0.6 / 0.2 = 2.9999...) losing a
+	// request that AllowN would admit
+	return int(math.Floor(available/costPerRequest + 1e-9)), nil
+}
+
+// ResetTime returns when a bucket holding tokens at now recovers under
+// natural refill at rate tokens per second: when it next holds one whole
+// token if it holds less, or otherwise when it reaches capacity. A full
+// bucket, or one that never refills (rate <= 0), reports now.
+func ResetTime(now time.Time, tokens, capacity, rate float64) time.Time {
+	target := capacity
+	if tokens < 1 {
+		target = math.Min(1, capacity)
+	}
+	if tokens >= target || !(rate > 0) {
+		return now
+	}
+	return now.Add(time.Duration((target - tokens) / rate * float64(time.Second)))
+}
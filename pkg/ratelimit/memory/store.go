@@ -0,0 +1,91 @@
+package memory
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+)
+
+// Store is an in-memory ratelimit.Store with one bucket per key, for
+// bucket.Limiter. Buckets are kept until reset; nothing expires them.
+type Store struct {
+	mu      sync.Mutex
+	buckets map[string]ratelimit.BucketState
+}
+
+// NewStore creates an empty in-memory store.
+func NewStore() *Store {
+	return &Store{buckets: make(map[string]ratelimit.BucketState)}
+}
+
+// GetBucket returns the stored state for key.
+func (s *Store) GetBucket(key string) (ratelimit.BucketState, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.buckets[key]
+	return state, ok, nil
+}
+
+// SetBucket overwrites the stored state for key.
+func (s *Store) SetBucket(key string, state ratelimit.BucketState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets[key] = state
+	return nil
+}
+
+// ConsumeIfAvailable applies take to key's bucket under the store's lock.
+func (s *Store) ConsumeIfAvailable(key string, take ratelimit.TakeFunc) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.buckets[key]
+	state, allowed := take(state, ok)
+	s.buckets[key] = state
+	return allowed, nil
+}
+
+// AddTokens applies add to key's bucket under the store's lock.
+func (s *Store) AddTokens(key string, add ratelimit.UpdateFunc) (ratelimit.BucketState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.buckets[key]
+	state = add(state, ok)
+	s.buckets[key] = state
+	return state, nil
+}
+
+// Scan returns up to limit buckets in key order, starting after the key
+// named by cursor. The states are copies, so callers can read them without
+// holding the store's lock.
+func (s *Store) Scan(cursor string, limit int) ([]string, []ratelimit.BucketState, string, error) {
+	limit = min(max(limit, 1), ratelimit.MaxSnapshotPage)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.buckets))
+	for key := range s.buckets {
+		if key > cursor {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	next := ""
+	if len(keys) > limit {
+		keys = keys[:limit]
+		next = keys[limit-1]
+	}
+	states := make([]ratelimit.BucketState, len(keys))
+	for i, key := range keys {
+		states[i] = s.buckets[key]
+	}
+	return keys, states, next, nil
+}
+
+// Ensure Store implements ratelimit.Store.
+var _ ratelimit.Store = (*Store)(nil)
+var _ ratelimit.Scanner = (*Store)(nil)
@@ -1,89 +1,418 @@
 package memory
 
 import (
+	"fmt"
 	"log"
+	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/bucket"
 )
 
 // TokenBucket implements a token bucket rate limiter.
+//
+// In the common case (no refill schedule or debt, balance within capacity)
+// the state is a single int64 updated by compare-and-swap, so requests don't
+// take the mutex. Paid overflow, debt, schedules, AllowAt and the admin
+// operations take the mutex path, which owns the state while fastState holds
+// lockedState.
 type TokenBucket struct {
-	capacity       float64
-	refillRate     float64 // tokens per second
-	tokens         float64
-	lastRefillTime time.Time
-	mu             sync.Mutex
+	rules   bucket.Rules
+	clock   ratelimit.Clock
+	redact  ratelimit.Redactor
+	state   ratelimit.BucketState // guarded by mu while on the mutex path; counters are in allowed and denied
+	allowed atomic.Int64
+	denied  atomic.Int64
+	mu      sync.Mutex
+
+	// Fast path state. Times are nanosecond offsets from base. fastState is
+	// the offset at which the balance was zero, so the balance at t is
+	// min(capNanos, t-fastState) nanoseconds of refill.
+	fast      bool // config allows the fast path
+	base      time.Time
+	capNanos  int64
+	fastState atomic.Int64 // lockedState while the mutex path owns the state
+	lastSeen  atomic.Int64 // latest time the fast path acted at
+}
+
+// lockedState marks the state as held in the mutex-guarded fields.
+const lockedState = math.MinInt64
+
+// Config holds configuration for the in-memory token bucket.
+type Config struct {
+	Capacity   float64
+	RefillRate float64 // tokens per second
+
+	// BurstCapacity caps the balance paid refills may build up. Natural refill
+	// still stops at Capacity, but a client may spend up to BurstCapacity
+	// tokens in a spike after paying. 0 leaves paid refills uncapped; values
+	// below Capacity are raised to Capacity.
+	BurstCapacity float64
+
+	// MinTokens is the lowest balance a request may push the bucket to.
+	// A negative value lets clients briefly go into token debt, repaid by
+	// natural refill; while in debt (balance <= 0) every request is denied.
+	// Default 0 (no debt).
+	MinTokens float64
+
+	// GraceOverage lets a client keep spending this many tokens past zero,
+	// into debt repaid by natural refill, before requests are denied (and
+	// payment asked for). Unlike MinTokens, a bucket already in debt keeps
+	// being served until the grace is used up. Default 0 (deny at zero).
+	GraceOverage float64
+
+	// BurstTTL expires paid tokens above Capacity that are still unspent
+	// this long after the last refill that added to them: the balance then
+	// drops back to Capacity. Tokens within Capacity are unaffected.
+	// Default 0 (overflow never expires).
+	BurstTTL time.Duration
+
+	// RefillSchedule optionally scales RefillRate by time of day, read in
+	// the clock's time zone. Nil keeps the rate constant.
+	RefillSchedule ratelimit.RefillSchedule
+
+	// RefillMode chooses what Refill does with paid tokens (default
+	// ratelimit.RefillStack, adding them to the balance).
+	RefillMode ratelimit.RefillMode
+
+	Clock ratelimit.Clock // Optional time source (default: ratelimit.SystemClock)
+
+	// Redact masks keys in the limiter's log lines. Nil logs them as is.
+	Redact ratelimit.Redactor
 }
 
 // NewTokenBucket creates a new TokenBucket with the given capacity and refill rate.
+// It panics if ratelimit.ValidateBucket rejects them.
 func NewTokenBucket(capacity float64, refillRate float64) *TokenBucket {
-	return &TokenBucket{
-		capacity:       capacity,
-		refillRate:     refillRate,
-		tokens:         capacity, // Start full
-		lastRefillTime: time.Now(),
+	return NewTokenBucketWithConfig(Config{
+		Capacity:   capacity,
+		RefillRate: refillRate,
+	})
+}
+
+// NewTokenBucketWithConfig creates a new TokenBucket from the given config.
+// It panics if ratelimit.ValidateBucket rejects its capacity or refill rate.
+func NewTokenBucketWithConfig(cfg Config) *TokenBucket {
+	if err := ratelimit.ValidateBucket(cfg.Capacity, cfg.RefillRate); err != nil {
+		panic(fmt.Sprintf("memory.NewTokenBucket: %v (capacity %g, refill rate %g)", err, cfg.Capacity, cfg.RefillRate))
+	}
+	clock := cfg.Clock
+	if clock == nil {
+		clock = ratelimit.SystemClock
+	}
+	now := clock.Now()
+	tb := &TokenBucket{
+		rules: bucket.Rules{
+			Capacity:   cfg.Capacity,
+			RefillRate: cfg.RefillRate,
+			Burst:      cfg.BurstCapacity,
+			MinTokens:  cfg.MinTokens,
+			Grace:      cfg.GraceOverage,
+			BurstTTL:   cfg.BurstTTL,
+			Schedule:   cfg.RefillSchedule,
+			Mode:       cfg.RefillMode,
+		}.Clamp(),
+		clock:  clock,
+		redact: cfg.Redact,
+		base:   now,
+	}
+	tb.state = tb.rules.New(now) // Start full
+
+	// The fast path needs a constant rate, no debt, and a full bucket's
+	// worth of refill time that fits comfortably in an int64
+	capSeconds := cfg.Capacity / cfg.RefillRate
+	tb.fast = len(cfg.RefillSchedule) == 0 && tb.rules.MinTokens == 0 && tb.rules.Grace == 0 &&
+		cfg.Capacity > 0 && cfg.RefillRate > 0 && capSeconds < 1<<32
+	tb.fastState.Store(lockedState)
+	if tb.fast {
+		tb.capNanos = tb.nanosFor(cfg.Capacity)
+		tb.publish()
 	}
+	return tb
 }
 
-// refill calculates how many tokens should be added since the last refill.
-// Only caps at capacity if tokens were below capacity before adding.
-// This preserves "overflow" tokens from paid refills.
-func (tb *TokenBucket) refill() {
-	now := time.Now()
-	duration := now.Sub(tb.lastRefillTime)
-	tokensToAdd := duration.Seconds() * tb.refillRate
-
-	// Only add tokens if below capacity (natural regeneration)
-	// If already above capacity (from paid refill), don't cap
-	if tb.tokens < tb.capacity {
-		tb.tokens += tokensToAdd
-		if tb.tokens > tb.capacity {
-			tb.tokens = tb.capacity
+// nanosFor returns the refill time worth tokens, rounded down.
+func (tb *TokenBucket) nanosFor(tokens float64) int64 {
+	return int64(tokens / tb.rules.RefillRate * 1e9)
+}
+
+// balance converts a fast path balance in nanoseconds of refill to tokens.
+func (tb *TokenBucket) balance(nanos int64) float64 {
+	if nanos >= tb.capNanos {
+		return tb.rules.Capacity
+	}
+	return float64(nanos) / 1e9 * tb.rules.RefillRate
+}
+
+// offset returns t as a fast path offset.
+func (tb *TokenBucket) offset(t time.Time) int64 {
+	return int64(t.Sub(tb.base))
+}
+
+// seen records that the fast path acted at offset t, returning the latest
+// such time: a caller whose clock read lost a race acts as of that instead,
+// as the mutex path would.
+func (tb *TokenBucket) seen(t int64) int64 {
+	for {
+		last := tb.lastSeen.Load()
+		if t <= last {
+			return last
+		}
+		if tb.lastSeen.CompareAndSwap(last, t) {
+			return t
+		}
+	}
+}
+
+// tryFast decides a request costing n at now without the mutex. ok is false
+// when the mutex path must decide instead.
+func (tb *TokenBucket) tryFast(n float64, now time.Time) (allowed, ok bool) {
+	if !tb.fast || n > tb.rules.Capacity {
+		return false, false
+	}
+	t := tb.seen(tb.offset(now))
+	need := tb.nanosFor(n)
+	for {
+		state := tb.fastState.Load()
+		if state == lockedState {
+			return false, false
+		}
+		empty := max(state, t-tb.capNanos) // Natural refill stops at capacity
+		if avail := t - empty; avail <= 0 || avail < need {
+			tb.denied.Add(1)
+			return false, true
 		}
+		if tb.fastState.CompareAndSwap(state, empty+need) {
+			tb.allowed.Add(1)
+			return true, true
+		}
+	}
+}
+
+// lock takes the mutex and moves the state off the fast path, so tokens and
+// lastRefillTime are current until unlock.
+func (tb *TokenBucket) lock() {
+	tb.mu.Lock()
+	state := tb.fastState.Swap(lockedState)
+	if state == lockedState {
+		return
+	}
+	last := tb.lastSeen.Load()
+	tb.state.Tokens = tb.balance(last - state)
+	tb.state.LastRefill = tb.base.Add(time.Duration(last))
+}
+
+// unlock hands the state back to the fast path when it's eligible, and
+// releases the mutex.
+func (tb *TokenBucket) unlock() {
+	tb.publish()
+	tb.mu.Unlock()
+}
+
+// publish moves the state onto the fast path if the config and balance
+// allow it. Overflow from paid refills stays on the mutex path until spent.
+func (tb *TokenBucket) publish() {
+	if !tb.fast || tb.state.Tokens < 0 || tb.state.Tokens > tb.rules.Capacity {
+		return
 	}
-	tb.lastRefillTime = now
+	last := tb.offset(tb.state.LastRefill)
+	tb.lastSeen.Store(last)
+	tb.fastState.Store(last - tb.nanosFor(tb.state.Tokens))
+}
+
+// refill settles natural refill up to the clock's time. See
+// bucket.Rules.Settle.
+func (tb *TokenBucket) refill() {
+	tb.state = tb.rules.Settle(tb.state, tb.clock.Now())
 }
 
 // Allow checks if a token is available and consumes it if so.
 // The key parameter is ignored for in-memory implementation but required for Limiter interface.
 func (tb *TokenBucket) Allow(key string) (bool, error) {
-	tb.mu.Lock()
-	defer tb.mu.Unlock()
+	return tb.AllowN(key, 1)
+}
 
-	tb.refill()
+// AllowN checks if n tokens are available and consumes them if so.
+// n may be fractional, e.g. 0.25 for a cheap endpoint. With a negative
+// MinTokens, a request may overdraw the bucket down to MinTokens as long as
+// the bucket isn't already in debt; with GraceOverage, down to -GraceOverage
+// even if it is.
+func (tb *TokenBucket) AllowN(key string, n float64) (bool, error) {
+	now := tb.clock.Now()
+	if n > 0 {
+		if allowed, ok := tb.tryFast(n, now); ok {
+			return allowed, nil
+		}
+	}
+	return tb.allowN(n, now)
+}
+
+// AllowWithReset is Allow, also returning when the bucket recovers at the
+// current refill rate: see ratelimit.ResetTime. The key parameter is ignored
+// for in-memory implementation.
+func (tb *TokenBucket) AllowWithReset(key string) (bool, time.Time, error) {
+	allowed, err := tb.Allow(key)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	now := tb.clock.Now()
+	tokens, err := tb.Available(key)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	return allowed, ratelimit.ResetTime(now, tokens, tb.rules.Capacity, tb.rules.Rate(now)), nil
+}
+
+// AllowAt is Allow using at, rather than the clock, for refill math. It lets
+// recorded traffic be replayed, or tests simulate refill without sleeping.
+// Timestamps older than the bucket's last update accrue no tokens.
+// The key parameter is ignored for in-memory implementation.
+func (tb *TokenBucket) AllowAt(key string, at time.Time) (bool, error) {
+	return tb.allowN(1, at)
+}
 
-	if tb.tokens >= 1 {
-		tb.tokens--
-		return true, nil
+// allowN consumes n tokens as of at, if available.
+func (tb *TokenBucket) allowN(n float64, at time.Time) (bool, error) {
+	if n <= 0 {
+		return false, ratelimit.ErrInvalidCost
 	}
 
-	return false, nil
+	tb.lock()
+	defer tb.unlock()
+
+	var allowed bool
+	tb.state, allowed = tb.rules.Take(tb.rules.Settle(tb.state, at), n)
+	if allowed {
+		tb.allowed.Add(1)
+	} else {
+		tb.denied.Add(1)
+	}
+	return allowed, nil
 }
 
 // Available returns the current number of tokens (after a refill).
 // The key parameter is ignored for in-memory implementation (single bucket).
 func (tb *TokenBucket) Available(key string) (float64, error) {
-	tb.mu.Lock()
-	defer tb.mu.Unlock()
+	if tb.fast {
+		t := max(tb.offset(tb.clock.Now()), tb.lastSeen.Load())
+		if state := tb.fastState.Load(); state != lockedState {
+			return tb.balance(t - state), nil
+		}
+	}
+
+	tb.lock()
+	defer tb.unlock()
 	tb.refill()
-	return tb.tokens, nil
+	return tb.state.Tokens, nil
 }
 
-// Refill adds tokens to the bucket without capping at capacity.
-// This allows paid tokens to exceed the normal limit ("burst" tokens).
+// Refill adds tokens to the bucket without capping at capacity, or applies
+// them as Config.RefillMode says.
+// This allows paid tokens to exceed the normal limit ("burst" tokens), up to
+// BurstCapacity when set. A balance already above the cap isn't reduced.
+// Natural refill accrued so far is settled first, so it isn't lost.
 // The key parameter is ignored for in-memory implementation.
 func (tb *TokenBucket) Refill(key string, tokens float64) error {
-	tb.mu.Lock()
-	defer tb.mu.Unlock()
+	return tb.refillWith(tb.rules.Mode, key, tokens)
+}
+
+// RefillTo raises the balance to target if it's below, up to BurstCapacity
+// when set, whatever Config.RefillMode says. See ratelimit.TargetRefiller.
+// The key parameter is ignored for in-memory implementation.
+func (tb *TokenBucket) RefillTo(key string, target float64) error {
+	return tb.refillWith(ratelimit.RefillAtLeast, key, target)
+}
+
+// refillWith settles natural refill, then applies tokens as mode says.
+func (tb *TokenBucket) refillWith(mode ratelimit.RefillMode, key string, tokens float64) error {
+	tb.lock()
+	defer tb.unlock()
 
-	before := tb.tokens
-	tb.tokens += tokens
-	// No cap - allow overflow beyond capacity for paid tokens
-	log.Printf("[REFILL] key=%s before=%.2f added=%.2f after=%.2f", key, before, tokens, tb.tokens)
+	now := tb.clock.Now()
+	tb.state = tb.rules.Settle(tb.state, now)
+	before := tb.state.Tokens
+	tb.state = tb.rules.Add(tb.state, mode, tokens, now)
+	log.Printf("[REFILL] key=%s before=%.2f added=%.2f after=%.2f", tb.redact.Redact(key), before, tokens, tb.state.Tokens)
 	return nil
 }
 
+// Refund returns unused tokens, raising the balance no higher than capacity.
+// See ratelimit.Refunder. The key parameter is ignored for in-memory
+// implementation.
+func (tb *TokenBucket) Refund(key string, tokens float64) error {
+	tb.lock()
+	defer tb.unlock()
+
+	tb.refill()
+	tb.state = tb.rules.Refund(tb.state, tokens)
+	return nil
+}
+
+// Reset restores the bucket to full capacity, starting it afresh: its
+// creation time and counters are reset too.
+// The key parameter is ignored for in-memory implementation.
+func (tb *TokenBucket) Reset(key string) error {
+	tb.lock()
+	defer tb.unlock()
+
+	tb.state = tb.rules.New(tb.clock.Now())
+	tb.allowed.Store(0)
+	tb.denied.Store(0)
+	return nil
+}
+
+// Info returns the bucket's balance, timestamps and request counters.
+// The key parameter is ignored for in-memory implementation (single bucket).
+func (tb *TokenBucket) Info(key string) (ratelimit.BucketInfo, error) {
+	tb.lock()
+	defer tb.unlock()
+
+	return ratelimit.BucketInfo{
+		Tokens:     tb.rules.TokensAt(tb.state, tb.clock.Now()),
+		LastRefill: tb.state.LastRefill,
+		CreatedAt:  tb.state.CreatedAt,
+		Allowed:    tb.allowed.Load(),
+		Denied:     tb.denied.Load(),
+	}, nil
+}
+
+// Drain empties the bucket, so it throttles until natural refill resumes.
+// The key parameter is ignored for in-memory implementation.
+func (tb *TokenBucket) Drain(key string) error {
+	tb.lock()
+	defer tb.unlock()
+
+	tb.state.Tokens = 0
+	tb.state.LastRefill = tb.clock.Now()
+	return nil
+}
+
+// Snapshot lists the bucket's balance after natural refill, without
+// changing it. Every key shares the one bucket, so the first page holds a
+// single entry under the empty key and there is no next page.
+func (tb *TokenBucket) Snapshot(cursor string, limit int) ([]ratelimit.KeyTokens, string, error) {
+	if cursor != "" {
+		return nil, "", nil
+	}
+	tb.lock()
+	defer tb.unlock()
+	return []ratelimit.KeyTokens{{Tokens: tb.rules.TokensAt(tb.state, tb.clock.Now())}}, "", nil
+}
+
+// Clock returns the clock the bucket's refill math reads.
+func (tb *TokenBucket) Clock() ratelimit.Clock {
+	return tb.clock
+}
+
 // Ensure TokenBucket implements Limiter interface.
 var _ ratelimit.Limiter = (*TokenBucket)(nil)
+var _ ratelimit.Resetter = (*TokenBucket)(nil)
+var _ ratelimit.Drainer = (*TokenBucket)(nil)
+var _ ratelimit.Inspector = (*TokenBucket)(nil)
+var _ ratelimit.Snapshotter = (*TokenBucket)(nil)
+var _ ratelimit.Clocked = (*TokenBucket)(nil)
+var _ ratelimit.Refunder = (*TokenBucket)(nil)
+var _ ratelimit.TargetRefiller = (*TokenBucket)(nil)
@@ -1,11 +1,17 @@
 package memory
 
 import (
+	"io"
+	"log"
 	"math"
+	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/ratelimittest"
 )
 
 // approxEqual checks if two floats are approximately equal within a tolerance.
@@ -44,7 +50,11 @@ func TestTokenBucket_Allow(t *testing.T) {
 }
 
 func TestTokenBucket_Refill(t *testing.T) {
-	tb := NewTokenBucket(5, 10) // 10 tokens per second
+	tb := NewTokenBucketWithConfig(Config{
+		Capacity:   5,
+		RefillRate: 10, // 10 tokens per second
+		Clock:      ratelimittest.NewFakeClock(),
+	})
 
 	// Empty the bucket
 	for i := 0; i < 5; i++ {
@@ -56,8 +66,8 @@ func TestTokenBucket_Refill(t *testing.T) {
 		t.Error("Should be empty now")
 	}
 
-	// Wait 100ms, should get 1 token (10/sec * 0.1sec = 1)
-	time.Sleep(110 * time.Millisecond)
+	// After 100ms, should get 1 token (10/sec * 0.1sec = 1)
+	ratelimittest.AdvanceTime(t, tb, 100*time.Millisecond)
 
 	allowed, _ = tb.Allow("")
 	if !allowed {
@@ -71,9 +81,13 @@ func TestTokenBucket_Refill(t *testing.T) {
 }
 
 func TestTokenBucket_MaxCapacity(t *testing.T) {
-	tb := NewTokenBucket(5, 100) // Fast refill
+	tb := NewTokenBucketWithConfig(Config{
+		Capacity:   5,
+		RefillRate: 100, // Fast refill
+		Clock:      ratelimittest.NewFakeClock(),
+	})
 
-	time.Sleep(100 * time.Millisecond)
+	ratelimittest.AdvanceTime(t, tb, 100*time.Millisecond)
 
 	if mustAvailable(tb) > 5 {
 		t.Errorf("Expected tokens to be capped at capacity 5, got %f", mustAvailable(tb))
@@ -167,7 +181,11 @@ func TestTokenBucket_RefillExceedsCapacity(t *testing.T) {
 }
 
 func TestTokenBucket_PartialConsumeRefillAndNaturalRegen(t *testing.T) {
-	tb := NewTokenBucket(5, 10) // Capacity 5, 10 tokens/sec refill
+	tb := NewTokenBucketWithConfig(Config{
+		Capacity:   5,
+		RefillRate: 10, // 10 tokens/sec refill
+		Clock:      ratelimittest.NewFakeClock(),
+	})
 
 	// Start with 5 tokens, consume 3 (leaving 2)
 	for i := 0; i < 3; i++ {
@@ -185,7 +203,7 @@ func TestTokenBucket_PartialConsumeRefillAndNaturalRegen(t *testing.T) {
 
 	// Should have 7 tokens now
 	// Let natural refill happen (100ms = 1 token, but we're above capacity so no natural regen)
-	time.Sleep(110 * time.Millisecond)
+	ratelimittest.AdvanceTime(t, tb, 100*time.Millisecond)
 
 	// Still should have only 7 tokens (overflow preserved, no natural regen above capacity)
 	successCount := 0
@@ -452,3 +470,618 @@ func TestTokenBucket_RefillOnEmptyBucket(t *testing.T) {
 		t.Error("5th request should be rejected")
 	}
 }
+
+func TestTokenBucket_AllowNFractionalCost(t *testing.T) {
+	tb := NewTokenBucket(1, 0.001) // 1 token, negligible natural refill
+
+	// A single token covers four 0.25-cost calls
+	for i := 0; i < 4; i++ {
+		allowed, err := tb.AllowN("", 0.25)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !allowed {
+			t.Errorf("Expected cheap request %d to be allowed", i+1)
+		}
+	}
+
+	// Fifth is denied
+	allowed, _ := tb.AllowN("", 0.25)
+	if allowed {
+		t.Error("Expected 5th cheap request to be rejected")
+	}
+
+	if avail := mustAvailable(tb); !approxEqual(avail, 0, 0.01) {
+		t.Errorf("Expected ~0 tokens after four 0.25 deductions, got %.4f", avail)
+	}
+}
+
+func TestTokenBucket_AllowNMixedCosts(t *testing.T) {
+	tb := NewTokenBucket(2, 0.001)
+
+	tb.AllowN("", 0.5)
+	tb.AllowN("", 0.75)
+
+	if avail := mustAvailable(tb); !approxEqual(avail, 0.75, 0.01) {
+		t.Errorf("Expected ~0.75 tokens, got %.4f", avail)
+	}
+
+	// A full-cost request no longer fits, a cheaper one does
+	if allowed, _ := tb.Allow(""); allowed {
+		t.Error("Expected cost-1 request to be rejected with 0.75 tokens")
+	}
+	if allowed, _ := tb.AllowN("", 0.5); !allowed {
+		t.Error("Expected cost-0.5 request to be allowed with 0.75 tokens")
+	}
+}
+
+func TestTokenBucket_AllowNInvalidCost(t *testing.T) {
+	tb := NewTokenBucket(5, 1)
+
+	for _, n := range []float64{0, -1} {
+		if _, err := tb.AllowN("", n); err != ratelimit.ErrInvalidCost {
+			t.Errorf("AllowN(%v): expected ErrInvalidCost, got %v", n, err)
+		}
+	}
+}
+
+func TestTokenBucket_DebtMode(t *testing.T) {
+	tb := NewTokenBucketWithConfig(Config{
+		Capacity:   2,
+		RefillRate: 10, // 10 tokens/sec
+		MinTokens:  -2,
+	})
+
+	// A cost-3 request overdraws the 2-token bucket into debt
+	allowed, err := tb.AllowN("", 3)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !allowed {
+		t.Fatal("Expected overdraw into debt to be allowed")
+	}
+	if avail := mustAvailable(tb); !approxEqual(avail, -1, 0.05) {
+		t.Errorf("Expected ~-1 tokens in debt, got %.2f", avail)
+	}
+
+	// In debt: throttled, even for cheap requests
+	if allowed, _ := tb.Allow(""); allowed {
+		t.Error("Expected request to be throttled while in debt")
+	}
+	if allowed, _ := tb.AllowN("", 0.1); allowed {
+		t.Error("Expected cheap request to be throttled while in debt")
+	}
+
+	// ~150ms of refill brings the balance back above zero
+	time.Sleep(150 * time.Millisecond)
+	if allowed, _ := tb.Allow(""); !allowed {
+		t.Error("Expected request to be allowed once balance climbed above zero")
+	}
+}
+
+func TestTokenBucket_DebtFloor(t *testing.T) {
+	tb := NewTokenBucketWithConfig(Config{
+		Capacity:   2,
+		RefillRate: 0.001,
+		MinTokens:  -2,
+	})
+
+	// Overdrawing beyond MinTokens is rejected
+	if allowed, _ := tb.AllowN("", 5); allowed {
+		t.Error("Expected request that would exceed the debt floor to be rejected")
+	}
+	if avail := mustAvailable(tb); !approxEqual(avail, 2, 0.01) {
+		t.Errorf("Expected rejected request to leave 2 tokens, got %.2f", avail)
+	}
+}
+
+func TestTokenBucket_GraceOverage(t *testing.T) {
+	tb := NewTokenBucketWithConfig(Config{
+		Capacity:     2,
+		RefillRate:   1,
+		GraceOverage: 2,
+		Clock:        ratelimittest.NewFakeClock(),
+	})
+
+	// Two requests on tokens, two more on grace, even though in debt
+	for i := 0; i < 4; i++ {
+		if allowed, _ := tb.Allow(""); !allowed {
+			t.Fatalf("Expected request %d allowed", i+1)
+		}
+	}
+	if avail := mustAvailable(tb); !approxEqual(avail, -2, 0.01) {
+		t.Errorf("Expected grace to leave -2 tokens, got %.2f", avail)
+	}
+	if allowed, _ := tb.Allow(""); allowed {
+		t.Error("Expected a request past the grace to be denied")
+	}
+
+	// Natural refill repays the debt before grace is available again
+	ratelimittest.AdvanceTime(t, tb, time.Second)
+	if allowed, _ := tb.Allow(""); !allowed {
+		t.Error("Expected a request once refill repaid part of the debt")
+	}
+	if allowed, _ := tb.Allow(""); allowed {
+		t.Error("Expected the repaid grace to be spent")
+	}
+}
+
+func TestTokenBucket_BurstTTL(t *testing.T) {
+	tb := NewTokenBucketWithConfig(Config{
+		Capacity:   4,
+		RefillRate: 1,
+		BurstTTL:   time.Hour,
+		Clock:      ratelimittest.NewFakeClock(),
+	})
+
+	tb.Refill("", 6) // 10 tokens: 6 above capacity
+	ratelimittest.AdvanceTime(t, tb, 59*time.Minute)
+	if avail := mustAvailable(tb); !approxEqual(avail, 10, 0.01) {
+		t.Errorf("Expected paid overflow kept before the TTL, got %.2f", avail)
+	}
+
+	// A later purchase restarts the window
+	tb.Refill("", 1)
+	ratelimittest.AdvanceTime(t, tb, 30*time.Minute)
+	if avail := mustAvailable(tb); !approxEqual(avail, 11, 0.01) {
+		t.Errorf("Expected overflow kept after a new refill, got %.2f", avail)
+	}
+
+	// Unspent overflow decays back to capacity after the TTL
+	ratelimittest.AdvanceTime(t, tb, 30*time.Minute)
+	if avail := mustAvailable(tb); !approxEqual(avail, 4, 0.01) {
+		t.Errorf("Expected overflow to expire down to capacity, got %.2f", avail)
+	}
+	if allowed, _ := tb.AllowN("", 4); !allowed {
+		t.Error("Expected in-capacity tokens to be unaffected by the TTL")
+	}
+	if allowed, _ := tb.Allow(""); allowed {
+		t.Error("Expected the expired overflow to be gone")
+	}
+
+	// Tokens within capacity never expire
+	ratelimittest.AdvanceTime(t, tb, 2*time.Hour)
+	if avail := mustAvailable(tb); !approxEqual(avail, 4, 0.01) {
+		t.Errorf("Expected natural refill to capacity, got %.2f", avail)
+	}
+}
+
+func TestTokenBucket_NoDebtByDefault(t *testing.T) {
+	tb := NewTokenBucket(2, 0.001)
+
+	if allowed, _ := tb.AllowN("", 3); allowed {
+		t.Error("Expected overdraw to be rejected without MinTokens")
+	}
+}
+
+func TestTokenBucket_Conformance(t *testing.T) {
+	ratelimittest.RunConformance(t, func(capacity, refillRate float64, clock ratelimit.Clock) ratelimit.Limiter {
+		return NewTokenBucketWithConfig(Config{
+			Capacity:   capacity,
+			RefillRate: refillRate,
+			Clock:      clock,
+		})
+	})
+}
+
+func TestTokenBucket_AllowAt(t *testing.T) {
+	clock := ratelimittest.NewFakeClock()
+	tb := NewTokenBucketWithConfig(Config{
+		Capacity:   2,
+		RefillRate: 1, // 1 token/sec
+		Clock:      clock,
+	})
+	start := clock.Now()
+
+	// Drain the bucket at t=0
+	for i := 0; i < 2; i++ {
+		if allowed, _ := tb.AllowAt("", start); !allowed {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+	}
+	if allowed, _ := tb.AllowAt("", start.Add(500*time.Millisecond)); allowed {
+		t.Error("Expected rejection before a full token accrued")
+	}
+
+	// One token has accrued by t=1s, without sleeping
+	if allowed, _ := tb.AllowAt("", start.Add(time.Second)); !allowed {
+		t.Error("Expected request at t=1s to be allowed")
+	}
+
+	// An out-of-order timestamp accrues nothing
+	if allowed, _ := tb.AllowAt("", start); allowed {
+		t.Error("Expected replayed earlier timestamp to be rejected")
+	}
+	if allowed, _ := tb.AllowAt("", start.Add(2*time.Second)); !allowed {
+		t.Error("Expected request at t=2s to be allowed")
+	}
+}
+
+func TestTokenBucket_BurstCapacity(t *testing.T) {
+	clock := ratelimittest.NewFakeClock()
+	tb := NewTokenBucketWithConfig(Config{
+		Capacity:      3,
+		RefillRate:    1, // 1 token/sec
+		BurstCapacity: 6,
+		Clock:         clock,
+	})
+
+	// Natural refill never exceeds steady capacity
+	tb.AllowN("", 3)
+	clock.Advance(time.Hour)
+	if got, _ := tb.Available(""); got != 3 {
+		t.Errorf("Expected natural refill capped at capacity 3, got %.2f", got)
+	}
+
+	// Paid refill may go past capacity, but only up to the burst cap
+	tb.Refill("", 10)
+	if got, _ := tb.Available(""); got != 6 {
+		t.Errorf("Expected paid refill capped at burst 6, got %.2f", got)
+	}
+
+	// A spike may spend the whole burst before throttling
+	for i := 0; i < 6; i++ {
+		if allowed, _ := tb.Allow(""); !allowed {
+			t.Fatalf("Expected burst request %d to be allowed", i+1)
+		}
+	}
+	if allowed, _ := tb.Allow(""); allowed {
+		t.Error("Expected request beyond burst to be rejected")
+	}
+}
+
+func TestTokenBucket_BurstCapacityBelowCapacity(t *testing.T) {
+	tb := NewTokenBucketWithConfig(Config{
+		Capacity:      4,
+		RefillRate:    0.001,
+		BurstCapacity: 2,
+	})
+
+	// A burst cap below capacity is raised to capacity
+	tb.Refill("", 5)
+	if got, _ := tb.Available(""); got < 3.99 || got > 4.01 {
+		t.Errorf("Expected paid refill capped at capacity 4, got %.2f", got)
+	}
+}
+
+func TestTokenBucket_Drain(t *testing.T) {
+	clock := ratelimittest.NewFakeClock()
+	tb := NewTokenBucketWithConfig(Config{
+		Capacity:   4,
+		RefillRate: 2, // 2 tokens/sec
+		Clock:      clock,
+	})
+	tb.Refill("", 4) // Burst tokens are drained too
+
+	if err := tb.Drain(""); err != nil {
+		t.Fatalf("Drain error: %v", err)
+	}
+	if allowed, _ := tb.Allow(""); allowed {
+		t.Error("Expected drained bucket to be rate limited immediately")
+	}
+
+	// Natural refill resumes from the drain
+	clock.Advance(time.Second)
+	if got, _ := tb.Available(""); got != 2 {
+		t.Errorf("Expected 2 tokens one second after drain, got %.2f", got)
+	}
+}
+
+func TestTokenBucket_RefillSchedule(t *testing.T) {
+	// Start just before a 09:00-17:00 window that triples the rate
+	clock := ratelimittest.NewFakeClockAt(time.Date(2024, 1, 8, 8, 59, 0, 0, time.UTC))
+	tb := NewTokenBucketWithConfig(Config{
+		Capacity:   100,
+		RefillRate: 1, // 1 token/sec
+		RefillSchedule: ratelimit.RefillSchedule{
+			{Start: 9 * time.Hour, End: 17 * time.Hour, Multiplier: 3},
+		},
+		Clock: clock,
+	})
+
+	// Before the window the base rate applies
+	tb.Drain("")
+	clock.Advance(10 * time.Second) // 08:59:10
+	if got, _ := tb.Available(""); !approxEqual(got, 10, 1e-6) {
+		t.Errorf("Expected 10 tokens at the base rate, got %.2f", got)
+	}
+
+	// Once the window opens, refill runs three times faster
+	clock.Advance(time.Minute) // 09:00:10
+	tb.Drain("")
+	clock.Advance(10 * time.Second)
+	if got, _ := tb.Available(""); !approxEqual(got, 30, 1e-6) {
+		t.Errorf("Expected 30 tokens at 3x inside the window, got %.2f", got)
+	}
+
+	// After it closes the rate drops back
+	clock.Advance(8 * time.Hour) // 17:00:20
+	tb.Drain("")
+	clock.Advance(10 * time.Second)
+	if got, _ := tb.Available(""); !approxEqual(got, 10, 1e-6) {
+		t.Errorf("Expected 10 tokens after the window, got %.2f", got)
+	}
+}
+
+func TestRefillSchedule_WrapsMidnight(t *testing.T) {
+	schedule := ratelimit.RefillSchedule{
+		{Start: 22 * time.Hour, End: 6 * time.Hour, Multiplier: 0.5},
+	}
+	at := func(hour int) time.Time { return time.Date(2024, 1, 8, hour, 0, 0, 0, time.UTC) }
+
+	if got := schedule.Multiplier(at(23)); got != 0.5 {
+		t.Errorf("Expected 0.5 before midnight, got %g", got)
+	}
+	if got := schedule.Multiplier(at(3)); got != 0.5 {
+		t.Errorf("Expected 0.5 after midnight, got %g", got)
+	}
+	if got := schedule.Multiplier(at(12)); got != 1 {
+		t.Errorf("Expected 1 outside the window, got %g", got)
+	}
+	if got := schedule.Slowest(); got != 0.5 {
+		t.Errorf("Expected slowest multiplier 0.5, got %g", got)
+	}
+}
+
+func TestTokenBucket_Info(t *testing.T) {
+	clock := ratelimittest.NewFakeClock()
+	tb := NewTokenBucketWithConfig(Config{
+		Capacity:   2,
+		RefillRate: 1, // 1 token/sec
+		Clock:      clock,
+	})
+	created := clock.Now()
+
+	tb.Allow("")
+	tb.Allow("")
+	clock.Advance(500 * time.Millisecond)
+	tb.Allow("") // Denied: half a token has accrued
+
+	info, err := tb.Info("")
+	if err != nil {
+		t.Fatalf("Info failed: %v", err)
+	}
+	if info.Allowed != 2 || info.Denied != 1 {
+		t.Errorf("Expected 2 allowed and 1 denied, got %d and %d", info.Allowed, info.Denied)
+	}
+	if !approxEqual(info.Tokens, 0.5, 1e-6) {
+		t.Errorf("Expected 0.5 tokens, got %.4f", info.Tokens)
+	}
+	if !info.CreatedAt.Equal(created) || !info.LastRefill.Equal(clock.Now()) {
+		t.Errorf("Expected created %v and last refill %v, got %+v", created, clock.Now(), info)
+	}
+
+	// Reading doesn't count as activity
+	clock.Advance(time.Second)
+	if info, _ = tb.Info(""); !info.LastRefill.Equal(created.Add(500 * time.Millisecond)) {
+		t.Errorf("Expected Info not to move the last refill, got %v", info.LastRefill)
+	}
+
+	// Reset starts the bucket's history over
+	tb.Reset("")
+	info, _ = tb.Info("")
+	if info.Allowed != 0 || info.Denied != 0 || !info.CreatedAt.Equal(clock.Now()) {
+		t.Errorf("Expected a fresh bucket after reset, got %+v", info)
+	}
+}
+
+func TestTokenBucket_Snapshot(t *testing.T) {
+	clock := ratelimittest.NewFakeClock()
+	tb := NewTokenBucketWithConfig(Config{Capacity: 4, RefillRate: 1, Clock: clock})
+
+	tb.AllowN("a", 3)
+	clock.Advance(time.Second)
+	before, _ := tb.Info("")
+
+	page, next, err := tb.Snapshot("", 10)
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if len(page) != 1 || page[0].Key != "" || !approxEqual(page[0].Tokens, 2, 1e-6) || next != "" {
+		t.Errorf("Expected the one bucket at 2 tokens with refill projected, got %+v, next %q", page, next)
+	}
+	if after, _ := tb.Info(""); after != before {
+		t.Errorf("Expected Snapshot not to change the bucket: %+v became %+v", before, after)
+	}
+	if page, _, _ := tb.Snapshot("x", 10); len(page) != 0 {
+		t.Errorf("Expected nothing past the first page, got %+v", page)
+	}
+}
+
+func TestTokenBucket_ConcurrentFastAndLockedPaths(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// A frozen clock means no natural refill, so every token is accounted for
+	tb := NewTokenBucketWithConfig(Config{
+		Capacity:   100,
+		RefillRate: 1,
+		Clock:      ratelimittest.NewFakeClock(),
+	})
+
+	var wg sync.WaitGroup
+	var allowed atomic.Int64
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if ok, _ := tb.Allow(""); ok {
+					allowed.Add(1)
+				}
+				tb.Available("")
+			}
+		}()
+	}
+	// Refills overflow capacity, moving the bucket onto the mutex path
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				tb.Refill("", 5)
+			}
+		}()
+	}
+	wg.Wait()
+
+	remaining := mustAvailable(tb)
+	if got := float64(allowed.Load()) + remaining; !approxEqual(got, 200, 1e-6) {
+		t.Errorf("Expected allowed plus remaining to equal the 200 tokens granted, got %d + %.2f", allowed.Load(), remaining)
+	}
+	info, _ := tb.Info("")
+	if info.Allowed != allowed.Load() || info.Allowed+info.Denied != 800 {
+		t.Errorf("Expected counters to match %d allowed of 800, got %+v", allowed.Load(), info)
+	}
+}
+
+func BenchmarkTokenBucket_Allow(b *testing.B) {
+	for _, bench := range []struct {
+		name string
+		cfg  Config
+	}{
+		{"fast", Config{Capacity: 1e9, RefillRate: 1e9}},
+		// A tiny debt allowance keeps the bucket on the mutex path
+		{"locked", Config{Capacity: 1e9, RefillRate: 1e9, MinTokens: -1e-9}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			tb := NewTokenBucketWithConfig(bench.cfg)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				tb.Allow("")
+			}
+		})
+		b.Run(bench.name+"-parallel", func(b *testing.B) {
+			tb := NewTokenBucketWithConfig(bench.cfg)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					tb.Allow("")
+				}
+			})
+		})
+	}
+}
+
+func TestTokenBucket_AllowWithReset(t *testing.T) {
+	clock := ratelimittest.NewFakeClock()
+	tb := NewTokenBucketWithConfig(Config{Capacity: 2, RefillRate: 2, Clock: clock})
+
+	// One token left: reset is when the bucket is full again
+	allowed, resetAt, err := tb.AllowWithReset("")
+	if err != nil || !allowed {
+		t.Fatalf("Expected the first request allowed, got %v, %v", allowed, err)
+	}
+	if want := clock.Now().Add(500 * time.Millisecond); !approxTime(resetAt, want) {
+		t.Errorf("Expected reset at full capacity %v, got %v", want, resetAt)
+	}
+
+	// Just below one token: reset is when the next whole token accrues
+	tb.Allow("")
+	clock.Advance(400 * time.Millisecond) // 0.8 tokens
+	allowed, resetAt, _ = tb.AllowWithReset("")
+	if allowed {
+		t.Fatal("Expected a request on 0.8 tokens denied")
+	}
+	if want := clock.Now().Add(100 * time.Millisecond); !approxTime(resetAt, want) {
+		t.Errorf("Expected reset at now + (1-0.8)/2s = %v, got %v", want, resetAt)
+	}
+}
+
+// approxTime checks that two times are within a millisecond.
+func approxTime(a, b time.Time) bool {
+	d := a.Sub(b)
+	return d > -time.Millisecond && d < time.Millisecond
+}
+
+func TestNewTokenBucket_InvalidSettings(t *testing.T) {
+	for _, tc := range []struct {
+		capacity, refillRate float64
+		want                 error
+	}{
+		{0.5, 1, ratelimit.ErrInvalidCapacity},
+		{0, 1, ratelimit.ErrInvalidCapacity},
+		{-4, 1, ratelimit.ErrInvalidCapacity},
+		{math.NaN(), 1, ratelimit.ErrInvalidCapacity},
+		{4, 0, ratelimit.ErrInvalidRefillRate},
+		{4, -1, ratelimit.ErrInvalidRefillRate},
+		{4, math.Inf(1), ratelimit.ErrInvalidRefillRate},
+	} {
+		if err := ratelimit.ValidateBucket(tc.capacity, tc.refillRate); err != tc.want {
+			t.Errorf("ValidateBucket(%g, %g): expected %v, got %v", tc.capacity, tc.refillRate, tc.want, err)
+		}
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("NewTokenBucket(%g, %g): expected a panic", tc.capacity, tc.refillRate)
+				}
+			}()
+			NewTokenBucket(tc.capacity, tc.refillRate)
+		}()
+	}
+
+	if err := ratelimit.ValidateBucket(1, 0.001); err != nil {
+		t.Errorf("Expected a one-token bucket valid, got %v", err)
+	}
+}
+
+func TestTokenBucket_RefillModes(t *testing.T) {
+	tests := []struct {
+		mode ratelimit.RefillMode
+		want float64
+	}{
+		{ratelimit.RefillStack, 5},    // 2 settled + 3 paid
+		{ratelimit.RefillSetFloor, 4}, // Raised to capacity
+		{ratelimit.RefillExact, 3},    // Set to the amount paid
+		{ratelimit.RefillAtLeast, 3},  // Raised to the amount paid
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode.String(), func(t *testing.T) {
+			clock := ratelimittest.NewFakeClock()
+			tb := NewTokenBucketWithConfig(Config{Capacity: 4, RefillRate: 1, RefillMode: tt.mode, Clock: clock})
+
+			tb.AllowN("", 3)
+			clock.Advance(time.Second) // Accrues a token, settled before the refill
+			if err := tb.Refill("", 3); err != nil {
+				t.Fatalf("Refill error: %v", err)
+			}
+			if got := mustAvailable(tb); !approxEqual(got, tt.want, 0.01) {
+				t.Errorf("Expected %.2f tokens, got %.2f", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestTokenBucket_RefillTo(t *testing.T) {
+	clock := ratelimittest.NewFakeClock()
+	tb := NewTokenBucketWithConfig(Config{Capacity: 4, RefillRate: 0.001, BurstCapacity: 10, Clock: clock})
+
+	// Tops a low balance up to the target, past capacity if need be
+	tb.AllowN("", 3)
+	if err := tb.RefillTo("", 6); err != nil {
+		t.Fatalf("RefillTo error: %v", err)
+	}
+	if got := mustAvailable(tb); !approxEqual(got, 6, 0.01) {
+		t.Errorf("Expected 6 tokens, got %.2f", got)
+	}
+
+	// Repeating it credits nothing more
+	for i := 0; i < 3; i++ {
+		tb.RefillTo("", 6)
+	}
+	if got := mustAvailable(tb); !approxEqual(got, 6, 0.01) {
+		t.Errorf("Expected repeated RefillTo to leave 6 tokens, got %.2f", got)
+	}
+
+	// A lower target never reduces the balance
+	tb.RefillTo("", 2)
+	if got := mustAvailable(tb); !approxEqual(got, 6, 0.01) {
+		t.Errorf("Expected a lower target to keep 6 tokens, got %.2f", got)
+	}
+
+	// The burst cap still applies
+	tb.RefillTo("", 20)
+	if got := mustAvailable(tb); !approxEqual(got, 10, 0.01) {
+		t.Errorf("Expected the target to be capped at burst capacity 10, got %.2f", got)
+	}
+}
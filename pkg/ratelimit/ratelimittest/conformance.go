@@ -0,0 +1,290 @@
+// Package ratelimittest provides shared test helpers for ratelimit.Limiter
+// implementations: a fake clock and a conformance suite that every backend
+// runs, so their behavior can't silently drift apart.
+package ratelimittest
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+)
+
+// FakeClock is a ratelimit.Clock that only moves when advanced.
+type FakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewFakeClock returns a FakeClock starting at a fixed instant.
+func NewFakeClock() *FakeClock {
+	return &FakeClock{now: time.Unix(1700000000, 0)}
+}
+
+// NewFakeClockAt returns a FakeClock starting at t, for tests that depend on
+// the time of day.
+func NewFakeClockAt(t time.Time) *FakeClock {
+	return &FakeClock{now: t}
+}
+
+// Now returns the clock's current time.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// AdvanceTime moves l's clock forward by d, so natural refill catches up
+// without sleeping. l must implement ratelimit.Clocked and have been
+// constructed with a FakeClock; otherwise the test fails, since sleeping
+// in its place would make it slow and flaky again.
+func AdvanceTime(t testing.TB, l ratelimit.Limiter, d time.Duration) {
+	t.Helper()
+	clocked, ok := l.(ratelimit.Clocked)
+	if !ok {
+		t.Fatalf("AdvanceTime: %T doesn't report its clock", l)
+	}
+	clock, ok := clocked.Clock().(*FakeClock)
+	if !ok {
+		t.Fatalf("AdvanceTime: %T isn't using a FakeClock", l)
+	}
+	clock.Advance(d)
+}
+
+// Factory builds a fresh limiter with the given capacity and refill rate
+// (tokens per second), reading time from clock.
+type Factory func(capacity, refillRate float64, clock ratelimit.Clock) ratelimit.Limiter
+
+// tolerance absorbs float rounding in token counts.
+const tolerance = 1e-6
+
+// key is the bucket exercised by the suite. Single-bucket limiters ignore it.
+const key = "conformance"
+
+// RunConformance runs the shared limiter behavior suite against factory.
+func RunConformance(t *testing.T, factory Factory) {
+	t.Helper()
+
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, factory Factory)
+	}{
+		{"AllowExhaust", testAllowExhaust},
+		{"NaturalRefill", testNaturalRefill},
+		{"NaturalRefillCappedAtCapacity", testNaturalRefillCapped},
+		{"PaidRefillOverflow", testPaidRefillOverflow},
+		{"BurstPreservedAboveCapacity", testBurstPreserved},
+		{"NaturalRefillResumesAfterBurst", testRefillResumesAfterBurst},
+		{"RefillSettlesAccrualFirst", testRefillSettlesAccrual},
+		{"AllowNFractional", testAllowNFractional},
+		{"AvailableDoesNotConsume", testAvailableDoesNotConsume},
+		{"RemainingRequests", testRemainingRequests},
+		{"Reset", testReset},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, factory)
+		})
+	}
+}
+
+func mustAllow(t *testing.T, l ratelimit.Limiter, n float64) bool {
+	t.Helper()
+	allowed, err := l.AllowN(key, n)
+	if err != nil {
+		t.Fatalf("AllowN(%v) error: %v", n, err)
+	}
+	return allowed
+}
+
+func expectAvailable(t *testing.T, l ratelimit.Limiter, want float64, msg string) {
+	t.Helper()
+	got, err := l.Available(key)
+	if err != nil {
+		t.Fatalf("Available error: %v", err)
+	}
+	if math.Abs(got-want) > tolerance {
+		t.Errorf("%s: expected %.4f tokens, got %.4f", msg, want, got)
+	}
+}
+
+func exhaust(t *testing.T, l ratelimit.Limiter, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if !mustAllow(t, l, 1) {
+			t.Fatalf("Request %d should be allowed while exhausting", i+1)
+		}
+	}
+}
+
+func testAllowExhaust(t *testing.T, factory Factory) {
+	l := factory(3, 1, NewFakeClock())
+
+	expectAvailable(t, l, 3, "new bucket")
+	exhaust(t, l, 3)
+	if mustAllow(t, l, 1) {
+		t.Error("Expected request beyond capacity to be rejected")
+	}
+	expectAvailable(t, l, 0, "exhausted bucket")
+}
+
+func testNaturalRefill(t *testing.T, factory Factory) {
+	clock := NewFakeClock()
+	l := factory(3, 2, clock) // 2 tokens/sec
+
+	exhaust(t, l, 3)
+	clock.Advance(500 * time.Millisecond)
+	expectAvailable(t, l, 1, "after 500ms at 2/sec")
+
+	if !mustAllow(t, l, 1) {
+		t.Error("Expected refilled token to be allowed")
+	}
+	if mustAllow(t, l, 1) {
+		t.Error("Expected only one token to have refilled")
+	}
+}
+
+func testNaturalRefillCapped(t *testing.T, factory Factory) {
+	clock := NewFakeClock()
+	l := factory(3, 2, clock)
+
+	exhaust(t, l, 2)
+	clock.Advance(time.Hour)
+	expectAvailable(t, l, 3, "natural refill after an hour")
+}
+
+func testPaidRefillOverflow(t *testing.T, factory Factory) {
+	l := factory(3, 1, NewFakeClock())
+
+	if err := l.Refill(key, 3); err != nil {
+		t.Fatalf("Refill error: %v", err)
+	}
+	expectAvailable(t, l, 6, "full bucket plus paid refill")
+
+	exhaust(t, l, 6)
+	if mustAllow(t, l, 1) {
+		t.Error("Expected request beyond burst to be rejected")
+	}
+}
+
+func testBurstPreserved(t *testing.T, factory Factory) {
+	clock := NewFakeClock()
+	l := factory(3, 1, clock)
+
+	l.Refill(key, 3)
+	exhaust(t, l, 1)
+	clock.Advance(time.Minute)
+	expectAvailable(t, l, 5, "burst above capacity after waiting")
+}
+
+func testRefillResumesAfterBurst(t *testing.T, factory Factory) {
+	clock := NewFakeClock()
+	l := factory(3, 2, clock)
+
+	l.Refill(key, 3) // 6 tokens
+	exhaust(t, l, 5) // 1 token, below capacity
+	clock.Advance(time.Second)
+	expectAvailable(t, l, 3, "natural refill resumed below capacity")
+}
+
+func testRefillSettlesAccrual(t *testing.T, factory Factory) {
+	clock := NewFakeClock()
+	l := factory(4, 1, clock)
+
+	exhaust(t, l, 4)
+	clock.Advance(2 * time.Second) // 2 tokens accrue
+	if err := l.Refill(key, 4); err != nil {
+		t.Fatalf("Refill error: %v", err)
+	}
+	expectAvailable(t, l, 6, "accrued plus paid tokens")
+
+	clock.Advance(2 * time.Second)
+	expectAvailable(t, l, 6, "accrual not double counted after refill")
+}
+
+func testAllowNFractional(t *testing.T, factory Factory) {
+	l := factory(1, 1, NewFakeClock())
+
+	for i := 0; i < 4; i++ {
+		if !mustAllow(t, l, 0.25) {
+			t.Errorf("Expected cheap request %d to be allowed", i+1)
+		}
+	}
+	if mustAllow(t, l, 0.25) {
+		t.Error("Expected 5th cheap request to be rejected")
+	}
+	if _, err := l.AllowN(key, 0); err != ratelimit.ErrInvalidCost {
+		t.Errorf("Expected ErrInvalidCost for zero cost, got %v", err)
+	}
+}
+
+func testAvailableDoesNotConsume(t *testing.T, factory Factory) {
+	l := factory(2, 1, NewFakeClock())
+
+	for i := 0; i < 5; i++ {
+		expectAvailable(t, l, 2, "repeated Available")
+	}
+	exhaust(t, l, 2)
+}
+
+func testRemainingRequests(t *testing.T, factory Factory) {
+	clock := NewFakeClock()
+	l := factory(3, 1, clock)
+
+	exhaust(t, l, 3)
+	clock.Advance(2500 * time.Millisecond) // 2.5 tokens
+
+	for _, tt := range []struct {
+		cost float64
+		want int
+	}{
+		{1, 2},
+		{0.5, 5},
+		{0.3, 8},
+		{2.5, 1},
+		{3, 0}, // Costs more than is available
+	} {
+		got, err := ratelimit.RemainingRequests(l, key, tt.cost)
+		if err != nil {
+			t.Fatalf("RemainingRequests(%v) error: %v", tt.cost, err)
+		}
+		if got != tt.want {
+			t.Errorf("RemainingRequests(%v): expected %d, got %d", tt.cost, tt.want, got)
+		}
+	}
+	expectAvailable(t, l, 2.5, "after RemainingRequests")
+
+	if _, err := ratelimit.RemainingRequests(l, key, 0); err != ratelimit.ErrInvalidCost {
+		t.Errorf("Expected ErrInvalidCost for zero cost, got %v", err)
+	}
+}
+
+func testReset(t *testing.T, factory Factory) {
+	clock := NewFakeClock()
+	l := factory(3, 1, clock)
+
+	resetter, ok := l.(ratelimit.Resetter)
+	if !ok {
+		t.Skip("limiter does not implement ratelimit.Resetter")
+	}
+
+	exhaust(t, l, 3)
+	if err := resetter.Reset(key); err != nil {
+		t.Fatalf("Reset error: %v", err)
+	}
+	expectAvailable(t, l, 3, "after reset")
+
+	// Reset also drops paid overflow
+	l.Refill(key, 5)
+	resetter.Reset(key)
+	expectAvailable(t, l, 3, "reset after paid refill")
+}
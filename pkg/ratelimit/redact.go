@@ -0,0 +1,47 @@
+package ratelimit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// Redactor masks a client identifier, such as a limiter key, an IP address
+// or a wallet, before it's written to a log. A nil Redactor logs identifiers
+// unchanged.
+type Redactor func(id string) string
+
+// Redact returns id as it should be logged.
+func (r Redactor) Redact(id string) string {
+	if r == nil {
+		return id
+	}
+	return r(id)
+}
+
+// HashRedactor logs identifiers as a short salted SHA-256 digest, so log
+// lines about one client can still be correlated without revealing it.
+// Use a secret salt: unsalted digests of IP addresses are easy to reverse.
+func HashRedactor(salt string) Redactor {
+	return func(id string) string {
+		if id == "" {
+			return id
+		}
+		sum := sha256.Sum256([]byte(salt + id))
+		return "h:" + hex.EncodeToString(sum[:6])
+	}
+}
+
+// MaskRedactor logs only the start of an identifier: an IPv4 address keeps
+// its first octet, anything else its first four characters.
+func MaskRedactor() Redactor {
+	return func(id string) string {
+		if i := strings.IndexByte(id, '.'); i > 0 && strings.Count(id, ".") == 3 {
+			return id[:i] + ".x.x.x"
+		}
+		if len(id) <= 4 {
+			return strings.Repeat("*", len(id))
+		}
+		return id[:4] + "***"
+	}
+}
@@ -0,0 +1,52 @@
+package ratelimit_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+)
+
+func TestRedactor_Nil(t *testing.T) {
+	var r ratelimit.Redactor
+	if got := r.Redact("192.0.2.1"); got != "192.0.2.1" {
+		t.Errorf("Expected a nil Redactor to log as is, got %q", got)
+	}
+}
+
+func TestHashRedactor(t *testing.T) {
+	r := ratelimit.HashRedactor("salt")
+
+	got := r.Redact("192.0.2.1")
+	if !strings.HasPrefix(got, "h:") || len(got) != 14 || strings.Contains(got, "192.0.2.1") {
+		t.Errorf("Expected a short digest, got %q", got)
+	}
+	if again := r.Redact("192.0.2.1"); again != got {
+		t.Errorf("Expected the same digest for one identifier, got %q and %q", got, again)
+	}
+	if other := r.Redact("192.0.2.2"); other == got {
+		t.Errorf("Expected different identifiers to get different digests, both got %q", got)
+	}
+	if salted := ratelimit.HashRedactor("pepper").Redact("192.0.2.1"); salted == got {
+		t.Errorf("Expected the salt to change the digest, both got %q", got)
+	}
+	if empty := r.Redact(""); empty != "" {
+		t.Errorf("Expected an empty identifier to stay empty, got %q", empty)
+	}
+}
+
+func TestMaskRedactor(t *testing.T) {
+	r := ratelimit.MaskRedactor()
+	tests := map[string]string{
+		"192.0.2.1":   "192.x.x.x",
+		"2001:db8::1": "2001***",
+		"0x1111111111111111111111111111111111111111": "0x11***",
+		"abcd": "****",
+		"":     "",
+	}
+	for id, want := range tests {
+		if got := r.Redact(id); got != want {
+			t.Errorf("MaskRedactor(%q) = %q, want %q", id, got, want)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// slotProxy stands in for one Redis Cluster node: it forwards commands to a
+// miniredis, or, while redirect is set, answers commands on keys with the
+// MOVED or ASK error a cluster sends while resharding. miniredis has no
+// cluster mode of its own. Replies are read as RESP2.
+type slotProxy struct {
+	ln      net.Listener
+	backend string
+
+	mu       sync.Mutex
+	redirect string // e.g. "MOVED 0 127.0.0.1:1234"; "" forwards everything
+}
+
+func newSlotProxy(t *testing.T, backend string) *slotProxy {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	p := &slotProxy{ln: ln, backend: backend}
+	t.Cleanup(func() { ln.Close() })
+	go p.serve()
+	return p
+}
+
+func (p *slotProxy) Addr() string {
+	return p.ln.Addr().String()
+}
+
+func (p *slotProxy) setRedirect(redirect string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.redirect = redirect
+}
+
+func (p *slotProxy) serve() {
+	for {
+		conn, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+		go p.handle(conn)
+	}
+}
+
+// connectionCommands never carry a key, so they're forwarded even while
+// redirecting.
+var connectionCommands = map[string]bool{
+	"HELLO": true, "PING": true, "CLIENT": true, "SELECT": true, "AUTH": true, "READONLY": true,
+}
+
+func (p *slotProxy) handle(conn net.Conn) {
+	defer conn.Close()
+	backend, err := net.Dial("tcp", p.backend)
+	if err != nil {
+		return
+	}
+	defer backend.Close()
+
+	clientR, backendR := bufio.NewReader(conn), bufio.NewReader(backend)
+	for {
+		raw, name, err := readCommand(clientR)
+		if err != nil {
+			return
+		}
+
+		p.mu.Lock()
+		redirect := p.redirect
+		p.mu.Unlock()
+
+		switch {
+		case name == "ASKING":
+			_, err = io.WriteString(conn, "+OK\r\n")
+		case redirect != "" && !connectionCommands[name]:
+			_, err = io.WriteString(conn, "-"+redirect+"\r\n")
+		default:
+			if _, err = backend.Write(raw); err == nil {
+				var reply []byte
+				if reply, err = readReply(backendR); err == nil {
+					_, err = conn.Write(reply)
+				}
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readCommand reads one command, an array of bulk strings, returning its
+// bytes and upper-cased name.
+func readCommand(r *bufio.Reader) (raw []byte, name string, err error) {
+	header, err := r.ReadString('\n')
+	if err != nil {
+		return nil, "", err
+	}
+	if !strings.HasPrefix(header, "*") {
+		return nil, "", fmt.Errorf("unexpected command %q", header)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(header[1:]))
+	if err != nil {
+		return nil, "", err
+	}
+	raw = []byte(header)
+	for i := 0; i < n; i++ {
+		arg, err := readReply(r)
+		if err != nil {
+			return nil, "", err
+		}
+		if i == 0 {
+			fields := strings.SplitN(string(arg), "\r\n", 3)
+			name = strings.ToUpper(fields[1])
+		}
+		raw = append(raw, arg...)
+	}
+	return raw, name, nil
+}
+
+// readReply reads one RESP2 value and returns its bytes.
+func readReply(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	raw := []byte(line)
+	switch line[0] {
+	case '+', '-', ':':
+		return raw, nil
+	case '$':
+		n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil || n < 0 {
+			return raw, err
+		}
+		body := make([]byte, n+2)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, err
+		}
+		return append(raw, body...), nil
+	case '*':
+		n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < n; i++ {
+			elem, err := readReply(r)
+			if err != nil {
+				return nil, err
+			}
+			raw = append(raw, elem...)
+		}
+		return raw, nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
+
+// migrateKey copies a bucket's hash from one miniredis to another and
+// deletes the original, as MIGRATE does while a slot moves.
+func migrateKey(t *testing.T, from, to *miniredis.Miniredis, key string) {
+	t.Helper()
+	fields, err := from.HKeys(key)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", key, err)
+	}
+	for _, field := range fields {
+		to.HSet(key, field, from.HGet(key, field))
+	}
+	from.Del(key)
+}
+
+func TestTokenBucket_FollowsClusterRedirects(t *testing.T) {
+	nodeA, nodeB := miniredis.RunT(t), miniredis.RunT(t)
+	proxyA, proxyB := newSlotProxy(t, nodeA.Addr()), newSlotProxy(t, nodeB.Addr())
+
+	// Every slot starts on node A
+	var mu sync.Mutex
+	owner := proxyA.Addr()
+	client := goredis.NewClusterClient(&goredis.ClusterOptions{
+		ClusterSlots: func(ctx context.Context) ([]goredis.ClusterSlot, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return []goredis.ClusterSlot{{Start: 0, End: 16383, Nodes: []goredis.ClusterNode{{Addr: owner}}}}, nil
+		},
+		Protocol: 2,
+	})
+	defer client.Close()
+
+	rtb := NewTokenBucket(Config{Client: client, Capacity: 5, RefillRate: 0.001})
+	for i := 0; i < 2; i++ {
+		if allowed, err := rtb.Allow("wallet"); err != nil || !allowed {
+			t.Fatalf("Expected request %d allowed on node A, got %v, %v", i+1, allowed, err)
+		}
+	}
+
+	// Mid-migration: the key is already on B, A still owns the slot
+	migrateKey(t, nodeA, nodeB, "ratelimit:wallet")
+	proxyA.setRedirect("ASK 0 " + proxyB.Addr())
+	if allowed, err := rtb.Allow("wallet"); err != nil || !allowed {
+		t.Fatalf("Expected the request to follow ASK to node B, got %v, %v", allowed, err)
+	}
+	if nodeA.Exists("ratelimit:wallet") {
+		t.Error("Expected no bucket recreated on node A")
+	}
+
+	// Migration done: B owns the slot
+	mu.Lock()
+	owner = proxyB.Addr()
+	mu.Unlock()
+	proxyA.setRedirect("MOVED 0 " + proxyB.Addr())
+	for i := 0; i < 2; i++ {
+		if allowed, err := rtb.Allow("wallet"); err != nil || !allowed {
+			t.Fatalf("Expected request %d to follow MOVED to node B, got %v, %v", i+1, allowed, err)
+		}
+	}
+
+	// The bucket carried its balance across both moves
+	if allowed, err := rtb.Allow("wallet"); err != nil || allowed {
+		t.Errorf("Expected the sixth request denied by the migrated bucket, got %v, %v", allowed, err)
+	}
+	if avail, err := rtb.Available("wallet"); err != nil || avail > 0.1 {
+		t.Errorf("Expected an empty bucket on node B, got %.2f, %v", avail, err)
+	}
+}
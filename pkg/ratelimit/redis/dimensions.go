@@ -0,0 +1,139 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+)
+
+// dimensionsScript checks every bucket in KEYS and charges them all only if
+// all allow. ARGV[1..3] are now, the schedule multiplier and the slowest
+// scale; then each key has its capacity, refill rate and cost. Returns 1 or
+// 0, then each key's balance and whether it denied (1) or not (0).
+var dimensionsScript = redis.NewScript(`
+	local now = tonumber(ARGV[1])
+	local multiplier = tonumber(ARGV[2])
+	local slowest = tonumber(ARGV[3])
+	local capacity = 0 -- Set per key: rebase and expire_burst read it
+` + serverNow + rebaseCapacity + expireBurst + `
+	local function settings(i)
+		local base = 3 + (i - 1) * 3
+		return tonumber(ARGV[base + 1]), tonumber(ARGV[base + 2]), tonumber(ARGV[base + 3])
+	end
+
+	-- Settle natural refill on every bucket before deciding
+	local balances = {}
+	local denied = {}
+	local allowed = true
+	for i, key in ipairs(KEYS) do
+		local refill_rate, cost
+		capacity, refill_rate, cost = settings(i)
+		local data = redis.call("HMGET", key, "tokens", "last_refill", "capacity", "burst_expires")
+		local tokens = rebase(tonumber(data[1]) or capacity, data[3])
+		local last_refill = tonumber(data[2]) or now
+		tokens = expire_burst(tokens, data[4])
+		if tokens < capacity and now > last_refill then
+			tokens = math.min(tokens + (now - last_refill) * refill_rate * multiplier, capacity)
+		end
+		balances[i] = tokens
+		denied[i] = tokens - cost < 0
+		if denied[i] then
+			allowed = false
+		end
+	end
+
+	local result = {allowed and 1 or 0}
+	for i, key in ipairs(KEYS) do
+		local refill_rate, cost
+		capacity, refill_rate, cost = settings(i)
+		if allowed then
+			balances[i] = balances[i] - cost
+			redis.call("HSET", key, "tokens", balances[i], "last_refill", now, "capacity", capacity)
+			redis.call("HSETNX", key, "created", now)
+			redis.call("HINCRBY", key, "allowed", 1)
+			redis.call("EXPIRE", key, math.ceil(capacity / (refill_rate * slowest)) + 1)
+		end
+		-- Return as strings: Lua numbers are truncated to integers in replies
+		table.insert(result, tostring(balances[i]))
+		table.insert(result, denied[i] and 1 or 0)
+	end
+	return result
+`)
+
+// AllowDimensions checks a request against several buckets in one script,
+// which Redis runs atomically: the request is allowed only if every
+// dimension allows it, and otherwise no bucket is charged. See
+// ratelimit.DimensionChecker. Dimensions don't use MinTokens or
+// GraceOverage, and denials aren't counted in Info. In Redis Cluster the
+// dimensions' keys must share a hash slot.
+func (r *TokenBucket) AllowDimensions(dims map[string]ratelimit.DimensionConfig) (ratelimit.Decision, error) {
+	names := make([]string, 0, len(dims))
+	for name := range dims {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	keys := make([]string, len(names))
+	seen := make(map[string]string, len(names))
+	args := []interface{}{r.now(), r.multiplier(), r.schedule.Slowest()}
+	for i, name := range names {
+		dim := dims[name]
+		if err := checkKey(dim.Key); err != nil {
+			return ratelimit.Decision{}, err
+		}
+		if other, ok := seen[dim.Key]; ok {
+			return ratelimit.Decision{}, fmt.Errorf("redis: dimensions %s and %s share key %q", other, name, dim.Key)
+		}
+		seen[dim.Key] = name
+		capacity, refillRate, cost := dim.Capacity, dim.RefillRate, dim.Cost
+		if capacity == 0 {
+			capacity = r.capacity
+		}
+		if refillRate == 0 {
+			refillRate = r.refillRate
+		}
+		if cost == 0 {
+			cost = 1
+		}
+		if !(cost > 0) {
+			return ratelimit.Decision{}, ratelimit.ErrInvalidCost
+		}
+		if err := ratelimit.ValidateBucket(capacity, refillRate); err != nil {
+			return ratelimit.Decision{}, fmt.Errorf("redis: dimension %s: %w", name, err)
+		}
+		keys[i] = r.fullKey(dim.Key)
+		args = append(args, capacity, refillRate, cost)
+	}
+
+	decision := ratelimit.Decision{Allowed: true, Remaining: make(map[string]float64, len(names))}
+	if len(names) == 0 {
+		return decision, nil
+	}
+
+	result, err := dimensionsScript.Run(context.Background(), r.client, keys, args...).Slice()
+	if err != nil {
+		return ratelimit.Decision{}, wrapErr(err)
+	}
+	if len(result) != 1+2*len(names) {
+		return ratelimit.Decision{}, fmt.Errorf("redis: unexpected dimensions reply %v", result)
+	}
+	decision.Allowed = result[0] == int64(1)
+	for i, name := range names {
+		tokens, err := strconv.ParseFloat(fmt.Sprint(result[1+2*i]), 64)
+		if err != nil {
+			return ratelimit.Decision{}, fmt.Errorf("redis: unexpected dimensions reply %v", result)
+		}
+		decision.Remaining[name] = tokens
+		if result[2+2*i] == int64(1) {
+			decision.Denied = append(decision.Denied, name)
+		}
+	}
+	return decision, nil
+}
+
+var _ ratelimit.DimensionChecker = (*TokenBucket)(nil)
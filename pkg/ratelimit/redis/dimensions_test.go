@@ -0,0 +1,84 @@
+package redis
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/ratelimittest"
+)
+
+func TestTokenBucket_AllowDimensions(t *testing.T) {
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+
+	tb := NewTokenBucket(Config{Client: client, Capacity: 10, RefillRate: 1, Clock: ratelimittest.NewFakeClock()})
+	dims := map[string]ratelimit.DimensionConfig{
+		"ip":     {Key: "ip:192.0.2.1", Capacity: 2},
+		"user":   {Key: "user:alice", Capacity: 5},
+		"global": {Key: "global"}, // The limiter's capacity
+	}
+
+	for i := 0; i < 2; i++ {
+		d, err := tb.AllowDimensions(dims)
+		if err != nil {
+			t.Fatalf("AllowDimensions error: %v", err)
+		}
+		if !d.Allowed || len(d.Denied) != 0 {
+			t.Fatalf("Expected request %d allowed, got %+v", i+1, d)
+		}
+	}
+
+	// The per-IP bucket is empty: it alone is reported
+	d, err := tb.AllowDimensions(dims)
+	if err != nil {
+		t.Fatalf("AllowDimensions error: %v", err)
+	}
+	if d.Allowed || !reflect.DeepEqual(d.Denied, []string{"ip"}) {
+		t.Fatalf("Expected denial by ip only, got %+v", d)
+	}
+	want := map[string]float64{"ip": 0, "user": 3, "global": 8}
+	if !reflect.DeepEqual(d.Remaining, want) {
+		t.Errorf("Expected remaining %v, got %v", want, d.Remaining)
+	}
+
+	// Nothing was taken from the dimensions that allowed
+	for key, tokens := range map[string]float64{"user:alice": 3, "global": 8} {
+		if avail, _ := tb.Available(key); avail != tokens {
+			t.Errorf("Expected %s untouched at %.0f tokens, got %.2f", key, tokens, avail)
+		}
+	}
+
+	// A costlier request hits the user limit too
+	dims["user"] = ratelimit.DimensionConfig{Key: "user:alice", Capacity: 5, Cost: 4}
+	d, _ = tb.AllowDimensions(dims)
+	if d.Allowed || !reflect.DeepEqual(d.Denied, []string{"ip", "user"}) {
+		t.Errorf("Expected denial by ip and user, got %+v", d)
+	}
+}
+
+func TestTokenBucket_AllowDimensionsInvalid(t *testing.T) {
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+
+	tb := NewTokenBucket(Config{Client: client, Capacity: 10, RefillRate: 1})
+	tests := map[string]struct {
+		dims map[string]ratelimit.DimensionConfig
+		want error
+	}{
+		"missing key":   {map[string]ratelimit.DimensionConfig{"ip": {}}, ratelimit.ErrInvalidKey},
+		"negative cost": {map[string]ratelimit.DimensionConfig{"ip": {Key: "a", Cost: -1}}, ratelimit.ErrInvalidCost},
+		"bad capacity":  {map[string]ratelimit.DimensionConfig{"ip": {Key: "a", Capacity: 0.5}}, ratelimit.ErrInvalidCapacity},
+	}
+	for name, tt := range tests {
+		if _, err := tb.AllowDimensions(tt.dims); !errors.Is(err, tt.want) {
+			t.Errorf("%s: expected %v, got %v", name, tt.want, err)
+		}
+	}
+
+	shared := map[string]ratelimit.DimensionConfig{"ip": {Key: "a"}, "user": {Key: "a"}}
+	if _, err := tb.AllowDimensions(shared); err == nil {
+		t.Error("Expected an error for dimensions sharing a key")
+	}
+}
@@ -0,0 +1,46 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+	"github.com/redis/go-redis/v9"
+)
+
+// wrapErr classifies a Redis error. Connection failures are wrapped with
+// ratelimit.ErrBackendUnavailable; anything else (script or reply errors) is
+// returned unchanged. The original error stays reachable via errors.Is/As.
+func wrapErr(err error) error {
+	if err == nil || !isUnavailable(err) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ratelimit.ErrBackendUnavailable, err)
+}
+
+// isUnavailable reports whether err means Redis couldn't be reached.
+func isUnavailable(err error) bool {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr):
+		return true
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	case errors.Is(err, redis.ErrClosed), errors.Is(err, redis.ErrPoolTimeout), errors.Is(err, redis.ErrPoolExhausted):
+		return true
+	case errors.Is(err, context.DeadlineExceeded):
+		return true
+	}
+	return redis.IsLoadingError(err) || redis.IsMaxClientsError(err)
+}
+
+// checkKey rejects keys that can't identify a bucket.
+func checkKey(key string) error {
+	if key == "" {
+		return ratelimit.ErrInvalidKey
+	}
+	return nil
+}
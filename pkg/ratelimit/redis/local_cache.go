@@ -0,0 +1,397 @@
+package redis
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+)
+
+// syncScript charges KEYS[1] the tokens a LocalCache spent locally, then
+// tries to take a request's cost. ARGV[1..7] are capacity, refill rate, now,
+// the schedule multiplier, the slowest scale, the tokens to charge and the
+// cost (0 to only charge). Charges can't push the balance below zero.
+// Returns 1 or 0, and the balance left as a string.
+var syncScript = redis.NewScript(`
+	local key = KEYS[1]
+	local capacity = tonumber(ARGV[1])
+	local refill_rate = tonumber(ARGV[2])
+	local now = tonumber(ARGV[3])
+	local multiplier = tonumber(ARGV[4])
+	local slowest = tonumber(ARGV[5])
+	local charge = tonumber(ARGV[6])
+	local cost = tonumber(ARGV[7])
+` + serverNow + rebaseCapacity + expireBurst + `
+	local data = redis.call("HMGET", key, "tokens", "last_refill", "capacity", "burst_expires")
+	local tokens = expire_burst(rebase(tonumber(data[1]) or capacity, data[3]), data[4])
+	local last_refill = tonumber(data[2]) or now
+	if tokens < capacity and now > last_refill then
+		tokens = math.min(tokens + (now - last_refill) * refill_rate * multiplier, capacity)
+	end
+
+	tokens = math.max(tokens - charge, 0)
+	local allowed = 0
+	if cost > 0 and tokens - cost >= 0 then
+		tokens = tokens - cost
+		allowed = 1
+		redis.call("HINCRBY", key, "allowed", 1)
+	end
+	redis.call("HSET", key, "tokens", tokens, "last_refill", now, "capacity", capacity)
+	redis.call("HSETNX", key, "created", now)
+	redis.call("EXPIRE", key, math.ceil(capacity / (refill_rate * slowest)) + 1)
+	-- Return as a string: Lua numbers are truncated to integers in replies
+	return {allowed, tostring(tokens)}
+`)
+
+// LocalCacheConfig configures a LocalCache.
+type LocalCacheConfig struct {
+	// Size is the most keys cached at once. Past it, the least recently
+	// used key is synced and dropped. Default 1024.
+	Size int
+
+	// Tolerance is the most tokens a key may spend locally before they're
+	// charged to Redis, and so bounds how far Redis lags behind this
+	// instance. Default 1, which charges every request (no batching).
+	Tolerance float64
+
+	// SyncInterval is how often the background sync charges pending tokens
+	// and refreshes cached balances, and how long a local denial stands
+	// before Redis is asked again. 0 disables the background sync: call
+	// Sync, and every denial is confirmed with Redis.
+	SyncInterval time.Duration
+}
+
+// LocalCache answers hot keys' requests from an in-memory copy of their
+// balance, batching the tokens spent and charging them to the Redis bucket
+// in one call once Tolerance is reached, and at least every SyncInterval.
+// It trades accuracy for fewer Redis round trips:
+//
+//   - Redis lags this instance by up to Tolerance tokens per key, so
+//     instances sharing a bucket may together admit up to Tolerance tokens
+//     per instance beyond its balance. Such overspend isn't carried as
+//     debt: charges stop at zero.
+//   - Tokens refilled naturally, or by other instances, are seen only at
+//     the next sync, and a denial stands until then.
+//   - MinTokens and GraceOverage don't apply to requests the cache admits,
+//     and Info counts only the requests that reached Redis.
+//
+// Refill through the cache takes effect at once. Call Close to stop the
+// background sync and charge what's pending.
+type LocalCache struct {
+	limiter   *TokenBucket
+	size      int
+	tolerance float64
+	interval  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // key → *cacheEntry in lru
+	lru     *list.List               // Most recently used at the front
+
+	stop      chan struct{} // Closed by Close to end the sync loop
+	done      chan struct{} // Closed when the sync loop has returned
+	closeOnce sync.Once
+}
+
+// cacheEntry is a key's balance as this instance sees it.
+type cacheEntry struct {
+	key     string
+	balance float64   // Redis balance at the last sync, less local spending
+	pending float64   // Tokens spent locally but not yet charged to Redis
+	synced  time.Time // When balance was last read from Redis
+}
+
+// NewLocalCache returns a cache in front of limiter, starting the
+// background sync if SyncInterval is set.
+func NewLocalCache(limiter *TokenBucket, cfg LocalCacheConfig) *LocalCache {
+	if cfg.Size <= 0 {
+		cfg.Size = 1024
+	}
+	if !(cfg.Tolerance >= 1) {
+		cfg.Tolerance = 1
+	}
+	c := &LocalCache{
+		limiter:   limiter,
+		size:      cfg.Size,
+		tolerance: cfg.Tolerance,
+		interval:  max(cfg.SyncInterval, 0),
+		entries:   make(map[string]*list.Element),
+		lru:       list.New(),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if c.interval > 0 {
+		go c.syncLoop()
+	} else {
+		close(c.done)
+	}
+	return c
+}
+
+// Close stops the background sync and charges every key's pending tokens
+// to Redis.
+func (c *LocalCache) Close() error {
+	c.closeOnce.Do(func() { close(c.stop) })
+	<-c.done
+	return c.Sync()
+}
+
+func (c *LocalCache) syncLoop() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			if err := c.Sync(); err != nil {
+				c.limiter.logf("[CACHE] Sync failed: %v", err)
+			}
+		}
+	}
+}
+
+// Allow checks if a request for the given key should be allowed.
+func (c *LocalCache) Allow(key string) (bool, error) {
+	return c.AllowN(key, 1)
+}
+
+// AllowN checks if a request costing n tokens should be allowed, locally
+// when key's cached balance covers it or a local denial still stands, and
+// otherwise in Redis, charging whatever was pending in the same call.
+func (c *LocalCache) AllowN(key string, n float64) (bool, error) {
+	if n <= 0 {
+		return false, ratelimit.ErrInvalidCost
+	}
+	if err := checkKey(key); err != nil {
+		return false, err
+	}
+
+	c.mu.Lock()
+	e := c.lookup(key)
+	if e != nil && e.balance-n >= 0 {
+		e.balance -= n
+		e.pending += n
+		if e.pending < c.tolerance {
+			c.mu.Unlock()
+			return true, nil
+		}
+		// Tolerance reached: charge the batch, this request included. The
+		// request is already admitted, so a failed charge is only logged and
+		// kept pending for the next sync.
+		pending := e.pending
+		e.pending = 0
+		c.mu.Unlock()
+		if _, err := c.sync(key, pending, 0); err != nil {
+			c.limiter.logf("[CACHE] Failed to charge key %s: %v", c.limiter.redact.Redact(key), err)
+		}
+		return true, nil
+	}
+	if e != nil && c.interval > 0 && c.limiter.clock.Now().Sub(e.synced) < c.interval {
+		c.mu.Unlock()
+		return false, nil
+	}
+	var pending float64
+	if e != nil {
+		pending, e.pending = e.pending, 0
+	}
+	c.mu.Unlock()
+
+	return c.sync(key, pending, n)
+}
+
+// Sync charges every cached key's pending tokens to Redis and refreshes
+// their balances. Keys with nothing pending whose balance is a full
+// SyncInterval old are dropped instead, to be reloaded on next use. It runs
+// every SyncInterval when set.
+func (c *LocalCache) Sync() error {
+	c.mu.Lock()
+	type charge struct {
+		key     string
+		pending float64
+	}
+	var charges []charge
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		e := el.Value.(*cacheEntry)
+		if e.pending == 0 && c.interval > 0 && c.limiter.clock.Now().Sub(e.synced) >= c.interval {
+			c.remove(el) // Idle: reload on next use
+		} else {
+			charges = append(charges, charge{e.key, e.pending})
+			e.pending = 0
+		}
+		el = next
+	}
+	c.mu.Unlock()
+
+	var firstErr error
+	for _, ch := range charges {
+		if _, err := c.sync(ch.key, ch.pending, 0); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// sync charges key pending tokens in Redis, tries to take cost (0 takes
+// nothing) and caches the balance left. On error the pending tokens are
+// kept for the next sync.
+func (c *LocalCache) sync(key string, pending, cost float64) (bool, error) {
+	r := c.limiter
+	result, err := syncScript.Run(
+		context.Background(),
+		r.client,
+		[]string{r.fullKey(key)},
+		r.capacity,
+		r.refillRate,
+		r.now(),
+		r.multiplier(),
+		r.schedule.Slowest(),
+		pending,
+		cost,
+	).Slice()
+	if err == nil && len(result) != 2 {
+		err = fmt.Errorf("redis: unexpected sync reply %v", result)
+	}
+	var tokens float64
+	if err == nil {
+		if tokens, err = strconv.ParseFloat(fmt.Sprint(result[1]), 64); err != nil {
+			err = fmt.Errorf("redis: unexpected sync reply %v", result)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.lookup(key)
+	if err != nil {
+		if e == nil && pending > 0 {
+			e = c.insert(key)
+		}
+		if e != nil {
+			e.pending += pending
+		}
+		return false, wrapErr(err)
+	}
+	if e == nil {
+		e = c.insert(key)
+	}
+	// Tokens spent locally while Redis was being called are still pending
+	e.balance = tokens - e.pending
+	e.synced = r.clock.Now()
+	return result[0] == int64(1), nil
+}
+
+// lookup returns key's entry, marking it used, or nil if it isn't cached.
+// The caller holds mu.
+func (c *LocalCache) lookup(key string) *cacheEntry {
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry)
+}
+
+// insert caches an empty entry for key, evicting the least recently used
+// key if the cache is full. An evicted key's pending tokens are charged in
+// the background. The caller holds mu.
+func (c *LocalCache) insert(key string) *cacheEntry {
+	if c.lru.Len() >= c.size {
+		oldest := c.lru.Back()
+		evicted := oldest.Value.(*cacheEntry)
+		c.remove(oldest)
+		if evicted.pending > 0 {
+			go func() {
+				if _, err := c.sync(evicted.key, evicted.pending, 0); err != nil {
+					c.limiter.logf("[CACHE] Failed to charge evicted key %s: %v", c.limiter.redact.Redact(evicted.key), err)
+				}
+			}()
+		}
+	}
+	e := &cacheEntry{key: key}
+	c.entries[key] = c.lru.PushFront(e)
+	return e
+}
+
+// remove drops el from the cache. The caller holds mu.
+func (c *LocalCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+}
+
+// Refill charges key's pending tokens, then refills its Redis bucket. The
+// cached balance is dropped, so the next request sees the refill.
+func (c *LocalCache) Refill(key string, tokens float64) error {
+	if err := c.flush(key); err != nil {
+		return err
+	}
+	return c.limiter.Refill(key, tokens)
+}
+
+// RefillTo charges key's pending tokens, then tops its Redis bucket up to
+// target. See ratelimit.TargetRefiller.
+func (c *LocalCache) RefillTo(key string, target float64) error {
+	if err := c.flush(key); err != nil {
+		return err
+	}
+	return c.limiter.RefillTo(key, target)
+}
+
+// flush charges key's pending tokens to Redis and drops it from the cache.
+func (c *LocalCache) flush(key string) error {
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil
+	}
+	pending := el.Value.(*cacheEntry).pending
+	c.remove(el)
+	c.mu.Unlock()
+
+	if pending == 0 {
+		return nil
+	}
+	if _, err := c.sync(key, pending, 0); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// Available returns key's balance as this instance sees it: the cached
+// balance if key is cached, otherwise the Redis bucket's.
+func (c *LocalCache) Available(key string) (float64, error) {
+	if err := checkKey(key); err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		balance := el.Value.(*cacheEntry).balance
+		c.mu.Unlock()
+		return balance, nil
+	}
+	c.mu.Unlock()
+	return c.limiter.Available(key)
+}
+
+// Ready reports whether Redis is reachable. See TokenBucket.Ready.
+func (c *LocalCache) Ready() bool {
+	return c.limiter.Ready()
+}
+
+var (
+	_ ratelimit.Limiter        = (*LocalCache)(nil)
+	_ ratelimit.ReadyChecker   = (*LocalCache)(nil)
+	_ ratelimit.TargetRefiller = (*LocalCache)(nil)
+)
@@ -0,0 +1,112 @@
+package redis
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/ratelimittest"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// countingHook counts the scripts a client runs in Redis, the limiter's
+// round trips.
+type countingHook struct{ calls atomic.Int64 }
+
+func (h *countingHook) DialHook(next goredis.DialHook) goredis.DialHook { return next }
+
+func (h *countingHook) ProcessHook(next goredis.ProcessHook) goredis.ProcessHook {
+	return func(ctx context.Context, cmd goredis.Cmder) error {
+		if name := cmd.Name(); name == "evalsha" || name == "eval" {
+			h.calls.Add(1)
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (h *countingHook) ProcessPipelineHook(next goredis.ProcessPipelineHook) goredis.ProcessPipelineHook {
+	return next
+}
+
+func TestLocalCache_BatchesRedisCalls(t *testing.T) {
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+	hook := &countingHook{}
+	client.AddHook(hook)
+
+	const tolerance, burst = 10, 100
+	tb := NewTokenBucket(Config{Client: client, Capacity: 1000, RefillRate: 1, Clock: ratelimittest.NewFakeClock()})
+	cache := NewLocalCache(tb, LocalCacheConfig{Tolerance: tolerance})
+	defer cache.Close()
+
+	for i := 0; i < burst; i++ {
+		allowed, err := cache.Allow("hot")
+		if err != nil || !allowed {
+			t.Fatalf("Request %d: expected allowed, got %v, %v", i+1, allowed, err)
+		}
+	}
+	// One load, then one charge per Tolerance tokens (plus the first EVAL)
+	if calls := hook.calls.Load(); calls > burst/tolerance+2 {
+		t.Errorf("Expected about %d Redis calls for %d requests, got %d", burst/tolerance+1, burst, calls)
+	}
+
+	// Redis lags by less than Tolerance before a sync, and not at all after
+	tokens, err := tb.Available("hot")
+	if err != nil {
+		t.Fatalf("Available error: %v", err)
+	}
+	if want := 1000.0 - burst; tokens < want || tokens >= want+tolerance {
+		t.Errorf("Expected Redis within %d tokens of %g, got %g", tolerance, want, tokens)
+	}
+	if err := cache.Sync(); err != nil {
+		t.Fatalf("Sync error: %v", err)
+	}
+	if tokens, _ := tb.Available("hot"); tokens != 1000-burst {
+		t.Errorf("Expected %d tokens in Redis after sync, got %g", 1000-burst, tokens)
+	}
+}
+
+func TestLocalCache_DenialAndRefill(t *testing.T) {
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+	hook := &countingHook{}
+	client.AddHook(hook)
+
+	clock := ratelimittest.NewFakeClock()
+	tb := NewTokenBucket(Config{Client: client, Capacity: 5, RefillRate: 0.001, Clock: clock})
+	cache := NewLocalCache(tb, LocalCacheConfig{Tolerance: 3, SyncInterval: time.Hour})
+
+	for i := 0; i < 5; i++ {
+		if allowed, err := cache.Allow("k"); err != nil || !allowed {
+			t.Fatalf("Request %d: expected allowed, got %v, %v", i+1, allowed, err)
+		}
+	}
+
+	// The cached denial stands without asking Redis
+	before := hook.calls.Load()
+	for i := 0; i < 3; i++ {
+		if allowed, _ := cache.Allow("k"); allowed {
+			t.Fatal("Expected an exhausted key to be denied")
+		}
+	}
+	if calls := hook.calls.Load() - before; calls != 0 {
+		t.Errorf("Expected local denials, got %d Redis calls", calls)
+	}
+
+	// A refill through the cache is seen at once
+	if err := cache.Refill("k", 5); err != nil {
+		t.Fatalf("Refill error: %v", err)
+	}
+	if allowed, err := cache.Allow("k"); err != nil || !allowed {
+		t.Fatalf("Expected allowed after refill, got %v, %v", allowed, err)
+	}
+
+	// Close charges what's still pending
+	if err := cache.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	if tokens, _ := tb.Available("k"); tokens < 3.99 || tokens > 4.01 {
+		t.Errorf("Expected 4 tokens in Redis after close, got %g", tokens)
+	}
+}
@@ -0,0 +1,50 @@
+package redis
+
+import (
+	"sync"
+	"time"
+)
+
+// Logf is where the limiter writes its log lines. log.Printf satisfies it.
+type Logf func(format string, args ...interface{})
+
+// logSampler thins out a verbose log line under heavy traffic: it passes one
+// in every lines, and at most perSecond of those each second. The zero value
+// passes everything.
+type logSampler struct {
+	every     int
+	perSecond int
+
+	mu          sync.Mutex
+	seen        int
+	windowStart time.Time
+	inWindow    int
+	suppressed  int
+}
+
+// allow reports whether a line at now should be logged, and how many lines
+// were suppressed since the last one that was.
+func (s *logSampler) allow(now time.Time) (ok bool, suppressed int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seen++
+	if s.every > 1 && (s.seen-1)%s.every != 0 {
+		s.suppressed++
+		return false, 0
+	}
+	if s.perSecond > 0 {
+		if now.Sub(s.windowStart) >= time.Second {
+			s.windowStart = now
+			s.inWindow = 0
+		}
+		if s.inWindow >= s.perSecond {
+			s.suppressed++
+			return false, 0
+		}
+		s.inWindow++
+	}
+
+	suppressed, s.suppressed = s.suppressed, 0
+	return true, suppressed
+}
@@ -0,0 +1,212 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+	"github.com/redis/go-redis/v9"
+)
+
+// maxTxRetries bounds optimistic-lock retries when a key is contended.
+const maxTxRetries = 50
+
+// Store is a Redis-backed ratelimit.Store, for bucket.Limiter. Each bucket
+// is a hash with the fields TokenBucket uses, times in Unix seconds. Atomic
+// operations use WATCH/MULTI optimistic transactions, so the bucket rules
+// run in Go rather than Lua.
+type Store struct {
+	client    redis.UniversalClient
+	keyPrefix string
+	ttl       time.Duration
+}
+
+// StoreConfig holds configuration for the Redis store.
+type StoreConfig struct {
+	// Client is a *redis.Client, or a *redis.ClusterClient for Redis
+	// Cluster. Every operation touches a single key.
+	Client redis.UniversalClient
+
+	KeyPrefix string        // Optional prefix for Redis keys (default: "ratelimit:")
+	TTL       time.Duration // Optional expiry refreshed on every write (0 = no expiry)
+}
+
+// NewStore creates a new Redis-backed store.
+func NewStore(cfg StoreConfig) *Store {
+	prefix := cfg.KeyPrefix
+	if prefix == "" {
+		prefix = "ratelimit:"
+	}
+	return &Store{
+		client:    cfg.Client,
+		keyPrefix: prefix,
+		ttl:       cfg.TTL,
+	}
+}
+
+// GetBucket returns the stored state for key.
+func (s *Store) GetBucket(key string) (ratelimit.BucketState, bool, error) {
+	if err := checkKey(key); err != nil {
+		return ratelimit.BucketState{}, false, err
+	}
+	state, exists, err := s.get(context.Background(), s.client, s.keyPrefix+key)
+	return state, exists, wrapErr(err)
+}
+
+// SetBucket overwrites the stored state for key.
+func (s *Store) SetBucket(key string, state ratelimit.BucketState) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		s.set(ctx, pipe, s.keyPrefix+key, state)
+		return nil
+	})
+	return wrapErr(err)
+}
+
+// ConsumeIfAvailable applies take to key's bucket in a transaction.
+func (s *Store) ConsumeIfAvailable(key string, take ratelimit.TakeFunc) (bool, error) {
+	var allowed bool
+	_, err := s.update(key, func(state ratelimit.BucketState, exists bool) ratelimit.BucketState {
+		state, allowed = take(state, exists)
+		return state
+	})
+	return allowed, err
+}
+
+// AddTokens applies add to key's bucket in a transaction.
+func (s *Store) AddTokens(key string, add ratelimit.UpdateFunc) (ratelimit.BucketState, error) {
+	return s.update(key, add)
+}
+
+// update runs fn as a read-modify-write transaction on key, retrying if
+// another client modifies the key concurrently, and returns the state saved.
+func (s *Store) update(key string, fn ratelimit.UpdateFunc) (ratelimit.BucketState, error) {
+	if err := checkKey(key); err != nil {
+		return ratelimit.BucketState{}, err
+	}
+	ctx := context.Background()
+	fullKey := s.keyPrefix + key
+
+	var saved ratelimit.BucketState
+	txf := func(tx *redis.Tx) error {
+		state, exists, err := s.get(ctx, tx, fullKey)
+		if err != nil {
+			return err
+		}
+		saved = fn(state, exists)
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			s.set(ctx, pipe, fullKey, saved)
+			return nil
+		})
+		return err
+	}
+
+	for i := 0; i < maxTxRetries; i++ {
+		err := s.client.Watch(ctx, txf, fullKey)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return saved, wrapErr(err)
+		}
+	}
+	return ratelimit.BucketState{}, fmt.Errorf("redis store: key still contended after %d attempts: %w", maxTxRetries, redis.TxFailedErr)
+}
+
+// Scan lists a page of buckets with SCAN, so it never blocks Redis. Keys
+// that expire mid-scan are left out.
+func (s *Store) Scan(cursor string, limit int) ([]string, []ratelimit.BucketState, string, error) {
+	ctx := context.Background()
+	fullKeys, next, err := scanKeys(ctx, s.client, s.keyPrefix, cursor, limit)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	keys := make([]string, 0, len(fullKeys))
+	states := make([]ratelimit.BucketState, 0, len(fullKeys))
+	for _, fullKey := range fullKeys {
+		state, exists, err := s.get(ctx, s.client, fullKey)
+		if err != nil {
+			return nil, nil, "", wrapErr(err)
+		}
+		if exists {
+			keys = append(keys, strings.TrimPrefix(fullKey, s.keyPrefix))
+			states = append(states, state)
+		}
+	}
+	return keys, states, next, nil
+}
+
+// storeFields are the hash fields a bucket is stored in, in BucketState
+// order.
+var storeFields = []string{"tokens", "last_refill", "created", "burst_expires", "allowed", "denied"}
+
+// get loads a bucket hash.
+func (s *Store) get(ctx context.Context, c redis.Cmdable, fullKey string) (ratelimit.BucketState, bool, error) {
+	data, err := c.HMGet(ctx, fullKey, storeFields...).Result()
+	if err != nil {
+		return ratelimit.BucketState{}, false, err
+	}
+	if _, ok := data[0].(string); !ok {
+		return ratelimit.BucketState{}, false, nil
+	}
+
+	var nums [6]float64
+	for i, v := range data {
+		str, ok := v.(string)
+		if !ok {
+			continue // Unset: zero
+		}
+		if nums[i], err = strconv.ParseFloat(str, 64); err != nil {
+			return ratelimit.BucketState{}, false, fmt.Errorf("bucket %s field %s: %w", fullKey, storeFields[i], err)
+		}
+	}
+	return ratelimit.BucketState{
+		Tokens:       nums[0],
+		LastRefill:   fromSeconds(nums[1]),
+		CreatedAt:    fromSeconds(nums[2]),
+		BurstExpires: fromSeconds(nums[3]),
+		Allowed:      int64(nums[4]),
+		Denied:       int64(nums[5]),
+	}, true, nil
+}
+
+// set queues the writes that store a bucket hash.
+func (s *Store) set(ctx context.Context, pipe redis.Pipeliner, fullKey string, state ratelimit.BucketState) {
+	pipe.HSet(ctx, fullKey,
+		"tokens", state.Tokens,
+		"last_refill", toSeconds(state.LastRefill),
+		"created", toSeconds(state.CreatedAt),
+		"burst_expires", toSeconds(state.BurstExpires),
+		"allowed", state.Allowed,
+		"denied", state.Denied)
+	if s.ttl > 0 {
+		pipe.Expire(ctx, fullKey, s.ttl)
+	}
+}
+
+// toSeconds returns t in Unix seconds with microsecond precision, or 0 for
+// the zero time.
+func toSeconds(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixMicro()) / 1e6
+}
+
+// fromSeconds is the inverse of toSeconds.
+func fromSeconds(secs float64) time.Time {
+	if secs == 0 {
+		return time.Time{}
+	}
+	return time.UnixMicro(int64(math.Round(secs * 1e6)))
+}
+
+// Ensure Store implements ratelimit.Store.
+var _ ratelimit.Store = (*Store)(nil)
+var _ ratelimit.Scanner = (*Store)(nil)
@@ -2,7 +2,15 @@ package redis
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/haseeb/ratelimiter/pkg/ratelimit"
@@ -11,75 +19,484 @@ import (
 
 // TokenBucket implements a distributed token bucket using Redis.
 type TokenBucket struct {
-	client     *redis.Client
+	client     redis.UniversalClient
 	capacity   float64
+	burst      float64 // cap on paid refills (0 = uncapped)
+	refillMode ratelimit.RefillMode
 	refillRate float64 // tokens per second
-	keyPrefix  string
+	schedule   ratelimit.RefillSchedule
+	minTokens  float64 // lowest balance consumption may reach (<= 0)
+	grace      float64 // tokens a request may overdraw, even in debt (>= 0)
+	burstTTL   float64 // seconds paid overflow lasts unspent (0 = forever)
+	clock      ratelimit.Clock
+	serverTime bool   // take "now" from Redis TIME instead of clock
+	basePrefix string // KeyPrefix, before any namespace
+	keyPrefix  string // basePrefix plus "<namespace>:" when namespaced
+	hashKeys   bool   // store keys as SHA-256 digests
 	script     *redis.Script
+	ready      *atomic.Bool // set once a PING has succeeded; shared by scoped copies
+	logf       Logf
+	redact     ratelimit.Redactor
+	refillLog  *logSampler // samples successful refill lines; shared by scoped copies
 }
 
+// readyTimeout bounds the PING made by Ready, so a request arriving while
+// Redis is still down isn't held up.
+const readyTimeout = 500 * time.Millisecond
+
 // Config holds configuration for the Redis token bucket.
 type Config struct {
-	Client     *redis.Client
+	// Client is a *redis.Client, or a *redis.ClusterClient for Redis
+	// Cluster. The cluster client follows MOVED and ASK redirections while
+	// slots are resharded, and each script touches only its own bucket's
+	// key, so it runs wherever that key's slot lives. Snapshot only scans
+	// one cluster node.
+	Client redis.UniversalClient
+
+	// Capacity may change between deploys without dropping buckets. Each
+	// bucket records the capacity it was written under: after an increase,
+	// natural refill fills the new headroom; after a decrease, the next touch
+	// clamps the balance to the new capacity, keeping any paid tokens above
+	// the old one.
 	Capacity   float64
 	RefillRate float64
 	KeyPrefix  string // Optional prefix for Redis keys (default: "ratelimit:")
+
+	// Namespace isolates a tenant sharing Redis with others: keys become
+	// "<KeyPrefix><Namespace>:<key>", so identical keys in different
+	// namespaces are separate buckets. Empty keeps keys unscoped.
+	Namespace string
+
+	// HashKeys stores each key as the hex SHA-256 digest of the key, after
+	// the prefix and namespace, so identifiers such as API keys or wallet
+	// addresses never appear in Redis. Lookups by the raw key work as
+	// before, but Snapshot can only report digests. Off by default, since
+	// raw keys are easier to debug.
+	HashKeys bool
+
+	// BurstCapacity caps the balance paid refills may build up. Natural refill
+	// still stops at Capacity, but a client may spend up to BurstCapacity
+	// tokens in a spike after paying. 0 leaves paid refills uncapped; values
+	// below Capacity are raised to Capacity.
+	BurstCapacity float64
+
+	// MinTokens is the lowest balance a request may push the bucket to.
+	// A negative value lets clients briefly go into token debt, repaid by
+	// natural refill; while in debt (balance <= 0) every request is denied.
+	// Default 0 (no debt).
+	MinTokens float64
+
+	// GraceOverage lets a client keep spending this many tokens past zero,
+	// into debt repaid by natural refill, before requests are denied (and
+	// payment asked for). Unlike MinTokens, a bucket already in debt keeps
+	// being served until the grace is used up. Default 0 (deny at zero).
+	GraceOverage float64
+
+	// BurstTTL expires paid tokens above Capacity that are still unspent
+	// this long after the last refill that added to them: the balance then
+	// drops back to Capacity. Tokens within Capacity are unaffected. The
+	// expiry is stored in the bucket, so replicas agree on it, and the key
+	// is kept until then. Default 0 (overflow never expires, and keeps the
+	// key until it's spent).
+	BurstTTL time.Duration
+
+	// RefillMode chooses what Refill does with paid tokens (default
+	// ratelimit.RefillStack, adding them to the balance).
+	RefillMode ratelimit.RefillMode
+
+	// RefillSchedule optionally scales RefillRate by time of day. The
+	// multiplier is picked from Clock in its time zone and passed to the
+	// scripts, even when ServerTime is set. Nil keeps the rate constant.
+	RefillSchedule ratelimit.RefillSchedule
+
+	Clock ratelimit.Clock // Optional time source (default: ratelimit.SystemClock)
+
+	// ServerTime makes the scripts read the current time from Redis's TIME
+	// command instead of the app host, so clock skew between app replicas
+	// can't make them disagree about refill. Clock is then ignored, except
+	// for explicit timestamps passed to AllowAt. Needs Redis 5 or later
+	// (scripts replicated by effects).
+	ServerTime bool
+
+	// Logf receives the limiter's log lines. Nil uses log.Printf.
+	Logf Logf
+
+	// Redact masks keys in the limiter's log lines. Nil logs them as is.
+	Redact ratelimit.Redactor
+
+	// RefillLogEvery and RefillLogPerSecond sample the [REFILL] line logged
+	// for each successful refill, which floods logs under heavy paid
+	// traffic: only one in RefillLogEvery is logged (<= 1 logs all), and at
+	// most RefillLogPerSecond of those a second (0 = no cap). Logged lines
+	// report how many were skipped. Failed refills are always logged.
+	RefillLogEvery     int
+	RefillLogPerSecond int
 }
 
-// NewTokenBucket creates a new Redis-backed token bucket.
+// serverNow is spliced into each script: an app-supplied "now" below zero
+// means "use the Redis server's clock".
+const serverNow = `
+	if now < 0 then
+		local t = redis.call("TIME")
+		now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+	end
+`
+
+// rebaseCapacity is spliced into each script after capacity is read. rebase
+// adjusts a balance stored under old_capacity to the current capacity: the
+// natural part above capacity is clamped, while paid overflow above the old
+// capacity is kept. A missing or smaller old capacity needs no adjustment.
+const rebaseCapacity = `
+	local function rebase(tokens, old_capacity)
+		old_capacity = tonumber(old_capacity)
+		if old_capacity == nil or old_capacity <= capacity or tokens <= capacity then
+			return tokens
+		end
+		return capacity + math.max(tokens - old_capacity, 0)
+	end
+`
+
+// expireBurst is spliced into each script after now and capacity are read.
+// expire_burst drops paid overflow above capacity back to capacity once the
+// bucket's burst_expires time has passed.
+const expireBurst = `
+	local function expire_burst(tokens, expires)
+		expires = tonumber(expires)
+		if expires ~= nil and tokens > capacity and now >= expires then
+			return capacity
+		end
+		return tokens
+	end
+`
+
+// keepKey is spliced into each script that writes a bucket, after now and
+// capacity are read. keep sets key's expiry to ttl seconds, long enough for
+// the bucket to refill to capacity untouched, or longer while it holds paid
+// overflow: until the overflow expires at expires, or for good if it never
+// does. An expired key reads as a full bucket, so the overflow would be lost.
+const keepKey = `
+	local function keep(key, tokens, ttl, expires)
+		if tokens > capacity then
+			expires = tonumber(expires)
+			if expires == nil then
+				redis.call("PERSIST", key)
+				return
+			end
+			ttl = math.max(ttl, math.ceil(expires - now) + 1)
+		end
+		redis.call("EXPIRE", key, ttl)
+	end
+`
+
+// refillKey is spliced into the refill scripts after the bucket settings
+// are read. refill settles natural refill on key, then adds tokens above
+// capacity, or applies them as mode says (ratelimit.RefillMode's values), up
+// to the burst cap if one is set (burst > 0). A balance already above the
+// cap isn't reduced. Tokens added above capacity expire burst_ttl seconds
+// later (burst_ttl <= 0 never expires them). It returns the old and new
+// token counts.
+const refillKey = `
+	local function refill(key, tokens_to_add)
+		local data = redis.call("HMGET", key, "tokens", "last_refill", "capacity", "burst_expires")
+		local current = expire_burst(rebase(tonumber(data[1]) or capacity, data[3]), data[4])
+		local last_refill = tonumber(data[2]) or now
+
+		-- Settle natural refill first so accrued tokens aren't lost
+		if current < capacity then
+			current = current + (now - last_refill) * refill_rate * multiplier
+			if current > capacity then
+				current = capacity
+			end
+		end
+
+		local new_tokens = current + tokens_to_add
+		if mode == 1 then -- RefillSetFloor
+			new_tokens = math.max(current, capacity)
+		elseif mode == 2 then -- RefillExact
+			new_tokens = tokens_to_add
+		elseif mode == 3 then -- RefillAtLeast
+			new_tokens = math.max(current, tokens_to_add)
+		end
+		-- Paid tokens may overflow capacity, up to the burst cap
+		if burst > 0 and new_tokens > burst then
+			new_tokens = math.max(current, burst)
+		end
+
+		redis.call("HSET", key, "tokens", new_tokens, "last_refill", now, "capacity", capacity)
+		local expires = data[4]
+		if burst_ttl <= 0 then
+			expires = nil
+			redis.call("HDEL", key, "burst_expires")
+		elseif new_tokens > capacity and new_tokens > current then
+			expires = now + burst_ttl
+			redis.call("HSET", key, "burst_expires", expires)
+		end
+		redis.call("HSETNX", key, "created", now)
+		keep(key, new_tokens, math.ceil(capacity / (refill_rate * slowest)) + 1, expires)
+		return current, new_tokens
+	end
+`
+
+// refillScript atomically refills KEYS[1] with ARGV[1] tokens. ARGV[6]
+// scales the refill rate for the current schedule window, ARGV[7] is the
+// slowest scale, which sizes the key's expiry, ARGV[8] is the refill mode
+// and ARGV[9] the burst TTL in seconds. Returns both old and new token
+// counts for logging.
+var refillScript = redis.NewScript(`
+	local tokens_to_add = tonumber(ARGV[1])
+	local capacity = tonumber(ARGV[2])
+	local refill_rate = tonumber(ARGV[3])
+	local now = tonumber(ARGV[4])
+	local burst = tonumber(ARGV[5])
+	local multiplier = tonumber(ARGV[6])
+	local slowest = tonumber(ARGV[7])
+	local mode = tonumber(ARGV[8])
+	local burst_ttl = tonumber(ARGV[9])
+` + serverNow + rebaseCapacity + expireBurst + keepKey + refillKey + `
+	local current, new_tokens = refill(KEYS[1], tokens_to_add)
+	-- Return as strings: Lua numbers are truncated to integers in replies
+	return {tostring(current), tostring(new_tokens)}
+`)
+
+// refillMultiScript refills every key in KEYS, adding ARGV[8+i] tokens to
+// KEYS[i]; ARGV[1..8] are the bucket settings in refillScript's order. Every
+// key is checked before any is written, so a key that can't hold a bucket
+// fails the whole call with nothing credited. Returns the old and new token
+// counts of each key in turn.
+var refillMultiScript = redis.NewScript(`
+	local capacity = tonumber(ARGV[1])
+	local refill_rate = tonumber(ARGV[2])
+	local now = tonumber(ARGV[3])
+	local burst = tonumber(ARGV[4])
+	local multiplier = tonumber(ARGV[5])
+	local slowest = tonumber(ARGV[6])
+	local mode = tonumber(ARGV[7])
+	local burst_ttl = tonumber(ARGV[8])
+` + serverNow + rebaseCapacity + expireBurst + keepKey + refillKey + `
+	for _, key in ipairs(KEYS) do
+		local kind = redis.call("TYPE", key)["ok"]
+		if kind ~= "hash" and kind ~= "none" then
+			return redis.error_reply("WRONGTYPE " .. key .. " holds a " .. kind .. ", not a bucket")
+		end
+	end
+
+	local result = {}
+	for i, key in ipairs(KEYS) do
+		local current, new_tokens = refill(key, tonumber(ARGV[8 + i]))
+		table.insert(result, tostring(current))
+		table.insert(result, tostring(new_tokens))
+	end
+	return result
+`)
+
+// NewTokenBucket creates a new Redis-backed token bucket. It panics if
+// ratelimit.ValidateBucket rejects its capacity or refill rate.
 func NewTokenBucket(cfg Config) *TokenBucket {
+	if err := ratelimit.ValidateBucket(cfg.Capacity, cfg.RefillRate); err != nil {
+		panic(fmt.Sprintf("redis.NewTokenBucket: %v (capacity %g, refill rate %g)", err, cfg.Capacity, cfg.RefillRate))
+	}
 	prefix := cfg.KeyPrefix
 	if prefix == "" {
 		prefix = "ratelimit:"
 	}
 
-	// Lua script for atomic refill + consume
+	// Lua script for atomic refill + consume. Returns whether the request
+	// was allowed, the balance left and the time the balance is as of, as
+	// strings since Lua numbers are truncated to integers in replies.
 	script := redis.NewScript(`
 		local key = KEYS[1]
 		local capacity = tonumber(ARGV[1])
 		local refill_rate = tonumber(ARGV[2])
 		local now = tonumber(ARGV[3])
-
-		local data = redis.call("HMGET", key, "tokens", "last_refill")
-		local tokens = tonumber(data[1]) or capacity
+		local cost = tonumber(ARGV[4])
+		local min_tokens = tonumber(ARGV[5])
+		local multiplier = tonumber(ARGV[6]) -- Refill rate scale for the schedule window
+		local slowest = tonumber(ARGV[7])    -- Slowest scale, for the key's expiry
+		local grace = tonumber(ARGV[8])      -- Overdraft allowed even in debt
+	` + serverNow + rebaseCapacity + expireBurst + keepKey + `
+		local data = redis.call("HMGET", key, "tokens", "last_refill", "capacity", "burst_expires")
+		local tokens = rebase(tonumber(data[1]) or capacity, data[3])
 		local last_refill = tonumber(data[2]) or now
 
-		-- Natural refill based on elapsed time
+		-- Natural refill based on elapsed time. A timestamp older than the last
+		-- refill (out-of-order replay) accrues nothing and doesn't rewind it.
 		-- Only add tokens if below capacity (preserves overflow from paid refills)
 		local elapsed = now - last_refill
+		if elapsed < 0 then
+			elapsed = 0
+			now = last_refill
+		end
+		tokens = expire_burst(tokens, data[4])
 		if tokens < capacity then
-			tokens = tokens + elapsed * refill_rate
+			tokens = tokens + elapsed * refill_rate * multiplier
 			if tokens > capacity then
 				tokens = capacity
 			end
 		end
 
-		-- Try to consume one token
-		if tokens >= 1 then
-			tokens = tokens - 1
-			redis.call("HMSET", key, "tokens", tokens, "last_refill", now)
-			redis.call("EXPIRE", key, math.ceil(capacity / refill_rate) + 1)
-			return 1
+		-- Keep the key until a bucket in full debt has refilled to capacity,
+		-- even at the schedule's slowest rate, and any paid overflow expires
+		local ttl = math.ceil((capacity - math.min(min_tokens, -grace)) / (refill_rate * slowest)) + 1
+
+		redis.call("HSETNX", key, "created", now)
+
+		-- Try to consume the requested (possibly fractional) cost.
+		-- Buckets in debt are throttled; others may overdraw down to min_tokens.
+		-- Any bucket may overdraw down to -grace.
+		if (tokens > 0 and tokens - cost >= min_tokens) or tokens - cost >= -grace then
+			tokens = tokens - cost
+			redis.call("HMSET", key, "tokens", tokens, "last_refill", now, "capacity", capacity)
+			redis.call("HINCRBY", key, "allowed", 1)
+			keep(key, tokens, ttl, data[4])
+			return {1, tostring(tokens), tostring(now)}
 		else
-			redis.call("HMSET", key, "tokens", tokens, "last_refill", now)
-			redis.call("EXPIRE", key, math.ceil(capacity / refill_rate) + 1)
-			return 0
+			redis.call("HMSET", key, "tokens", tokens, "last_refill", now, "capacity", capacity)
+			redis.call("HINCRBY", key, "denied", 1)
+			keep(key, tokens, ttl, data[4])
+			return {0, tostring(tokens), tostring(now)}
 		end
 	`)
 
+	minTokens := cfg.MinTokens
+	if minTokens > 0 {
+		minTokens = 0
+	}
+
+	clock := cfg.Clock
+	if clock == nil {
+		clock = ratelimit.SystemClock
+	}
+
+	burst := cfg.BurstCapacity
+	if burst > 0 && burst < cfg.Capacity {
+		burst = cfg.Capacity
+	}
+
+	logf := cfg.Logf
+	if logf == nil {
+		logf = log.Printf
+	}
+
 	return &TokenBucket{
 		client:     cfg.Client,
 		capacity:   cfg.Capacity,
+		burst:      burst,
+		refillMode: cfg.RefillMode,
 		refillRate: cfg.RefillRate,
-		keyPrefix:  prefix,
+		schedule:   cfg.RefillSchedule,
+		minTokens:  minTokens,
+		grace:      max(cfg.GraceOverage, 0),
+		burstTTL:   max(cfg.BurstTTL.Seconds(), 0),
+		clock:      clock,
+		serverTime: cfg.ServerTime,
+		basePrefix: prefix,
+		keyPrefix:  namespacedPrefix(prefix, cfg.Namespace),
+		hashKeys:   cfg.HashKeys,
 		script:     script,
+		ready:      new(atomic.Bool),
+		logf:       logf,
+		redact:     cfg.Redact,
+		refillLog:  &logSampler{every: cfg.RefillLogEvery, perSecond: cfg.RefillLogPerSecond},
+	}
+}
+
+// namespacedPrefix returns the key prefix for namespace under prefix.
+func namespacedPrefix(prefix, namespace string) string {
+	if namespace == "" {
+		return prefix
+	}
+	return prefix + namespace + ":"
+}
+
+// Scoped returns a limiter with the same settings and client whose keys live
+// in namespace, replacing any namespace r has. It's cheap, so a multi-tenant
+// server can scope per request.
+func (r *TokenBucket) Scoped(namespace string) *TokenBucket {
+	return &TokenBucket{
+		client:     r.client,
+		capacity:   r.capacity,
+		burst:      r.burst,
+		refillMode: r.refillMode,
+		refillRate: r.refillRate,
+		schedule:   r.schedule,
+		minTokens:  r.minTokens,
+		grace:      r.grace,
+		burstTTL:   r.burstTTL,
+		clock:      r.clock,
+		serverTime: r.serverTime,
+		basePrefix: r.basePrefix,
+		keyPrefix:  namespacedPrefix(r.basePrefix, namespace),
+		hashKeys:   r.hashKeys,
+		script:     r.script,
+		ready:      r.ready,
+		logf:       r.logf,
+		redact:     r.redact,
+		refillLog:  r.refillLog,
 	}
 }
 
+// fullKey returns the Redis key holding key's bucket.
+func (r *TokenBucket) fullKey(key string) string {
+	if r.hashKeys {
+		sum := sha256.Sum256([]byte(key))
+		return r.keyPrefix + hex.EncodeToString(sum[:])
+	}
+	return r.keyPrefix + key
+}
+
 // Allow checks if a request for the given key should be allowed.
 func (r *TokenBucket) Allow(key string) (bool, error) {
-	fullKey := r.keyPrefix + key
-	now := float64(time.Now().UnixMicro()) / 1e6 // seconds with microsecond precision
+	return r.AllowN(key, 1)
+}
+
+// AllowN checks if a request costing n tokens should be allowed.
+// n may be fractional, e.g. 0.25 for a cheap endpoint.
+func (r *TokenBucket) AllowN(key string, n float64) (bool, error) {
+	return r.allowN(key, n, time.Time{})
+}
+
+// AllowAt is Allow using at, rather than the clock, for refill math. It lets
+// recorded traffic be replayed, or tests simulate refill without sleeping.
+// Timestamps older than the bucket's last update accrue no tokens.
+func (r *TokenBucket) AllowAt(key string, at time.Time) (bool, error) {
+	return r.allowN(key, 1, at)
+}
+
+// AllowWithReset is Allow, also returning when key's bucket recovers at the
+// current refill rate: see ratelimit.ResetTime. The decision and balance
+// come from the same script run.
+func (r *TokenBucket) AllowWithReset(key string) (bool, time.Time, error) {
+	allowed, tokens, now, err := r.consume(key, 1, time.Time{})
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	return allowed, ratelimit.ResetTime(now, tokens, r.capacity, r.refillRate*r.schedule.Multiplier(now)), nil
+}
+
+// allowN runs the consume script as of at, or as of now if at is zero.
+func (r *TokenBucket) allowN(key string, n float64, at time.Time) (bool, error) {
+	allowed, _, _, err := r.consume(key, n, at)
+	return allowed, err
+}
+
+// consume runs the consume script as of at, or as of now if at is zero,
+// returning the decision, the balance left and the time the script took it
+// as of: Redis's clock when ServerTime is set.
+func (r *TokenBucket) consume(key string, n float64, at time.Time) (bool, float64, time.Time, error) {
+	if n <= 0 {
+		return false, 0, time.Time{}, ratelimit.ErrInvalidCost
+	}
+	if err := checkKey(key); err != nil {
+		return false, 0, time.Time{}, err
+	}
+
+	fullKey := r.fullKey(key)
+	now := r.now()
+	multiplier := r.multiplier()
+	if !at.IsZero() {
+		now = unixSeconds(at)
+		multiplier = r.schedule.Multiplier(at)
+	}
 
 	result, err := r.script.Run(
 		context.Background(),
@@ -88,13 +505,60 @@ func (r *TokenBucket) Allow(key string) (bool, error) {
 		r.capacity,
 		r.refillRate,
 		now,
-	).Int()
+		n,
+		r.minTokens,
+		multiplier,
+		r.schedule.Slowest(),
+		r.grace,
+	).Slice()
 
 	if err != nil {
-		return false, err
+		return false, 0, time.Time{}, wrapErr(err)
+	}
+	if len(result) != 3 {
+		return false, 0, time.Time{}, fmt.Errorf("redis: unexpected consume reply %v", result)
+	}
+	tokens, err := strconv.ParseFloat(fmt.Sprint(result[1]), 64)
+	if err != nil {
+		return false, 0, time.Time{}, fmt.Errorf("redis: unexpected consume reply %v", result)
+	}
+	secs, err := strconv.ParseFloat(fmt.Sprint(result[2]), 64)
+	if err != nil {
+		return false, 0, time.Time{}, fmt.Errorf("redis: unexpected consume reply %v", result)
+	}
+	return result[0] == int64(1), tokens, fromSeconds(secs), nil
+}
+
+// now returns the clock's current time in seconds with microsecond precision,
+// or -1 for the scripts to read Redis's clock when ServerTime is set.
+func (r *TokenBucket) now() float64 {
+	if r.serverTime {
+		return -1
+	}
+	return unixSeconds(r.clock.Now())
+}
+
+// multiplier returns the refill rate scale in force now.
+func (r *TokenBucket) multiplier() float64 {
+	return r.schedule.Multiplier(r.clock.Now())
+}
+
+// currentTime returns the current time in seconds for writes made outside
+// the scripts, from Redis when ServerTime is set.
+func (r *TokenBucket) currentTime(ctx context.Context) (float64, error) {
+	if !r.serverTime {
+		return r.now(), nil
+	}
+	t, err := r.client.Time(ctx).Result()
+	if err != nil {
+		return 0, wrapErr(err)
 	}
+	return unixSeconds(t), nil
+}
 
-	return result == 1, nil
+// unixSeconds converts t to Unix seconds with microsecond precision.
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixMicro()) / 1e6
 }
 
 // KeyPrefix returns the current key prefix (useful for testing).
@@ -102,27 +566,36 @@ func (r *TokenBucket) KeyPrefix() string {
 	return r.keyPrefix
 }
 
-// Refill adds tokens to the bucket for the given key without capping at capacity.
-// This allows paid tokens to exceed the normal limit ("burst" tokens).
-func (r *TokenBucket) Refill(key string, tokens float64) error {
-	fullKey := r.keyPrefix + key
+// Clock returns the clock refill math reads, or nil with ServerTime set,
+// where the Redis server's clock decides.
+func (r *TokenBucket) Clock() ratelimit.Clock {
+	if r.serverTime {
+		return nil
+	}
+	return r.clock
+}
 
-	// Lua script for atomic refill without capacity cap
-	// Returns both old and new token counts for logging
-	refillScript := redis.NewScript(`
-		local key = KEYS[1]
-		local tokens_to_add = tonumber(ARGV[1])
-		local capacity = tonumber(ARGV[2])
-		local refill_rate = tonumber(ARGV[3])
+// Refill adds tokens to the bucket for the given key without capping at capacity,
+// or applies them as Config.RefillMode says.
+// This allows paid tokens to exceed the normal limit ("burst" tokens), up to
+// BurstCapacity when set.
+func (r *TokenBucket) Refill(key string, tokens float64) error {
+	return r.refillWith(r.refillMode, key, tokens)
+}
 
-		local current = tonumber(redis.call("HGET", key, "tokens")) or capacity
-		local new_tokens = current + tokens_to_add
-		-- No cap - allow overflow beyond capacity for paid tokens
+// RefillTo raises key's balance to target if it's below, up to
+// BurstCapacity when set, whatever Config.RefillMode says. See
+// ratelimit.TargetRefiller.
+func (r *TokenBucket) RefillTo(key string, target float64) error {
+	return r.refillWith(ratelimit.RefillAtLeast, key, target)
+}
 
-		redis.call("HSET", key, "tokens", new_tokens)
-		redis.call("EXPIRE", key, math.ceil(capacity / refill_rate) + 1)
-		return {current, new_tokens}
-	`)
+// refillWith refills key's bucket with tokens, applied as mode says.
+func (r *TokenBucket) refillWith(mode ratelimit.RefillMode, key string, tokens float64) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	fullKey := r.fullKey(key)
 
 	result, err := refillScript.Run(
 		context.Background(),
@@ -131,54 +604,184 @@ func (r *TokenBucket) Refill(key string, tokens float64) error {
 		tokens,
 		r.capacity,
 		r.refillRate,
-	).Int64Slice()
+		r.now(),
+		r.burst,
+		r.multiplier(),
+		r.schedule.Slowest(),
+		int(mode),
+		r.burstTTL,
+	).Float64Slice()
 
 	if err != nil {
+		r.logf("[REFILL] key=%s added=%.2f failed: %v", r.redact.Redact(key), tokens, err)
+		return wrapErr(err)
+	}
+
+	r.logRefill(key, tokens, result[0], result[1])
+	return nil
+}
+
+// logRefill logs a successful refill, subject to sampling.
+func (r *TokenBucket) logRefill(key string, added, before, after float64) {
+	ok, skipped := r.refillLog.allow(r.clock.Now())
+	if !ok {
+		return
+	}
+	key = r.redact.Redact(key)
+	if skipped > 0 {
+		r.logf("[REFILL] key=%s before=%.2f added=%.2f after=%.2f (%d refills not logged)", key, before, added, after, skipped)
+		return
+	}
+	r.logf("[REFILL] key=%s before=%.2f added=%.2f after=%.2f", key, before, added, after)
+}
+
+// Refund returns unused tokens to key's bucket, raising the balance no higher
+// than capacity. See ratelimit.Refunder. It's a refill capped at capacity,
+// so it isn't logged as one.
+func (r *TokenBucket) Refund(key string, tokens float64) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	err := refillScript.Run(
+		context.Background(),
+		r.client,
+		[]string{r.fullKey(key)},
+		tokens,
+		r.capacity,
+		r.refillRate,
+		r.now(),
+		r.capacity, // Burst cap: a refund can't raise the balance past capacity
+		r.multiplier(),
+		r.schedule.Slowest(),
+		int(ratelimit.RefillStack),
+		r.burstTTL,
+	).Err()
+	return wrapErr(err)
+}
+
+// RefillTx refills the bucket and runs any extra commands queued by also in a
+// single MULTI/EXEC round trip. It's meant for callers that pair a refill
+// with another Redis write of their own, such as recording a payment in a
+// Redis-backed ledger: pipelining the two saves a round trip and applies
+// them together. also may be nil.
+func (r *TokenBucket) RefillTx(key string, tokens float64, also func(pipe redis.Pipeliner)) error {
+	if err := checkKey(key); err != nil {
 		return err
 	}
+	fullKey := r.fullKey(key)
+
+	var refillCmd *redis.Cmd
+	_, err := r.client.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		// EVAL rather than EVALSHA: a NOSCRIPT error can't be retried inside MULTI
+		refillCmd = refillScript.Eval(context.Background(), pipe, []string{fullKey}, tokens, r.capacity, r.refillRate, r.now(), r.burst, r.multiplier(), r.schedule.Slowest(), int(r.refillMode), r.burstTTL)
+		if also != nil {
+			also(pipe)
+		}
+		return nil
+	})
+	if err != nil {
+		r.logf("[REFILL] key=%s added=%.2f failed: %v", r.redact.Redact(key), tokens, err)
+		return wrapErr(err)
+	}
 
-	oldTokens := float64(result[0])
-	newTokens := float64(result[1])
-	log.Printf("[REFILL] key=%s before=%.2f added=%.2f after=%.2f", key, oldTokens, tokens, newTokens)
+	result, err := refillCmd.Float64Slice()
+	if err != nil {
+		r.logf("[REFILL] key=%s added=%.2f failed: %v", r.redact.Redact(key), tokens, err)
+		return wrapErr(err)
+	}
+	r.logRefill(key, tokens, result[0], result[1])
 
 	return nil
 }
 
-// Available returns the current number of tokens for the given key.
-// This is useful for debugging and testing.
-func (r *TokenBucket) Available(key string) (float64, error) {
-	fullKey := r.keyPrefix + key
+// RefillMulti refills several keys together, for linked quotas such as a
+// payment crediting both a per-IP and a per-wallet bucket. All refills run
+// in one script, which Redis executes atomically, and every key is checked
+// before any is written: a key that can't hold a bucket, or an error
+// reaching Redis, leaves none credited. In Redis Cluster the keys must share
+// a hash slot.
+func (r *TokenBucket) RefillMulti(refills map[string]float64) error {
+	if len(refills) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(refills))
+	for key := range refills {
+		if err := checkKey(key); err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 
-	// Lua script to get current tokens after natural refill
-	availableScript := redis.NewScript(`
-		local key = KEYS[1]
-		local capacity = tonumber(ARGV[1])
-		local refill_rate = tonumber(ARGV[2])
-		local now = tonumber(ARGV[3])
+	fullKeys := make([]string, len(keys))
+	args := []interface{}{r.capacity, r.refillRate, r.now(), r.burst, r.multiplier(), r.schedule.Slowest(), int(r.refillMode), r.burstTTL}
+	for i, key := range keys {
+		fullKeys[i] = r.fullKey(key)
+		args = append(args, refills[key])
+	}
 
-		local data = redis.call("HMGET", key, "tokens", "last_refill")
-		local tokens = tonumber(data[1])
-		local last_refill = tonumber(data[2])
+	result, err := refillMultiScript.Run(context.Background(), r.client, fullKeys, args...).Float64Slice()
+	if err != nil {
+		redacted := make([]string, len(keys))
+		for i, key := range keys {
+			redacted[i] = r.redact.Redact(key)
+		}
+		r.logf("[REFILL] keys=%s failed: %v", strings.Join(redacted, ","), err)
+		return wrapErr(err)
+	}
+	for i, key := range keys {
+		r.logRefill(key, refills[key], result[2*i], result[2*i+1])
+	}
+	return nil
+}
 
-		-- If key doesn't exist, return capacity
-		if tokens == nil then
-			return capacity
-		end
+// Available returns the current number of tokens for the given key.
+// This is useful for debugging and testing.
+func (r *TokenBucket) Available(key string) (float64, error) {
+	if err := checkKey(key); err != nil {
+		return 0, err
+	}
+	return r.available(r.fullKey(key))
+}
 
-		-- Calculate natural refill (but don't modify)
-		-- Only add tokens if below capacity (preserves overflow from paid refills)
-		if last_refill ~= nil and tokens < capacity then
-			local elapsed = now - last_refill
-			tokens = tokens + elapsed * refill_rate
-			if tokens > capacity then
-				tokens = capacity
-			end
+// availableScript returns KEYS[1]'s balance after natural refill, without
+// modifying it, or capacity if the key has no bucket. ARGV[1..4] are the
+// capacity, refill rate, now and the refill rate scale for the schedule
+// window.
+var availableScript = redis.NewScript(`
+	local key = KEYS[1]
+	local capacity = tonumber(ARGV[1])
+	local refill_rate = tonumber(ARGV[2])
+	local now = tonumber(ARGV[3])
+	local multiplier = tonumber(ARGV[4])
+` + serverNow + rebaseCapacity + expireBurst + `
+	local data = redis.call("HMGET", key, "tokens", "last_refill", "capacity", "burst_expires")
+	local tokens = tonumber(data[1])
+	local last_refill = tonumber(data[2])
+
+	-- If key doesn't exist, return capacity
+	if tokens == nil then
+		return tostring(capacity)
+	end
+	tokens = expire_burst(rebase(tokens, data[3]), data[4])
+
+	-- Calculate natural refill (but don't modify)
+	-- Only add tokens if below capacity (preserves overflow from paid refills)
+	if last_refill ~= nil and tokens < capacity then
+		local elapsed = now - last_refill
+		tokens = tokens + elapsed * refill_rate * multiplier
+		if tokens > capacity then
+			tokens = capacity
 		end
+	end
 
-		return tokens
-	`)
+	-- Return as a string: Lua numbers are truncated to integers in replies
+	return tostring(tokens)
+`)
 
-	now := float64(time.Now().UnixMicro()) / 1e6
+// available returns the current number of tokens stored at fullKey.
+func (r *TokenBucket) available(fullKey string) (float64, error) {
+	now := r.now()
 
 	result, err := availableScript.Run(
 		context.Background(),
@@ -187,14 +790,223 @@ func (r *TokenBucket) Available(key string) (float64, error) {
 		r.capacity,
 		r.refillRate,
 		now,
+		r.multiplier(),
 	).Float64()
 
 	if err != nil {
-		return 0, err
+		return 0, wrapErr(err)
 	}
 
 	return result, nil
 }
 
+// Seed sets the initial token count of each key, e.g. to pre-load VIP keys
+// with a burst balance on deploy. Balances may exceed capacity; that
+// overflow doesn't expire, and keeps the key until it's spent. All keys are
+// written in a single MULTI/EXEC round trip with last_refill set to now.
+func (r *TokenBucket) Seed(entries map[string]float64) error {
+	for key := range entries {
+		if err := checkKey(key); err != nil {
+			return err
+		}
+	}
+
+	ctx := context.Background()
+	now, err := r.currentTime(ctx)
+	if err != nil {
+		return err
+	}
+	ttl := time.Duration(math.Ceil((r.capacity-min(r.minTokens, -r.grace))/(r.refillRate*r.schedule.Slowest()))+1) * time.Second
+
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for key, tokens := range entries {
+			fullKey := r.fullKey(key)
+			pipe.HSet(ctx, fullKey, "tokens", tokens, "last_refill", now, "capacity", r.capacity)
+			pipe.HDel(ctx, fullKey, "burst_expires")
+			pipe.HSetNX(ctx, fullKey, "created", now)
+			if tokens > r.capacity {
+				// Seeded overflow never expires, so neither may the key
+				pipe.Persist(ctx, fullKey)
+			} else {
+				pipe.Expire(ctx, fullKey, ttl)
+			}
+		}
+		return nil
+	})
+	return wrapErr(err)
+}
+
+// Reset deletes the bucket for key, so its next request sees a full bucket.
+func (r *TokenBucket) Reset(key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	return wrapErr(r.client.Del(context.Background(), r.fullKey(key)).Err())
+}
+
+// Drain sets key's balance to zero, keeping the bucket so natural refill
+// resumes from now.
+func (r *TokenBucket) Drain(key string) error {
+	return r.Seed(map[string]float64{key: 0})
+}
+
+// openScript creates KEYS[1] as an empty bucket if it doesn't exist,
+// returning 1 if it did. ARGV[1] is now, ARGV[2] the capacity and ARGV[3]
+// the key's expiry in seconds.
+var openScript = redis.NewScript(`
+	local now = tonumber(ARGV[1])
+	local capacity = tonumber(ARGV[2])
+	local ttl = tonumber(ARGV[3])
+` + serverNow + `
+	if redis.call("EXISTS", KEYS[1]) == 1 then
+		return 0
+	end
+	redis.call("HSET", KEYS[1], "tokens", 0, "last_refill", now, "capacity", capacity, "created", now)
+	redis.call("EXPIRE", KEYS[1], ttl)
+	return 1
+`)
+
+// Open creates key's bucket empty if it has none. The check and the write
+// are one script, so concurrent callers can't both create it and wipe what
+// the first one refilled in between. See ratelimit.Opener.
+func (r *TokenBucket) Open(key string) (bool, error) {
+	if err := checkKey(key); err != nil {
+		return false, err
+	}
+	created, err := openScript.Run(
+		context.Background(),
+		r.client,
+		[]string{r.fullKey(key)},
+		r.now(),
+		r.capacity,
+		int64(math.Ceil(r.capacity/(r.refillRate*r.schedule.Slowest())))+1,
+	).Int()
+	if err != nil {
+		return false, wrapErr(err)
+	}
+	return created == 1, nil
+}
+
+// Info returns key's balance, as Available does, along with its timestamps
+// and request counters. A key with no bucket reports a full balance and zero
+// values for the rest.
+func (r *TokenBucket) Info(key string) (ratelimit.BucketInfo, error) {
+	tokens, err := r.Available(key)
+	if err != nil {
+		return ratelimit.BucketInfo{}, err
+	}
+	info := ratelimit.BucketInfo{Tokens: tokens}
+
+	fields, err := r.client.HMGet(context.Background(), r.fullKey(key), "last_refill", "created", "allowed", "denied").Result()
+	if err != nil {
+		return ratelimit.BucketInfo{}, wrapErr(err)
+	}
+	info.LastRefill = parseSeconds(fields[0])
+	info.CreatedAt = parseSeconds(fields[1])
+	info.Allowed = parseCount(fields[2])
+	info.Denied = parseCount(fields[3])
+	return info, nil
+}
+
+// parseSeconds converts a Unix seconds hash field to a time, or the zero
+// time if the field is missing.
+func parseSeconds(field interface{}) time.Time {
+	s, _ := field.(string)
+	secs, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMicro(int64(math.Round(secs * 1e6)))
+}
+
+// Snapshot lists a page of keys under the limiter's prefix with SCAN, each
+// with its balance as Available reports it. Scanning a non-namespaced
+// limiter also lists namespaced keys, as "<namespace>:<key>". With HashKeys
+// set, keys are listed as their digests.
+func (r *TokenBucket) Snapshot(cursor string, limit int) ([]ratelimit.KeyTokens, string, error) {
+	fullKeys, next, err := scanKeys(context.Background(), r.client, r.keyPrefix, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	page := make([]ratelimit.KeyTokens, 0, len(fullKeys))
+	for _, fullKey := range fullKeys {
+		key := strings.TrimPrefix(fullKey, r.keyPrefix)
+		tokens, err := r.available(fullKey)
+		if err != nil {
+			return nil, "", err
+		}
+		page = append(page, ratelimit.KeyTokens{Key: key, Tokens: tokens})
+	}
+	return page, next, nil
+}
+
+// scanKeys runs one SCAN step over the bucket hashes under prefix. Cursors
+// are SCAN's own, formatted as strings, with "" for both the first and the
+// final step; limit is passed as SCAN's COUNT hint.
+func scanKeys(ctx context.Context, client redis.UniversalClient, prefix, cursor string, limit int) ([]string, string, error) {
+	var start uint64
+	if cursor != "" {
+		var err error
+		if start, err = strconv.ParseUint(cursor, 10, 64); err != nil {
+			return nil, "", fmt.Errorf("invalid snapshot cursor %q", cursor)
+		}
+	}
+	limit = min(max(limit, 1), ratelimit.MaxSnapshotPage)
+
+	keys, next, err := client.ScanType(ctx, start, globEscape(prefix)+"*", int64(limit), "hash").Result()
+	if err != nil {
+		return nil, "", wrapErr(err)
+	}
+	if next == 0 {
+		return keys, "", nil
+	}
+	return keys, strconv.FormatUint(next, 10), nil
+}
+
+// globEscape quotes the characters MATCH treats as wildcards.
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// parseCount converts a counter hash field to an int, or 0 if missing.
+func parseCount(field interface{}) int64 {
+	s, _ := field.(string)
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
+
+// Ready reports whether Redis has answered a PING. Until it does, each call
+// pings again; after the first success the result is cached and Ready stops
+// talking to Redis.
+func (r *TokenBucket) Ready() bool {
+	if r.ready.Load() {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), readyTimeout)
+	defer cancel()
+	if err := r.client.Ping(ctx).Err(); err != nil {
+		return false
+	}
+	r.ready.Store(true)
+	return true
+}
+
 // Ensure TokenBucket implements Limiter interface.
 var _ ratelimit.Limiter = (*TokenBucket)(nil)
+var _ ratelimit.Resetter = (*TokenBucket)(nil)
+var _ ratelimit.Drainer = (*TokenBucket)(nil)
+var _ ratelimit.ReadyChecker = (*TokenBucket)(nil)
+var _ ratelimit.Inspector = (*TokenBucket)(nil)
+var _ ratelimit.Snapshotter = (*TokenBucket)(nil)
+var _ ratelimit.Clocked = (*TokenBucket)(nil)
+var _ ratelimit.Refunder = (*TokenBucket)(nil)
+var _ ratelimit.TargetRefiller = (*TokenBucket)(nil)
+var _ ratelimit.Opener = (*TokenBucket)(nil)
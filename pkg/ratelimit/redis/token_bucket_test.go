@@ -1,15 +1,52 @@
 package redis
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/alicebob/miniredis/v2"
 	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/ratelimittest"
 	goredis "github.com/redis/go-redis/v9"
 )
 
+// setupRedis returns a client for the Redis the tests run against, and a
+// cleanup function. That's a fresh miniredis unless REDIS_ADDR names a real
+// server, so CI can check the scripts against the real engine; its database
+// is flushed first. Tests that control the server itself (its clock, or
+// stopping it) use miniredis regardless.
+func setupRedis(t *testing.T) (*goredis.Client, func()) {
+	t.Helper()
+	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
+		return setupRealRedis(t, addr)
+	}
+	return setupMiniredis(t)
+}
+
+// setupRealRedis connects to the Redis server at addr and flushes its
+// database.
+func setupRealRedis(t *testing.T, addr string) (*goredis.Client, func()) {
+	t.Helper()
+	client := goredis.NewClient(&goredis.Options{Addr: addr})
+	if err := client.FlushDB(context.Background()).Err(); err != nil {
+		client.Close()
+		t.Fatalf("Failed to flush Redis at %s: %v", addr, err)
+	}
+	return client, func() { client.Close() }
+}
+
 // setupMiniredis creates a miniredis server and returns a redis client and cleanup function.
 func setupMiniredis(t *testing.T) (*goredis.Client, func()) {
 	t.Helper()
@@ -29,7 +66,7 @@ func setupMiniredis(t *testing.T) (*goredis.Client, func()) {
 }
 
 func TestTokenBucket_Allow(t *testing.T) {
-	client, cleanup := setupMiniredis(t)
+	client, cleanup := setupRedis(t)
 	defer cleanup()
 
 	rtb := NewTokenBucket(Config{
@@ -60,13 +97,14 @@ func TestTokenBucket_Allow(t *testing.T) {
 }
 
 func TestTokenBucket_Refill(t *testing.T) {
-	client, cleanup := setupMiniredis(t)
+	client, cleanup := setupRedis(t)
 	defer cleanup()
 
 	rtb := NewTokenBucket(Config{
 		Client:     client,
 		Capacity:   5,
 		RefillRate: 10, // 10 tokens per second
+		Clock:      ratelimittest.NewFakeClock(),
 	})
 
 	// Empty the bucket
@@ -79,8 +117,8 @@ func TestTokenBucket_Refill(t *testing.T) {
 		t.Error("Should be empty now")
 	}
 
-	// Wait 110ms, should get 1 token (10/sec * 0.11sec ≈ 1.1)
-	time.Sleep(110 * time.Millisecond)
+	// After 110ms, should get 1 token (10/sec * 0.11sec ≈ 1.1)
+	ratelimittest.AdvanceTime(t, rtb, 110*time.Millisecond)
 
 	allowed, err := rtb.Allow("refill-test")
 	if err != nil {
@@ -98,13 +136,14 @@ func TestTokenBucket_Refill(t *testing.T) {
 }
 
 func TestTokenBucket_MaxCapacity(t *testing.T) {
-	client, cleanup := setupMiniredis(t)
+	client, cleanup := setupRedis(t)
 	defer cleanup()
 
 	rtb := NewTokenBucket(Config{
 		Client:     client,
 		Capacity:   5,
 		RefillRate: 100, // Fast refill
+		Clock:      ratelimittest.NewFakeClock(),
 	})
 
 	// Consume all 5 tokens first
@@ -115,8 +154,8 @@ func TestTokenBucket_MaxCapacity(t *testing.T) {
 		}
 	}
 
-	// Wait for bucket to refill (should refill to capacity, not beyond)
-	time.Sleep(100 * time.Millisecond)
+	// Let the bucket refill (to capacity, not beyond)
+	ratelimittest.AdvanceTime(t, rtb, 100*time.Millisecond)
 
 	// Should still only be able to consume 5 tokens (capacity)
 	successCount := 0
@@ -133,7 +172,7 @@ func TestTokenBucket_MaxCapacity(t *testing.T) {
 }
 
 func TestTokenBucket_DifferentKeys(t *testing.T) {
-	client, cleanup := setupMiniredis(t)
+	client, cleanup := setupRedis(t)
 	defer cleanup()
 
 	rtb := NewTokenBucket(Config{
@@ -161,7 +200,7 @@ func TestTokenBucket_DifferentKeys(t *testing.T) {
 }
 
 func TestTokenBucket_CustomKeyPrefix(t *testing.T) {
-	client, cleanup := setupMiniredis(t)
+	client, cleanup := setupRedis(t)
 	defer cleanup()
 
 	rtb := NewTokenBucket(Config{
@@ -181,7 +220,7 @@ func TestTokenBucket_CustomKeyPrefix(t *testing.T) {
 }
 
 func TestTokenBucket_DefaultKeyPrefix(t *testing.T) {
-	client, cleanup := setupMiniredis(t)
+	client, cleanup := setupRedis(t)
 	defer cleanup()
 
 	rtb := NewTokenBucket(Config{
@@ -197,7 +236,7 @@ func TestTokenBucket_DefaultKeyPrefix(t *testing.T) {
 }
 
 func TestTokenBucket_ThreadSafety(t *testing.T) {
-	client, cleanup := setupMiniredis(t)
+	client, cleanup := setupRedis(t)
 	defer cleanup()
 
 	rtb := NewTokenBucket(Config{
@@ -230,7 +269,7 @@ func TestTokenBucket_ThreadSafety(t *testing.T) {
 
 // TestLimiterInterface verifies that TokenBucket implements the Limiter interface.
 func TestLimiterInterface(t *testing.T) {
-	client, cleanup := setupMiniredis(t)
+	client, cleanup := setupRedis(t)
 	defer cleanup()
 
 	var _ ratelimit.Limiter = NewTokenBucket(Config{
@@ -241,7 +280,7 @@ func TestLimiterInterface(t *testing.T) {
 }
 
 func TestTokenBucket_ZeroInitialState(t *testing.T) {
-	client, cleanup := setupMiniredis(t)
+	client, cleanup := setupRedis(t)
 	defer cleanup()
 
 	rtb := NewTokenBucket(Config{
@@ -258,7 +297,7 @@ func TestTokenBucket_ZeroInitialState(t *testing.T) {
 }
 
 func TestTokenBucket_BurstThenThrottle(t *testing.T) {
-	client, cleanup := setupMiniredis(t)
+	client, cleanup := setupRedis(t)
 	defer cleanup()
 
 	rtb := NewTokenBucket(Config{
@@ -292,7 +331,7 @@ func TestTokenBucket_BurstThenThrottle(t *testing.T) {
 }
 
 func TestTokenBucket_RefillMethod(t *testing.T) {
-	client, cleanup := setupMiniredis(t)
+	client, cleanup := setupRedis(t)
 	defer cleanup()
 
 	rtb := NewTokenBucket(Config{
@@ -334,7 +373,7 @@ func TestTokenBucket_RefillMethod(t *testing.T) {
 }
 
 func TestTokenBucket_RefillExceedsCapacity(t *testing.T) {
-	client, cleanup := setupMiniredis(t)
+	client, cleanup := setupRedis(t)
 	defer cleanup()
 
 	rtb := NewTokenBucket(Config{
@@ -365,7 +404,7 @@ func TestTokenBucket_RefillExceedsCapacity(t *testing.T) {
 }
 
 func TestTokenBucket_PartialConsumeAndRefill(t *testing.T) {
-	client, cleanup := setupMiniredis(t)
+	client, cleanup := setupRedis(t)
 	defer cleanup()
 
 	rtb := NewTokenBucket(Config{
@@ -403,7 +442,7 @@ func TestTokenBucket_PartialConsumeAndRefill(t *testing.T) {
 }
 
 func TestTokenBucket_Available(t *testing.T) {
-	client, cleanup := setupMiniredis(t)
+	client, cleanup := setupRedis(t)
 	defer cleanup()
 
 	rtb := NewTokenBucket(Config{
@@ -434,3 +473,1298 @@ func TestTokenBucket_Available(t *testing.T) {
 		t.Errorf("Expected ~3 available tokens after consuming 2, got %.2f", available)
 	}
 }
+
+func TestTokenBucket_AllowNFractionalCost(t *testing.T) {
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+
+	rtb := NewTokenBucket(Config{
+		Client:     client,
+		Capacity:   1,
+		RefillRate: 0.001, // Negligible natural refill
+	})
+
+	// A single token covers four 0.25-cost calls
+	for i := 0; i < 4; i++ {
+		allowed, err := rtb.AllowN("fractional", 0.25)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !allowed {
+			t.Errorf("Expected cheap request %d to be allowed", i+1)
+		}
+	}
+
+	// Fifth is denied
+	allowed, err := rtb.AllowN("fractional", 0.25)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if allowed {
+		t.Error("Expected 5th cheap request to be rejected")
+	}
+
+	available, err := rtb.Available("fractional")
+	if err != nil {
+		t.Fatalf("Available error: %v", err)
+	}
+	if available < 0 || available > 0.01 {
+		t.Errorf("Expected ~0 tokens after four 0.25 deductions, got %.4f", available)
+	}
+}
+
+func TestTokenBucket_AvailableFractional(t *testing.T) {
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+
+	rtb := NewTokenBucket(Config{
+		Client:     client,
+		Capacity:   2,
+		RefillRate: 0.001,
+	})
+
+	rtb.AllowN("frac-available", 0.5)
+	rtb.AllowN("frac-available", 0.75)
+
+	// Available must not truncate fractional balances to integers
+	available, err := rtb.Available("frac-available")
+	if err != nil {
+		t.Fatalf("Available error: %v", err)
+	}
+	if available < 0.74 || available > 0.76 {
+		t.Errorf("Expected ~0.75 available tokens, got %.4f", available)
+	}
+
+	if allowed, _ := rtb.Allow("frac-available"); allowed {
+		t.Error("Expected cost-1 request to be rejected with 0.75 tokens")
+	}
+}
+
+func TestTokenBucket_AllowNInvalidCost(t *testing.T) {
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+
+	rtb := NewTokenBucket(Config{Client: client, Capacity: 5, RefillRate: 1})
+
+	for _, n := range []float64{0, -1} {
+		if _, err := rtb.AllowN("invalid-cost", n); err != ratelimit.ErrInvalidCost {
+			t.Errorf("AllowN(%v): expected ErrInvalidCost, got %v", n, err)
+		}
+	}
+}
+
+func TestTokenBucket_RefillTx(t *testing.T) {
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+
+	rtb := NewTokenBucket(Config{
+		Client:     client,
+		Capacity:   2,
+		RefillRate: 0.001,
+	})
+
+	rtb.Allow("tx-key")
+	rtb.Allow("tx-key")
+
+	// Refill and record a trust entry in the same transaction
+	err := rtb.RefillTx("tx-key", 2, func(pipe goredis.Pipeliner) {
+		pipe.ZAdd(context.Background(), "trust:0xwallet", goredis.Z{Score: 1, Member: "payment-1"})
+	})
+	if err != nil {
+		t.Fatalf("RefillTx error: %v", err)
+	}
+
+	available, _ := rtb.Available("tx-key")
+	if available < 1.99 || available > 2.01 {
+		t.Errorf("Expected ~2 tokens after RefillTx, got %.2f", available)
+	}
+	if n := client.ZCard(context.Background(), "trust:0xwallet").Val(); n != 1 {
+		t.Errorf("Expected trust entry to be written in the same transaction, got %d", n)
+	}
+
+	// Nil extra commands behaves like Refill
+	if err := rtb.RefillTx("tx-key", 1, nil); err != nil {
+		t.Fatalf("RefillTx error: %v", err)
+	}
+	available, _ = rtb.Available("tx-key")
+	if available < 2.99 || available > 3.01 {
+		t.Errorf("Expected ~3 tokens after second RefillTx, got %.2f", available)
+	}
+}
+
+// recordTrust is the Redis write paired with a refill in the benchmarks below.
+func recordTrust(ctx context.Context, c goredis.Cmdable, i int) {
+	c.ZAdd(ctx, "trust:0xbench", goredis.Z{Score: float64(i), Member: i})
+}
+
+func BenchmarkRefill_SeparateTrustRecord(b *testing.B) {
+	mr := miniredis.RunT(b)
+	client := goredis.NewClient(&goredis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	rtb := NewTokenBucket(Config{Client: client, Capacity: 5, RefillRate: 1})
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := rtb.Refill("bench", 1); err != nil {
+			b.Fatal(err)
+		}
+		recordTrust(ctx, client, i)
+	}
+}
+
+func BenchmarkRefillTx_CombinedTrustRecord(b *testing.B) {
+	mr := miniredis.RunT(b)
+	client := goredis.NewClient(&goredis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	rtb := NewTokenBucket(Config{Client: client, Capacity: 5, RefillRate: 1})
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := rtb.RefillTx("bench", 1, func(pipe goredis.Pipeliner) {
+			recordTrust(ctx, pipe, i)
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestTokenBucket_DebtMode(t *testing.T) {
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+
+	rtb := NewTokenBucket(Config{
+		Client:     client,
+		Capacity:   2,
+		RefillRate: 10, // 10 tokens/sec
+		MinTokens:  -2,
+	})
+
+	// A cost-3 request overdraws the 2-token bucket into debt
+	allowed, err := rtb.AllowN("debt", 3)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !allowed {
+		t.Fatal("Expected overdraw into debt to be allowed")
+	}
+	available, _ := rtb.Available("debt")
+	if available < -1.05 || available > -0.95 {
+		t.Errorf("Expected ~-1 tokens in debt, got %.2f", available)
+	}
+
+	// In debt: throttled
+	if allowed, _ := rtb.Allow("debt"); allowed {
+		t.Error("Expected request to be throttled while in debt")
+	}
+
+	// Beyond the floor: rejected
+	if allowed, _ := rtb.AllowN("fresh", 5); allowed {
+		t.Error("Expected request that would exceed the debt floor to be rejected")
+	}
+
+	// ~150ms of refill brings the balance back above zero
+	time.Sleep(150 * time.Millisecond)
+	if allowed, _ := rtb.Allow("debt"); !allowed {
+		t.Error("Expected request to be allowed once balance climbed above zero")
+	}
+}
+
+func TestTokenBucket_Conformance(t *testing.T) {
+	t.Run("miniredis", func(t *testing.T) {
+		runConformance(t, setupMiniredis)
+	})
+	t.Run("redis", func(t *testing.T) {
+		addr := os.Getenv("REDIS_ADDR")
+		if addr == "" {
+			t.Skip("REDIS_ADDR not set")
+		}
+		runConformance(t, func(t *testing.T) (*goredis.Client, func()) {
+			return setupRealRedis(t, addr)
+		})
+	})
+}
+
+// runConformance runs the shared Limiter suite against a Redis from setup.
+func runConformance(t *testing.T, setup func(t *testing.T) (*goredis.Client, func())) {
+	ratelimittest.RunConformance(t, func(capacity, refillRate float64, clock ratelimit.Clock) ratelimit.Limiter {
+		client, cleanup := setup(t)
+		t.Cleanup(cleanup)
+		return NewTokenBucket(Config{
+			Client:     client,
+			Capacity:   capacity,
+			RefillRate: refillRate,
+			Clock:      clock,
+		})
+	})
+}
+
+func TestTokenBucket_ConnectionErrorIsBackendUnavailable(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Failed to start miniredis: %v", err)
+	}
+	client := goredis.NewClient(&goredis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	defer client.Close()
+
+	tb := NewTokenBucket(Config{Client: client, Capacity: 5, RefillRate: 1})
+	mr.Close() // Backend goes away
+
+	if _, err := tb.Allow("test-key"); !errors.Is(err, ratelimit.ErrBackendUnavailable) {
+		t.Errorf("Allow: expected ErrBackendUnavailable, got %v", err)
+	}
+	if err := tb.Refill("test-key", 1); !errors.Is(err, ratelimit.ErrBackendUnavailable) {
+		t.Errorf("Refill: expected ErrBackendUnavailable, got %v", err)
+	}
+	if _, err := tb.Available("test-key"); !errors.Is(err, ratelimit.ErrBackendUnavailable) {
+		t.Errorf("Available: expected ErrBackendUnavailable, got %v", err)
+	}
+}
+
+// freeAddr returns a local address nothing is listening on yet.
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to reserve a port: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestTokenBucket_ReadyAfterLateStart(t *testing.T) {
+	addr := freeAddr(t)
+	client := goredis.NewClient(&goredis.Options{Addr: addr, MaxRetries: -1})
+	defer client.Close()
+
+	tb := NewTokenBucket(Config{Client: client, Capacity: 5, RefillRate: 1})
+	if tb.Ready() {
+		t.Fatal("Expected not ready before Redis is up")
+	}
+
+	mr := miniredis.NewMiniRedis()
+	if err := mr.StartAddr(addr); err != nil {
+		t.Fatalf("Failed to start miniredis: %v", err)
+	}
+	if !tb.Ready() {
+		t.Fatal("Expected ready once Redis answers")
+	}
+
+	// Readiness is sticky; later outages are reported per call instead
+	mr.Close()
+	if !tb.Ready() {
+		t.Error("Expected Ready to stay true after the first success")
+	}
+}
+
+func TestTokenBucket_ScriptErrorIsNotBackendUnavailable(t *testing.T) {
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+
+	tb := NewTokenBucket(Config{Client: client, Capacity: 5, RefillRate: 1})
+
+	// A non-hash value under the key makes the script fail with WRONGTYPE
+	client.Set(context.Background(), tb.KeyPrefix()+"test-key", "oops", 0)
+	_, err := tb.Allow("test-key")
+	if err == nil {
+		t.Fatal("Expected script error")
+	}
+	if errors.Is(err, ratelimit.ErrBackendUnavailable) {
+		t.Errorf("Script error should not be classed as backend unavailable: %v", err)
+	}
+}
+
+func TestTokenBucket_EmptyKeyIsInvalid(t *testing.T) {
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+
+	tb := NewTokenBucket(Config{Client: client, Capacity: 5, RefillRate: 1})
+
+	if _, err := tb.Allow(""); !errors.Is(err, ratelimit.ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey, got %v", err)
+	}
+}
+
+func TestTokenBucket_Seed(t *testing.T) {
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+
+	tb := NewTokenBucket(Config{
+		Client:     client,
+		Capacity:   5,
+		RefillRate: 1,
+	})
+
+	err := tb.Seed(map[string]float64{
+		"vip":   50,  // Burst balance above capacity
+		"quiet": 1.5, // Partially drained
+	})
+	if err != nil {
+		t.Fatalf("Seed error: %v", err)
+	}
+
+	if avail, _ := tb.Available("vip"); avail < 49.99 {
+		t.Errorf("Expected seeded 50 tokens for vip, got %.2f", avail)
+	}
+	if avail, _ := tb.Available("quiet"); avail < 1.49 || avail > 1.6 {
+		t.Errorf("Expected seeded ~1.5 tokens for quiet, got %.2f", avail)
+	}
+	if avail, _ := tb.Available("other"); avail != 5 {
+		t.Errorf("Expected unseeded key at capacity 5, got %.2f", avail)
+	}
+
+	if err := tb.Seed(map[string]float64{"": 1}); !errors.Is(err, ratelimit.ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey for empty key, got %v", err)
+	}
+}
+
+func TestTokenBucket_AllowAt(t *testing.T) {
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+
+	tb := NewTokenBucket(Config{
+		Client:     client,
+		Capacity:   2,
+		RefillRate: 1, // 1 token/sec
+	})
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// Drain the bucket at t=0
+	for i := 0; i < 2; i++ {
+		if allowed, _ := tb.AllowAt("replay", start); !allowed {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+	}
+	if allowed, _ := tb.AllowAt("replay", start.Add(500*time.Millisecond)); allowed {
+		t.Error("Expected rejection before a full token accrued")
+	}
+
+	// One token has accrued by t=1s, without sleeping
+	if allowed, _ := tb.AllowAt("replay", start.Add(time.Second)); !allowed {
+		t.Error("Expected request at t=1s to be allowed")
+	}
+
+	// An out-of-order timestamp accrues nothing
+	if allowed, _ := tb.AllowAt("replay", start); allowed {
+		t.Error("Expected replayed earlier timestamp to be rejected")
+	}
+	if allowed, _ := tb.AllowAt("replay", start.Add(2*time.Second)); !allowed {
+		t.Error("Expected request at t=2s to be allowed")
+	}
+}
+
+func TestTokenBucket_BurstCapacity(t *testing.T) {
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+
+	clock := ratelimittest.NewFakeClock()
+	tb := NewTokenBucket(Config{
+		Client:        client,
+		Capacity:      3,
+		RefillRate:    1, // 1 token/sec
+		BurstCapacity: 6,
+		Clock:         clock,
+	})
+
+	// Natural refill never exceeds steady capacity
+	tb.AllowN("burst", 3)
+	clock.Advance(time.Hour)
+	if got, _ := tb.Available("burst"); got != 3 {
+		t.Errorf("Expected natural refill capped at capacity 3, got %.2f", got)
+	}
+
+	// Paid refill may go past capacity, but only up to the burst cap
+	if err := tb.Refill("burst", 10); err != nil {
+		t.Fatalf("Refill error: %v", err)
+	}
+	if got, _ := tb.Available("burst"); got != 6 {
+		t.Errorf("Expected paid refill capped at burst 6, got %.2f", got)
+	}
+
+	// RefillTx honours the same cap
+	if err := tb.RefillTx("burst", 10, nil); err != nil {
+		t.Fatalf("RefillTx error: %v", err)
+	}
+	if got, _ := tb.Available("burst"); got != 6 {
+		t.Errorf("Expected transactional refill capped at burst 6, got %.2f", got)
+	}
+
+	// A spike may spend the whole burst before throttling
+	for i := 0; i < 6; i++ {
+		if allowed, _ := tb.Allow("burst"); !allowed {
+			t.Fatalf("Expected burst request %d to be allowed", i+1)
+		}
+	}
+	if allowed, _ := tb.Allow("burst"); allowed {
+		t.Error("Expected request beyond burst to be rejected")
+	}
+}
+
+func TestTokenBucket_Drain(t *testing.T) {
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+
+	clock := ratelimittest.NewFakeClock()
+	tb := NewTokenBucket(Config{
+		Client:     client,
+		Capacity:   4,
+		RefillRate: 2, // 2 tokens/sec
+		Clock:      clock,
+	})
+	tb.Refill("drain", 4) // Burst tokens are drained too
+
+	if err := tb.Drain("drain"); err != nil {
+		t.Fatalf("Drain error: %v", err)
+	}
+	if exists, _ := client.Exists(context.Background(), "ratelimit:drain").Result(); exists != 1 {
+		t.Error("Expected drain to keep the bucket")
+	}
+	if allowed, _ := tb.Allow("drain"); allowed {
+		t.Error("Expected drained bucket to be rate limited immediately")
+	}
+
+	// Natural refill resumes from the drain
+	clock.Advance(time.Second)
+	if got, _ := tb.Available("drain"); got < 1.99 || got > 2.01 {
+		t.Errorf("Expected 2 tokens one second after drain, got %.2f", got)
+	}
+	if err := tb.Drain(""); err != ratelimit.ErrInvalidKey {
+		t.Errorf("Expected ErrInvalidKey for empty key, got %v", err)
+	}
+}
+
+func TestTokenBucket_Open(t *testing.T) {
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+
+	tb := NewTokenBucket(Config{Client: client, Capacity: 4, RefillRate: 0.001})
+
+	// A missing bucket is created empty
+	if created, err := tb.Open("open"); err != nil || !created {
+		t.Fatalf("Expected Open to create the bucket, got %v, %v", created, err)
+	}
+	if got, _ := tb.Available("open"); got > 0.01 {
+		t.Errorf("Expected an opened bucket to be empty, got %.2f", got)
+	}
+	if info, _ := tb.Info("open"); info.CreatedAt.IsZero() {
+		t.Error("Expected an opened bucket to report its creation time")
+	}
+
+	// Opening it again leaves what was refilled since
+	tb.Refill("open", 2)
+	if created, err := tb.Open("open"); err != nil || created {
+		t.Fatalf("Expected Open to leave an existing bucket, got %v, %v", created, err)
+	}
+	if got, _ := tb.Available("open"); got < 1.99 {
+		t.Errorf("Expected the refill kept, got %.2f", got)
+	}
+
+	// So does opening a bucket that was used but never opened
+	tb.Allow("used")
+	tb.Open("used")
+	if got, _ := tb.Available("used"); got < 2.99 {
+		t.Errorf("Expected a used bucket left as is, got %.2f", got)
+	}
+	if _, err := tb.Open(""); err != ratelimit.ErrInvalidKey {
+		t.Errorf("Expected ErrInvalidKey for empty key, got %v", err)
+	}
+}
+
+func TestTokenBucket_ServerTimeIgnoresAppSkew(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := goredis.NewClient(&goredis.Options{Addr: mr.Addr()})
+	defer client.Close()
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	mr.SetTime(start)
+
+	// Two app replicas whose clocks disagree by an hour
+	newReplica := func(skew time.Duration) *TokenBucket {
+		clock := ratelimittest.NewFakeClock()
+		clock.Advance(skew)
+		return NewTokenBucket(Config{
+			Client:     client,
+			Capacity:   4,
+			RefillRate: 1, // 1 token/sec
+			Clock:      clock,
+			ServerTime: true,
+		})
+	}
+	a := newReplica(0)
+	b := newReplica(time.Hour)
+
+	for i := 0; i < 4; i++ {
+		if allowed, _ := a.Allow("skew"); !allowed {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+	}
+
+	// Replica b would see a full bucket by its own clock; Redis's says empty
+	if got, _ := b.Available("skew"); got != 0 {
+		t.Errorf("Expected skewed replica to see 0 tokens, got %.2f", got)
+	}
+	if allowed, _ := b.Allow("skew"); allowed {
+		t.Error("Expected skewed replica to be rate limited")
+	}
+
+	mr.SetTime(start.Add(2 * time.Second))
+	gotA, _ := a.Available("skew")
+	gotB, _ := b.Available("skew")
+	if gotA != gotB || gotA < 1.99 || gotA > 2.01 {
+		t.Errorf("Expected both replicas to see 2 tokens, got %.2f and %.2f", gotA, gotB)
+	}
+
+	// Writes made outside the scripts use Redis's clock too
+	if err := b.Drain("skew"); err != nil {
+		t.Fatalf("Drain error: %v", err)
+	}
+	mr.SetTime(start.Add(3 * time.Second))
+	if got, _ := a.Available("skew"); got < 0.99 || got > 1.01 {
+		t.Errorf("Expected 1 token a second after drain, got %.2f", got)
+	}
+
+	// Reset times are reckoned from Redis's clock as well
+	_, reset, err := b.AllowWithReset("skew")
+	if err != nil {
+		t.Fatalf("AllowWithReset error: %v", err)
+	}
+	if want := start.Add(4 * time.Second); reset.Sub(want).Abs() > time.Millisecond {
+		t.Errorf("Expected the skewed replica's reset at %v by Redis's clock, got %v", want, reset)
+	}
+}
+
+func TestTokenBucket_RefillSchedule(t *testing.T) {
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+
+	// Start just before a 09:00-17:00 window that triples the rate
+	clock := ratelimittest.NewFakeClockAt(time.Date(2024, 1, 8, 8, 59, 0, 0, time.UTC))
+	tb := NewTokenBucket(Config{
+		Client:     client,
+		Capacity:   100,
+		RefillRate: 1, // 1 token/sec
+		RefillSchedule: ratelimit.RefillSchedule{
+			{Start: 9 * time.Hour, End: 17 * time.Hour, Multiplier: 3},
+		},
+		Clock: clock,
+	})
+
+	tb.Drain("sched")
+	clock.Advance(10 * time.Second) // 08:59:10
+	if got, _ := tb.Available("sched"); math.Abs(got-10) > 1e-6 {
+		t.Errorf("Expected 10 tokens at the base rate, got %.2f", got)
+	}
+
+	// The multiplier in force is passed to the script
+	clock.Advance(time.Minute) // 09:00:10
+	tb.Drain("sched")
+	clock.Advance(10 * time.Second)
+	if got, _ := tb.Available("sched"); math.Abs(got-30) > 1e-6 {
+		t.Errorf("Expected 30 tokens at 3x inside the window, got %.2f", got)
+	}
+	for i := 0; i < 30; i++ {
+		if allowed, _ := tb.Allow("sched"); !allowed {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+	}
+	if allowed, _ := tb.Allow("sched"); allowed {
+		t.Error("Expected request beyond the scheduled refill to be rejected")
+	}
+}
+
+func TestTokenBucket_AllowNWithOverflow(t *testing.T) {
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+
+	clock := ratelimittest.NewFakeClock()
+	tb := NewTokenBucket(Config{
+		Client:     client,
+		Capacity:   5,
+		RefillRate: 1, // 1 token/sec
+		Clock:      clock,
+	})
+
+	// A paid refill takes the bucket past capacity to 15
+	if err := tb.Refill("overflow", 10); err != nil {
+		t.Fatalf("Refill error: %v", err)
+	}
+
+	// Weighted requests spend the overflow, n tokens at a time
+	if allowed, _ := tb.AllowN("overflow", 4); !allowed {
+		t.Fatal("Expected AllowN(4) to spend overflow tokens")
+	}
+	if got, _ := tb.Available("overflow"); math.Abs(got-11) > 1e-6 {
+		t.Errorf("Expected 11 tokens after AllowN(4), got %.2f", got)
+	}
+
+	// Above capacity, natural refill is off: time passing adds nothing
+	clock.Advance(10 * time.Second)
+	if allowed, _ := tb.AllowN("overflow", 0.5); !allowed {
+		t.Fatal("Expected AllowN(0.5) to be allowed")
+	}
+	if got, _ := tb.Available("overflow"); math.Abs(got-10.5) > 1e-6 {
+		t.Errorf("Expected natural refill to stay off above capacity (10.5), got %.2f", got)
+	}
+
+	// A cost above the balance is refused without touching the overflow
+	if allowed, _ := tb.AllowN("overflow", 11); allowed {
+		t.Error("Expected AllowN(11) to be refused with 10.5 tokens")
+	}
+	if allowed, _ := tb.AllowN("overflow", 10.5); !allowed {
+		t.Error("Expected AllowN(10.5) to spend exactly the remaining balance")
+	}
+
+	// Back under capacity, natural refill resumes
+	clock.Advance(2 * time.Second)
+	if got, _ := tb.Available("overflow"); math.Abs(got-2) > 1e-6 {
+		t.Errorf("Expected natural refill below capacity (2), got %.2f", got)
+	}
+}
+
+func TestTokenBucket_Namespaces(t *testing.T) {
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+
+	base := NewTokenBucket(Config{Client: client, Capacity: 2, RefillRate: 0.001})
+	tenantA := base.Scoped("tenant-a")
+	tenantB := NewTokenBucket(Config{Client: client, Capacity: 2, RefillRate: 0.001, Namespace: "tenant-b"})
+
+	if got := tenantA.KeyPrefix(); got != "ratelimit:tenant-a:" {
+		t.Errorf("Expected namespaced prefix ratelimit:tenant-a:, got %q", got)
+	}
+
+	// Exhausting a key in one namespace leaves the same key elsewhere untouched
+	tenantA.AllowN("shared-key", 2)
+	if allowed, _ := tenantA.Allow("shared-key"); allowed {
+		t.Error("Expected tenant A's key to be exhausted")
+	}
+	for name, tb := range map[string]*TokenBucket{"tenant B": tenantB, "unscoped": base} {
+		if got, _ := tb.Available("shared-key"); math.Abs(got-2) > 0.01 {
+			t.Errorf("Expected %s's shared-key to be full, got %.2f", name, got)
+		}
+	}
+
+	// Resets are scoped too
+	tenantB.Allow("shared-key")
+	if err := tenantA.Reset("shared-key"); err != nil {
+		t.Fatalf("Reset error: %v", err)
+	}
+	if got, _ := tenantB.Available("shared-key"); math.Abs(got-1) > 0.01 {
+		t.Errorf("Expected tenant A's reset to leave tenant B at 1 token, got %.2f", got)
+	}
+
+	// Re-scoping replaces the namespace rather than nesting it
+	if got := tenantB.Scoped("tenant-a").KeyPrefix(); got != "ratelimit:tenant-a:" {
+		t.Errorf("Expected Scoped to replace the namespace, got %q", got)
+	}
+}
+
+func TestTokenBucket_Info(t *testing.T) {
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+
+	clock := ratelimittest.NewFakeClock()
+	tb := NewTokenBucket(Config{
+		Client:     client,
+		Capacity:   2,
+		RefillRate: 1, // 1 token/sec
+		Clock:      clock,
+	})
+
+	// An untouched key reports a full bucket and nothing else
+	info, err := tb.Info("inspect")
+	if err != nil {
+		t.Fatalf("Info failed: %v", err)
+	}
+	if info.Tokens != 2 || !info.CreatedAt.IsZero() || info.Allowed != 0 || info.Denied != 0 {
+		t.Errorf("Expected an empty full bucket, got %+v", info)
+	}
+
+	created := clock.Now()
+	tb.Allow("inspect")
+	tb.Allow("inspect")
+	clock.Advance(500 * time.Millisecond)
+	tb.Allow("inspect") // Denied: half a token has accrued
+
+	info, err = tb.Info("inspect")
+	if err != nil {
+		t.Fatalf("Info failed: %v", err)
+	}
+	if info.Allowed != 2 || info.Denied != 1 {
+		t.Errorf("Expected 2 allowed and 1 denied, got %d and %d", info.Allowed, info.Denied)
+	}
+	if math.Abs(info.Tokens-0.5) > 1e-6 {
+		t.Errorf("Expected 0.5 tokens, got %.4f", info.Tokens)
+	}
+	if !info.CreatedAt.Equal(created) {
+		t.Errorf("Expected created at %v, got %v", created, info.CreatedAt)
+	}
+	if !info.LastRefill.Equal(clock.Now()) {
+		t.Errorf("Expected last refill at %v, got %v", clock.Now(), info.LastRefill)
+	}
+
+	// Later activity moves the last refill but not the creation time
+	clock.Advance(2 * time.Second)
+	if err := tb.Refill("inspect", 1); err != nil {
+		t.Fatalf("Refill failed: %v", err)
+	}
+	info, _ = tb.Info("inspect")
+	if !info.LastRefill.Equal(clock.Now()) {
+		t.Errorf("Expected last refill to follow the refill, got %v", info.LastRefill)
+	}
+	if !info.CreatedAt.Equal(created) {
+		t.Errorf("Expected creation time to stay %v, got %v", created, info.CreatedAt)
+	}
+}
+
+func TestTokenBucket_CapacityChange(t *testing.T) {
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+
+	clock := ratelimittest.NewFakeClock()
+	bucket := func(capacity float64) *TokenBucket {
+		return NewTokenBucket(Config{Client: client, Capacity: capacity, RefillRate: 1, Clock: clock})
+	}
+
+	t.Run("decrease clamps on next touch", func(t *testing.T) {
+		if allowed, _ := bucket(10).Allow("shrink"); !allowed {
+			t.Fatal("Expected first request to be allowed")
+		}
+
+		// Redeployed with a smaller capacity: the 9 stored tokens don't
+		// count as paid overflow
+		small := bucket(4)
+		if got, _ := small.Available("shrink"); got != 4 {
+			t.Errorf("Expected balance clamped to 4, got %.2f", got)
+		}
+		for i := 0; i < 4; i++ {
+			if allowed, _ := small.Allow("shrink"); !allowed {
+				t.Fatalf("Request %d: expected allowed", i+1)
+			}
+		}
+		if allowed, _ := small.Allow("shrink"); allowed {
+			t.Error("Expected rejection after 4 requests at the new capacity")
+		}
+	})
+
+	t.Run("decrease keeps paid overflow", func(t *testing.T) {
+		large := bucket(10)
+		if err := large.Refill("paid", 3); err != nil { // 13 tokens, 3 of them paid
+			t.Fatalf("Refill failed: %v", err)
+		}
+		if got, _ := bucket(4).Available("paid"); got != 7 {
+			t.Errorf("Expected new capacity plus 3 paid tokens (7), got %.2f", got)
+		}
+	})
+
+	t.Run("increase adds headroom", func(t *testing.T) {
+		small := bucket(4)
+		for i := 0; i < 4; i++ {
+			small.Allow("grow")
+		}
+
+		large := bucket(10)
+		clock.Advance(6 * time.Second)
+		if got, _ := large.Available("grow"); math.Abs(got-6) > 1e-6 {
+			t.Errorf("Expected 6 tokens refilled toward the new capacity, got %.2f", got)
+		}
+		clock.Advance(time.Minute)
+		if got, _ := large.Available("grow"); got != 10 {
+			t.Errorf("Expected refill to stop at the new capacity of 10, got %.2f", got)
+		}
+	})
+}
+
+func TestTokenBucket_RefillLogSampling(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Failed to start miniredis: %v", err)
+	}
+	client := goredis.NewClient(&goredis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	defer client.Close()
+
+	var mu sync.Mutex
+	var lines []string
+	clock := ratelimittest.NewFakeClock()
+	tb := NewTokenBucket(Config{
+		Client:             client,
+		Capacity:           10,
+		RefillRate:         1,
+		Clock:              clock,
+		RefillLogEvery:     10,
+		RefillLogPerSecond: 5,
+		Logf: func(format string, args ...interface{}) {
+			mu.Lock()
+			defer mu.Unlock()
+			lines = append(lines, fmt.Sprintf(format, args...))
+		},
+	})
+
+	// 1000 refills in one second: 1 in 10 sampled, capped at 5 lines
+	for i := 0; i < 1000; i++ {
+		if err := tb.Refill("paid", 1); err != nil {
+			t.Fatalf("Refill %d failed: %v", i+1, err)
+		}
+	}
+	if len(lines) != 5 {
+		t.Errorf("Expected 5 refill lines, got %d", len(lines))
+	}
+
+	// The next window's first line reports what was skipped
+	clock.Advance(time.Second)
+	for i := 0; i < 10; i++ {
+		tb.Refill("paid", 1)
+	}
+	if last := lines[len(lines)-1]; !strings.Contains(last, "(959 refills not logged)") {
+		t.Errorf("Expected the skipped count in %q", last)
+	}
+
+	// Failures are never sampled away
+	mr.Close()
+	before := len(lines)
+	for i := 0; i < 3; i++ {
+		if err := tb.Refill("paid", 1); err == nil {
+			t.Fatal("Expected refill to fail with Redis down")
+		}
+	}
+	if failures := len(lines) - before; failures != 3 {
+		t.Errorf("Expected every failed refill to be logged, got %d of 3", failures)
+	}
+}
+
+func TestTokenBucket_RefillMulti(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+
+	clock := ratelimittest.NewFakeClock()
+	tb := NewTokenBucket(Config{Client: client, Capacity: 2, RefillRate: 1, Clock: clock})
+	tb.Drain("ip:192.0.2.1")
+
+	if err := tb.RefillMulti(map[string]float64{"ip:192.0.2.1": 2, "wallet:0xabc": 3}); err != nil {
+		t.Fatalf("RefillMulti failed: %v", err)
+	}
+	if got, _ := tb.Available("ip:192.0.2.1"); got != 2 {
+		t.Errorf("Expected the drained IP bucket credited to 2, got %.2f", got)
+	}
+	if got, _ := tb.Available("wallet:0xabc"); got != 5 {
+		t.Errorf("Expected the new wallet bucket at capacity plus 3, got %.2f", got)
+	}
+}
+
+func TestTokenBucket_RefillMultiIsAllOrNothing(t *testing.T) {
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+
+	clock := ratelimittest.NewFakeClock()
+	tb := NewTokenBucket(Config{Client: client, Capacity: 2, RefillRate: 1, Clock: clock})
+	tb.Drain("ip:192.0.2.1")
+
+	// A key clobbered by something other than a bucket fails the refill
+	if err := client.Set(context.Background(), tb.KeyPrefix()+"wallet:0xabc", "oops", 0).Err(); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	err := tb.RefillMulti(map[string]float64{"ip:192.0.2.1": 2, "wallet:0xabc": 3})
+	if err == nil {
+		t.Fatal("Expected RefillMulti to fail on a non-bucket key")
+	}
+	if errors.Is(err, ratelimit.ErrBackendUnavailable) {
+		t.Errorf("Expected a script error, not ErrBackendUnavailable: %v", err)
+	}
+	if got, _ := tb.Available("ip:192.0.2.1"); got != 0 {
+		t.Errorf("Expected the IP bucket left uncredited, got %.2f", got)
+	}
+
+	// So does an invalid key, before anything reaches Redis
+	if err := tb.RefillMulti(map[string]float64{"ip:192.0.2.1": 2, "": 3}); !errors.Is(err, ratelimit.ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey, got %v", err)
+	}
+	if got, _ := tb.Available("ip:192.0.2.1"); got != 0 {
+		t.Errorf("Expected the IP bucket left uncredited, got %.2f", got)
+	}
+}
+
+func TestTokenBucket_Snapshot(t *testing.T) {
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+
+	clock := ratelimittest.NewFakeClock()
+	tb := NewTokenBucket(Config{Client: client, Capacity: 5, RefillRate: 1, Clock: clock})
+	for i := 0; i < 5; i++ {
+		tb.AllowN(fmt.Sprintf("key%d", i), float64(i+1))
+	}
+	clock.Advance(time.Second)
+
+	// Not buckets: a different prefix, and a non-hash under ours
+	client.HSet(context.Background(), "other:key0", "tokens", 1)
+	client.Set(context.Background(), tb.KeyPrefix()+"marker", "x", 0)
+
+	got := make(map[string]float64)
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 20 {
+			t.Fatal("Snapshot cursor never finished")
+		}
+		page, next, err := tb.Snapshot(cursor, 2)
+		if err != nil {
+			t.Fatalf("Snapshot failed: %v", err)
+		}
+		for _, kt := range page {
+			got[kt.Key] = kt.Tokens
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	if len(got) != 5 {
+		t.Fatalf("Expected the 5 buckets, got %v", got)
+	}
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("key%d", i)
+		want := math.Min(5, float64(5-(i+1)+1))
+		if math.Abs(got[key]-want) > 0.01 {
+			t.Errorf("Expected %s at %.2f with refill projected, got %.4f", key, want, got[key])
+		}
+	}
+
+	// Listing doesn't write: the stored balance is still pre-refill
+	if stored, _ := client.HGet(context.Background(), tb.KeyPrefix()+"key4", "tokens").Float64(); stored != 0 {
+		t.Errorf("Snapshot should not modify buckets, stored tokens now %.2f", stored)
+	}
+
+	if _, _, err := tb.Snapshot("not-a-cursor", 10); err == nil {
+		t.Error("Expected an invalid cursor to fail")
+	}
+}
+
+func TestTokenBucket_HashKeys(t *testing.T) {
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+
+	const secret = "apikey:sk-live-123"
+	sum := sha256.Sum256([]byte(secret))
+	hashed := "ratelimit:tenant:" + hex.EncodeToString(sum[:])
+
+	tb := NewTokenBucket(Config{Client: client, Capacity: 3, RefillRate: 0.001, Namespace: "tenant", HashKeys: true})
+	if allowed, err := tb.AllowN(secret, 2); err != nil || !allowed {
+		t.Fatalf("Expected the first request allowed, got %v, %v", allowed, err)
+	}
+
+	// The bucket lives under the digest, never the raw key
+	ctx := context.Background()
+	if n, _ := client.Exists(ctx, hashed).Result(); n != 1 {
+		t.Errorf("Expected the bucket stored at %s", hashed)
+	}
+	keys, _ := client.Keys(ctx, "*").Result()
+	for _, key := range keys {
+		if strings.Contains(key, secret) {
+			t.Errorf("Raw key leaked into Redis as %s", key)
+		}
+	}
+
+	// A second limiter, and a scoped copy, map the key to the same bucket
+	again := NewTokenBucket(Config{Client: client, Capacity: 3, RefillRate: 0.001, HashKeys: true}).Scoped("tenant")
+	if got, _ := again.Available(secret); math.Abs(got-1) > 0.01 {
+		t.Errorf("Expected 1 token through another limiter, got %.2f", got)
+	}
+
+	// Refill, Available and Allow stay consistent under hashing
+	if err := tb.Refill(secret, 4); err != nil {
+		t.Fatalf("Refill failed: %v", err)
+	}
+	if got, _ := tb.Available(secret); math.Abs(got-5) > 0.01 {
+		t.Errorf("Expected 5 tokens after refilling 4, got %.2f", got)
+	}
+	if allowed, _ := tb.AllowN(secret, 5); !allowed {
+		t.Error("Expected the refilled tokens spendable")
+	}
+	if allowed, _ := tb.Allow(secret); allowed {
+		t.Error("Expected the bucket exhausted")
+	}
+
+	// Snapshot reports digests, with their balances
+	page, _, err := tb.Snapshot("", 10)
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if len(page) != 1 || page[0].Key != hex.EncodeToString(sum[:]) || math.Abs(page[0].Tokens) > 0.01 {
+		t.Errorf("Expected the digest listed at 0 tokens, got %+v", page)
+	}
+
+	if err := tb.Reset(secret); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	if n, _ := client.Exists(ctx, hashed).Result(); n != 0 {
+		t.Error("Expected Reset to delete the hashed bucket")
+	}
+}
+
+func TestTokenBucket_AllowWithReset(t *testing.T) {
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+
+	clock := ratelimittest.NewFakeClock()
+	tb := NewTokenBucket(Config{Client: client, Capacity: 2, RefillRate: 2, Clock: clock})
+
+	// One token left: reset is when the bucket is full again
+	allowed, resetAt, err := tb.AllowWithReset("k")
+	if err != nil || !allowed {
+		t.Fatalf("Expected the first request allowed, got %v, %v", allowed, err)
+	}
+	if got := resetAt.Sub(clock.Now()); math.Abs(got.Seconds()-0.5) > 0.001 {
+		t.Errorf("Expected reset 500ms out at full capacity, got %v", got)
+	}
+
+	// Just below one token: reset is when the next whole token accrues
+	tb.Allow("k")
+	clock.Advance(400 * time.Millisecond) // 0.8 tokens
+	allowed, resetAt, _ = tb.AllowWithReset("k")
+	if allowed {
+		t.Fatal("Expected a request on 0.8 tokens denied")
+	}
+	if got := resetAt.Sub(clock.Now()); math.Abs(got.Seconds()-0.1) > 0.001 {
+		t.Errorf("Expected reset (1-0.8)/2 = 100ms out, got %v", got)
+	}
+}
+
+func TestNewTokenBucket_InvalidSettings(t *testing.T) {
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+
+	for _, settings := range [][2]float64{{0.5, 1}, {4, 0}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("NewTokenBucket with capacity %g, refill rate %g: expected a panic", settings[0], settings[1])
+				}
+			}()
+			NewTokenBucket(Config{Client: client, Capacity: settings[0], RefillRate: settings[1]})
+		}()
+	}
+}
+
+func TestTokenBucket_GraceOverage(t *testing.T) {
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+
+	tb := NewTokenBucket(Config{Client: client, Capacity: 2, RefillRate: 1, GraceOverage: 2, Clock: ratelimittest.NewFakeClock()})
+
+	// Two requests on tokens, two more on grace, even though in debt
+	for i := 0; i < 4; i++ {
+		if allowed, _ := tb.Allow("grace"); !allowed {
+			t.Fatalf("Expected request %d allowed", i+1)
+		}
+	}
+	if avail, _ := tb.Available("grace"); avail < -2.01 || avail > -1.99 {
+		t.Errorf("Expected grace to leave -2 tokens, got %.2f", avail)
+	}
+	if allowed, _ := tb.Allow("grace"); allowed {
+		t.Error("Expected a request past the grace to be denied")
+	}
+
+	// Natural refill repays the debt before grace is available again
+	ratelimittest.AdvanceTime(t, tb, 1100*time.Millisecond)
+	if allowed, _ := tb.Allow("grace"); !allowed {
+		t.Error("Expected a request once refill repaid part of the debt")
+	}
+	if allowed, _ := tb.Allow("grace"); allowed {
+		t.Error("Expected the repaid grace to be spent")
+	}
+}
+
+func TestTokenBucket_BurstTTL(t *testing.T) {
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+
+	tb := NewTokenBucket(Config{Client: client, Capacity: 4, RefillRate: 1, BurstTTL: time.Hour, Clock: ratelimittest.NewFakeClock()})
+	expect := func(want float64, context string) {
+		t.Helper()
+		if avail, _ := tb.Available("burst"); avail < want-0.01 || avail > want+0.01 {
+			t.Errorf("%s: expected %.2f tokens, got %.2f", context, want, avail)
+		}
+	}
+
+	tb.Refill("burst", 6) // 10 tokens: 6 above capacity
+	ratelimittest.AdvanceTime(t, tb, 59*time.Minute)
+	expect(10, "before the TTL")
+
+	// A later purchase restarts the window
+	tb.Refill("burst", 1)
+	ratelimittest.AdvanceTime(t, tb, 30*time.Minute)
+	expect(11, "after a new refill")
+
+	// Unspent overflow decays back to capacity after the TTL
+	ratelimittest.AdvanceTime(t, tb, 30*time.Minute)
+	expect(4, "after the TTL")
+	if allowed, _ := tb.AllowN("burst", 4); !allowed {
+		t.Error("Expected in-capacity tokens to be unaffected by the TTL")
+	}
+	if allowed, _ := tb.Allow("burst"); allowed {
+		t.Error("Expected the expired overflow to be gone")
+	}
+
+	// A refill after expiry starts a fresh burst rather than reviving the old one
+	tb.Refill("burst", 5)
+	expect(5, "after refilling an expired burst")
+	ratelimittest.AdvanceTime(t, tb, time.Hour)
+	expect(4, "after the new burst's TTL")
+}
+
+func TestTokenBucket_BurstTTLOutlivesKeyExpiry(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := goredis.NewClient(&goredis.Options{Addr: mr.Addr()})
+	defer client.Close()
+
+	// An untouched bucket refills in 4s, so its key would expire long
+	// before the overflow
+	tb := NewTokenBucket(Config{Client: client, Capacity: 4, RefillRate: 1, BurstTTL: time.Hour, Clock: ratelimittest.NewFakeClock()})
+	advance := func(d time.Duration) {
+		ratelimittest.AdvanceTime(t, tb, d)
+		mr.FastForward(d)
+	}
+	expect := func(want float64, context string) {
+		t.Helper()
+		if avail, _ := tb.Available("burst"); avail < want-0.01 || avail > want+0.01 {
+			t.Errorf("%s: expected %.2f tokens, got %.2f", context, want, avail)
+		}
+	}
+
+	tb.Refill("burst", 6) // 10 tokens: 6 above capacity
+	tb.Allow("burst")     // Spending some mustn't shorten the key's life
+	advance(time.Hour - time.Second)
+	if !mr.Exists("ratelimit:burst") {
+		t.Fatal("Expected the key to be kept while it holds overflow")
+	}
+	expect(9, "just before the burst TTL")
+
+	advance(2 * time.Second)
+	expect(4, "just after the burst TTL")
+	if mr.Exists("ratelimit:burst") {
+		t.Error("Expected the key to expire once its overflow did")
+	}
+
+	// Seeded overflow never expires, so the key is kept until it's spent
+	tb.Seed(map[string]float64{"burst": 6})
+	advance(24 * time.Hour)
+	expect(6, "a day after seeding")
+}
+
+func TestTokenBucket_Refund(t *testing.T) {
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+
+	tb := NewTokenBucket(Config{Client: client, Capacity: 10, RefillRate: 1, Clock: ratelimittest.NewFakeClock()})
+
+	r, err := ratelimit.ReserveN(tb, "refund", 5)
+	if err != nil || !r.OK() {
+		t.Fatalf("Expected 5 tokens reserved, got ok=%v err=%v", r != nil && r.OK(), err)
+	}
+	if err := r.CommitUsed(3); err != nil {
+		t.Fatalf("CommitUsed error: %v", err)
+	}
+	if avail, _ := tb.Available("refund"); avail < 6.99 || avail > 7.01 {
+		t.Errorf("Expected 2 of 5 refunded, leaving 7, got %.2f", avail)
+	}
+
+	// A refund can't raise the balance past capacity, but keeps paid overflow
+	if err := tb.Refund("refund", 5); err != nil {
+		t.Fatalf("Refund error: %v", err)
+	}
+	if avail, _ := tb.Available("refund"); avail < 9.99 || avail > 10.01 {
+		t.Errorf("Expected the refund capped at 10, got %.2f", avail)
+	}
+	tb.Refill("refund", 2)
+	tb.Refund("refund", 1)
+	if avail, _ := tb.Available("refund"); avail < 11.99 || avail > 12.01 {
+		t.Errorf("Expected paid overflow of 12 kept, got %.2f", avail)
+	}
+}
+
+func TestTokenBucket_RefillModes(t *testing.T) {
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+
+	tests := []struct {
+		mode ratelimit.RefillMode
+		want float64
+	}{
+		{ratelimit.RefillStack, 5},    // 2 settled + 3 paid
+		{ratelimit.RefillSetFloor, 4}, // Raised to capacity
+		{ratelimit.RefillExact, 3},    // Set to the amount paid
+		{ratelimit.RefillAtLeast, 3},  // Raised to the amount paid
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode.String(), func(t *testing.T) {
+			clock := ratelimittest.NewFakeClock()
+			tb := NewTokenBucket(Config{Client: client, Capacity: 4, RefillRate: 1, RefillMode: tt.mode, Clock: clock})
+			refills := map[string]func(key string) error{
+				"Refill":      func(key string) error { return tb.Refill(key, 3) },
+				"RefillTx":    func(key string) error { return tb.RefillTx(key, 3, nil) },
+				"RefillMulti": func(key string) error { return tb.RefillMulti(map[string]float64{key: 3}) },
+			}
+			for name, refill := range refills {
+				key := tt.mode.String() + ":" + name
+				tb.AllowN(key, 3)
+				clock.Advance(time.Second) // Accrues a token, settled before the refill
+				if err := refill(key); err != nil {
+					t.Fatalf("%s error: %v", name, err)
+				}
+				if got, _ := tb.Available(key); math.Abs(got-tt.want) > 0.01 {
+					t.Errorf("Expected %s to leave %.2f tokens, got %.2f", name, tt.want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestTokenBucket_RefillTo(t *testing.T) {
+	client, cleanup := setupRedis(t)
+	defer cleanup()
+
+	tb := NewTokenBucket(Config{Client: client, Capacity: 4, RefillRate: 0.001, BurstCapacity: 10})
+	key := "refill-to"
+
+	// Tops a low balance up to the target, past capacity if need be
+	tb.AllowN(key, 3)
+	if err := tb.RefillTo(key, 6); err != nil {
+		t.Fatalf("RefillTo error: %v", err)
+	}
+	if got, _ := tb.Available(key); math.Abs(got-6) > 0.01 {
+		t.Errorf("Expected 6 tokens, got %.2f", got)
+	}
+
+	// Repeating it credits nothing more
+	for i := 0; i < 3; i++ {
+		tb.RefillTo(key, 6)
+	}
+	if got, _ := tb.Available(key); math.Abs(got-6) > 0.01 {
+		t.Errorf("Expected repeated RefillTo to leave 6 tokens, got %.2f", got)
+	}
+
+	// A lower target never reduces the balance
+	tb.RefillTo(key, 2)
+	if got, _ := tb.Available(key); math.Abs(got-6) > 0.01 {
+		t.Errorf("Expected a lower target to keep 6 tokens, got %.2f", got)
+	}
+
+	// The burst cap still applies, and other keys are untouched
+	tb.RefillTo(key, 20)
+	if got, _ := tb.Available(key); math.Abs(got-10) > 0.01 {
+		t.Errorf("Expected the target to be capped at burst capacity 10, got %.2f", got)
+	}
+	if got, _ := tb.Available("other"); got != 4 {
+		t.Errorf("Expected another key to stay at capacity, got %.2f", got)
+	}
+}
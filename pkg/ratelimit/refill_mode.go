@@ -0,0 +1,63 @@
+package ratelimit
+
+import "fmt"
+
+// RefillMode chooses what Refill does with paid tokens. Natural refill is
+// settled first in every mode, and a burst cap still applies after it.
+type RefillMode int
+
+const (
+	// RefillStack adds the tokens to the current balance (the default).
+	RefillStack RefillMode = iota
+	// RefillSetFloor raises the balance to at least capacity, keeping a
+	// larger one. The tokens passed are ignored.
+	RefillSetFloor
+	// RefillExact sets the balance to the tokens passed, even if lower.
+	RefillExact
+	// RefillAtLeast raises the balance to the tokens passed, keeping a
+	// larger one, so repeating a refill credits nothing more.
+	RefillAtLeast
+)
+
+// ParseRefillMode parses "stack", "set_floor", "exact" or "at_least"; "" is
+// RefillStack.
+func ParseRefillMode(s string) (RefillMode, error) {
+	switch s {
+	case "", "stack":
+		return RefillStack, nil
+	case "set_floor":
+		return RefillSetFloor, nil
+	case "exact":
+		return RefillExact, nil
+	case "at_least":
+		return RefillAtLeast, nil
+	}
+	return RefillStack, fmt.Errorf("unknown refill mode %q", s)
+}
+
+// String returns the mode's name as ParseRefillMode accepts it.
+func (m RefillMode) String() string {
+	switch m {
+	case RefillSetFloor:
+		return "set_floor"
+	case RefillExact:
+		return "exact"
+	case RefillAtLeast:
+		return "at_least"
+	}
+	return "stack"
+}
+
+// Apply returns the balance after refilling a bucket holding balance
+// tokens, before any burst cap.
+func (m RefillMode) Apply(balance, tokens, capacity float64) float64 {
+	switch m {
+	case RefillSetFloor:
+		return max(balance, capacity)
+	case RefillExact:
+		return tokens
+	case RefillAtLeast:
+		return max(balance, tokens)
+	}
+	return balance + tokens
+}
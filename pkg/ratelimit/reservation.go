@@ -0,0 +1,69 @@
+package ratelimit
+
+import "sync"
+
+// Reservation holds tokens taken up front for a request whose real cost is
+// only known once it has run, such as an API call made of sub-operations.
+// Reserve a high estimate with ReserveN, then CommitUsed what was spent.
+type Reservation struct {
+	limiter Limiter
+	key     string
+	tokens  float64
+	ok      bool
+
+	mu   sync.Mutex
+	done bool
+}
+
+// ReserveN takes n tokens from key's bucket as l.AllowN would. If they
+// aren't available the reservation isn't OK and holds nothing. Returns
+// ErrInvalidCost if n is not positive.
+func ReserveN(l Limiter, key string, n float64) (*Reservation, error) {
+	allowed, err := l.AllowN(key, n)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reservation{limiter: l, key: key, ok: allowed}
+	if allowed {
+		r.tokens = n
+	}
+	return r, nil
+}
+
+// OK reports whether the tokens were reserved.
+func (r *Reservation) OK() bool {
+	return r.ok
+}
+
+// Tokens returns the tokens reserved, or 0 if the reservation isn't OK.
+func (r *Reservation) Tokens() float64 {
+	return r.tokens
+}
+
+// CommitUsed keeps used of the reserved tokens and refunds the rest; used is
+// clamped to the reservation. Limiters implementing Refunder take the refund
+// back no higher than capacity; others get it through Refill, as if paid.
+// Only the first CommitUsed or Cancel has any effect.
+func (r *Reservation) CommitUsed(used float64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.done || !r.ok {
+		return nil
+	}
+	r.done = true
+
+	refund := r.tokens - min(max(used, 0), r.tokens)
+	if refund <= 0 {
+		return nil
+	}
+	if refunder, ok := r.limiter.(Refunder); ok {
+		return refunder.Refund(r.key, refund)
+	}
+	return r.limiter.Refill(r.key, refund)
+}
+
+// Cancel refunds the whole reservation, as CommitUsed(0).
+func (r *Reservation) Cancel() error {
+	return r.CommitUsed(0)
+}
@@ -0,0 +1,98 @@
+package ratelimit_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/bucket"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/memory"
+)
+
+// plainLimiter hides any optional interfaces, such as Refunder.
+type plainLimiter struct{ ratelimit.Limiter }
+
+func expectTokens(t *testing.T, l ratelimit.Limiter, key string, want float64, context string) {
+	t.Helper()
+	got, err := l.Available(key)
+	if err != nil {
+		t.Fatalf("%s: Available error: %v", context, err)
+	}
+	if math.Abs(got-want) > 0.01 {
+		t.Errorf("%s: expected %.2f tokens, got %.2f", context, want, got)
+	}
+}
+
+func TestReserveN_CommitUsed(t *testing.T) {
+	limiters := map[string]func() ratelimit.Limiter{
+		"memory": func() ratelimit.Limiter { return memory.NewTokenBucket(10, 0.001) },
+		"bucket": func() ratelimit.Limiter { return bucket.New(memory.NewStore(), 10, 0.001) },
+		"refill": func() ratelimit.Limiter { return plainLimiter{memory.NewTokenBucket(10, 0.001)} },
+	}
+	for name, newLimiter := range limiters {
+		t.Run(name, func(t *testing.T) {
+			l := newLimiter()
+
+			r, err := ratelimit.ReserveN(l, "k", 5)
+			if err != nil {
+				t.Fatalf("ReserveN error: %v", err)
+			}
+			if !r.OK() || r.Tokens() != 5 {
+				t.Fatalf("Expected 5 tokens reserved, got ok=%v tokens=%.2f", r.OK(), r.Tokens())
+			}
+			expectTokens(t, l, "k", 5, "after reserving 5")
+
+			// Keep 3, refund 2
+			if err := r.CommitUsed(3); err != nil {
+				t.Fatalf("CommitUsed error: %v", err)
+			}
+			expectTokens(t, l, "k", 7, "after committing 3")
+
+			// Only the first commit counts
+			if err := r.CommitUsed(0); err != nil {
+				t.Fatalf("Second CommitUsed error: %v", err)
+			}
+			expectTokens(t, l, "k", 7, "after a second commit")
+		})
+	}
+}
+
+func TestReserveN_NotAvailable(t *testing.T) {
+	l := memory.NewTokenBucket(4, 0.001)
+
+	r, err := ratelimit.ReserveN(l, "k", 5)
+	if err != nil {
+		t.Fatalf("ReserveN error: %v", err)
+	}
+	if r.OK() || r.Tokens() != 0 {
+		t.Errorf("Expected nothing reserved beyond capacity, got ok=%v tokens=%.2f", r.OK(), r.Tokens())
+	}
+	if err := r.Cancel(); err != nil {
+		t.Fatalf("Cancel error: %v", err)
+	}
+	expectTokens(t, l, "k", 4, "after cancelling a failed reservation")
+
+	if _, err := ratelimit.ReserveN(l, "k", 0); err != ratelimit.ErrInvalidCost {
+		t.Errorf("Expected ErrInvalidCost for a zero reservation, got %v", err)
+	}
+}
+
+func TestReserveN_RefundCappedAtCapacity(t *testing.T) {
+	l := memory.NewTokenBucket(10, 0.001)
+
+	r, _ := ratelimit.ReserveN(l, "k", 5)
+	// Paid in the meantime: the refund mustn't stack onto it past capacity
+	if err := l.Refill("k", 3); err != nil {
+		t.Fatalf("Refill error: %v", err)
+	}
+	if err := r.CommitUsed(1); err != nil {
+		t.Fatalf("CommitUsed error: %v", err)
+	}
+	expectTokens(t, l, "k", 10, "refund capped at capacity")
+
+	// A balance above capacity is kept, and a reservation clamps over-use
+	l.Refill("k", 5)
+	r, _ = ratelimit.ReserveN(l, "k", 2)
+	r.CommitUsed(7)
+	expectTokens(t, l, "k", 13, "over-used reservation")
+}
@@ -0,0 +1,71 @@
+package ratelimit
+
+import (
+	"fmt"
+	"time"
+)
+
+// RefillWindow scales the refill rate during a daily time range, such as
+// doubling it during business hours.
+type RefillWindow struct {
+	Start      time.Duration // Offset from midnight the window opens at
+	End        time.Duration // Offset from midnight it closes at; before Start wraps past midnight
+	Multiplier float64       // Factor applied to the refill rate, > 0
+}
+
+// contains reports whether the time-of-day offset tod falls in the window.
+func (w RefillWindow) contains(tod time.Duration) bool {
+	if w.Start <= w.End {
+		return tod >= w.Start && tod < w.End
+	}
+	return tod >= w.Start || tod < w.End
+}
+
+// RefillSchedule scales the refill rate by time of day. Windows are read in
+// the location of the time passed to Multiplier, so limiters follow their
+// clock's zone. The first matching window wins; outside all windows the
+// multiplier is 1.
+//
+// Refill is settled at the rate in force when a bucket is touched, so an
+// interval spanning a boundary accrues at the later window's rate.
+type RefillSchedule []RefillWindow
+
+// Validate checks that every window lies within a day and has a positive
+// multiplier.
+func (s RefillSchedule) Validate() error {
+	for i, w := range s {
+		if w.Start < 0 || w.Start >= 24*time.Hour || w.End < 0 || w.End > 24*time.Hour {
+			return fmt.Errorf("refill window %d: times must be within a day", i)
+		}
+		if w.Multiplier <= 0 {
+			return fmt.Errorf("refill window %d: multiplier must be positive, got %g", i, w.Multiplier)
+		}
+	}
+	return nil
+}
+
+// Multiplier returns the refill rate multiplier in force at t.
+func (s RefillSchedule) Multiplier(t time.Time) float64 {
+	if len(s) == 0 {
+		return 1
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	tod := t.Sub(midnight)
+	for _, w := range s {
+		if w.contains(tod) {
+			return w.Multiplier
+		}
+	}
+	return 1
+}
+
+// Slowest returns the smallest multiplier the schedule can apply, including
+// the default of 1. Backends size key expiry with it, so an idle bucket
+// isn't dropped before it would have refilled.
+func (s RefillSchedule) Slowest() float64 {
+	slowest := 1.0
+	for _, w := range s {
+		slowest = min(slowest, w.Multiplier)
+	}
+	return slowest
+}
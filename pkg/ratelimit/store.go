@@ -0,0 +1,51 @@
+package ratelimit
+
+import "time"
+
+// BucketState is the stored state of a single token bucket.
+type BucketState struct {
+	Tokens       float64
+	LastRefill   time.Time
+	CreatedAt    time.Time
+	BurstExpires time.Time // When paid overflow above capacity is dropped (zero if never)
+	Allowed      int64     // Requests allowed since creation
+	Denied       int64     // Requests denied since creation
+}
+
+// UpdateFunc computes a bucket's new state from its stored one. exists is
+// false when the key has no stored state yet.
+type UpdateFunc func(state BucketState, exists bool) BucketState
+
+// TakeFunc is an UpdateFunc for a request: it also reports whether the
+// request was allowed.
+type TakeFunc func(state BucketState, exists bool) (BucketState, bool)
+
+// Store persists token bucket state for a shared algorithm layer, such as
+// bucket.Limiter. Stores only load and save state atomically; the refill and
+// consumption rules live in the functions callers pass, so every backend
+// behaves the same.
+type Store interface {
+	// GetBucket returns the stored state for key, and whether it exists.
+	GetBucket(key string) (BucketState, bool, error)
+
+	// SetBucket overwrites the stored state for key.
+	SetBucket(key string, state BucketState) error
+
+	// ConsumeIfAvailable atomically applies take to key's stored state and
+	// saves the result, whether or not the request was allowed. take settles
+	// natural refill and deducts the request's cost if the bucket covers it.
+	ConsumeIfAvailable(key string, take TakeFunc) (bool, error)
+
+	// AddTokens atomically applies add, a paid refill, refund or other
+	// credit, to key's stored state and saves the result, returning it.
+	AddTokens(key string, add UpdateFunc) (BucketState, error)
+}
+
+// Scanner is implemented by stores that can list their buckets, letting a
+// limiter built on them take snapshots.
+type Scanner interface {
+	// Scan returns a page of about limit stored keys and their states,
+	// starting from cursor ("" for the first page), and the cursor of the
+	// next page ("" once every key has been listed).
+	Scan(cursor string, limit int) (keys []string, states []BucketState, next string, err error)
+}
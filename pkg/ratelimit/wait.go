@@ -0,0 +1,47 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrWaitExceeded is returned by WaitN when the tokens won't accrue before
+// the context's deadline, so waiting would be in vain.
+var ErrWaitExceeded = errors.New("ratelimit: wait would exceed deadline")
+
+// waitPoll is how often WaitN retries when it can't tell how long the
+// tokens will take: with no refill rate, or a balance it can't read.
+const waitPoll = 50 * time.Millisecond
+
+// WaitN blocks until n tokens can be taken from key's bucket, then takes
+// them. refillRate, the bucket's tokens per second, sizes each wait; with 0
+// WaitN polls. It gives up with ErrWaitExceeded as soon as the next wait
+// would pass ctx's deadline, or with ctx's error once ctx is done. Limiter
+// errors are returned as is.
+func WaitN(ctx context.Context, l Limiter, key string, n, refillRate float64) error {
+	for {
+		allowed, err := l.AllowN(key, n)
+		if err != nil || allowed {
+			return err
+		}
+
+		wait := waitPoll
+		if refillRate > 0 {
+			if avail, err := l.Available(key); err == nil && avail < n {
+				wait = max(time.Duration((n-avail)/refillRate*float64(time.Second)), time.Millisecond)
+			}
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return ErrWaitExceeded
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
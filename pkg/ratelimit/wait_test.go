@@ -0,0 +1,53 @@
+package ratelimit_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/haseeb/ratelimiter/pkg/ratelimit"
+	"github.com/haseeb/ratelimiter/pkg/ratelimit/memory"
+)
+
+func TestWaitN(t *testing.T) {
+	l := memory.NewTokenBucket(1, 20) // A token every 50ms
+	l.Allow("")
+
+	// Waits out the refill, then takes the token
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := ratelimit.WaitN(ctx, l, "", 1, 20); err != nil {
+		t.Fatalf("WaitN error: %v", err)
+	}
+	if waited := time.Since(start); waited < 30*time.Millisecond {
+		t.Errorf("Expected WaitN to wait for the refill, returned after %v", waited)
+	}
+	if avail, _ := l.Available(""); avail > 0.5 {
+		t.Errorf("Expected WaitN to take the token, %.2f left", avail)
+	}
+}
+
+func TestWaitN_Exceeded(t *testing.T) {
+	l := memory.NewTokenBucket(1, 1) // A token a second
+	l.Allow("")
+
+	// A deadline the refill can't meet fails at once
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := ratelimit.WaitN(ctx, l, "", 1, 1); !errors.Is(err, ratelimit.ErrWaitExceeded) {
+		t.Fatalf("Expected ErrWaitExceeded, got %v", err)
+	}
+	if waited := time.Since(start); waited > 50*time.Millisecond {
+		t.Errorf("Expected WaitN to give up without waiting, took %v", waited)
+	}
+
+	// Without a refill rate it polls until the context is done
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if err := ratelimit.WaitN(ctx, l, "", 1, 0); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
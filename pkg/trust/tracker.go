@@ -1,21 +1,120 @@
 package trust
 
 import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
 	"sync"
 	"time"
 )
 
 // Config holds trust tracker configuration.
 type Config struct {
-	Threshold int           // Successful payments needed to become trusted
+	Threshold int           // Successful payments needed to enter probation
 	Window    time.Duration // Time window for counting payments
+
+	// OptimisticThreshold is the successful payments needed to graduate from
+	// probation to trusted. A wallet in probation still settles
+	// synchronously while its payments keep counting; only a trusted wallet
+	// takes the optimistic path. 0, or anything below Threshold, means
+	// Threshold: wallets are trusted as soon as they reach it.
+	OptimisticThreshold int
+
+	// RetriedWeight is how much a success that needed settlement retries
+	// counts toward Threshold, relative to a clean one (default 0.5).
+	RetriedWeight float64
+
+	// SweepInterval is how often a background sweep drops wallets whose
+	// payments have all left the window. Without it, a wallet's history is
+	// only trimmed when it pays again, so one-off wallets linger. 0 disables
+	// the sweep; call Close to stop it.
+	SweepInterval time.Duration
+
+	// MaxWallets caps how many wallets' payment histories and spending are
+	// kept. Past it, the least recently active wallets are evicted, bounding
+	// memory under a flood of unique wallets. 0 means no cap.
+	MaxWallets int
+
+	// MaxTrusted caps how many wallets may be trusted at once, bounding the
+	// unsettled exposure of the optimistic path. A wallet takes a slot the
+	// first time IsTrusted finds it at threshold and holds it until its
+	// trust lapses; while every slot is held, other qualifying wallets are
+	// reported untrusted. OnTrustChange still reports threshold crossings.
+	// 0 means no cap.
+	MaxTrusted int
+
+	// OnTrustChange is called when a wallet crosses OptimisticThreshold:
+	// on a Record* call, when its payments leave the window (noticed by
+	// Sweep or its next Record* call), or when MaxWallets evicts it. It runs
+	// after the tracker lock is released, so it may safely call back into
+	// the tracker.
+	OnTrustChange func(wallet string, nowTrusted bool)
+}
+
+// Outcome classifies how a payment's settlement went.
+type Outcome int
+
+const (
+	// Clean is a settlement that succeeded on the first attempt.
+	Clean Outcome = iota
+	// Retried is a settlement that succeeded only after retries. It builds
+	// trust more slowly than a clean one (see Config.RetriedWeight).
+	Retried
+	// Failed is a settlement that never succeeded. It revokes trust.
+	Failed
+)
+
+// Level is how far a wallet has come toward trust.
+type Level int
+
+const (
+	// Untrusted wallets are below Threshold, or blocked.
+	Untrusted Level = iota
+	// Probation wallets have reached Threshold but not OptimisticThreshold,
+	// or have reached it without a MaxTrusted slot. They settle synchronously.
+	Probation
+	// Trusted wallets may take the optimistic path.
+	Trusted
+)
+
+// String returns the level's name, as used in logs and the admin API.
+func (l Level) String() string {
+	switch l {
+	case Probation:
+		return "probation"
+	case Trusted:
+		return "trusted"
+	default:
+		return "untrusted"
+	}
+}
+
+// payment is one recorded success and how much it counts toward trust.
+type payment struct {
+	at     time.Time
+	weight float64
 }
 
 // Tracker tracks wallet trust based on payment history.
 type Tracker struct {
 	mu       sync.RWMutex
-	payments map[string][]time.Time // wallet address → payment timestamps
+	payments map[string][]payment // wallet address → recent successes
+	blocked  map[string]bool      // wallets an operator has blocked
+	lastPaid map[string]time.Time // when each wallet last had a payment accepted
+	slots    map[string]bool      // wallets holding a MaxTrusted slot
+	spend    map[string]*spending // lifetime accounting of each wallet's payments
+	notified map[string]bool      // wallets OnTrustChange last reported trusted
+	pending  []trustChange        // OnTrustChange calls waiting for the lock to be released
 	config   Config
+
+	// Wallets with payment history, most recently active at the front
+	activity *list.List
+	elems    map[string]*list.Element
+
+	stop      chan struct{} // Closed by Close to end the sweep
+	closeOnce sync.Once
 }
 
 // New creates a new trust tracker with the given config.
@@ -23,85 +122,476 @@ func New(cfg Config) *Tracker {
 	if cfg.Threshold <= 0 {
 		cfg.Threshold = 3
 	}
+	if cfg.OptimisticThreshold < cfg.Threshold {
+		cfg.OptimisticThreshold = cfg.Threshold
+	}
 	if cfg.Window <= 0 {
 		cfg.Window = time.Hour
 	}
-	return &Tracker{
-		payments: make(map[string][]time.Time),
+	if cfg.RetriedWeight <= 0 || cfg.RetriedWeight > 1 {
+		cfg.RetriedWeight = 0.5
+	}
+	t := &Tracker{
+		payments: make(map[string][]payment),
+		blocked:  make(map[string]bool),
+		lastPaid: make(map[string]time.Time),
+		slots:    make(map[string]bool),
+		spend:    make(map[string]*spending),
+		notified: make(map[string]bool),
 		config:   cfg,
+		activity: list.New(),
+		elems:    make(map[string]*list.Element),
+		stop:     make(chan struct{}),
+	}
+	if cfg.SweepInterval > 0 {
+		go t.sweepLoop(cfg.SweepInterval)
+	}
+	return t
+}
+
+// Close stops the background sweep, if one is running.
+func (t *Tracker) Close() {
+	t.closeOnce.Do(func() { close(t.stop) })
+}
+
+func (t *Tracker) sweepLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+			t.Sweep()
+		}
+	}
+}
+
+// Sweep drops every wallet whose payments have all left the window and
+// returns how many were dropped. It runs every Config.SweepInterval when set.
+// Wallets whose trust lapsed since it was last reported get OnTrustChange.
+func (t *Tracker) Sweep() int {
+	t.mu.Lock()
+	dropped := 0
+	for wallet := range t.payments {
+		t.cleanup(wallet)
+		if len(t.payments[wallet]) == 0 {
+			t.forget(wallet)
+			dropped++
+		}
+	}
+	for wallet := range t.notified {
+		t.reconcileLocked(wallet)
 	}
+	t.mu.Unlock()
+
+	t.flush()
+	return dropped
 }
 
-// IsTrusted returns true if the wallet has enough recent successful payments.
+// IsTrusted returns true if the wallet has enough recent successful payments
+// to reach OptimisticThreshold, isn't blocked and, under Config.MaxTrusted,
+// holds or can take a slot.
 func (t *Tracker) IsTrusted(wallet string) bool {
+	if t.config.MaxTrusted <= 0 {
+		t.mu.RLock()
+		defer t.mu.RUnlock()
+		return t.qualifiesLocked(wallet)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.qualifiesLocked(wallet) {
+		delete(t.slots, wallet)
+		return false
+	}
+	if t.slots[wallet] {
+		return true
+	}
+
+	// Free the slots of wallets whose trust has lapsed before counting
+	for w := range t.slots {
+		if !t.qualifiesLocked(w) {
+			delete(t.slots, w)
+		}
+	}
+	if len(t.slots) >= t.config.MaxTrusted {
+		return false
+	}
+	t.slots[wallet] = true
+	return true
+}
+
+// qualifiesLocked reports whether the wallet is at OptimisticThreshold and
+// not blocked, ignoring MaxTrusted (must hold lock).
+func (t *Tracker) qualifiesLocked(wallet string) bool {
+	return !t.blocked[wallet] && t.trustedLocked(wallet)
+}
+
+// countTrustedLocked counts the trusted wallets: those at OptimisticThreshold, or
+// under MaxTrusted those still qualifying for their slot (must hold lock).
+func (t *Tracker) countTrustedLocked() int {
+	trusted := 0
+	if t.config.MaxTrusted > 0 {
+		for wallet := range t.slots {
+			if t.qualifiesLocked(wallet) {
+				trusted++
+			}
+		}
+		return trusted
+	}
+	for wallet := range t.payments {
+		if t.qualifiesLocked(wallet) {
+			trusted++
+		}
+	}
+	return trusted
+}
+
+// Level returns the wallet's trust level. Unlike IsTrusted it never takes a
+// MaxTrusted slot: a wallet qualifying without one is in probation.
+func (t *Tracker) Level(wallet string) Level {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
+	return t.levelLocked(wallet)
+}
 
-	return t.countRecent(wallet) >= t.config.Threshold
+// levelLocked returns the wallet's trust level (must hold lock).
+func (t *Tracker) levelLocked(wallet string) Level {
+	if t.blocked[wallet] {
+		return Untrusted
+	}
+	if t.qualifiesLocked(wallet) && (t.config.MaxTrusted <= 0 || t.slots[wallet]) {
+		return Trusted
+	}
+	if t.reachesLocked(wallet, t.config.Threshold) {
+		return Probation
+	}
+	return Untrusted
+}
+
+// Block marks a wallet as blocked: it's never trusted and its payments should
+// be refused until Unblock is called. Its payment history is kept.
+func (t *Tracker) Block(wallet string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.blocked[wallet] = true
+}
+
+// Unblock lifts a block placed by Block.
+func (t *Tracker) Unblock(wallet string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.blocked, wallet)
+}
+
+// IsBlocked returns true if the wallet has been blocked.
+func (t *Tracker) IsBlocked(wallet string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.blocked[wallet]
+}
+
+// ReservePayment enforces a minimum interval between accepted payments from a
+// wallet. If the wallet's last accepted payment was less than interval ago it
+// returns false and how long to wait; otherwise it records now as the last
+// payment and returns true. Call it only for verified payments, so a forged
+// payer address can't lock a wallet out.
+func (t *Tracker) ReservePayment(wallet string, interval time.Duration) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if last, ok := t.lastPaid[wallet]; ok {
+		if wait := interval - now.Sub(last); wait > 0 {
+			return wait, false
+		}
+	}
+	t.lastPaid[wallet] = now
+
+	// Forget wallets whose interval has passed, keeping the map small
+	if len(t.lastPaid) > 1024 {
+		for w, last := range t.lastPaid {
+			if now.Sub(last) >= interval {
+				delete(t.lastPaid, w)
+			}
+		}
+	}
+	return 0, true
 }
 
 // countRecent counts payments within the time window (must hold lock).
 func (t *Tracker) countRecent(wallet string) int {
 	cutoff := time.Now().Add(-t.config.Window)
 	count := 0
-	for _, ts := range t.payments[wallet] {
-		if ts.After(cutoff) {
+	for _, p := range t.payments[wallet] {
+		if p.at.After(cutoff) {
 			count++
 		}
 	}
 	return count
 }
 
+// scoreRecent sums the weights of payments within the time window (must hold lock).
+func (t *Tracker) scoreRecent(wallet string) float64 {
+	cutoff := time.Now().Add(-t.config.Window)
+	score := 0.0
+	for _, p := range t.payments[wallet] {
+		if p.at.After(cutoff) {
+			score += p.weight
+		}
+	}
+	return score
+}
+
+// trustedLocked reports whether the wallet's recent payments reach
+// OptimisticThreshold, ignoring blocks (must hold lock).
+func (t *Tracker) trustedLocked(wallet string) bool {
+	return t.reachesLocked(wallet, t.config.OptimisticThreshold)
+}
+
+// reachesLocked reports whether the wallet's recent payments score at least
+// threshold (must hold lock).
+func (t *Tracker) reachesLocked(wallet string, threshold int) bool {
+	// Small tolerance so e.g. 6 x 0.5 isn't pushed under 3 by rounding
+	return t.scoreRecent(wallet) >= float64(threshold)-1e-9
+}
+
 // RecordSuccess adds a successful payment timestamp for the wallet.
 func (t *Tracker) RecordSuccess(wallet string) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
+	t.RecordSuccessN(wallet, 1)
+}
 
-	t.payments[wallet] = append(t.payments[wallet], time.Now())
-	t.cleanup(wallet)
+// RecordSuccessN records a successful payment that counts weight times toward
+// trust, e.g. a large payment worth several regular ones. A weight below 1
+// counts once. Weights above OptimisticThreshold are capped: the extra
+// timestamps would all expire together, so they can't extend trust.
+func (t *Tracker) RecordSuccessN(wallet string, weight int) {
+	t.RecordOutcome(wallet, Clean, weight)
 }
 
 // RecordFailure clears payment history for the wallet (soft penalty).
 func (t *Tracker) RecordFailure(wallet string) {
+	t.RecordOutcome(wallet, Failed, 0)
+}
+
+// RecordOutcome records a settlement for the wallet by how it went. Clean and
+// Retried successes count n times toward trust (as RecordSuccessN), retried
+// ones at Config.RetriedWeight each. Failed clears the payment history.
+func (t *Tracker) RecordOutcome(wallet string, outcome Outcome, n int) {
 	t.mu.Lock()
-	defer t.mu.Unlock()
+	switch outcome {
+	case Failed:
+		t.forget(wallet)
+	default:
+		weight := 1.0
+		if outcome == Retried {
+			weight = t.config.RetriedWeight
+		}
+		now := time.Now()
+		for i := 0; i < max(1, min(n, t.config.OptimisticThreshold)); i++ {
+			t.payments[wallet] = append(t.payments[wallet], payment{at: now, weight: weight})
+		}
+		t.cleanup(wallet)
+		t.touch(wallet)
+	}
+
+	t.reconcileLocked(wallet)
+	t.mu.Unlock()
+
+	t.flush()
+}
+
+// trustChange is an OnTrustChange call queued under the lock.
+type trustChange struct {
+	wallet  string
+	trusted bool
+}
+
+// reconcileLocked queues an OnTrustChange call if the wallet's trust differs
+// from what was last reported for it (must hold lock).
+func (t *Tracker) reconcileLocked(wallet string) {
+	if t.config.OnTrustChange == nil {
+		return
+	}
+	trusted := t.trustedLocked(wallet)
+	if trusted == t.notified[wallet] {
+		return
+	}
+	if trusted {
+		t.notified[wallet] = true
+	} else {
+		delete(t.notified, wallet)
+	}
+	t.pending = append(t.pending, trustChange{wallet, trusted})
+}
 
+// flush makes the queued OnTrustChange calls (must not hold lock).
+func (t *Tracker) flush() {
+	t.mu.Lock()
+	changes := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+
+	for _, c := range changes {
+		t.config.OnTrustChange(c.wallet, c.trusted)
+	}
+}
+
+// touch marks the wallet as the most recently active, evicting the least
+// recently active wallets beyond MaxWallets (must hold lock). Evicted wallets
+// that were trusted get a queued OnTrustChange call.
+func (t *Tracker) touch(wallet string) {
+	if e, ok := t.elems[wallet]; ok {
+		t.activity.MoveToFront(e)
+	} else {
+		t.elems[wallet] = t.activity.PushFront(wallet)
+	}
+
+	for t.config.MaxWallets > 0 && t.activity.Len() > t.config.MaxWallets {
+		evicted := t.activity.Back().Value.(string)
+		delete(t.spend, evicted)
+		t.forget(evicted)
+		t.reconcileLocked(evicted)
+	}
+}
+
+// forget drops the wallet's payment history (must hold lock). A wallet with
+// spending recorded stays in the activity list, so MaxWallets still evicts
+// its spending.
+func (t *Tracker) forget(wallet string) {
 	delete(t.payments, wallet)
+	delete(t.slots, wallet)
+	if _, spent := t.spend[wallet]; spent {
+		return
+	}
+	if e, ok := t.elems[wallet]; ok {
+		t.activity.Remove(e)
+		delete(t.elems, wallet)
+	}
 }
 
 // cleanup removes expired timestamps to prevent memory growth (must hold lock).
 func (t *Tracker) cleanup(wallet string) {
 	cutoff := time.Now().Add(-t.config.Window)
 	payments := t.payments[wallet]
-	kept := make([]time.Time, 0, len(payments))
-	for _, ts := range payments {
-		if ts.After(cutoff) {
-			kept = append(kept, ts)
+	kept := make([]payment, 0, len(payments))
+	for _, p := range payments {
+		if p.at.After(cutoff) {
+			kept = append(kept, p)
 		}
 	}
 	t.payments[wallet] = kept
 }
 
+// Config returns the tracker's effective config, with defaults applied.
+func (t *Tracker) Config() Config {
+	return t.config
+}
+
+// Threshold returns the successful payments needed to enter probation.
+func (t *Tracker) Threshold() int {
+	return t.config.Threshold
+}
+
+// Window returns how far back payments count toward trust.
+func (t *Tracker) Window() time.Duration {
+	return t.config.Window
+}
+
+// Tier is a trust level above Untrusted and the recent payments needed to
+// reach it.
+type Tier struct {
+	Level    Level
+	Payments int
+}
+
+// Tiers returns the levels a wallet climbs through, lowest first: probation
+// at Threshold, then trusted at OptimisticThreshold. The two coincide when
+// OptimisticThreshold is unset.
+func (t *Tracker) Tiers() []Tier {
+	return []Tier{
+		{Level: Probation, Payments: t.config.Threshold},
+		{Level: Trusted, Payments: t.config.OptimisticThreshold},
+	}
+}
+
 // Stats returns trust statistics for monitoring.
 type Stats struct {
 	TrustedWallets   int `json:"trusted_wallets"`
+	ProbationWallets int `json:"probation_wallets"`
 	TotalWalletsSeen int `json:"total_wallets_seen"`
+	BlockedWallets   int `json:"blocked_wallets"`
 }
 
 func (t *Tracker) Stats() Stats {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
 
-	trusted := 0
+	probation := 0
 	for wallet := range t.payments {
-		if t.countRecent(wallet) >= t.config.Threshold {
-			trusted++
+		if t.levelLocked(wallet) == Probation {
+			probation++
 		}
 	}
 	return Stats{
-		TrustedWallets:   trusted,
+		TrustedWallets:   t.countTrustedLocked(),
+		ProbationWallets: probation,
 		TotalWalletsSeen: len(t.payments),
+		BlockedWallets:   len(t.blocked),
+	}
+}
+
+// spending accumulates a wallet's settled payments.
+type spending struct {
+	payments int64
+	tokens   float64
+	paid     big.Int // Atomic units
+}
+
+// WalletStats is a wallet's lifetime spending, for accounting. Unlike trust
+// it isn't limited to Window or cleared by a failed settlement; it's only
+// dropped when MaxWallets evicts the wallet.
+type WalletStats struct {
+	Payments      int64   `json:"payments"`       // Payments settled
+	TokensGranted float64 `json:"tokens_granted"` // Tokens refilled for them
+	AmountPaid    string  `json:"amount_paid"`    // Their total, in the asset's atomic units
+}
+
+// RecordGrant accounts for a settled payment of amount atomic units that
+// granted the wallet tokens. An amount that isn't a decimal integer counts
+// the payment and tokens but adds nothing to AmountPaid. Spending is keyed
+// by wallet, which may differ from the key trust is recorded under, and
+// counts as activity toward MaxWallets.
+func (t *Tracker) RecordGrant(wallet string, tokens float64, amount string) {
+	t.mu.Lock()
+	defer t.flush()
+	defer t.mu.Unlock()
+
+	s, ok := t.spend[wallet]
+	if !ok {
+		s = &spending{}
+		t.spend[wallet] = s
+	}
+	s.payments++
+	s.tokens += tokens
+	if paid, ok := new(big.Int).SetString(amount, 10); ok && paid.Sign() > 0 {
+		s.paid.Add(&s.paid, paid)
+	}
+	t.touch(wallet)
+}
+
+// WalletStats returns the wallet's spending. A wallet with none recorded
+// reports zeros.
+func (t *Tracker) WalletStats(wallet string) WalletStats {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	s, ok := t.spend[wallet]
+	if !ok {
+		return WalletStats{AmountPaid: "0"}
 	}
+	return WalletStats{Payments: s.payments, TokensGranted: s.tokens, AmountPaid: s.paid.String()}
 }
 
 // RecentPayments returns the count of recent payments for a wallet.
@@ -110,3 +600,105 @@ func (t *Tracker) RecentPayments(wallet string) int {
 	defer t.mu.RUnlock()
 	return t.countRecent(wallet)
 }
+
+// RecentScore returns the weighted sum of a wallet's recent payments: the
+// score compared against Threshold and OptimisticThreshold.
+func (t *Tracker) RecentScore(wallet string) float64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.scoreRecent(wallet)
+}
+
+// snapshotVersion is bumped when the snapshot format changes incompatibly.
+const snapshotVersion = 1
+
+// snapshot is the JSON form of a tracker's state written by Export.
+type snapshot struct {
+	Version int                          `json:"version"`
+	Wallets map[string][]snapshotPayment `json:"wallets"`
+	Blocked []string                     `json:"blocked,omitempty"`
+}
+
+type snapshotPayment struct {
+	At     time.Time `json:"at"`
+	Weight float64   `json:"weight"`
+}
+
+// Export serializes the tracker's payment history and blocked wallets as
+// JSON, e.g. to save to disk on shutdown and restore with Import.
+// Per-wallet payment intervals (ReservePayment) aren't included.
+func (t *Tracker) Export() ([]byte, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	snap := snapshot{Version: snapshotVersion, Wallets: make(map[string][]snapshotPayment, len(t.payments))}
+	for wallet, payments := range t.payments {
+		out := make([]snapshotPayment, len(payments))
+		for i, p := range payments {
+			out[i] = snapshotPayment{At: p.at, Weight: p.weight}
+		}
+		snap.Wallets[wallet] = out
+	}
+	for wallet := range t.blocked {
+		snap.Blocked = append(snap.Blocked, wallet)
+	}
+	sort.Strings(snap.Blocked)
+	return json.Marshal(snap)
+}
+
+// Import restores state saved by Export, replacing the history of each
+// wallet with unexpired payments in the snapshot and adding its blocks. Payments are re-checked
+// against the current window, so ones that expired while the snapshot sat
+// on disk are dropped. OnTrustChange isn't called for imported wallets, only
+// for any wallets they evict.
+func (t *Tracker) Import(data []byte) error {
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("trust: invalid snapshot: %w", err)
+	}
+	if snap.Version != snapshotVersion {
+		return fmt.Errorf("trust: unsupported snapshot version %d", snap.Version)
+	}
+
+	t.mu.Lock()
+	defer t.flush()
+	defer t.mu.Unlock()
+
+	// Restore wallets oldest activity first, so the most recently active end
+	// up at the front and survive MaxWallets
+	type restored struct {
+		wallet   string
+		payments []payment
+	}
+	var wallets []restored
+	cutoff := time.Now().Add(-t.config.Window)
+	for wallet, saved := range snap.Wallets {
+		var kept []payment
+		for _, p := range saved {
+			if p.At.After(cutoff) && p.Weight > 0 {
+				kept = append(kept, payment{at: p.At, weight: p.Weight})
+			}
+		}
+		if len(kept) == 0 {
+			continue
+		}
+		sort.Slice(kept, func(i, j int) bool { return kept[i].at.Before(kept[j].at) })
+		wallets = append(wallets, restored{wallet, kept})
+	}
+	sort.Slice(wallets, func(i, j int) bool {
+		return wallets[i].payments[len(wallets[i].payments)-1].at.Before(wallets[j].payments[len(wallets[j].payments)-1].at)
+	})
+	for _, w := range wallets {
+		t.payments[w.wallet] = w.payments
+		t.touch(w.wallet)
+		if t.config.OnTrustChange != nil && t.trustedLocked(w.wallet) {
+			// Already trusted: its loss is reported, its restore isn't
+			t.notified[w.wallet] = true
+		}
+	}
+
+	for _, wallet := range snap.Blocked {
+		t.blocked[wallet] = true
+	}
+	return nil
+}
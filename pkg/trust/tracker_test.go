@@ -1,6 +1,8 @@
 package trust
 
 import (
+	"fmt"
+	"slices"
 	"testing"
 	"time"
 )
@@ -156,6 +158,21 @@ func TestTracker_DefaultConfig(t *testing.T) {
 	if !tracker.IsTrusted(wallet) {
 		t.Error("Should be trusted with 3 payments")
 	}
+
+	// The defaults are reported back
+	if tracker.Threshold() != 3 || tracker.Window() != time.Hour {
+		t.Errorf("Expected defaults 3 and 1h, got %d and %v", tracker.Threshold(), tracker.Window())
+	}
+	if cfg := tracker.Config(); cfg.RetriedWeight != 0.5 || cfg.Threshold != 3 {
+		t.Errorf("Expected effective config with defaults, got %+v", cfg)
+	}
+	if want := []Tier{{Probation, 3}, {Trusted, 3}}; !slices.Equal(tracker.Tiers(), want) {
+		t.Errorf("Expected tiers %v, got %v", want, tracker.Tiers())
+	}
+	tiered := New(Config{Threshold: 2, OptimisticThreshold: 5})
+	if want := []Tier{{Probation, 2}, {Trusted, 5}}; !slices.Equal(tiered.Tiers(), want) {
+		t.Errorf("Expected tiers %v, got %v", want, tiered.Tiers())
+	}
 }
 
 func TestTracker_Concurrent(t *testing.T) {
@@ -193,3 +210,501 @@ func TestTracker_Concurrent(t *testing.T) {
 		t.Errorf("Expected 10 payments, got %d", tracker.RecentPayments(wallet))
 	}
 }
+
+func TestTracker_OnTrustChange(t *testing.T) {
+	type change struct {
+		wallet     string
+		nowTrusted bool
+	}
+	var changes []change
+
+	tracker := New(Config{
+		Threshold: 2,
+		Window:    time.Hour,
+		OnTrustChange: func(wallet string, nowTrusted bool) {
+			changes = append(changes, change{wallet, nowTrusted})
+		},
+	})
+
+	wallet := "0xhook"
+
+	// Below threshold - no transition
+	tracker.RecordSuccess(wallet)
+	if len(changes) != 0 {
+		t.Fatalf("Expected no callback below threshold, got %v", changes)
+	}
+
+	// Crossing the threshold fires once
+	tracker.RecordSuccess(wallet)
+	if len(changes) != 1 || changes[0] != (change{wallet, true}) {
+		t.Fatalf("Expected trusted transition, got %v", changes)
+	}
+
+	// Further successes and reads don't fire again
+	tracker.RecordSuccess(wallet)
+	tracker.IsTrusted(wallet)
+	tracker.RecentPayments(wallet)
+	tracker.Stats()
+	if len(changes) != 1 {
+		t.Fatalf("Expected no callback while already trusted, got %v", changes)
+	}
+
+	// Failure revokes trust and fires the downward transition
+	tracker.RecordFailure(wallet)
+	if len(changes) != 2 || changes[1] != (change{wallet, false}) {
+		t.Fatalf("Expected untrusted transition, got %v", changes)
+	}
+
+	// Failure on an untrusted wallet doesn't fire
+	tracker.RecordFailure(wallet)
+	tracker.RecordFailure("0xunknown")
+	if len(changes) != 2 {
+		t.Errorf("Expected no callback for untrusted failures, got %v", changes)
+	}
+}
+
+func TestTracker_OnTrustChangeOnLapse(t *testing.T) {
+	changes := make(map[string][]bool)
+	tracker := New(Config{
+		Threshold:  2,
+		Window:     50 * time.Millisecond,
+		MaxWallets: 2,
+		OnTrustChange: func(wallet string, nowTrusted bool) {
+			changes[wallet] = append(changes[wallet], nowTrusted)
+		},
+	})
+
+	// Expiry is reported by the sweep, even if part of the history is left
+	tracker.RecordSuccess("0xswept")
+	time.Sleep(30 * time.Millisecond)
+	tracker.RecordSuccess("0xswept")
+	time.Sleep(30 * time.Millisecond)
+	tracker.Sweep()
+	if got := changes["0xswept"]; len(got) != 2 || !got[0] || got[1] {
+		t.Errorf("Expected 0xswept trusted then lapsed, got %v", got)
+	}
+	tracker.Sweep()
+	if got := changes["0xswept"]; len(got) != 2 {
+		t.Errorf("Expected a lapse reported once, got %v", got)
+	}
+
+	// Or by the wallet's next payment, which alone doesn't restore trust
+	tracker.RecordSuccessN("0xpaid", 2)
+	time.Sleep(60 * time.Millisecond)
+	tracker.RecordSuccess("0xpaid")
+	if got := changes["0xpaid"]; len(got) != 2 || !got[0] || got[1] {
+		t.Errorf("Expected 0xpaid trusted then lapsed, got %v", got)
+	}
+
+	// Eviction past MaxWallets reports the evicted wallet's loss
+	tracker.RecordSuccessN("0xa", 2)
+	tracker.RecordSuccessN("0xb", 2)
+	tracker.RecordSuccessN("0xc", 2)
+	if got := changes["0xa"]; len(got) != 2 || !got[0] || got[1] {
+		t.Errorf("Expected evicted 0xa trusted then lapsed, got %v", got)
+	}
+}
+
+func TestTracker_Block(t *testing.T) {
+	tracker := New(Config{Threshold: 1, Window: time.Hour})
+	wallet := "0xblocked"
+
+	tracker.RecordSuccess(wallet)
+	if !tracker.IsTrusted(wallet) {
+		t.Fatal("Wallet should be trusted after 1 payment")
+	}
+
+	tracker.Block(wallet)
+	if !tracker.IsBlocked(wallet) {
+		t.Error("Wallet should be blocked")
+	}
+	if tracker.IsTrusted(wallet) {
+		t.Error("Blocked wallet should not be trusted")
+	}
+	stats := tracker.Stats()
+	if stats.BlockedWallets != 1 || stats.TrustedWallets != 0 {
+		t.Errorf("Expected 1 blocked and 0 trusted wallets, got %+v", stats)
+	}
+
+	// Unblocking restores trust from the retained history
+	tracker.Unblock(wallet)
+	if tracker.IsBlocked(wallet) || !tracker.IsTrusted(wallet) {
+		t.Error("Unblocked wallet should be trusted again")
+	}
+}
+
+func TestTracker_RecordSuccessN(t *testing.T) {
+	var changes []bool
+	tracker := New(Config{
+		Threshold:     3,
+		Window:        time.Hour,
+		OnTrustChange: func(wallet string, nowTrusted bool) { changes = append(changes, nowTrusted) },
+	})
+
+	// One large payment reaches the threshold in a single call
+	tracker.RecordSuccessN("0xwhale", 3)
+	if !tracker.IsTrusted("0xwhale") {
+		t.Error("Wallet with a weight-3 payment should be trusted")
+	}
+	if len(changes) != 1 || !changes[0] {
+		t.Errorf("Expected one trust change to true, got %v", changes)
+	}
+
+	// Weights are capped at the threshold
+	tracker.RecordSuccessN("0xhuge", 1000)
+	if got := tracker.RecentPayments("0xhuge"); got != 3 {
+		t.Errorf("Expected weight capped at threshold 3, got %d", got)
+	}
+
+	// A zero weight still counts once
+	tracker.RecordSuccessN("0xsmall", 0)
+	if got := tracker.RecentPayments("0xsmall"); got != 1 {
+		t.Errorf("Expected zero weight to count once, got %d", got)
+	}
+}
+
+func TestTracker_RetriedOutcomesBuildTrustSlower(t *testing.T) {
+	tracker := New(Config{Threshold: 3, Window: time.Hour}) // Retried counts 0.5
+
+	for i := 0; i < 3; i++ {
+		tracker.RecordOutcome("0xclean", Clean, 1)
+	}
+	if !tracker.IsTrusted("0xclean") {
+		t.Error("Expected 3 clean successes to reach trust")
+	}
+
+	for i := 0; i < 5; i++ {
+		tracker.RecordOutcome("0xretried", Retried, 1)
+		if tracker.IsTrusted("0xretried") {
+			t.Fatalf("Expected %d retried successes to fall short of trust", i+1)
+		}
+	}
+	tracker.RecordOutcome("0xretried", Retried, 1)
+	if !tracker.IsTrusted("0xretried") {
+		t.Error("Expected 6 retried successes to reach trust")
+	}
+	if got := tracker.RecentPayments("0xretried"); got != 6 {
+		t.Errorf("Expected 6 recent payments, got %d", got)
+	}
+	if got := tracker.RecentScore("0xretried"); got < 2.99 || got > 3.01 {
+		t.Errorf("Expected 6 retried payments to score 3, got %.2f", got)
+	}
+
+	tracker.RecordOutcome("0xretried", Failed, 0)
+	if tracker.IsTrusted("0xretried") || tracker.RecentPayments("0xretried") != 0 {
+		t.Error("Expected a failed outcome to clear payment history")
+	}
+}
+
+func TestTracker_RetriedWeight(t *testing.T) {
+	tracker := New(Config{Threshold: 2, Window: time.Hour, RetriedWeight: 0.25})
+
+	for i := 0; i < 7; i++ {
+		tracker.RecordOutcome("0xwallet", Retried, 1)
+	}
+	if tracker.IsTrusted("0xwallet") {
+		t.Error("Expected 7 x 0.25 to fall short of threshold 2")
+	}
+	tracker.RecordOutcome("0xwallet", Retried, 1)
+	if !tracker.IsTrusted("0xwallet") {
+		t.Error("Expected 8 x 0.25 to reach threshold 2")
+	}
+}
+
+func TestTracker_ReservePayment(t *testing.T) {
+	tracker := New(Config{})
+	const interval = 50 * time.Millisecond
+
+	if _, ok := tracker.ReservePayment("0xa", interval); !ok {
+		t.Fatal("Expected first payment to be accepted")
+	}
+	wait, ok := tracker.ReservePayment("0xa", interval)
+	if ok {
+		t.Fatal("Expected rapid repeat payment to be refused")
+	}
+	if wait <= 0 || wait > interval {
+		t.Errorf("Expected wait within (0, %v], got %v", interval, wait)
+	}
+	if _, ok := tracker.ReservePayment("0xb", interval); !ok {
+		t.Error("Expected another wallet to be unaffected")
+	}
+
+	time.Sleep(interval)
+	if _, ok := tracker.ReservePayment("0xa", interval); !ok {
+		t.Error("Expected payment after the interval to be accepted")
+	}
+}
+
+func TestTracker_MaxWalletsEvictsLeastRecentlyActive(t *testing.T) {
+	tracker := New(Config{Threshold: 1, MaxWallets: 3})
+
+	tracker.RecordSuccess("0xa")
+	tracker.RecordSuccess("0xb")
+	tracker.RecordSuccess("0xc")
+	tracker.RecordSuccess("0xa") // 0xa is active again; 0xb is now the oldest
+
+	tracker.RecordSuccess("0xd")
+	if got := tracker.Stats().TotalWalletsSeen; got != 3 {
+		t.Errorf("Expected the cap to hold 3 wallets, got %d", got)
+	}
+	if tracker.IsTrusted("0xb") {
+		t.Error("Expected least recently active wallet 0xb to be evicted")
+	}
+	for _, w := range []string{"0xa", "0xc", "0xd"} {
+		if !tracker.IsTrusted(w) {
+			t.Errorf("Expected active wallet %s to be kept", w)
+		}
+	}
+
+	// A failure frees its slot without evicting anyone else
+	tracker.RecordFailure("0xc")
+	tracker.RecordSuccess("0xe")
+	if !tracker.IsTrusted("0xa") || !tracker.IsTrusted("0xd") || !tracker.IsTrusted("0xe") {
+		t.Error("Expected remaining wallets to be kept after a failure freed a slot")
+	}
+}
+
+func TestTracker_MaxTrusted(t *testing.T) {
+	tracker := New(Config{Threshold: 1, Window: time.Hour, MaxTrusted: 2})
+
+	for _, wallet := range []string{"0xa", "0xb", "0xc"} {
+		tracker.RecordSuccess(wallet)
+	}
+
+	// The first two to be checked fill the cap
+	if !tracker.IsTrusted("0xa") || !tracker.IsTrusted("0xb") {
+		t.Fatal("Expected the first two qualifying wallets to be trusted")
+	}
+	if tracker.IsTrusted("0xc") {
+		t.Error("Expected a third qualifying wallet kept untrusted while the cap is full")
+	}
+	if got := tracker.Stats().TrustedWallets; got != 2 {
+		t.Errorf("Expected 2 trusted wallets, got %d", got)
+	}
+
+	// Slot holders stay trusted on later checks
+	if !tracker.IsTrusted("0xa") {
+		t.Error("Expected a slot holder to stay trusted")
+	}
+
+	// Losing trust frees the slot for the waiting wallet
+	tracker.RecordFailure("0xa")
+	if !tracker.IsTrusted("0xc") {
+		t.Error("Expected the waiting wallet to take the freed slot")
+	}
+	if tracker.IsTrusted("0xa") {
+		t.Error("Expected the failed wallet to lose trust")
+	}
+}
+
+func TestTracker_Probation(t *testing.T) {
+	var changes []bool
+	tracker := New(Config{
+		Threshold:           2,
+		OptimisticThreshold: 4,
+		Window:              time.Hour,
+		OnTrustChange:       func(wallet string, nowTrusted bool) { changes = append(changes, nowTrusted) },
+	})
+	wallet := "0xprobation"
+
+	want := []Level{Untrusted, Probation, Probation, Trusted, Trusted}
+	for i, level := range want {
+		tracker.RecordSuccess(wallet)
+		if got := tracker.Level(wallet); got != level {
+			t.Errorf("After %d payments: expected %s, got %s", i+1, level, got)
+		}
+		if got := tracker.IsTrusted(wallet); got != (level == Trusted) {
+			t.Errorf("After %d payments: expected IsTrusted %v, got %v", i+1, level == Trusted, got)
+		}
+	}
+
+	// Only graduating to trusted is reported
+	if len(changes) != 1 || !changes[0] {
+		t.Errorf("Expected one change to trusted, got %v", changes)
+	}
+
+	stats := tracker.Stats()
+	if stats.TrustedWallets != 1 || stats.ProbationWallets != 0 {
+		t.Errorf("Expected 1 trusted and 0 in probation, got %+v", stats)
+	}
+	tracker.RecordSuccessN("0xother", 3)
+	if got := tracker.Stats().ProbationWallets; got != 1 {
+		t.Errorf("Expected 1 wallet in probation, got %d", got)
+	}
+
+	// Blocked wallets are untrusted whatever their history
+	tracker.Block(wallet)
+	if got := tracker.Level(wallet); got != Untrusted {
+		t.Errorf("Expected a blocked wallet untrusted, got %s", got)
+	}
+}
+
+func TestTracker_OptimisticThresholdDefaultsToThreshold(t *testing.T) {
+	tracker := New(Config{Threshold: 2, OptimisticThreshold: 1})
+	if got := tracker.Config().OptimisticThreshold; got != 2 {
+		t.Errorf("Expected OptimisticThreshold raised to Threshold, got %d", got)
+	}
+
+	// With no margin, wallets go straight from untrusted to trusted
+	tracker.RecordSuccess("0xa")
+	tracker.RecordSuccess("0xa")
+	if got := tracker.Level("0xa"); got != Trusted {
+		t.Errorf("Expected trusted at threshold, got %s", got)
+	}
+}
+
+func TestTracker_MaxTrustedSlotExpires(t *testing.T) {
+	tracker := New(Config{Threshold: 1, Window: 100 * time.Millisecond, MaxTrusted: 1})
+
+	tracker.RecordSuccess("0xa")
+	if !tracker.IsTrusted("0xa") {
+		t.Fatal("Expected the first wallet to be trusted")
+	}
+
+	// Once 0xa's trust expires, a new wallet can take its slot
+	time.Sleep(150 * time.Millisecond)
+	tracker.RecordSuccess("0xb")
+	if !tracker.IsTrusted("0xb") {
+		t.Error("Expected the new wallet trusted after the holder's trust expired")
+	}
+}
+
+func TestTracker_Sweep(t *testing.T) {
+	tracker := New(Config{Threshold: 1, Window: 50 * time.Millisecond})
+
+	tracker.RecordSuccess("0xold")
+	time.Sleep(60 * time.Millisecond)
+	tracker.RecordSuccess("0xnew")
+
+	if dropped := tracker.Sweep(); dropped != 1 {
+		t.Errorf("Expected 1 expired wallet dropped, got %d", dropped)
+	}
+	if got := tracker.Stats().TotalWalletsSeen; got != 1 {
+		t.Errorf("Expected only 0xnew left, got %d wallets", got)
+	}
+	if !tracker.IsTrusted("0xnew") {
+		t.Error("Expected the active wallet to survive the sweep")
+	}
+}
+
+func TestTracker_WalletStats(t *testing.T) {
+	tracker := New(Config{Threshold: 1, MaxWallets: 2})
+
+	if got := tracker.WalletStats("0xa"); got != (WalletStats{AmountPaid: "0"}) {
+		t.Errorf("Expected zero stats for an unseen wallet, got %+v", got)
+	}
+
+	tracker.RecordGrant("0xa", 2, "1000")
+	tracker.RecordGrant("0xa", 5, "99999999999999999999") // Beyond int64
+	tracker.RecordGrant("0xa", 1, "not-a-number")
+	tracker.RecordGrant("0xb", 3, "500")
+	got := tracker.WalletStats("0xa")
+	if got.Payments != 3 || got.TokensGranted != 8 || got.AmountPaid != "100000000000000000999" {
+		t.Errorf("Expected 3 payments, 8 tokens, 100000000000000000999 paid, got %+v", got)
+	}
+
+	// A failed settlement revokes trust but not the accounting
+	tracker.RecordSuccess("0xa")
+	tracker.RecordFailure("0xa")
+	if got := tracker.WalletStats("0xa"); got.Payments != 3 {
+		t.Errorf("Expected accounting to survive a failure, got %+v", got)
+	}
+
+	// Eviction under MaxWallets drops it
+	tracker.RecordSuccess("0xb")
+	tracker.RecordSuccess("0xc")
+	tracker.RecordSuccess("0xd")
+	if got := tracker.WalletStats("0xb"); got.Payments != 0 {
+		t.Errorf("Expected an evicted wallet's accounting dropped, got %+v", got)
+	}
+}
+
+func TestTracker_WalletStatsBoundedUnderTrustKeys(t *testing.T) {
+	tracker := New(Config{Threshold: 1, MaxWallets: 4})
+
+	// Trust recorded under a key other than the paying wallet, as with
+	// per-API-key trust, still keeps spending under the cap
+	for i := range 50 {
+		wallet := fmt.Sprintf("0x%04d", i)
+		tracker.RecordSuccess("key:" + wallet)
+		tracker.RecordGrant(wallet, 1, "1000")
+	}
+	tracker.mu.RLock()
+	defer tracker.mu.RUnlock()
+	if len(tracker.spend) > 4 || tracker.activity.Len() > 4 {
+		t.Errorf("Expected at most 4 tracked entries, got %d spending and %d active", len(tracker.spend), tracker.activity.Len())
+	}
+}
+
+func TestTracker_BackgroundSweep(t *testing.T) {
+	tracker := New(Config{Threshold: 1, Window: 20 * time.Millisecond, SweepInterval: 10 * time.Millisecond})
+	defer tracker.Close()
+
+	tracker.RecordSuccess("0xa")
+	deadline := time.Now().Add(time.Second)
+	for tracker.Stats().TotalWalletsSeen != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := tracker.Stats().TotalWalletsSeen; got != 0 {
+		t.Errorf("Expected the background sweep to drop the expired wallet, %d left", got)
+	}
+}
+
+func TestTracker_ExportImportRoundTrip(t *testing.T) {
+	src := New(Config{Threshold: 2, Window: time.Hour})
+	src.RecordSuccess("0xtrusted")
+	src.RecordSuccess("0xtrusted")
+	src.RecordSuccess("0xnew")
+	src.Block("0xbad")
+
+	data, err := src.Export()
+	if err != nil {
+		t.Fatalf("Export error: %v", err)
+	}
+
+	dst := New(Config{Threshold: 2, Window: time.Hour})
+	if err := dst.Import(data); err != nil {
+		t.Fatalf("Import error: %v", err)
+	}
+	if !dst.IsTrusted("0xtrusted") {
+		t.Error("Expected trusted wallet to stay trusted across export/import")
+	}
+	if got := dst.RecentPayments("0xnew"); got != 1 {
+		t.Errorf("Expected 1 payment for 0xnew, got %d", got)
+	}
+	if !dst.IsBlocked("0xbad") {
+		t.Error("Expected block to survive export/import")
+	}
+}
+
+func TestTracker_ImportDropsExpiredPayments(t *testing.T) {
+	src := New(Config{Threshold: 1, Window: time.Hour})
+	src.RecordSuccess("0xa")
+	data, err := src.Export()
+	if err != nil {
+		t.Fatalf("Export error: %v", err)
+	}
+
+	// Restored by a tracker whose window the payment has since left
+	time.Sleep(20 * time.Millisecond)
+	dst := New(Config{Threshold: 1, Window: 10 * time.Millisecond})
+	if err := dst.Import(data); err != nil {
+		t.Fatalf("Import error: %v", err)
+	}
+	if dst.IsTrusted("0xa") {
+		t.Error("Expected expired payments not to restore trust")
+	}
+	if got := dst.Stats().TotalWalletsSeen; got != 0 {
+		t.Errorf("Expected expired wallet not to be restored, got %d wallets", got)
+	}
+}
+
+func TestTracker_ImportRejectsBadSnapshot(t *testing.T) {
+	tracker := New(Config{})
+	if err := tracker.Import([]byte("not json")); err == nil {
+		t.Error("Expected error for malformed snapshot")
+	}
+	if err := tracker.Import([]byte(`{"version": 99}`)); err == nil {
+		t.Error("Expected error for unknown snapshot version")
+	}
+}